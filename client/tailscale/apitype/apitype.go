@@ -4,7 +4,11 @@
 // Package apitype contains types for the Tailscale LocalAPI and control plane API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // LocalAPIHost is the Host header value used by the LocalAPI.
 const LocalAPIHost = "local-tailscaled.sock"
@@ -57,3 +61,132 @@ type ExitNodeSuggestionResponse struct {
 	Name     string
 	Location tailcfg.LocationView `json:",omitempty"`
 }
+
+// SSHRecording is the metadata of a Tailscale SSH session recording stored on
+// the local disk of the node, as returned by the LocalAPI ssh/recordings
+// handler. It does not include the recording contents.
+type SSHRecording struct {
+	// Name is the base name of the recording file.
+	Name string
+
+	// SessionID is the ID of the recorded session, as shared with control.
+	// It is empty for recordings made by older versions of tailscaled.
+	SessionID string `json:",omitempty"`
+
+	// ConnectionID is the ID of the SSH connection the session belonged to.
+	ConnectionID string `json:",omitempty"`
+
+	// Start is when the recording started.
+	Start time.Time
+
+	// Size is the size of the recording file in bytes.
+	Size int64
+
+	// SSHUser is the username as presented by the client.
+	SSHUser string `json:",omitempty"`
+
+	// LocalUser is the effective username on the node.
+	LocalUser string `json:",omitempty"`
+
+	// Part is the index, from zero, of the recording among the parts of
+	// its session's recording, if it was split in parts.
+	Part int `json:",omitempty"`
+}
+
+// SSHConnAction is the action that a Tailscale SSH connection was resolved
+// to, as returned by the LocalAPI ssh/conn-action handler for debugging.
+type SSHConnAction struct {
+	// ConnectionID is the ID of the SSH connection.
+	ConnectionID string
+
+	// SSHUser is the username as presented by the client.
+	SSHUser string `json:",omitempty"`
+
+	// LocalUser is the effective username on the node.
+	LocalUser string `json:",omitempty"`
+
+	// Delegated is whether the action was the result of resolving one or
+	// more HoldAndDelegate actions, rather than the first matching action.
+	Delegated bool `json:",omitempty"`
+
+	// Action is the final action after any HoldAndDelegate resolution. The
+	// URLs in it are redacted.
+	Action *tailcfg.SSHAction
+}
+
+// SSHSession is an active Tailscale SSH session, as returned by the LocalAPI
+// ssh/sessions handler.
+type SSHSession struct {
+	// SessionID is the ID of the session, as shared with control.
+	SessionID string
+
+	// ConnectionID is the ID of the SSH connection the session belongs to.
+	ConnectionID string
+
+	// SSHUser is the username as presented by the client.
+	SSHUser string `json:",omitempty"`
+
+	// LocalUser is the effective username on the node.
+	LocalUser string `json:",omitempty"`
+
+	// Recording is the status of the session's recording.
+	Recording SSHSessionRecording
+}
+
+// SSHSessionRecording is the recording status of an active Tailscale SSH
+// session.
+type SSHSessionRecording struct {
+	// Active is whether the session is currently being recorded to at
+	// least one sink.
+	Active bool
+
+	// FailedOpen is whether recording to any sink required by policy
+	// failed, either to start or since, and the session was allowed to
+	// continue regardless.
+	FailedOpen bool `json:",omitempty"`
+
+	// Sinks are the sinks that recording the session started with.
+	Sinks []SSHSessionRecordingSink `json:",omitempty"`
+}
+
+// SSHSessionRecordingSink is the status of one of the sinks of the recording
+// of an active Tailscale SSH session.
+type SSHSessionRecordingSink struct {
+	// Destination is where the sink records to: the address of a recorder,
+	// or "local" for the local disk of the node.
+	Destination string
+
+	// Format is the format of the recording.
+	Format string
+
+	// FailedOpen is whether writing to the sink failed, after which the
+	// session continued without it.
+	FailedOpen bool `json:",omitempty"`
+}
+
+// SSHEffectivePolicy is the SSH policy that the Tailscale SSH server of a
+// node is enforcing, as returned by the LocalAPI ssh/policy handler.
+type SSHEffectivePolicy struct {
+	// Enabled is whether the node is running Tailscale SSH. If not, no
+	// policy is in effect.
+	Enabled bool
+
+	// Source is where Policy came from: "netmap" for the tailnet policy
+	// from control, "file" for the debug policy file, or empty if no
+	// policy is in effect, in which case all connections are rejected.
+	Source string `json:",omitempty"`
+
+	// File is the path of the debug policy file set by
+	// TS_DEBUG_SSH_POLICY_FILE, if any, whether or not it's in effect.
+	File string `json:",omitempty"`
+
+	// TailnetPolicyIgnored is whether TS_DEBUG_SSH_IGNORE_TAILNET_POLICY
+	// is set, so that the tailnet policy isn't used.
+	TailnetPolicyIgnored bool `json:",omitempty"`
+
+	// Error is why the debug policy file couldn't be used, if it couldn't.
+	Error string `json:",omitempty"`
+
+	// Policy is the policy in effect, if any, as found in its source.
+	Policy *tailcfg.SSHPolicy `json:",omitempty"`
+}
@@ -635,6 +635,70 @@ func (lc *LocalClient) FileTargets(ctx context.Context) ([]apitype.FileTarget, e
 	return decodeJSON[[]apitype.FileTarget](body)
 }
 
+// SSHRecordings returns the metadata of the Tailscale SSH session recordings
+// stored on the local disk of the node, most recent first. It requires local
+// admin access.
+func (lc *LocalClient) SSHRecordings(ctx context.Context) ([]apitype.SSHRecording, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh/recordings")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.SSHRecording](body)
+}
+
+// SSHConnAction returns the action that the active Tailscale SSH connection
+// with the provided ID was resolved to, after any HoldAndDelegate resolution.
+// It requires local admin access.
+func (lc *LocalClient) SSHConnAction(ctx context.Context, connID string) (*apitype.SSHConnAction, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh/conn-action?id="+url.QueryEscape(connID))
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.SSHConnAction](body)
+}
+
+// SSHSessions returns the active Tailscale SSH sessions of the node, including
+// the status of their recordings. It requires local admin access.
+func (lc *LocalClient) SSHSessions(ctx context.Context) ([]apitype.SSHSession, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh/sessions")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[[]apitype.SSHSession](body)
+}
+
+// SSHEffectivePolicy returns the SSH policy that the Tailscale SSH server of
+// the node is enforcing and where it came from. It requires local admin
+// access.
+func (lc *LocalClient) SSHEffectivePolicy(ctx context.Context) (*apitype.SSHEffectivePolicy, error) {
+	body, err := lc.get200(ctx, "/localapi/v0/ssh/policy")
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSON[*apitype.SSHEffectivePolicy](body)
+}
+
+// SSHRecording returns the contents of the named Tailscale SSH session
+// recording stored on the local disk of the node. The name is one returned by
+// SSHRecordings. The caller must close the returned ReadCloser. It requires
+// local admin access.
+func (lc *LocalClient) SSHRecording(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+apitype.LocalAPIHost+"/localapi/v0/ssh/recording?name="+url.QueryEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := lc.doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
+
 // PushFile sends Taildrop file r to target.
 //
 // A size of -1 means unknown.
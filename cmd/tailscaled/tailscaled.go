@@ -275,6 +275,18 @@ func trySynologyMigration(p string) error {
 	return nil
 }
 
+// checkStoreHealth checks that the state store st is usable, so that a
+// misconfigured external store fails tailscaled at startup with a clear
+// error, rather than later on.
+func checkStoreHealth(st ipn.StateStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := store.HealthCheck(ctx, st); err != nil {
+		return fmt.Errorf("state store health check: %w", err)
+	}
+	return nil
+}
+
 func statePathOrDefault() string {
 	if args.statepath != "" {
 		return args.statepath
@@ -585,6 +597,9 @@ func getLocalBackend(ctx context.Context, logf logger.Logf, logID logid.PublicID
 	if err != nil {
 		return nil, fmt.Errorf("store.New: %w", err)
 	}
+	if err := checkStoreHealth(store); err != nil {
+		return nil, err
+	}
 	sys.Set(store)
 
 	if w, ok := sys.Tun.GetOK(); ok {
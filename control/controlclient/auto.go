@@ -735,6 +735,13 @@ func (c *Auto) DoNoiseRequest(req *http.Request) (*http.Response, error) {
 	return c.direct.DoNoiseRequest(req)
 }
 
+// NoiseTransportReady reports whether DoNoiseRequest can send requests to the
+// control server over Noise, authenticated by the server's Noise public key,
+// which isn't known until it has been fetched from the server.
+func (c *Auto) NoiseTransportReady() bool {
+	return c.direct.haveServerNoiseKey()
+}
+
 // GetSingleUseNoiseRoundTripper returns a RoundTripper that can be only be used
 // once (and must be used once) to make a single HTTP request over the noise
 // channel to the coordination server.
@@ -1538,6 +1538,14 @@ func (c *Direct) SetDNS(ctx context.Context, req *tailcfg.SetDNSRequest) (err er
 	return c.setDNSNoise(ctx, req)
 }
 
+// haveServerNoiseKey reports whether the control server's Noise public key is
+// known, without which DoNoiseRequest fails.
+func (c *Direct) haveServerNoiseKey() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.serverNoiseKey.IsZero()
+}
+
 func (c *Direct) DoNoiseRequest(req *http.Request) (*http.Response, error) {
 	if c.panicOnUse {
 		panic("tainted client")
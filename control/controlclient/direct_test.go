@@ -87,6 +87,30 @@ func TestNewDirect(t *testing.T) {
 	}
 }
 
+func TestHaveServerNoiseKey(t *testing.T) {
+	k := key.NewMachine()
+	c, err := NewDirect(Options{
+		ServerURL: "https://example.com",
+		Hostinfo:  hostinfo.New(),
+		GetMachinePrivateKey: func() (key.MachinePrivate, error) {
+			return k, nil
+		},
+		Dialer: tsdial.NewDialer(netmon.NewStatic()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.haveServerNoiseKey() {
+		t.Error("haveServerNoiseKey = true before fetching the server's keys")
+	}
+	c.mu.Lock()
+	c.serverNoiseKey = key.NewMachine().Public()
+	c.mu.Unlock()
+	if !c.haveServerNoiseKey() {
+		t.Error("haveServerNoiseKey = false with the server's key known")
+	}
+}
+
 func fakeEndpoints(ports ...uint16) (ret []tailcfg.Endpoint) {
 	for _, port := range ports {
 		ret = append(ret, tailcfg.Endpoint{
@@ -377,6 +377,18 @@ func (t *Tracker) SetControlHealth(problems []string) {
 	t.selfCheckLocked()
 }
 
+// LastStreamedMapResponse returns when a tailcfg.MapResponse was last
+// received in streaming mode, including keep-alives, or the zero time if
+// none has been.
+func (t *Tracker) LastStreamedMapResponse() time.Time {
+	if t.nil() {
+		return time.Time{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastStreamedMapResponse
+}
+
 // GotStreamedMapResponse notes that we got a tailcfg.MapResponse
 // message in streaming mode, even if it's just a keep-alive message.
 //
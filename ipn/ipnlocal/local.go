@@ -133,6 +133,27 @@ type SSHServer interface {
 
 	// Shutdown is called when tailscaled is shutting down.
 	Shutdown()
+
+	// ListRecordings returns the metadata of the SSH session recordings
+	// stored on local disk, most recent first.
+	ListRecordings() ([]apitype.SSHRecording, error)
+
+	// OpenRecording opens the named local-disk SSH session recording, as
+	// returned by ListRecordings, for reading.
+	OpenRecording(name string) (*os.File, error)
+
+	// ConnAction returns the action that the active SSH connection with
+	// the provided ID was resolved to, and whether there is such a
+	// connection.
+	ConnAction(connID string) (_ apitype.SSHConnAction, ok bool)
+
+	// ActiveSessions returns the active SSH sessions, including the
+	// status of their recordings.
+	ActiveSessions() []apitype.SSHSession
+
+	// EffectivePolicy returns the SSH policy currently in effect and
+	// where it came from.
+	EffectivePolicy() apitype.SSHEffectivePolicy
 }
 
 type newSSHServerFunc func(logger.Logf, *LocalBackend) (SSHServer, error)
@@ -5763,6 +5784,17 @@ func (b *LocalBackend) DoNoiseRequest(req *http.Request) (*http.Response, error)
 	return cc.DoNoiseRequest(req)
 }
 
+// ControlTransportSecure reports whether DoNoiseRequest sends requests to
+// control over the Noise protocol, authenticated by control's Noise public
+// key: whether there is a control client, and it knows that key. Otherwise,
+// DoNoiseRequest fails rather than using another transport.
+func (b *LocalBackend) ControlTransportSecure() bool {
+	b.mu.Lock()
+	cc := b.ccAuto
+	b.mu.Unlock()
+	return cc != nil && cc.NoiseTransportReady()
+}
+
 func (b *LocalBackend) sshServerOrInit() (_ SSHServer, err error) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
@@ -5789,6 +5821,59 @@ func (b *LocalBackend) updateSELinuxHealthWarning() {
 	}
 }
 
+// SSHRecordings returns the metadata of the SSH session recordings stored on
+// local disk, most recent first.
+func (b *LocalBackend) SSHRecordings() ([]apitype.SSHRecording, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	return s.ListRecordings()
+}
+
+// OpenSSHRecording opens the named SSH session recording stored on local disk
+// for reading. The name must be one returned by SSHRecordings.
+func (b *LocalBackend) OpenSSHRecording(name string) (*os.File, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	return s.OpenRecording(name)
+}
+
+// SSHConnAction returns the action that the active SSH connection with the
+// provided ID was resolved to, or nil if there's no such connection.
+func (b *LocalBackend) SSHConnAction(connID string) (*apitype.SSHConnAction, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	if ca, ok := s.ConnAction(connID); ok {
+		return &ca, nil
+	}
+	return nil, nil
+}
+
+// SSHSessions returns the active SSH sessions, including the status of their
+// recordings.
+func (b *LocalBackend) SSHSessions() ([]apitype.SSHSession, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return nil, err
+	}
+	return s.ActiveSessions(), nil
+}
+
+// SSHEffectivePolicy returns the SSH policy that the SSH server is currently
+// enforcing and where it came from: the netmap or the debug policy file.
+func (b *LocalBackend) SSHEffectivePolicy() (apitype.SSHEffectivePolicy, error) {
+	s, err := b.sshServerOrInit()
+	if err != nil {
+		return apitype.SSHEffectivePolicy{}, err
+	}
+	return s.EffectivePolicy(), nil
+}
+
 func (b *LocalBackend) handleSSHConn(c net.Conn) (err error) {
 	s, err := b.sshServerOrInit()
 	if err != nil {
@@ -119,6 +119,11 @@
 	"set-gui-visible":             (*Handler).serveSetGUIVisible,
 	"set-push-device-token":       (*Handler).serveSetPushDeviceToken,
 	"set-use-exit-node-enabled":   (*Handler).serveSetUseExitNodeEnabled,
+	"ssh/conn-action":             (*Handler).serveSSHConnAction,
+	"ssh/policy":                  (*Handler).serveSSHPolicy,
+	"ssh/recording":               (*Handler).serveSSHRecording,
+	"ssh/recordings":              (*Handler).serveSSHRecordings,
+	"ssh/sessions":                (*Handler).serveSSHSessions,
 	"start":                       (*Handler).serveStart,
 	"status":                      (*Handler).serveStatus,
 	"suggest-exit-node":           (*Handler).serveSuggestExitNode,
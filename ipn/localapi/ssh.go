@@ -0,0 +1,212 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/util/httpm"
+)
+
+// localBackendSSHMethods is the subset of ipn.LocalBackend as needed
+// by the localapi SSH handlers.
+type localBackendSSHMethods interface {
+	SSHRecordings() ([]apitype.SSHRecording, error)
+	OpenSSHRecording(name string) (*os.File, error)
+	SSHConnAction(connID string) (*apitype.SSHConnAction, error)
+	SSHSessions() ([]apitype.SSHSession, error)
+	SSHEffectivePolicy() (apitype.SSHEffectivePolicy, error)
+}
+
+// permitSSHAdmin reports whether the caller may use the SSH admin endpoints,
+// which expose the details and contents of SSH sessions. If not, it writes a
+// 403 error to w.
+//
+// They're restricted to local admins with write access, as decided by
+// connIsLocalAdmin.
+func (h *Handler) permitSSHAdmin(w http.ResponseWriter) bool {
+	if !h.PermitWrite || !h.connIsLocalAdmin() {
+		http.Error(w, "ssh admin access denied; must be a local admin", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *Handler) serveSSHRecordings(w http.ResponseWriter, r *http.Request) {
+	h.serveSSHRecordingsWithBackend(w, r, h.b)
+}
+
+// serveSSHRecordingsWithBackend lists the metadata of the SSH session
+// recordings stored on local disk. It never returns their contents.
+func (h *Handler) serveSSHRecordingsWithBackend(w http.ResponseWriter, r *http.Request, b localBackendSSHMethods) {
+	if !h.permitSSHAdmin(w) {
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	recs, err := b.SSHRecordings()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if recs == nil {
+		recs = []apitype.SSHRecording{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recs)
+}
+
+func (h *Handler) serveSSHRecording(w http.ResponseWriter, r *http.Request) {
+	h.serveSSHRecordingWithBackend(w, r, h.b)
+}
+
+// serveSSHRecordingWithBackend streams the contents of a single SSH session
+// recording stored on local disk, selected by either its file name ("name")
+// or its session ID ("id"). It supports HTTP range requests so that playback
+// tools can seek.
+func (h *Handler) serveSSHRecordingWithBackend(w http.ResponseWriter, r *http.Request, b localBackendSSHMethods) {
+	if !h.permitSSHAdmin(w) {
+		return
+	}
+	if r.Method != httpm.GET && r.Method != httpm.HEAD {
+		http.Error(w, "want GET or HEAD", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("name")
+	if id := r.FormValue("id"); id != "" && name == "" {
+		recs, err := b.SSHRecordings()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, rec := range recs {
+			if rec.SessionID == id {
+				name = rec.Name
+				break
+			}
+		}
+		if name == "" {
+			http.Error(w, "no recording for session", http.StatusNotFound)
+			return
+		}
+	}
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		http.Error(w, "invalid recording name", http.StatusBadRequest)
+		return
+	}
+	f, err := b.OpenSSHRecording(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "recording not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if strings.HasSuffix(name, ".gz") {
+		// Compressed per TS_SSH_RECORDING_GZIP.
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-asciicast")
+	}
+	http.ServeContent(w, r, name, fi.ModTime(), f)
+}
+
+func (h *Handler) serveSSHConnAction(w http.ResponseWriter, r *http.Request) {
+	h.serveSSHConnActionWithBackend(w, r, h.b)
+}
+
+// serveSSHConnActionWithBackend returns the action that the active SSH
+// connection with the ID in the "id" parameter was resolved to, for
+// debugging.
+func (h *Handler) serveSSHConnActionWithBackend(w http.ResponseWriter, r *http.Request, b localBackendSSHMethods) {
+	if !h.permitSSHAdmin(w) {
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	ca, err := b.SSHConnAction(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ca == nil {
+		http.Error(w, "no active connection with that id", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ca)
+}
+
+func (h *Handler) serveSSHSessions(w http.ResponseWriter, r *http.Request) {
+	h.serveSSHSessionsWithBackend(w, r, h.b)
+}
+
+// serveSSHSessionsWithBackend lists the active SSH sessions, including
+// whether each is being recorded, to which sinks, and whether recording has
+// failed open, so that sessions running unrecorded can be spotted.
+func (h *Handler) serveSSHSessionsWithBackend(w http.ResponseWriter, r *http.Request, b localBackendSSHMethods) {
+	if !h.permitSSHAdmin(w) {
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	sessions, err := b.SSHSessions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if sessions == nil {
+		sessions = []apitype.SSHSession{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func (h *Handler) serveSSHPolicy(w http.ResponseWriter, r *http.Request) {
+	h.serveSSHPolicyWithBackend(w, r, h.b)
+}
+
+// serveSSHPolicyWithBackend returns the SSH policy that the SSH server is
+// enforcing and where it came from, so that admins can confirm it's the one
+// they configured.
+func (h *Handler) serveSSHPolicyWithBackend(w http.ResponseWriter, r *http.Request, b localBackendSSHMethods) {
+	if !h.permitSSHAdmin(w) {
+		return
+	}
+	if r.Method != httpm.GET {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	ep, err := b.SSHEffectivePolicy()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ep)
+}
@@ -0,0 +1,347 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package localapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// fakeSSHBackend implements localBackendSSHMethods for testing.
+type fakeSSHBackend struct {
+	recordings []apitype.SSHRecording
+	dir        string // directory of recordings opened by OpenSSHRecording
+
+	opened []string // names passed to OpenSSHRecording
+
+	connActions map[string]*apitype.SSHConnAction // by conn ID
+
+	sessions []apitype.SSHSession
+
+	policy apitype.SSHEffectivePolicy
+}
+
+func (b *fakeSSHBackend) SSHRecordings() ([]apitype.SSHRecording, error) {
+	return b.recordings, nil
+}
+
+func (b *fakeSSHBackend) OpenSSHRecording(name string) (*os.File, error) {
+	b.opened = append(b.opened, name)
+	return os.Open(filepath.Join(b.dir, name))
+}
+
+func (b *fakeSSHBackend) SSHConnAction(connID string) (*apitype.SSHConnAction, error) {
+	return b.connActions[connID], nil
+}
+
+func (b *fakeSSHBackend) SSHSessions() ([]apitype.SSHSession, error) {
+	return b.sessions, nil
+}
+
+func (b *fakeSSHBackend) SSHEffectivePolicy() (apitype.SSHEffectivePolicy, error) {
+	return b.policy, nil
+}
+
+func TestServeSSHRecordings(t *testing.T) {
+	b := &fakeSSHBackend{
+		recordings: []apitype.SSHRecording{{
+			Name:      "ssh-session-1-abc.cast",
+			SessionID: "sess-1",
+			Start:     time.Unix(1, 0).UTC(),
+			Size:      123,
+			SSHUser:   "alice",
+			LocalUser: "root",
+		}},
+	}
+	tests := []struct {
+		name        string
+		permitWrite bool
+		admin       bool
+		method      string
+		wantStatus  int
+	}{
+		{"denied", false, true, "GET", http.StatusForbidden},
+		{"not-admin", true, false, "GET", http.StatusForbidden},
+		{"wrong-method", true, true, "POST", http.StatusMethodNotAllowed},
+		{"ok", true, true, "GET", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{PermitRead: true, PermitWrite: tt.permitWrite, testConnIsLocalAdmin: &tt.admin}
+			rec := httptest.NewRecorder()
+			h.serveSSHRecordingsWithBackend(rec, httptest.NewRequest(tt.method, "/localapi/v0/ssh/recordings", nil), b)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var got []apitype.SSHRecording
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, b.recordings) {
+				t.Errorf("got %+v; want %+v", got, b.recordings)
+			}
+		})
+	}
+}
+
+func TestServeSSHRecording(t *testing.T) {
+	const contents = `{"version":2}` + "\n" + `[0.5,"o","hello"]` + "\n"
+	dir := t.TempDir()
+	const name = "ssh-session-1-abc.cast"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		admin      bool
+		query      string
+		rangeHdr   string
+		wantStatus int
+		wantBody   string
+		wantOpened bool
+	}{
+		{name: "not-admin", admin: false, query: "name=" + name, wantStatus: http.StatusForbidden},
+		{name: "by-name", admin: true, query: "name=" + name, wantStatus: http.StatusOK, wantBody: contents, wantOpened: true},
+		{name: "by-session-id", admin: true, query: "id=sess-1", wantStatus: http.StatusOK, wantBody: contents, wantOpened: true},
+		{name: "unknown-session-id", admin: true, query: "id=sess-2", wantStatus: http.StatusNotFound},
+		{name: "missing", admin: true, query: "name=ssh-session-2-def.cast", wantStatus: http.StatusNotFound, wantOpened: true},
+		{name: "no-name", admin: true, query: "", wantStatus: http.StatusBadRequest},
+		{name: "traversal", admin: true, query: "name=" + url.QueryEscape("../../etc/passwd"), wantStatus: http.StatusBadRequest},
+		{name: "traversal-dotdot", admin: true, query: "name=..", wantStatus: http.StatusBadRequest},
+		{name: "traversal-backslash", admin: true, query: "name=" + url.QueryEscape(`..\x`), wantStatus: http.StatusBadRequest},
+		{name: "range", admin: true, query: "name=" + name, rangeHdr: "bytes=0-12", wantStatus: http.StatusPartialContent, wantBody: `{"version":2}`, wantOpened: true},
+		{name: "range-suffix", admin: true, query: "name=" + name, rangeHdr: "bytes=-18", wantStatus: http.StatusPartialContent, wantBody: `[0.5,"o","hello"]` + "\n", wantOpened: true},
+		{name: "range-unsatisfiable", admin: true, query: "name=" + name, rangeHdr: "bytes=1000-", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantOpened: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeSSHBackend{
+				dir:        dir,
+				recordings: []apitype.SSHRecording{{Name: name, SessionID: "sess-1"}},
+			}
+			h := &Handler{PermitRead: true, PermitWrite: true, testConnIsLocalAdmin: &tt.admin}
+			req := httptest.NewRequest("GET", "/localapi/v0/ssh/recording?"+tt.query, nil)
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			rec := httptest.NewRecorder()
+			h.serveSSHRecordingWithBackend(rec, req, b)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+			if tt.wantBody != "" {
+				if got := rec.Body.String(); got != tt.wantBody {
+					t.Errorf("body = %q; want %q", got, tt.wantBody)
+				}
+			}
+			if got := len(b.opened) > 0; got != tt.wantOpened {
+				t.Errorf("opened = %q; want opened=%v", b.opened, tt.wantOpened)
+			}
+		})
+	}
+}
+
+func TestServeSSHConnAction(t *testing.T) {
+	want := &apitype.SSHConnAction{
+		ConnectionID: "ssh-conn-1",
+		SSHUser:      "alice",
+		LocalUser:    "root",
+		Delegated:    true,
+		Action: &tailcfg.SSHAction{
+			Accept:                   true,
+			SessionDuration:          time.Hour,
+			AllowLocalPortForwarding: true,
+		},
+	}
+	b := &fakeSSHBackend{
+		connActions: map[string]*apitype.SSHConnAction{"ssh-conn-1": want},
+	}
+	tests := []struct {
+		name        string
+		permitWrite bool
+		admin       bool
+		method      string
+		query       string
+		wantStatus  int
+	}{
+		{"denied", false, true, "GET", "id=ssh-conn-1", http.StatusForbidden},
+		{"not-admin", true, false, "GET", "id=ssh-conn-1", http.StatusForbidden},
+		{"wrong-method", true, true, "POST", "id=ssh-conn-1", http.StatusMethodNotAllowed},
+		{"no-id", true, true, "GET", "", http.StatusBadRequest},
+		{"unknown-id", true, true, "GET", "id=ssh-conn-2", http.StatusNotFound},
+		{"ok", true, true, "GET", "id=ssh-conn-1", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{PermitRead: true, PermitWrite: tt.permitWrite, testConnIsLocalAdmin: &tt.admin}
+			rec := httptest.NewRecorder()
+			h.serveSSHConnActionWithBackend(rec, httptest.NewRequest(tt.method, "/localapi/v0/ssh/conn-action?"+tt.query, nil), b)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var got *apitype.SSHConnAction
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v; want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestServeSSHSessions(t *testing.T) {
+	b := &fakeSSHBackend{
+		sessions: []apitype.SSHSession{{
+			SessionID:    "sess-1",
+			ConnectionID: "ssh-conn-1",
+			SSHUser:      "alice",
+			LocalUser:    "root",
+			Recording: apitype.SSHSessionRecording{
+				Active:     true,
+				FailedOpen: true,
+				Sinks: []apitype.SSHSessionRecordingSink{
+					{Destination: "100.64.0.1:80", Format: "cast"},
+					{Destination: "100.64.0.2:80", Format: "raw-jsonl", FailedOpen: true},
+				},
+			},
+		}},
+	}
+	tests := []struct {
+		name       string
+		admin      bool
+		method     string
+		wantStatus int
+	}{
+		{"not-admin", false, "GET", http.StatusForbidden},
+		{"wrong-method", true, "POST", http.StatusMethodNotAllowed},
+		{"ok", true, "GET", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{PermitRead: true, PermitWrite: true, testConnIsLocalAdmin: &tt.admin}
+			rec := httptest.NewRecorder()
+			h.serveSSHSessionsWithBackend(rec, httptest.NewRequest(tt.method, "/localapi/v0/ssh/sessions", nil), b)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %v; want %v; body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var got []apitype.SSHSession
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, b.sessions) {
+				t.Errorf("got %+v; want %+v", got, b.sessions)
+			}
+		})
+	}
+}
+
+func TestPermitSSHAdmin(t *testing.T) {
+	const name = "ssh-session-1-abc.cast"
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeSSHBackend{
+		dir:         dir,
+		recordings:  []apitype.SSHRecording{{Name: name}},
+		connActions: map[string]*apitype.SSHConnAction{"ssh-conn-1": {ConnectionID: "ssh-conn-1"}},
+	}
+	endpoints := []struct {
+		path  string
+		serve func(*Handler, http.ResponseWriter, *http.Request, localBackendSSHMethods)
+	}{
+		{"/localapi/v0/ssh/recordings", (*Handler).serveSSHRecordingsWithBackend},
+		{"/localapi/v0/ssh/recording?name=" + name, (*Handler).serveSSHRecordingWithBackend},
+		{"/localapi/v0/ssh/conn-action?id=ssh-conn-1", (*Handler).serveSSHConnActionWithBackend},
+		{"/localapi/v0/ssh/sessions", (*Handler).serveSSHSessionsWithBackend},
+		{"/localapi/v0/ssh/policy", (*Handler).serveSSHPolicyWithBackend},
+	}
+	callers := []struct {
+		name        string
+		permitWrite bool
+		admin       bool
+		wantStatus  int
+	}{
+		{"admin", true, true, http.StatusOK},
+		{"non-admin", true, false, http.StatusForbidden},
+		{"read-only-admin", false, true, http.StatusForbidden},
+		{"read-only", false, false, http.StatusForbidden},
+	}
+	for _, ep := range endpoints {
+		for _, c := range callers {
+			t.Run(ep.path+"/"+c.name, func(t *testing.T) {
+				h := &Handler{PermitRead: true, PermitWrite: c.permitWrite, testConnIsLocalAdmin: &c.admin}
+				rec := httptest.NewRecorder()
+				ep.serve(h, rec, httptest.NewRequest("GET", ep.path, nil), b)
+				if rec.Code != c.wantStatus {
+					t.Errorf("status = %v; want %v; body: %s", rec.Code, c.wantStatus, rec.Body.Bytes())
+				}
+			})
+		}
+	}
+}
+
+func TestServeSSHPolicy(t *testing.T) {
+	pol := &tailcfg.SSHPolicy{Rules: []*tailcfg.SSHRule{{
+		Principals: []*tailcfg.SSHPrincipal{{Any: true}},
+		SSHUsers:   map[string]string{"*": "="},
+		Action:     &tailcfg.SSHAction{Accept: true},
+	}}}
+	tests := []struct {
+		name   string
+		policy apitype.SSHEffectivePolicy
+	}{
+		{"netmap", apitype.SSHEffectivePolicy{Enabled: true, Source: "netmap", Policy: pol}},
+		{"file", apitype.SSHEffectivePolicy{Enabled: true, Source: "file", File: "/tmp/policy.json", Policy: pol}},
+		{"ignore-tailnet-policy", apitype.SSHEffectivePolicy{Enabled: true, TailnetPolicyIgnored: true}},
+		{"file-error", apitype.SSHEffectivePolicy{Enabled: true, File: "/tmp/policy.json", Error: "invalid SSH policy JSON"}},
+		{"disabled", apitype.SSHEffectivePolicy{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := true
+			h := &Handler{PermitRead: true, PermitWrite: true, testConnIsLocalAdmin: &admin}
+			rec := httptest.NewRecorder()
+			h.serveSSHPolicyWithBackend(rec, httptest.NewRequest("GET", "/localapi/v0/ssh/policy", nil), &fakeSSHBackend{policy: tt.policy})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %v; body: %s", rec.Code, rec.Body.Bytes())
+			}
+			var got apitype.SSHEffectivePolicy
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.policy) {
+				t.Errorf("got %+v; want %+v", got, tt.policy)
+			}
+		})
+	}
+
+	admin := true
+	h := &Handler{PermitRead: true, PermitWrite: true, testConnIsLocalAdmin: &admin}
+	rec := httptest.NewRecorder()
+	h.serveSSHPolicyWithBackend(rec, httptest.NewRequest("POST", "/localapi/v0/ssh/policy", nil), &fakeSSHBackend{})
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %v; want %v", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package awsstore
+
+import "tailscale.com/tstime"
+
+// storeOptions are the optional settings of an AWS store, set by the
+// Options passed to New.
+type storeOptions struct {
+	clock tstime.Clock      // or nil for tstime.StdClock
+	tags  map[string]string // or nil for no tags
+	tier  Tier              // or empty for TierIntelligent
+
+	maxRetries int  // defaultMaxRetries unless set by WithMaxRetries
+	noCreate   bool // set by WithoutCreate
+}
+
+// Option is an optional setting for New.
+type Option func(*storeOptions)
+
+// WithClock returns an Option making the store use clock for any
+// time-dependent behavior, instead of the real time. It's meant for tests.
+func WithClock(clock tstime.Clock) Option {
+	return func(o *storeOptions) { o.clock = clock }
+}
+
+// WithTags returns an Option tagging the SSM parameter with tags when the
+// store creates it. Tags of a parameter that already exists are left
+// alone, so that ones changed outside of tailscaled aren't overwritten.
+func WithTags(tags map[string]string) Option {
+	return func(o *storeOptions) { o.tags = tags }
+}
+
+// Tier is an SSM parameter tier.
+type Tier string
+
+// The SSM parameter tiers, with the values used by the SSM API.
+const (
+	// TierStandard parameters are free, but hold at most 4KB.
+	TierStandard Tier = "Standard"
+	// TierAdvanced parameters hold up to 8KB, at a cost.
+	TierAdvanced Tier = "Advanced"
+	// TierIntelligent uses the standard tier while the state fits in
+	// it, and the advanced tier otherwise.
+	TierIntelligent Tier = "Intelligent-Tiering"
+)
+
+// WithTier returns an Option making the store write its SSM parameter in
+// tier, rather than TierIntelligent. Note that SSM can't move a parameter
+// from the advanced tier back to the standard one.
+func WithTier(tier Tier) Option {
+	return func(o *storeOptions) { o.tier = tier }
+}
+
+// defaultMaxRetries is how many times SSM calls failing with a retryable
+// error are retried, unless set with WithMaxRetries.
+const defaultMaxRetries = 5
+
+// WithMaxRetries returns an Option making the store retry SSM calls that
+// are throttled or fail with a server error up to n times, with backoff,
+// rather than defaultMaxRetries times. Zero disables retries.
+func WithMaxRetries(n int) Option {
+	return func(o *storeOptions) { o.maxRetries = n }
+}
+
+// WithoutCreate returns an Option making New fail if the SSM parameter
+// doesn't exist, rather than create it, so that opening the store writes
+// nothing. It's for stores that are only read.
+func WithoutCreate() Option {
+	return func(o *storeOptions) { o.noCreate = true }
+}
@@ -11,19 +11,33 @@
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/mem"
+	"tailscale.com/logtail/backoff"
+	"tailscale.com/tstime"
 	"tailscale.com/types/logger"
 )
 
 const (
 	parameterNameRxStr = `^parameter(/.*)`
+
+	// maxRetryBackoff is the longest time to wait between retries of an
+	// SSM call.
+	maxRetryBackoff = 5 * time.Second
+
+	// opTimeout is the longest that loading or persisting the state may
+	// take, including retries.
+	opTimeout = 2 * time.Minute
 )
 
 var parameterNameRx = regexp.MustCompile(parameterNameRxStr)
@@ -43,8 +57,14 @@ type awsSSMClient interface {
 // store is a store which leverages AWS SSM parameter store
 // to persist the state
 type awsStore struct {
-	ssmClient awsSSMClient
-	ssmARN    arn.ARN
+	ssmClient  awsSSMClient
+	ssmARN     arn.ARN
+	logf       logger.Logf
+	clock      tstime.Clock
+	tags       map[string]string
+	tier       Tier
+	maxRetries int
+	noCreate   bool // fail, rather than create the parameter, if it doesn't exist
 
 	memory mem.Store
 }
@@ -57,15 +77,41 @@ type awsStore struct {
 // Tailscaled to only only store new state in-memory and
 // restarting Tailscaled can fail until you delete your state
 // from the AWS Parameter Store.
-func New(_ logger.Logf, ssmARN string) (ipn.StateStore, error) {
-	return newStore(ssmARN, nil)
+func New(logf logger.Logf, ssmARN string, opts ...Option) (ipn.StateStore, error) {
+	return newStore(logf, ssmARN, nil, opts...)
 }
 
 // newStore is NewStore, but for tests. If client is non-nil, it's
 // used instead of making one.
-func newStore(ssmARN string, client awsSSMClient) (ipn.StateStore, error) {
+func newStore(logf logger.Logf, ssmARN string, client awsSSMClient, opts ...Option) (ipn.StateStore, error) {
+	o := storeOptions{maxRetries: defaultMaxRetries}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	s := &awsStore{
-		ssmClient: client,
+		ssmClient:  client,
+		logf:       logf,
+		clock:      o.clock,
+		tags:       o.tags,
+		tier:       o.tier,
+		maxRetries: o.maxRetries,
+		noCreate:   o.noCreate,
+	}
+	if s.logf == nil {
+		s.logf = logger.Discard
+	}
+	if s.clock == nil {
+		s.clock = tstime.StdClock{}
+	}
+	if s.maxRetries < 0 {
+		return nil, fmt.Errorf("invalid max retries %d", s.maxRetries)
+	}
+	switch s.tier {
+	case "":
+		s.tier = TierIntelligent
+	case TierStandard, TierAdvanced, TierIntelligent:
+	default:
+		return nil, fmt.Errorf("invalid SSM parameter tier %q", s.tier)
 	}
 
 	var err error
@@ -98,7 +144,7 @@ func newStore(ssmARN string, client awsSSMClient) (ipn.StateStore, error) {
 
 	// Hydrate cache with the potentially current state
 	if err := s.LoadState(); err != nil {
-		return nil, err
+		return nil, s.explainError(err)
 	}
 	return s, nil
 
@@ -106,20 +152,29 @@ func newStore(ssmARN string, client awsSSMClient) (ipn.StateStore, error) {
 
 // LoadState attempts to read the state from AWS SSM parameter store key.
 func (s *awsStore) LoadState() error {
-	param, err := s.ssmClient.GetParameter(
-		context.TODO(),
-		&ssm.GetParameterInput{
-			Name:           aws.String(s.ParameterName()),
-			WithDecryption: aws.Bool(true),
-		},
-	)
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	var param *ssm.GetParameterOutput
+	err := s.retry(ctx, "GetParameter", func() (err error) {
+		param, err = s.ssmClient.GetParameter(
+			ctx,
+			&ssm.GetParameterInput{
+				Name:           aws.String(s.ParameterName()),
+				WithDecryption: aws.Bool(true),
+			},
+		)
+		return err
+	})
 
 	if err != nil {
 		var pnf *ssmTypes.ParameterNotFound
 		if errors.As(err, &pnf) {
+			if s.noCreate {
+				return fmt.Errorf("parameter %q doesn't exist", s.ParameterName())
+			}
 			// Create the parameter as it does not exist yet
 			// and return directly as it is defacto empty
-			return s.persistState()
+			return s.persistState(ctx, true)
 		}
 		return err
 	}
@@ -128,6 +183,39 @@ func (s *awsStore) LoadState() error {
 	return s.memory.LoadFromJSON([]byte(*param.Parameter.Value))
 }
 
+// HealthCheck implements store.HealthChecker. It checks that the parameter
+// can be read and decrypted, or doesn't exist yet. Write permissions can't
+// be checked without writing.
+func (s *awsStore) HealthCheck(ctx context.Context) error {
+	err := s.retry(ctx, "GetParameter", func() error {
+		_, err := s.ssmClient.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(s.ParameterName()),
+			WithDecryption: aws.Bool(true),
+		})
+		return err
+	})
+	var pnf *ssmTypes.ParameterNotFound
+	if err == nil || errors.As(err, &pnf) {
+		return nil
+	}
+	return s.explainError(err)
+}
+
+// explainError returns err, from an SSM call, with an explanation of what
+// to fix if it's a permissions problem.
+func (s *awsStore) explainError(err error) error {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "AccessDeniedException", "UnrecognizedClientException", "ExpiredTokenException":
+			return fmt.Errorf("%v: access denied; the AWS credentials in use need ssm:GetParameter and ssm:PutParameter on %s, and kms:Decrypt and kms:Encrypt on its KMS key: %w", s, s.ssmARN, err)
+		case "InvalidKeyId":
+			return fmt.Errorf("%v: the KMS key of the parameter is missing or disabled: %w", s, err)
+		}
+	}
+	return fmt.Errorf("%v: %w", s, err)
+}
+
 // ParameterName returns the parameter name extracted from
 // the provided ARN
 func (s *awsStore) ParameterName() (name string) {
@@ -155,11 +243,15 @@ func (s *awsStore) WriteState(id ipn.StateKey, bs []byte) (err error) {
 	}
 
 	// Persist the state in AWS SSM parameter store
-	return s.persistState()
+	ctx, cancel := context.WithTimeout(context.Background(), opTimeout)
+	defer cancel()
+	return s.persistState(ctx, false)
 }
 
-// PersistState saves the states into the AWS SSM parameter store
-func (s *awsStore) persistState() error {
+// PersistState saves the states into the AWS SSM parameter store.
+// If create is true, the parameter doesn't exist yet and is created
+// with s.tags, if any.
+func (s *awsStore) persistState(ctx context.Context, create bool) error {
 	// Generate JSON from in-memory cache
 	bs, err := s.memory.ExportToJSON()
 	if err != nil {
@@ -168,19 +260,88 @@ func (s *awsStore) persistState() error {
 
 	// Store in AWS SSM parameter store.
 	//
-	// We use intelligent tiering so that when the state is below 4kb, it uses Standard tiering
+	// By default, we use intelligent tiering so that when the state is below 4kb, it uses Standard tiering
 	// which is free. However, if it exceeds 4kb it switches the parameter to advanced tiering
 	// doubling the capacity to 8kb per the following docs:
 	// https://aws.amazon.com/about-aws/whats-new/2019/08/aws-systems-manager-parameter-store-announces-intelligent-tiering-to-enable-automatic-parameter-tier-selection/
-	_, err = s.ssmClient.PutParameter(
-		context.TODO(),
-		&ssm.PutParameterInput{
-			Name:      aws.String(s.ParameterName()),
-			Value:     aws.String(string(bs)),
-			Overwrite: aws.Bool(true),
-			Tier:      ssmTypes.ParameterTierIntelligentTiering,
-			Type:      ssmTypes.ParameterTypeSecureString,
-		},
-	)
-	return err
+	in := &ssm.PutParameterInput{
+		Name:      aws.String(s.ParameterName()),
+		Value:     aws.String(string(bs)),
+		Overwrite: aws.Bool(true),
+		Tier:      ssmTypes.ParameterTier(s.tier),
+		Type:      ssmTypes.ParameterTypeSecureString,
+	}
+	if create && len(s.tags) > 0 {
+		// SSM rejects tags when overwriting.
+		in.Overwrite = aws.Bool(false)
+		in.Tags = s.ssmTags()
+	}
+	attempts := 0
+	return s.retry(ctx, "PutParameter", func() error {
+		attempts++
+		_, err := s.ssmClient.PutParameter(ctx, in)
+		var pae *ssmTypes.ParameterAlreadyExists
+		if attempts > 1 && in.Tags != nil && errors.As(err, &pae) {
+			// An earlier attempt created the parameter, with its tags,
+			// though it seemed to fail. Overwrite it instead, which
+			// SSM only allows without tags.
+			s.logf("awsstore: %s already created; overwriting", s.ParameterName())
+			update := *in
+			update.Overwrite = aws.Bool(true)
+			update.Tags = nil
+			in = &update
+			_, err = s.ssmClient.PutParameter(ctx, in)
+		}
+		return err
+	})
+}
+
+// retry calls f, the SSM API call op, and retries it with backoff up to
+// s.maxRetries times while it fails with a retryable error, and ctx isn't
+// done. It returns the last error.
+func (s *awsStore) retry(ctx context.Context, op string, f func() error) error {
+	var bo *backoff.Backoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt == s.maxRetries || !isRetryable(err) {
+			return err
+		}
+		if bo == nil {
+			bo = backoff.NewBackoff("awsstore", s.logf, maxRetryBackoff)
+			bo.Clock = s.clock
+		}
+		s.logf("awsstore: %s failed, retrying: %v", op, err)
+		bo.BackOff(ctx, err)
+		if ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// isRetryable reports whether err, returned by an SSM API call, is worth
+// retrying: the call was throttled or failed on the server side. Other
+// errors, like validation and access denied ones, aren't.
+func isRetryable(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		switch ae.ErrorCode() {
+		case "ThrottlingException", "TooManyUpdates":
+			return true
+		}
+		if ae.ErrorFault() == smithy.FaultServer {
+			return true
+		}
+	}
+	var re interface{ HTTPStatusCode() int }
+	return errors.As(err, &re) && re.HTTPStatusCode() >= 500
+}
+
+// ssmTags returns s.tags as SSM tags, sorted by key.
+func (s *awsStore) ssmTags() []ssmTypes.Tag {
+	var tags []ssmTypes.Tag
+	for k, v := range s.tags {
+		tags = append(tags, ssmTypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	slices.SortFunc(tags, func(a, b ssmTypes.Tag) int { return strings.Compare(*a.Key, *b.Key) })
+	return tags
 }
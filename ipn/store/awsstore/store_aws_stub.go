@@ -13,6 +13,6 @@
 	"tailscale.com/types/logger"
 )
 
-func New(logger.Logf, string) (ipn.StateStore, error) {
+func New(logger.Logf, string, ...Option) (ipn.StateStore, error) {
 	return nil, fmt.Errorf("AWS store is not supported on %v", runtime.GOOS)
 }
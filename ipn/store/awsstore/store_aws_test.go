@@ -7,21 +7,40 @@
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/arn"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
 	"tailscale.com/ipn"
 	"tailscale.com/tstest"
+	"tailscale.com/tstime"
 )
 
 type mockedAWSSSMClient struct {
 	value string
+	puts  []*ssm.PutParameterInput // all PutParameter calls
+
+	// putErrs are errors to fail the next PutParameter calls with, after
+	// they take effect, like when a response is lost.
+	putErrs []error
+
+	getErrs []error // errors to fail the next GetParameter calls with
+	gets    int     // number of GetParameter calls
 }
 
 func (sp *mockedAWSSSMClient) GetParameter(_ context.Context, input *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	sp.gets++
+	if len(sp.getErrs) > 0 {
+		err := sp.getErrs[0]
+		sp.getErrs = sp.getErrs[1:]
+		return nil, err
+	}
 	output := new(ssm.GetParameterOutput)
 	if sp.value == "" {
 		return output, &ssmTypes.ParameterNotFound{}
@@ -35,7 +54,16 @@ func (sp *mockedAWSSSMClient) GetParameter(_ context.Context, input *ssm.GetPara
 }
 
 func (sp *mockedAWSSSMClient) PutParameter(_ context.Context, input *ssm.PutParameterInput, _ ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	sp.puts = append(sp.puts, input)
+	if !aws.ToBool(input.Overwrite) && sp.value != "" {
+		return nil, &ssmTypes.ParameterAlreadyExists{}
+	}
 	sp.value = *input.Value
+	if len(sp.putErrs) > 0 {
+		err := sp.putErrs[0]
+		sp.putErrs = sp.putErrs[1:]
+		return nil, err
+	}
 	return new(ssm.PutParameterOutput), nil
 }
 
@@ -65,7 +93,7 @@ func TestNewAWSStore(t *testing.T) {
 		Resource:  "parameter/foo",
 	}
 
-	s, err := newStore(storeParameterARN.String(), mc)
+	s, err := newStore(t.Logf, storeParameterARN.String(), mc)
 	if err != nil {
 		t.Fatalf("creating aws store failed: %v", err)
 	}
@@ -73,7 +101,7 @@ func TestNewAWSStore(t *testing.T) {
 
 	// Build a brand new file store and check that both IDs written
 	// above are still there.
-	s2, err := newStore(storeParameterARN.String(), mc)
+	s2, err := newStore(t.Logf, storeParameterARN.String(), mc)
 	if err != nil {
 		t.Fatalf("creating second aws store failed: %v", err)
 	}
@@ -98,6 +126,271 @@ func TestNewAWSStore(t *testing.T) {
 	}
 }
 
+func TestAWSStoreClock(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+
+	s, err := newStore(t.Logf, storeARN, &mockedAWSSSMClient{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*awsStore).clock.(tstime.StdClock); !ok {
+		t.Errorf("default clock = %T; want tstime.StdClock", s.(*awsStore).clock)
+	}
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := tstest.NewClock(tstest.ClockOpts{Start: start})
+	s, err = newStore(t.Logf, storeARN, &mockedAWSSSMClient{}, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.(*awsStore).clock
+	clock.Advance(time.Hour)
+	if got, want := c.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("store clock Now = %v; want %v", got, want)
+	}
+}
+
+func TestAWSStoreTags(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	tags := map[string]string{"Team": "net", "Env": "prod"}
+
+	mc := &mockedAWSSSMClient{}
+	s, err := newStore(t.Logf, storeARN, mc, WithTags(tags))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.puts) != 1 {
+		t.Fatalf("got %d PutParameter calls on create; want 1", len(mc.puts))
+	}
+	create := mc.puts[0]
+	var got []string
+	for _, tag := range create.Tags {
+		got = append(got, *tag.Key+"="+*tag.Value)
+	}
+	if want := "Env=prod,Team=net"; strings.Join(got, ",") != want {
+		t.Errorf("tags on create = %q; want %q", got, want)
+	}
+	if *create.Overwrite {
+		t.Errorf("create with tags has Overwrite set; SSM rejects that")
+	}
+
+	// Updates, and loading an existing parameter, leave tags alone.
+	if err := s.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newStore(t.Logf, storeARN, mc, WithTags(tags)); err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.puts) != 2 {
+		t.Fatalf("got %d PutParameter calls; want 2", len(mc.puts))
+	}
+	if update := mc.puts[1]; update.Tags != nil || !*update.Overwrite {
+		t.Errorf("update has Tags %v, Overwrite %v; want none, true", update.Tags, *update.Overwrite)
+	}
+}
+
+func TestAWSStoreTagsCreateRetried(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	tags := map[string]string{"Team": "net"}
+
+	// The create takes effect, but seems to fail, so it's retried.
+	clock := tstest.NewClock(tstest.ClockOpts{})
+	mc := &mockedAWSSSMClient{putErrs: []error{&ssmTypes.InternalServerError{}}}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := newStore(t.Logf, storeARN, mc, WithTags(tags), WithClock(clock))
+		errc <- err
+	}()
+	var err error
+Loop:
+	for {
+		select {
+		case err = <-errc:
+			break Loop
+		case <-time.After(time.Millisecond):
+			clock.Advance(maxRetryBackoff * 2)
+		}
+	}
+	if err != nil {
+		t.Fatalf("newStore: %v", err)
+	}
+	if len(mc.puts) != 3 {
+		t.Fatalf("got %d PutParameter calls; want create, retried create, overwrite", len(mc.puts))
+	}
+	if last := mc.puts[2]; last.Tags != nil || !*last.Overwrite {
+		t.Errorf("overwrite has Tags %v, Overwrite %v; want none, true", last.Tags, *last.Overwrite)
+	}
+}
+
+func TestAWSStoreTier(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	tests := []struct {
+		opts []Option
+		want ssmTypes.ParameterTier
+	}{
+		{nil, ssmTypes.ParameterTierIntelligentTiering},
+		{[]Option{WithTier(TierStandard)}, ssmTypes.ParameterTierStandard},
+		{[]Option{WithTier(TierAdvanced)}, ssmTypes.ParameterTierAdvanced},
+		{[]Option{WithTier(TierIntelligent)}, ssmTypes.ParameterTierIntelligentTiering},
+	}
+	for _, tt := range tests {
+		mc := &mockedAWSSSMClient{}
+		s, err := newStore(t.Logf, storeARN, mc, tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.WriteState("foo", []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		for i, in := range mc.puts {
+			if in.Tier != tt.want {
+				t.Errorf("PutParameter %d: Tier = %q; want %q", i, in.Tier, tt.want)
+			}
+		}
+	}
+
+	if _, err := newStore(t.Logf, storeARN, &mockedAWSSSMClient{}, WithTier("Bogus")); err == nil {
+		t.Error("newStore with an invalid tier succeeded")
+	}
+}
+
+func TestAWSStoreWithoutCreate(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+
+	mc := &mockedAWSSSMClient{}
+	if _, err := newStore(t.Logf, storeARN, mc, WithoutCreate()); err == nil {
+		t.Error("newStore of a missing parameter succeeded")
+	}
+	if len(mc.puts) != 0 {
+		t.Errorf("newStore of a missing parameter made %d PutParameter calls; want 0", len(mc.puts))
+	}
+
+	mc = &mockedAWSSSMClient{value: `{"foo":"YmFy"}`}
+	s, err := newStore(t.Logf, storeARN, mc, WithoutCreate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadState("foo"); err != nil || string(got) != "bar" {
+		t.Errorf("ReadState = %q, %v; want %q", got, err, "bar")
+	}
+	if len(mc.puts) != 0 {
+		t.Errorf("newStore made %d PutParameter calls; want 0", len(mc.puts))
+	}
+}
+
+func TestAWSStoreRetry(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	throttled := &smithy.GenericAPIError{Code: "ThrottlingException", Message: "Rate exceeded"}
+	tests := []struct {
+		name      string
+		errs      []error
+		opts      []Option
+		wantGets  int
+		wantError bool
+	}{
+		{
+			name:     "throttled-then-succeeds",
+			errs:     []error{throttled, throttled},
+			wantGets: 3,
+		},
+		{
+			name:     "server-error",
+			errs:     []error{&ssmTypes.InternalServerError{}},
+			wantGets: 2,
+		},
+		{
+			name:      "validation",
+			errs:      []error{&smithy.GenericAPIError{Code: "ValidationException"}},
+			wantGets:  1,
+			wantError: true,
+		},
+		{
+			name:      "access-denied",
+			errs:      []error{&smithy.GenericAPIError{Code: "AccessDeniedException"}},
+			wantGets:  1,
+			wantError: true,
+		},
+		{
+			name:      "max-retries",
+			errs:      []error{throttled, throttled, throttled},
+			opts:      []Option{WithMaxRetries(1)},
+			wantGets:  2,
+			wantError: true,
+		},
+		{
+			name:      "no-retries",
+			errs:      []error{throttled},
+			opts:      []Option{WithMaxRetries(0)},
+			wantGets:  1,
+			wantError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := tstest.NewClock(tstest.ClockOpts{})
+			mc := &mockedAWSSSMClient{value: `{"foo":"YmFy"}`, getErrs: tt.errs}
+			errc := make(chan error, 1)
+			go func() {
+				_, err := newStore(t.Logf, storeARN, mc, append(tt.opts, WithClock(clock))...)
+				errc <- err
+			}()
+			// Fire the backoff timers until the store is done.
+			var err error
+		Loop:
+			for {
+				select {
+				case err = <-errc:
+					break Loop
+				case <-time.After(time.Millisecond):
+					clock.Advance(maxRetryBackoff * 2)
+				}
+			}
+			if gotError := err != nil; gotError != tt.wantError {
+				t.Errorf("newStore error = %v; want error: %v", err, tt.wantError)
+			}
+			if mc.gets != tt.wantGets {
+				t.Errorf("got %d GetParameter calls; want %d", mc.gets, tt.wantGets)
+			}
+		})
+	}
+}
+
+func TestAWSStoreHealthCheck(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	denied := &smithy.GenericAPIError{Code: "AccessDeniedException", Message: "not authorized to perform ssm:GetParameter"}
+	ctx := context.Background()
+
+	mc := &mockedAWSSSMClient{}
+	s, err := newStore(t.Logf, storeARN, mc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(*awsStore).HealthCheck(ctx); err != nil {
+		t.Errorf("HealthCheck with permissions: %v", err)
+	}
+
+	mc.getErrs = []error{denied}
+	err = s.(*awsStore).HealthCheck(ctx)
+	if err == nil {
+		t.Fatal("HealthCheck without permissions succeeded")
+	}
+	if !errors.Is(err, denied) || !strings.Contains(err.Error(), "need ssm:GetParameter and ssm:PutParameter") {
+		t.Errorf("HealthCheck without permissions = %v; want an explanation wrapping %v", err, denied)
+	}
+
+	// The parameter not existing yet is fine; the store will create it.
+	mc.getErrs = []error{&ssmTypes.ParameterNotFound{}}
+	if err := s.(*awsStore).HealthCheck(ctx); err != nil {
+		t.Errorf("HealthCheck of missing parameter: %v", err)
+	}
+
+	// Creating the store without permissions explains the problem too.
+	mc = &mockedAWSSSMClient{getErrs: []error{denied}}
+	if _, err := newStore(t.Logf, storeARN, mc); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("newStore without permissions error = %v; want an explanation", err)
+	}
+}
+
 func testStoreSemantics(t *testing.T, store ipn.StateStore) {
 	t.Helper()
 
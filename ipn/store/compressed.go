@@ -0,0 +1,72 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"tailscale.com/ipn"
+)
+
+// compressedMagic prefixes the values written compressed by a
+// compressedStore. Values are JSON, text or keys, which never start with a
+// NUL byte, so any value lacking the prefix was written uncompressed.
+const compressedMagic = "\x00tsgz1"
+
+// compressedStore is a StateStore that gzips the values it writes to
+// another store, to fit more state in size-limited backends. See the
+// "compressed+" prefix of New.
+//
+// Values that don't shrink are written as is, and values written before
+// compression was enabled still read fine.
+type compressedStore struct {
+	s ipn.StateStore // the wrapped store
+}
+
+// HealthCheck implements HealthChecker by checking the wrapped store.
+func (s *compressedStore) HealthCheck(ctx context.Context) error { return HealthCheck(ctx, s.s) }
+
+func (s *compressedStore) String() string { return fmt.Sprintf("compressedStore(%v)", s.s) }
+
+// ReadState implements the StateStore interface.
+func (s *compressedStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	bs, err := s.s.ReadState(id)
+	if err != nil {
+		return nil, err
+	}
+	rest, ok := bytes.CutPrefix(bs, []byte(compressedMagic))
+	if !ok {
+		return bs, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(rest))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %q: %w", id, err)
+	}
+	bs, err = io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing %q: %w", id, err)
+	}
+	return bs, nil
+}
+
+// WriteState implements the StateStore interface.
+func (s *compressedStore) WriteState(id ipn.StateKey, bs []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString(compressedMagic)
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bs)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	// Write small values as is, unless that would make them look
+	// compressed.
+	if buf.Len() >= len(bs) && !bytes.HasPrefix(bs, []byte(compressedMagic)) {
+		return s.s.WriteState(id, bs)
+	}
+	return s.s.WriteState(id, buf.Bytes())
+}
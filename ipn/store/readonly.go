@@ -0,0 +1,46 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// errReadOnly is returned by the writes to a readOnlyStore that fails them.
+var errReadOnly = errors.New("state store is read-only")
+
+// readOnlyStore is a StateStore that reads from another store but never
+// writes to it, for disaster recovery drills and forensic inspection. See
+// the "readonly+" and "readonly-strict+" prefixes of New.
+type readOnlyStore struct {
+	s          ipn.StateStore // the wrapped store
+	logf       logger.Logf
+	failWrites bool // whether writes fail, rather than being dropped
+}
+
+// HealthCheck implements HealthChecker by checking the wrapped store.
+func (s *readOnlyStore) HealthCheck(ctx context.Context) error { return HealthCheck(ctx, s.s) }
+
+func (s *readOnlyStore) String() string { return fmt.Sprintf("readOnlyStore(%v)", s.s) }
+
+// ReadState implements the StateStore interface.
+func (s *readOnlyStore) ReadState(id ipn.StateKey) ([]byte, error) {
+	return s.s.ReadState(id)
+}
+
+// WriteState implements the StateStore interface. It logs and drops the
+// write, or fails it if s.failWrites.
+func (s *readOnlyStore) WriteState(id ipn.StateKey, bs []byte) error {
+	if s.failWrites {
+		s.logf("store: refusing write of %q to read-only store", id)
+		return fmt.Errorf("writing %q: %w", id, errReadOnly)
+	}
+	s.logf("store: dropping write of %q to read-only store", id)
+	return nil
+}
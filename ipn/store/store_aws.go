@@ -6,7 +6,14 @@
 package store
 
 import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"tailscale.com/ipn"
 	"tailscale.com/ipn/store/awsstore"
+	"tailscale.com/types/logger"
 )
 
 func init() {
@@ -14,5 +21,109 @@ func init() {
 }
 
 func registerAWSStore() {
-	Register("arn:", awsstore.New)
+	Register("arn:", func(logf logger.Logf, arg string) (ipn.StateStore, error) {
+		ssmARN, opts, err := parseAWSStoreArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		return awsstore.New(logf, ssmARN, opts...)
+	})
+	registerReadOnly("arn:", func(logf logger.Logf, arg string) (ipn.StateStore, error) {
+		ssmARN, opts, err := parseAWSStoreArg(arg)
+		if err != nil {
+			return nil, err
+		}
+		return awsstore.New(logf, ssmARN, append(opts, awsstore.WithoutCreate())...)
+	})
+}
+
+// parseAWSStoreArg splits arg, an SSM parameter ARN optionally followed by
+// a "?" and URL query parameters, into the ARN and the awsstore options
+// selected by the parameters.
+//
+// The supported parameters are:
+//
+//   - kmsContext: a KMS encryption context, as comma-separated key:value
+//     pairs. It's validated but always rejected, as SSM doesn't accept
+//     a caller-provided encryption context.
+//   - tags: tags to put on the SSM parameter when it's created, as
+//     comma-separated key=value pairs. See awsstore.WithTags.
+//   - tier: the SSM parameter tier, "standard", "advanced" or
+//     "intelligent" (the default). See awsstore.WithTier.
+//   - maxRetries: how many times to retry throttled SSM calls and SSM
+//     server errors. See awsstore.WithMaxRetries.
+func parseAWSStoreArg(arg string) (ssmARN string, opts []awsstore.Option, err error) {
+	ssmARN, rawQuery, ok := strings.Cut(arg, "?")
+	if !ok {
+		return ssmARN, nil, nil
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid AWS store parameters %q: %w", rawQuery, err)
+	}
+	for k, vs := range q {
+		if len(vs) != 1 {
+			return "", nil, fmt.Errorf("AWS store parameter %q given %d times", k, len(vs))
+		}
+		v := vs[0]
+		switch k {
+		case "kmsContext":
+			if _, err := parseKeyValues(v, ":"); err != nil {
+				return "", nil, fmt.Errorf("invalid kmsContext: %w", err)
+			}
+			// SSM encrypts SecureString parameters with the fixed
+			// encryption context PARAMETER_ARN=<parameter ARN>, and
+			// neither PutParameter nor GetParameter takes another one,
+			// so there's no way to honor this. Fail rather than let
+			// users believe it's enforced; a KMS key policy condition
+			// on kms:EncryptionContext:PARAMETER_ARN achieves the same.
+			return "", nil, fmt.Errorf("kmsContext is not supported: SSM always uses the encryption context PARAMETER_ARN=<parameter ARN>; restrict the KMS key policy with a kms:EncryptionContext:PARAMETER_ARN condition instead")
+		case "tags":
+			tags, err := parseKeyValues(v, "=")
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid tags: %w", err)
+			}
+			opts = append(opts, awsstore.WithTags(tags))
+		case "tier":
+			tier, ok := awsStoreTiers[v]
+			if !ok {
+				return "", nil, fmt.Errorf("invalid tier %q; want standard, advanced or intelligent", v)
+			}
+			opts = append(opts, awsstore.WithTier(tier))
+		case "maxRetries":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return "", nil, fmt.Errorf("invalid maxRetries %q", v)
+			}
+			opts = append(opts, awsstore.WithMaxRetries(n))
+		default:
+			return "", nil, fmt.Errorf("unknown AWS store parameter %q", k)
+		}
+	}
+	return ssmARN, opts, nil
+}
+
+// awsStoreTiers maps the values of the arn: store's tier parameter to the
+// tiers they select.
+var awsStoreTiers = map[string]awsstore.Tier{
+	"standard":    awsstore.TierStandard,
+	"advanced":    awsstore.TierAdvanced,
+	"intelligent": awsstore.TierIntelligent,
+}
+
+// parseKeyValues parses s, comma-separated pairs of a key and a value
+// separated by sep, into a map. Keys must be non-empty and unique.
+func parseKeyValues(s, sep string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, sep)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("malformed pair %q; want key%svalue", kv, sep)
+		}
+		if _, dup := m[k]; dup {
+			return nil, fmt.Errorf("duplicate key %q", k)
+		}
+		m[k] = v
+	}
+	return m, nil
 }
@@ -0,0 +1,56 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build (ts_aws || (linux && (arm64 || amd64))) && !ts_omit_aws
+
+package store
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAWSStoreArg(t *testing.T) {
+	const storeARN = "arn:aws:ssm:eu-west-1:123456789:parameter/foo"
+	tests := []struct {
+		arg      string
+		wantOpts int
+		wantErr  string // substring; empty for success
+	}{
+		{arg: storeARN},
+		{arg: storeARN + "?", wantOpts: 0},
+		{arg: storeARN + "?bogus=1", wantErr: `unknown AWS store parameter "bogus"`},
+		{arg: storeARN + "?kmsContext=a:1&kmsContext=b:2", wantErr: "given 2 times"},
+		{arg: storeARN + "?kmsContext=a", wantErr: `invalid kmsContext: malformed pair "a"`},
+		{arg: storeARN + "?kmsContext=a:1,,b:2", wantErr: `invalid kmsContext: malformed pair ""`},
+		{arg: storeARN + "?kmsContext=a:1,a:2", wantErr: `invalid kmsContext: duplicate key "a"`},
+		{arg: storeARN + "?kmsContext=k1:v1,k2:v2", wantErr: "kmsContext is not supported"},
+		{arg: storeARN + "?tags=Team=net,Env=prod", wantOpts: 1},
+		{arg: storeARN + "?tags=Team=net,Env=prod&bogus=1", wantErr: "unknown AWS store parameter"},
+		{arg: storeARN + "?tags=Team", wantErr: `invalid tags: malformed pair "Team"`},
+		{arg: storeARN + "?tier=advanced", wantOpts: 1},
+		{arg: storeARN + "?tier=advanced&tags=Team=net", wantOpts: 2},
+		{arg: storeARN + "?tier=Advanced", wantErr: `invalid tier "Advanced"`},
+		{arg: storeARN + "?maxRetries=0", wantOpts: 1},
+		{arg: storeARN + "?maxRetries=-1", wantErr: `invalid maxRetries "-1"`},
+	}
+	for _, tt := range tests {
+		ssmARN, opts, err := parseAWSStoreArg(tt.arg)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseAWSStoreArg(%q) error = %v; want %q", tt.arg, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAWSStoreArg(%q): %v", tt.arg, err)
+			continue
+		}
+		if ssmARN != storeARN {
+			t.Errorf("parseAWSStoreArg(%q) ARN = %q; want %q", tt.arg, ssmARN, storeARN)
+		}
+		if len(opts) != tt.wantOpts {
+			t.Errorf("parseAWSStoreArg(%q) got %d options; want %d", tt.arg, len(opts), tt.wantOpts)
+		}
+	}
+}
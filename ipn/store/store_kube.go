@@ -18,8 +18,11 @@ func init() {
 }
 
 func registerKubeStore() {
-	Register("kube:", func(logf logger.Logf, path string) (ipn.StateStore, error) {
+	newKubeStore := func(logf logger.Logf, path string) (ipn.StateStore, error) {
 		secretName := strings.TrimPrefix(path, "kube:")
 		return kubestore.New(logf, secretName)
-	})
+	}
+	Register("kube:", newKubeStore)
+	// kubestore.New only checks the secret's permissions.
+	registerReadOnly("kube:", newKubeStore)
 }
@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -32,6 +33,7 @@
 
 func registerDefaultStores() {
 	Register("mem:", mem.New)
+	registerReadOnly("mem:", mem.New)
 
 	for _, f := range registerAvailableExternalStores {
 		f()
@@ -40,6 +42,43 @@ func registerDefaultStores() {
 
 var knownStores map[string]Provider
 
+// knownReadOnlyStores are the Providers for the prefixes of knownStores that
+// can open their stores without writing anything, as registered by
+// registerReadOnly. Stores wrapped by a read-only wrapper must have one.
+var knownReadOnlyStores map[string]Provider
+
+// storeWrapper is a store that wraps another store, selected by the rest of
+// the path.
+type storeWrapper struct {
+	wrap func(logger.Logf, ipn.StateStore) ipn.StateStore
+
+	// readOnly is whether the wrapper never writes to the wrapped store,
+	// which is then opened without writing to it either.
+	readOnly bool
+}
+
+// knownWrappers maps the prefixes of the stores that wrap another store to
+// the wrappers.
+var knownWrappers = map[string]storeWrapper{
+	"readonly+": {
+		wrap: func(logf logger.Logf, s ipn.StateStore) ipn.StateStore {
+			return &readOnlyStore{s: s, logf: logf}
+		},
+		readOnly: true,
+	},
+	"readonly-strict+": {
+		wrap: func(logf logger.Logf, s ipn.StateStore) ipn.StateStore {
+			return &readOnlyStore{s: s, logf: logf, failWrites: true}
+		},
+		readOnly: true,
+	},
+	"compressed+": {
+		wrap: func(_ logger.Logf, s ipn.StateStore) ipn.StateStore {
+			return &compressedStore{s: s}
+		},
+	},
+}
+
 // New returns a StateStore based on the provided arg
 // and registered stores.
 // The arg is of the form "prefix:rest", where prefix was previously
@@ -50,19 +89,55 @@ func registerDefaultStores() {
 //   - if the string begins with "mem:", the suffix
 //     is ignored and an in-memory store is used.
 //   - (Linux-only) if the string begins with "arn:",
-//     the suffix an AWS ARN for an SSM.
+//     the suffix an AWS ARN for an SSM, optionally followed by "?" and
+//     query parameters configuring the store.
 //   - (Linux-only) if the string begins with "kube:",
 //     the suffix is a Kubernetes secret name
 //   - In all other cases, the path is treated as a filepath.
+//
+// Any of these may be preceded by wrapper prefixes, as in
+// "readonly+arn:...":
+//
+//   - "readonly+" reads from the store but drops, and logs, all writes.
+//   - "readonly-strict+" reads from the store but fails all writes.
+//   - "compressed+" gzips the values written to the store, and reads
+//     both compressed and uncompressed ones.
+//
+// The stores wrapped by "readonly+" and "readonly-strict+" aren't written to
+// when they're opened either: they must already exist, and only the file,
+// "arn:", "kube:" and "mem:" stores are supported.
 func New(logf logger.Logf, path string) (ipn.StateStore, error) {
+	return newStore(logf, path, false)
+}
+
+// newStore is New, but if readOnly, it opens the store without writing to it,
+// with its provider from knownReadOnlyStores.
+func newStore(logf logger.Logf, path string, readOnly bool) (ipn.StateStore, error) {
 	regOnce.Do(registerDefaultStores)
+	for prefix, w := range knownWrappers {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			s, err := newStore(logf, rest, readOnly || w.readOnly)
+			if err != nil {
+				return nil, err
+			}
+			return w.wrap(logf, s), nil
+		}
+	}
 	for prefix, sf := range knownStores {
 		if strings.HasPrefix(path, prefix) {
+			if readOnly {
+				if sf = knownReadOnlyStores[prefix]; sf == nil {
+					return nil, fmt.Errorf("%q stores can't be opened read-only", prefix)
+				}
+			}
 			// We can't strip the prefix here as some NewStoreFunc (like arn:)
 			// expect the prefix.
 			return sf(logf, path)
 		}
 	}
+	if readOnly {
+		return newReadOnlyFileStore(path)
+	}
 	if runtime.GOOS == "windows" {
 		path = TryWindowsAppDataMigration(logf, path)
 	}
@@ -84,6 +159,32 @@ func Register(prefix string, fn Provider) {
 	mak.Set(&knownStores, prefix, fn)
 }
 
+// registerReadOnly registers fn as the Provider of the stores with prefix,
+// which must also be registered with Register, for read-only wrappers. fn
+// must not write to the store, nor create it if it doesn't exist.
+func registerReadOnly(prefix string, fn Provider) {
+	mak.Set(&knownReadOnlyStores, prefix, fn)
+}
+
+// HealthChecker is implemented by the state stores that can check that
+// they're usable, such as that their backend is reachable and that
+// tailscaled has the permissions it needs there.
+type HealthChecker interface {
+	// HealthCheck returns an error explaining what's wrong if the store
+	// isn't usable, or nil if it is.
+	HealthCheck(context.Context) error
+}
+
+// HealthCheck checks whether s is usable, so that a misconfigured store
+// can be reported clearly at startup. It returns nil if s doesn't
+// implement HealthChecker.
+func HealthCheck(ctx context.Context, s ipn.StateStore) error {
+	if hc, ok := s.(HealthChecker); ok {
+		return hc.HealthCheck(ctx)
+	}
+	return nil
+}
+
 // TryWindowsAppDataMigration attempts to copy the Windows state file
 // from its old location to the new location. (Issue 2856)
 //
@@ -161,6 +262,27 @@ func NewFileStore(logf logger.Logf, path string) (ipn.StateStore, error) {
 	return ret, nil
 }
 
+// newReadOnlyFileStore returns a file store reading from path, for read-only
+// wrappers. Unlike NewFileStore, it creates neither the state directory nor
+// the file, and fails if the file doesn't exist or is empty.
+func newReadOnlyFileStore(path string) (ipn.StateStore, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) == 0 {
+		return nil, fmt.Errorf("state file %q is empty", path)
+	}
+	ret := &FileStore{
+		path:  path,
+		cache: map[ipn.StateKey][]byte{},
+	}
+	if err := json.Unmarshal(bs, &ret.cache); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 // ReadState implements the StateStore interface.
 func (s *FileStore) ReadState(id ipn.StateKey) ([]byte, error) {
 	s.mu.RLock()
@@ -4,6 +4,10 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
 	"path/filepath"
 	"testing"
 
@@ -177,3 +181,196 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestReadOnlyStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	fs, err := NewFileStore(t.Logf, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefix := range []string{"readonly+", "readonly-strict+"} {
+		t.Run(prefix, func(t *testing.T) {
+			s, err := New(t.Logf, prefix+path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ro, ok := s.(*readOnlyStore)
+			if !ok {
+				t.Fatalf("got %T; want *readOnlyStore", s)
+			}
+			if _, ok := ro.s.(*FileStore); !ok {
+				t.Fatalf("wrapped store is %T; want *FileStore", ro.s)
+			}
+			if bs, err := s.ReadState("foo"); err != nil || string(bs) != "bar" {
+				t.Errorf("ReadState(foo) = %q, %v; want bar", bs, err)
+			}
+			if _, err := s.ReadState("baz"); err != ipn.ErrStateNotExist {
+				t.Errorf("ReadState(baz) error = %v; want ErrStateNotExist", err)
+			}
+
+			err = s.WriteState("foo", []byte("changed"))
+			if wantErr := prefix == "readonly-strict+"; (err != nil) != wantErr {
+				t.Errorf("WriteState error = %v; want error: %v", err, wantErr)
+			} else if err != nil && !errors.Is(err, errReadOnly) {
+				t.Errorf("WriteState error = %v; want errReadOnly", err)
+			}
+			if bs, err := s.ReadState("foo"); err != nil || string(bs) != "bar" {
+				t.Errorf("ReadState(foo) after write = %q, %v; want bar", bs, err)
+			}
+			fs2, err := NewFileStore(t.Logf, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bs, _ := fs2.ReadState("foo"); string(bs) != "bar" {
+				t.Errorf("underlying file has foo = %q; want bar", bs)
+			}
+		})
+	}
+
+	// Wrappers compose with other prefixes.
+	s, err := New(t.Logf, "readonly+mem:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*readOnlyStore).s.(*mem.Store); !ok {
+		t.Errorf("readonly+mem: wraps %T; want *mem.Store", s.(*readOnlyStore).s)
+	}
+}
+
+func TestReadOnlyStoreMissing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state-dir")
+	for _, prefix := range []string{"readonly+", "readonly-strict+", "readonly+compressed+"} {
+		t.Run(prefix, func(t *testing.T) {
+			if _, err := New(t.Logf, prefix+filepath.Join(dir, "state")); err == nil {
+				t.Error("opening a missing state file succeeded")
+			}
+			if _, err := os.Stat(dir); !os.IsNotExist(err) {
+				t.Errorf("state dir was created: %v", err)
+			}
+		})
+	}
+
+	// Empty state files, as left by NewFileStore, aren't state either.
+	path := filepath.Join(t.TempDir(), "state")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(t.Logf, "readonly+"+path); err == nil {
+		t.Error("opening an empty state file succeeded")
+	}
+	if bs, err := os.ReadFile(path); err != nil || len(bs) != 0 {
+		t.Errorf("empty state file now has %q, %v", bs, err)
+	}
+
+	// Stores that can't be opened without writing aren't supported.
+	Register("test:", func(logger.Logf, string) (ipn.StateStore, error) {
+		t.Error("read-write provider called for a read-only store")
+		return new(mem.Store), nil
+	})
+	t.Cleanup(func() { delete(knownStores, "test:") })
+	if _, err := New(t.Logf, "readonly+test:"); err == nil {
+		t.Error("opening a store with no read-only provider succeeded")
+	}
+}
+
+func TestCompressedStore(t *testing.T) {
+	tstest.PanicOnLog()
+
+	s, err := New(t.Logf, "compressed+mem:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStoreSemantics(t, s)
+	under := s.(*compressedStore).s
+
+	big := bytes.Repeat([]byte(`{"some":"repetitive","state":true}`), 100)
+	tests := []struct {
+		name           string
+		value          []byte
+		wantCompressed bool
+	}{
+		{"big", big, true},
+		{"small", []byte("x"), false},
+		{"empty", []byte{}, false},
+		{"looks-compressed", []byte(compressedMagic), true},
+	}
+	for _, tt := range tests {
+		id := ipn.StateKey(tt.name)
+		if err := s.WriteState(id, tt.value); err != nil {
+			t.Fatalf("%s: WriteState: %v", tt.name, err)
+		}
+		raw, err := under.ReadState(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.HasPrefix(raw, []byte(compressedMagic)); got != tt.wantCompressed {
+			t.Errorf("%s: stored compressed = %v; want %v", tt.name, got, tt.wantCompressed)
+		}
+		if tt.name == "big" && len(raw) >= len(tt.value) {
+			t.Errorf("%s: stored %d bytes for %d", tt.name, len(raw), len(tt.value))
+		}
+		got, err := s.ReadState(id)
+		if err != nil {
+			t.Fatalf("%s: ReadState: %v", tt.name, err)
+		}
+		if !bytes.Equal(got, tt.value) {
+			t.Errorf("%s: ReadState = %q; want %q", tt.name, got, tt.value)
+		}
+	}
+
+	// Values written before compression was enabled read as is.
+	if err := under.WriteState("legacy", big); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.ReadState("legacy"); err != nil || !bytes.Equal(got, big) {
+		t.Errorf("ReadState(legacy) = %q, %v; want %q", got, err, big)
+	}
+
+	// Corrupt compressed values fail to read.
+	if err := under.WriteState("corrupt", []byte(compressedMagic+"garbage")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadState("corrupt"); err == nil {
+		t.Error("ReadState(corrupt) succeeded")
+	}
+
+	// Wrappers compose.
+	s, err = New(t.Logf, "readonly+compressed+mem:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.(*readOnlyStore).s.(*compressedStore); !ok {
+		t.Errorf("readonly+compressed+mem: wraps %T; want *compressedStore", s.(*readOnlyStore).s)
+	}
+}
+
+type healthCheckStore struct {
+	mem.Store
+	err error
+}
+
+func (s *healthCheckStore) HealthCheck(context.Context) error { return s.err }
+
+func TestHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	if err := HealthCheck(ctx, new(mem.Store)); err != nil {
+		t.Errorf("HealthCheck of store without checks = %v; want nil", err)
+	}
+	errBad := errors.New("bad")
+	for _, s := range []ipn.StateStore{
+		&healthCheckStore{err: errBad},
+		&readOnlyStore{s: &healthCheckStore{err: errBad}},
+		&compressedStore{s: &readOnlyStore{s: &healthCheckStore{err: errBad}}},
+	} {
+		if err := HealthCheck(ctx, s); err != errBad {
+			t.Errorf("HealthCheck(%T) = %v; want %v", s, err, errBad)
+		}
+	}
+	if err := HealthCheck(ctx, &compressedStore{s: &healthCheckStore{}}); err != nil {
+		t.Errorf("HealthCheck of healthy wrapped store = %v; want nil", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultRecorderBreakerThreshold is the default number of consecutive
+	// failures to connect to a recorder after which it's skipped; see
+	// sshRecorderBreakerThreshold.
+	defaultRecorderBreakerThreshold = 3
+
+	// defaultRecorderBreakerCooldown is the default of how long a recorder
+	// is skipped for; see sshRecorderBreakerCooldown.
+	defaultRecorderBreakerCooldown = 30 * time.Second
+)
+
+// recorderBreaker is a circuit breaker for connections to recorders, so that
+// sessions don't each pay the cost of connecting to, or timing out on, a
+// recorder that's consistently failing.
+//
+// After sshRecorderBreakerThreshold consecutive failures to connect to a
+// recorder, it's considered unhealthy and skipped, in favor of any other
+// recorders, until sshRecorderBreakerCooldown elapses. Then a single
+// session tries it again: success makes it healthy again, and failure skips
+// it for another cool-down.
+//
+// The zero value is ready to use. It's shared by all sessions of a server.
+type recorderBreaker struct {
+	mu     sync.Mutex
+	states map[netip.AddrPort]*recorderBreakerState
+}
+
+type recorderBreakerState struct {
+	failures  int       // consecutive failures to connect
+	openUntil time.Time // if non-zero, skip the recorder until then
+	trying    bool      // a session is trying it after its cool-down
+}
+
+// recorderBreakerThreshold returns the number of consecutive failures after
+// which recorders are skipped, or zero if they never are.
+func recorderBreakerThreshold() int {
+	n := sshRecorderBreakerThreshold()
+	switch {
+	case n == 0:
+		return defaultRecorderBreakerThreshold
+	case n < 0:
+		return 0
+	}
+	return n
+}
+
+// recorderBreakerCooldown returns how long unhealthy recorders are skipped
+// for.
+func recorderBreakerCooldown() time.Duration {
+	if d := sshRecorderBreakerCooldown(); d > 0 {
+		return d
+	}
+	return defaultRecorderBreakerCooldown
+}
+
+// allow reports whether a session should try to connect to the recorder ap
+// at now. Once it does, the session must report the outcome with done.
+func (b *recorderBreaker) allow(ap netip.AddrPort, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.states[ap]
+	if st == nil || st.openUntil.IsZero() {
+		return true
+	}
+	if now.Before(st.openUntil) || st.trying {
+		return false
+	}
+	st.trying = true
+	return true
+}
+
+// done records whether connecting to the recorder ap succeeded at now. It
+// reports whether ap became unhealthy or healthy again, respectively, if it
+// did.
+func (b *recorderBreaker) done(ap netip.AddrPort, ok bool, now time.Time) (opened, closed bool) {
+	threshold := recorderBreakerThreshold()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := b.states[ap]
+	if ok {
+		if st == nil {
+			return false, false
+		}
+		delete(b.states, ap)
+		return false, !st.openUntil.IsZero()
+	}
+	if threshold == 0 {
+		return false, false
+	}
+	if st == nil {
+		st = &recorderBreakerState{}
+		if b.states == nil {
+			b.states = map[netip.AddrPort]*recorderBreakerState{}
+		}
+		b.states[ap] = st
+	}
+	st.failures++
+	st.trying = false
+	if st.failures < threshold {
+		return false, false
+	}
+	opened = st.openUntil.IsZero()
+	st.openUntil = now.Add(recorderBreakerCooldown())
+	return opened, false
+}
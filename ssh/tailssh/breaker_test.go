@@ -0,0 +1,98 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"tailscale.com/envknob"
+)
+
+func TestRecorderBreaker(t *testing.T) {
+	envknob.Setenv("TS_SSH_RECORDER_BREAKER_THRESHOLD", "2")
+	envknob.Setenv("TS_SSH_RECORDER_BREAKER_COOLDOWN", "10s")
+	t.Cleanup(func() {
+		envknob.Setenv("TS_SSH_RECORDER_BREAKER_THRESHOLD", "")
+		envknob.Setenv("TS_SSH_RECORDER_BREAKER_COOLDOWN", "")
+	})
+
+	bad := netip.MustParseAddrPort("100.100.100.1:80")
+	good := netip.MustParseAddrPort("100.100.100.2:80")
+	now := time.Unix(1700000000, 0)
+	var b recorderBreaker
+
+	checkAllow := func(ap netip.AddrPort, want bool) {
+		t.Helper()
+		if got := b.allow(ap, now); got != want {
+			t.Fatalf("allow(%v) at %v = %v; want %v", ap, now.Unix(), got, want)
+		}
+	}
+	checkDone := func(ap netip.AddrPort, ok, wantOpened, wantClosed bool) {
+		t.Helper()
+		opened, closed := b.done(ap, ok, now)
+		if opened != wantOpened || closed != wantClosed {
+			t.Fatalf("done(%v, %v) = %v, %v; want %v, %v", ap, ok, opened, closed, wantOpened, wantClosed)
+		}
+	}
+
+	// A single failure doesn't make a recorder unhealthy.
+	checkAllow(bad, true)
+	checkDone(bad, false, false, false)
+	checkAllow(bad, true)
+	checkDone(bad, false, true, false)
+
+	// Now it's skipped until the cool-down elapses, while others aren't.
+	checkAllow(bad, false)
+	checkAllow(good, true)
+	checkDone(good, true, false, false)
+	now = now.Add(9 * time.Second)
+	checkAllow(bad, false)
+
+	// After the cool-down, only one session gets to try it.
+	now = now.Add(time.Second)
+	checkAllow(bad, true)
+	checkAllow(bad, false)
+
+	// Failing the trial skips it for another cool-down.
+	checkDone(bad, false, false, false)
+	checkAllow(bad, false)
+	now = now.Add(10 * time.Second)
+	checkAllow(bad, true)
+
+	// Succeeding makes it healthy again, with its failures forgotten.
+	checkDone(bad, true, false, true)
+	checkAllow(bad, true)
+	checkDone(bad, false, false, false)
+	checkAllow(bad, true)
+}
+
+func TestRecorderBreakerDisabled(t *testing.T) {
+	envknob.Setenv("TS_SSH_RECORDER_BREAKER_THRESHOLD", "-1")
+	t.Cleanup(func() { envknob.Setenv("TS_SSH_RECORDER_BREAKER_THRESHOLD", "") })
+
+	ap := netip.MustParseAddrPort("100.100.100.1:80")
+	now := time.Unix(1700000000, 0)
+	var b recorderBreaker
+	for i := range 10 {
+		if !b.allow(ap, now) {
+			t.Fatalf("recorder skipped after %d failures", i)
+		}
+		if opened, _ := b.done(ap, false, now); opened {
+			t.Fatalf("breaker opened after %d failures", i+1)
+		}
+	}
+}
+
+func TestRecorderBreakerDefaults(t *testing.T) {
+	if got := recorderBreakerThreshold(); got != defaultRecorderBreakerThreshold {
+		t.Errorf("threshold = %v; want %v", got, defaultRecorderBreakerThreshold)
+	}
+	if got := recorderBreakerCooldown(); got != defaultRecorderBreakerCooldown {
+		t.Errorf("cooldown = %v; want %v", got, defaultRecorderBreakerCooldown)
+	}
+}
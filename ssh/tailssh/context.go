@@ -0,0 +1,99 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"context"
+	"net/netip"
+	"os/user"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+// contextKey is the type of the keys of the values that tailssh stores in
+// the ssh.Context of authorized connections.
+type contextKey struct {
+	name string
+}
+
+var (
+	connInfoContextKey    = &contextKey{"tailssh-conn-info"}
+	localUserContextKey   = &contextKey{"tailssh-local-user"}
+	finalActionContextKey = &contextKey{"tailssh-final-action"}
+)
+
+// setContextValues stores the identity, local user and final action of c in
+// ctx, for the ConnIdentityFromContext, LocalUserFromContext and
+// FinalActionFromContext accessors. It must only be called once c has been
+// authorized.
+func (c *conn) setContextValues(ctx ssh.Context) {
+	if c.info != nil {
+		ctx.SetValue(connInfoContextKey, c.info)
+	}
+	if c.localUser != nil {
+		ctx.SetValue(localUserContextKey, c.localUser)
+	}
+	if c.finalAction != nil {
+		ctx.SetValue(finalActionContextKey, c.finalAction.View())
+	}
+}
+
+// ConnIdentity is the Tailscale identity of the client of an SSH connection.
+type ConnIdentity struct {
+	// SSHUser is the requested ssh-user ("root", "alice", etc).
+	SSHUser string
+
+	// Src is the Tailscale IP and port that the connection came from.
+	Src netip.AddrPort
+
+	// Dst is the Tailscale IP and port that the connection came for.
+	Dst netip.AddrPort
+
+	// Node is the node of Src.
+	Node tailcfg.NodeView
+
+	// UserProfile is the UserProfile of Node.
+	UserProfile tailcfg.UserProfile
+}
+
+// ConnIdentityFromContext returns the Tailscale identity of the client of
+// the SSH connection of ctx, which is the ssh.Context of a connection (or of
+// a session on it) handled by this package. It reports false if ctx has none,
+// such as before the connection is authorized.
+func ConnIdentityFromContext(ctx context.Context) (ConnIdentity, bool) {
+	ci, ok := ctx.Value(connInfoContextKey).(*sshConnInfo)
+	if !ok {
+		return ConnIdentity{}, false
+	}
+	return ConnIdentity{
+		SSHUser:     ci.sshUser,
+		Src:         ci.src,
+		Dst:         ci.dst,
+		Node:        ci.node,
+		UserProfile: ci.uprof,
+	}, true
+}
+
+// LocalUserFromContext returns the local user that the SSH connection of ctx
+// runs as. It reports false if ctx has none, such as before the connection is
+// authorized. The returned user is a copy that may be modified.
+func LocalUserFromContext(ctx context.Context) (*user.User, bool) {
+	lu, ok := ctx.Value(localUserContextKey).(*userMeta)
+	if !ok {
+		return nil, false
+	}
+	u := lu.User
+	return &u, true
+}
+
+// FinalActionFromContext returns the SSH policy action that the SSH
+// connection of ctx was resolved to, after following any HoldAndDelegate. It
+// reports false if ctx has none, such as before the connection is authorized.
+func FinalActionFromContext(ctx context.Context) (tailcfg.SSHActionView, bool) {
+	a, ok := ctx.Value(finalActionContextKey).(tailcfg.SSHActionView)
+	return a, ok && a.Valid()
+}
@@ -12,14 +12,19 @@
 package tailssh
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"log/syslog"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"runtime"
 	"slices"
@@ -28,6 +33,7 @@
 	"strings"
 	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/creack/pty"
 	"github.com/pkg/sftp"
@@ -57,6 +63,45 @@ func init() {
 	return nil, nil
 }
 
+// startSystemdScope moves the process pid into a new transient systemd
+// scope unit named unit. On success, it returns a func that stops the scope,
+// killing any processes left in it.
+// See startSystemdScopeLinux.
+var startSystemdScope = func(unit string, pid int) (stop func() error, err error) {
+	return nil, errors.ErrUnsupported
+}
+
+// maybeStartSystemdScope moves the session's process pid into a transient
+// systemd scope if requested by TS_SSH_SYSTEMD_SCOPE. If that's not
+// possible, the process keeps running where it is.
+func (ss *sshSession) maybeStartSystemdScope(pid int) {
+	if !sshSystemdScope() {
+		return
+	}
+	stop, err := startSystemdScope("tailscale-ssh-"+ss.sharedID+".scope", pid)
+	if err != nil {
+		ss.vlogf("not running session in systemd scope: %v", err)
+		return
+	}
+	ss.stopScope = stop
+}
+
+// commandLine returns the command that ss runs when it's not a subsystem:
+// the name of the program and its args, the argv[0] to run it with if not
+// name, whether it's the user's interactive login shell, and whether it's
+// the action's forced command.
+func (ss *sshSession) commandLine() (name string, args []string, argv0 string, isShell, isForced bool) {
+	if fc := ss.conn.finalAction.ForceCommand; fc != nil {
+		// The client's command, if any, is only passed along in
+		// $SSH_ORIGINAL_COMMAND; see launchProcess.
+		return fc.Args[0], append([]string(nil), fc.Args[1:]...), fc.Argv0, false, true
+	}
+	if rawCmd := ss.RawCommand(); rawCmd != "" {
+		return ss.conn.localUser.LoginShell(), []string{"-c", rawCmd}, "", false, false
+	}
+	return ss.conn.localUser.LoginShell(), []string{"-l"}, "", true, false // login shell
+}
+
 // newIncubatorCommand returns a new exec.Cmd configured with
 // `tailscaled be-child ssh` as the entrypoint.
 //
@@ -71,57 +116,41 @@ func (ss *sshSession) newIncubatorCommand() (cmd *exec.Cmd) {
 		}
 	}()
 	var (
-		name    string
-		args    []string
-		isSFTP  bool
-		isShell bool
+		name     string
+		args     []string
+		argv0    string
+		isSFTP   bool
+		isShell  bool
+		isForced bool
 	)
 	switch ss.Subsystem() {
 	case "sftp":
 		isSFTP = true
 	case "":
-		name = ss.conn.localUser.LoginShell()
-		if rawCmd := ss.RawCommand(); rawCmd != "" {
-			args = append(args, "-c", rawCmd)
-		} else {
-			isShell = true
-			args = append(args, "-l") // login shell
-		}
+		name, args, argv0, isShell, isForced = ss.commandLine()
 	default:
 		panic(fmt.Sprintf("unexpected subsystem: %v", ss.Subsystem()))
 	}
 
 	if ss.conn.srv.tailscaledPath == "" {
 		// TODO(maisem): this doesn't work with sftp
-		return exec.CommandContext(ss.ctx, name, args...)
+		if ss.containerPID != 0 {
+			nsArgs := nsenterArgs(ss.containerPID, "", "", name, args)
+			return exec.CommandContext(ss.ctx, nsArgs[0], nsArgs[1:]...)
+		}
+		cmd := exec.CommandContext(ss.ctx, name, args...)
+		if argv0 != "" {
+			cmd.Args[0] = argv0
+		}
+		return cmd
 	}
 	lu := ss.conn.localUser
-	ci := ss.conn.info
-	gids := strings.Join(ss.conn.userGroupIDs, ",")
-	remoteUser := ci.uprof.LoginName
-	if ci.node.IsTagged() {
-		remoteUser = strings.Join(ci.node.Tags().AsSlice(), ",")
-	}
-
-	incubatorArgs := []string{
-		"be-child",
-		"ssh",
-		"--uid=" + lu.Uid,
-		"--gid=" + lu.Gid,
-		"--groups=" + gids,
-		"--local-user=" + lu.Username,
-		"--remote-user=" + remoteUser,
-		"--remote-ip=" + ci.src.Addr().String(),
-		"--has-tty=false", // updated in-place by startWithPTY
-		"--tty-name=",     // updated in-place by startWithPTY
-	}
-
-	if debugTest.Load() {
-		incubatorArgs = append(incubatorArgs, "--debug-test")
-	}
-
+	incubatorArgs := ss.incubatorBaseArgs()
 	if isSFTP {
 		incubatorArgs = append(incubatorArgs, "--sftp")
+		if sshReadOnly() {
+			incubatorArgs = append(incubatorArgs, "--sftp-read-only")
+		}
 	} else {
 		if isShell {
 			incubatorArgs = append(incubatorArgs, "--shell")
@@ -129,7 +158,12 @@ func (ss *sshSession) newIncubatorCommand() (cmd *exec.Cmd) {
 		// Only the macOS version of the login command supports executing a
 		// command, all other versions only support launching a shell
 		// without taking any arguments.
-		shouldUseLoginCmd := isShell || runtime.GOOS == "darwin"
+		// A forced command must run exactly as specified, so it never
+		// goes through login, which would run it with the login shell.
+		// Nor does a synthetic user, which login doesn't know, nor a
+		// session with an overridden home, which login would reset, nor
+		// one entering a container, which login would escape.
+		shouldUseLoginCmd := (isShell || runtime.GOOS == "darwin") && !isForced && !lu.synthetic && !ss.homeDirOverride && ss.containerPID == 0
 		if hostinfo.IsSELinuxEnforcing() {
 			// If we're running on a SELinux-enabled system, the login
 			// command will be unable to set the correct context for the
@@ -143,6 +177,9 @@ func (ss *sshSession) newIncubatorCommand() (cmd *exec.Cmd) {
 			}
 		}
 		incubatorArgs = append(incubatorArgs, "--cmd="+name)
+		if argv0 != "" {
+			incubatorArgs = append(incubatorArgs, "--argv0="+argv0)
+		}
 		if len(args) > 0 {
 			incubatorArgs = append(incubatorArgs, "--")
 			incubatorArgs = append(incubatorArgs, args...)
@@ -151,6 +188,89 @@ func (ss *sshSession) newIncubatorCommand() (cmd *exec.Cmd) {
 	return exec.CommandContext(ss.ctx, ss.conn.srv.tailscaledPath, incubatorArgs...)
 }
 
+// incubatorBaseArgs returns the args of `tailscaled be-child ssh` common to
+// all the commands run for ss, before those specifying the command.
+func (ss *sshSession) incubatorBaseArgs() []string {
+	lu := ss.conn.localUser
+	ci := ss.conn.info
+	gids := strings.Join(ss.conn.userGroupIDs, ",")
+	remoteUser := ci.uprof.LoginName
+	if ci.node.IsTagged() {
+		remoteUser = strings.Join(ci.node.Tags().AsSlice(), ",")
+	}
+
+	incubatorArgs := []string{
+		"be-child",
+		"ssh",
+		"--uid=" + lu.Uid,
+		"--gid=" + lu.Gid,
+		"--groups=" + gids,
+		"--local-user=" + lu.Username,
+		"--remote-user=" + remoteUser,
+		"--remote-ip=" + ci.src.Addr().String(),
+		"--has-tty=false", // updated in-place by startWithPTY
+		"--tty-name=",     // updated in-place by startWithPTY
+	}
+	if ss.containerPID != 0 {
+		incubatorArgs = append(incubatorArgs, "--enter-pid="+strconv.Itoa(ss.containerPID))
+	}
+
+	if debugTest.Load() {
+		incubatorArgs = append(incubatorArgs, "--debug-test")
+	}
+	return incubatorArgs
+}
+
+// postSessionCommandTimeout bounds each run of SSHAction.PostSessionCommand.
+const postSessionCommandTimeout = time.Minute
+
+// runPostSessionCommand runs the action's PostSessionCommand, if any, once
+// the process of ss has exited, as the local user, with the baseline and
+// identity environment of the session. Failures are only logged.
+//
+// It doesn't use ss.ctx, which is done if the session was terminated.
+func (ss *sshSession) runPostSessionCommand() {
+	args := ss.conn.finalAction.PostSessionCommand
+	if len(args) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), postSessionCommandTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	if ss.conn.srv.tailscaledPath == "" {
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+	} else {
+		incubatorArgs := append(ss.incubatorBaseArgs(), "--cmd="+args[0])
+		if len(args) > 1 {
+			incubatorArgs = append(incubatorArgs, "--")
+			incubatorArgs = append(incubatorArgs, args[1:]...)
+		}
+		cmd = exec.CommandContext(ctx, ss.conn.srv.tailscaledPath, incubatorArgs...)
+	}
+	cmd.Dir = cmp.Or(ss.workDir, "/")
+	cmd.Env = envForUser(ss.conn.localUser)
+	if ss.homeDirOverride {
+		updateStringInSlice(cmd.Env, "HOME="+ss.conn.localUser.HomeDir, "HOME="+ss.homeDir)
+	}
+	ci := ss.conn.info
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
+		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
+	)
+	cmd.Env = append(cmd.Env, ss.identityEnv()...)
+	cmd.Env = append(cmd.Env, ss.scratchDirEnv()...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		const maxLogged = 512
+		if len(out) > maxLogged {
+			out = out[len(out)-maxLogged:]
+		}
+		ss.errf("post-session command %q failed: %v: %s", args, err, bytes.TrimSpace(out))
+		return
+	}
+	ss.logf("post-session command %q done", args)
+}
+
 var debugIncubator bool
 var debugTest atomic.Bool
 
@@ -179,11 +299,14 @@ type incubatorArgs struct {
 	ttyName      string
 	hasTTY       bool
 	cmdName      string
+	argv0        string
 	isSFTP       bool
+	sftpReadOnly bool
 	isShell      bool
 	loginCmdPath string
 	cmdArgs      []string
 	debugTest    bool
+	enterPID     int
 }
 
 func parseIncubatorArgs(args []string) (a incubatorArgs) {
@@ -197,10 +320,13 @@ func parseIncubatorArgs(args []string) (a incubatorArgs) {
 	flags.StringVar(&a.ttyName, "tty-name", "", "the tty name (pts/3)")
 	flags.BoolVar(&a.hasTTY, "has-tty", false, "is the output attached to a tty")
 	flags.StringVar(&a.cmdName, "cmd", "", "the cmd to launch (ignored in sftp mode)")
+	flags.StringVar(&a.argv0, "argv0", "", "the argv[0] to launch cmd with, if not cmd itself")
 	flags.BoolVar(&a.isShell, "shell", false, "is launching a shell (with no cmds)")
 	flags.BoolVar(&a.isSFTP, "sftp", false, "run sftp server (cmd is ignored)")
+	flags.BoolVar(&a.sftpReadOnly, "sftp-read-only", false, "refuse sftp requests that modify files")
 	flags.StringVar(&a.loginCmdPath, "login-cmd", "", "the path to `login` cmd")
 	flags.BoolVar(&a.debugTest, "debug-test", false, "should debug in test mode")
+	flags.IntVar(&a.enterPID, "enter-pid", 0, "the pid of a container process whose namespaces to run cmd in")
 	flags.Parse(args)
 	a.cmdArgs = flags.Args()
 	return a
@@ -277,6 +403,22 @@ func beIncubator(args []string) error {
 		groupIDs = append(groupIDs, int(gid))
 	}
 
+	if ia.enterPID != 0 {
+		// Namespaces can't be entered after dropping privileges, and a
+		// multi-threaded process can't enter a mount namespace at all,
+		// so exec nsenter to enter them and then drop privileges. Note
+		// that it clears the supplementary groups.
+		if ia.isSFTP {
+			return errors.New("sftp isn't supported in containers")
+		}
+		nsenter, err := exec.LookPath("nsenter")
+		if err != nil {
+			return err
+		}
+		logf("entering namespaces of pid %d", ia.enterPID)
+		return unix.Exec(nsenter, nsenterArgs(ia.enterPID, strconv.Itoa(ia.uid), strconv.Itoa(ia.gid), ia.cmdName, ia.cmdArgs), os.Environ())
+	}
+
 	if err := dropPrivileges(logf, ia.uid, ia.gid, groupIDs); err != nil {
 		return err
 	}
@@ -284,7 +426,11 @@ func beIncubator(args []string) error {
 	if ia.isSFTP {
 		logf("handling sftp")
 
-		server, err := sftp.NewServer(stdRWC{})
+		var opts []sftp.ServerOption
+		if ia.sftpReadOnly {
+			opts = append(opts, sftp.ReadOnly())
+		}
+		server, err := sftp.NewServer(stdRWC{}, opts...)
 		if err != nil {
 			return err
 		}
@@ -297,6 +443,9 @@ func beIncubator(args []string) error {
 	}
 
 	cmd := exec.Command(ia.cmdName, ia.cmdArgs...)
+	if ia.argv0 != "" {
+		cmd.Args[0] = ia.argv0
+	}
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -442,6 +591,257 @@ func dropPrivileges(logf logger.Logf, wantUid, wantGid int, supplementaryGroups
 	return nil
 }
 
+// resolveWorkDir sets ss.homeDir to the session's home directory: the one
+// from SSHAction.HomeDir if set, or else the local user's. It then sets
+// ss.workDir to the directory the session's process is started in: the home
+// directory if it's usable, or "/".
+//
+// If the home directory is missing or not a directory, or is an override
+// that the local user can't access, it warns the user and falls back to "/",
+// unless TS_SSH_REQUIRE_HOME_DIR is set, in which case it returns a
+// userVisibleError explaining why the session can't start. An invalid
+// override always fails the session.
+func (ss *sshSession) resolveWorkDir() error {
+	lu := ss.conn.localUser
+	homeDir := lu.HomeDir
+	if a := ss.conn.finalAction; a != nil && a.HomeDir != "" {
+		tmpl := a.HomeDir
+		var err error
+		homeDir, err = ss.conn.expandHomeDir(tmpl)
+		if err != nil {
+			ss.errf("invalid home directory override %q: %v", tmpl, err)
+			return userVisibleError{"Invalid home directory configured for this session", err}
+		}
+		ss.homeDirOverride = true
+	}
+	ss.homeDir = homeDir
+	err := checkHomeDir(homeDir)
+	if err == nil && ss.homeDirOverride {
+		err = checkDirAccessible(homeDir, lu, ss.conn.userGroupIDs)
+	}
+	if err == nil {
+		ss.workDir = homeDir
+		return nil
+	}
+	var pe *fs.PathError
+	reason := err
+	if errors.As(err, &pe) {
+		reason = pe.Err
+	}
+	if sshRequireHomeDir() {
+		ss.errf("home directory %q of %q unusable: %v", homeDir, lu.Username, err)
+		return userVisibleError{
+			fmt.Sprintf("Could not chdir to home directory %s: %v", homeDir, reason),
+			err,
+		}
+	}
+	ss.logf("home directory %q of %q unusable, using /: %v", homeDir, lu.Username, err)
+	fmt.Fprintf(ss.Stderr(), "Could not chdir to home directory %s: %v\r\n", homeDir, reason)
+	ss.workDir = "/"
+	return nil
+}
+
+// resolveContainer sets ss.containerPID to the process whose namespaces the
+// session must enter, per SSHAction.EnterContainer, if set. It returns a
+// userVisibleError if the session can't enter them.
+func (ss *sshSession) resolveContainer() error {
+	a := ss.conn.finalAction
+	if a == nil || a.EnterContainer == "" {
+		return nil
+	}
+	pid, err := containerPID(ss.ctx, a.EnterContainer)
+	if err == nil && ss.Subsystem() == "sftp" {
+		err = errors.New("SFTP isn't supported in containers")
+	}
+	if err != nil {
+		ss.errf("entering container %q: %v", a.EnterContainer, err)
+		return userVisibleError{
+			fmt.Sprintf("Cannot enter container %s: %v", a.EnterContainer, err),
+			err,
+		}
+	}
+	ss.logf("entering container %q (pid %d)", a.EnterContainer, pid)
+	ss.containerPID = pid
+	return nil
+}
+
+// scratchDirEnvVar is the environment variable holding the path of the
+// session's scratch directory; see SSHAction.ScratchDir.
+const scratchDirEnvVar = "TSSH_SCRATCH"
+
+// makeScratchDir creates ss.scratchDir, if SSHAction.ScratchDir is set: a
+// new directory in the temporary directory of tailscaled, owned by the local
+// user. If SSHAction.ScratchDirIsWorkDir is set, it also makes it
+// ss.workDir. It returns a userVisibleError if the directory can't be
+// created. It must be called after resolveWorkDir and resolveContainer.
+func (ss *sshSession) makeScratchDir() error {
+	a := ss.conn.finalAction
+	if a == nil || !a.ScratchDir {
+		return nil
+	}
+	fail := func(err error) error {
+		ss.errf("creating scratch directory: %v", err)
+		return userVisibleError{"Could not create the scratch directory for this session", err}
+	}
+	if ss.containerPID != 0 {
+		return fail(errors.New("scratch directories aren't supported in containers"))
+	}
+	lu := ss.conn.localUser
+	dir, err := os.MkdirTemp("", "tailscale-ssh-scratch-*")
+	if err != nil {
+		return fail(err)
+	}
+	if ss.conn.srv.euid() == 0 {
+		uid, err1 := strconv.Atoi(lu.Uid)
+		gid, err2 := strconv.Atoi(lu.Gid)
+		if err := cmp.Or(err1, err2); err == nil {
+			err = os.Lchown(dir, uid, gid)
+		}
+		if err != nil {
+			os.Remove(dir)
+			return fail(err)
+		}
+	}
+	ss.vlogf("created scratch directory %q", dir)
+	ss.scratchDir = dir
+	if a.ScratchDirIsWorkDir {
+		ss.workDir = dir
+	}
+	return nil
+}
+
+// scratchDirEnv returns the environment variables describing the scratch
+// directory of ss, if any.
+func (ss *sshSession) scratchDirEnv() []string {
+	if ss.scratchDir == "" {
+		return nil
+	}
+	return []string{scratchDirEnvVar + "=" + ss.scratchDir}
+}
+
+// removeScratchDir removes the scratch directory of ss, if any, with its
+// contents. It's a no-op if called again.
+func (ss *sshSession) removeScratchDir() {
+	dir := ss.scratchDir
+	if dir == "" {
+		return
+	}
+	ss.scratchDir = ""
+	if err := os.RemoveAll(dir); err != nil {
+		ss.errf("removing scratch directory: %v", err)
+		return
+	}
+	ss.vlogf("removed scratch directory %q", dir)
+}
+
+// containerPID returns the PID of a process in the container target, which
+// is a PID or the ID or name of a Docker container, after checking that
+// this host can enter its namespaces.
+func containerPID(ctx context.Context, target string) (int, error) {
+	if runtime.GOOS != "linux" {
+		return 0, errors.New("containers are only supported on Linux")
+	}
+	if os.Geteuid() != 0 {
+		return 0, errors.New("tailscaled must run as root to enter containers")
+	}
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		return 0, errors.New("nsenter is not installed")
+	}
+	pid, err := strconv.Atoi(target)
+	if err != nil {
+		out, err := exec.CommandContext(ctx, "docker", "inspect", "--format", "{{.State.Pid}}", "--", target).Output()
+		if err != nil {
+			return 0, errors.New("no such Docker container")
+		}
+		if pid, err = strconv.Atoi(strings.TrimSpace(string(out))); err != nil {
+			return 0, fmt.Errorf("unexpected docker inspect output %q", out)
+		}
+		if pid == 0 {
+			return 0, errors.New("container is not running")
+		}
+	}
+	if pid <= 0 {
+		return 0, fmt.Errorf("invalid pid %d", pid)
+	}
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d/ns/mnt", pid)); err != nil {
+		return 0, fmt.Errorf("process %d not found", pid)
+	}
+	return pid, nil
+}
+
+// nsenterArgs returns the nsenter command line running name with args in
+// the mount, PID and network namespaces, root and working directory of the
+// process pid, as uid and gid if uid is non-empty.
+func nsenterArgs(pid int, uid, gid, name string, args []string) []string {
+	a := []string{"nsenter", "--target=" + strconv.Itoa(pid), "--mount", "--pid", "--net", "--root", "--wd"}
+	if uid != "" {
+		a = append(a, "--setuid="+uid, "--setgid="+gid)
+	}
+	a = append(a, "--", name)
+	return append(a, args...)
+}
+
+// checkHomeDir reports whether dir can be used as the working directory of a
+// session, returning an error describing why not if it can't.
+func checkHomeDir(dir string) error {
+	if dir == "" {
+		return errors.New("no home directory")
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &fs.PathError{Op: "chdir", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// checkDirAccessible reports whether the directory dir and all its parents
+// can be searched by the local user lu, whose group IDs are gids, returning
+// an fs.PathError with EACCES if not. tailscaled runs as root, so unlike
+// checkHomeDir it can't just try; it checks the permission bits instead.
+func checkDirAccessible(dir string, lu *userMeta, gids []string) error {
+	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if uid == 0 {
+		return nil
+	}
+	inGroup := make(map[uint32]bool)
+	for _, g := range gids {
+		if gid, err := strconv.ParseUint(g, 10, 32); err == nil {
+			inGroup[uint32(gid)] = true
+		}
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		fi, err := os.Stat(d)
+		if err != nil {
+			return err
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("can't check ownership of %q", d)
+		}
+		var mask fs.FileMode
+		switch {
+		case uint64(st.Uid) == uid:
+			mask = 0o100
+		case inGroup[uint32(st.Gid)]:
+			mask = 0o010
+		default:
+			mask = 0o001
+		}
+		if fi.Mode().Perm()&mask == 0 {
+			return &fs.PathError{Op: "chdir", Path: dir, Err: syscall.EACCES}
+		}
+		if d == "/" {
+			return nil
+		}
+	}
+}
+
 // launchProcess launches an incubator process for the provided session.
 // It is responsible for configuring the process execution environment.
 // The caller can wait for the process to exit by calling cmd.Wait().
@@ -451,20 +851,27 @@ func (ss *sshSession) launchProcess() error {
 	ss.cmd = ss.newIncubatorCommand()
 
 	cmd := ss.cmd
-	homeDir := ss.conn.localUser.HomeDir
-	if _, err := os.Stat(homeDir); err == nil {
-		cmd.Dir = homeDir
-	} else if os.IsNotExist(err) {
-		// If the home directory doesn't exist, we can't chdir to it.
-		// Instead, we'll chdir to the root directory.
+	// Rather than have exec kill the process as soon as ss.ctx is done,
+	// leave its termination to killProcessOnContextDone, which gives it
+	// a chance to exit cleanly on SIGTERM first.
+	cmd.Cancel = func() error { return nil }
+	cmd.Dir = ss.workDir
+	if cmd.Dir == "" {
 		cmd.Dir = "/"
-	} else {
-		return err
 	}
 	cmd.Env = envForUser(ss.conn.localUser)
-	for _, kv := range ss.Environ() {
-		if acceptEnvPair(kv) {
-			cmd.Env = append(cmd.Env, kv)
+	if ss.homeDirOverride {
+		updateStringInSlice(cmd.Env, "HOME="+ss.conn.localUser.HomeDir, "HOME="+ss.homeDir)
+	}
+	fc := ss.conn.finalAction.ForceCommand
+	if fc == nil || !fc.ResetEnv {
+		for _, kv := range ss.Environ() {
+			if acceptEnvPair(kv) {
+				if term, ok := strings.CutPrefix(kv, "TERM="); ok {
+					kv = "TERM=" + ss.allowedTerm(term)
+				}
+				cmd.Env = append(cmd.Env, kv)
+			}
 		}
 	}
 
@@ -473,19 +880,43 @@ func (ss *sshSession) launchProcess() error {
 		fmt.Sprintf("SSH_CLIENT=%s %d %d", ci.src.Addr(), ci.src.Port(), ci.dst.Port()),
 		fmt.Sprintf("SSH_CONNECTION=%s %d %s %d", ci.src.Addr(), ci.src.Port(), ci.dst.Addr(), ci.dst.Port()),
 	)
+	if rawCmd := ss.RawCommand(); fc != nil && rawCmd != "" {
+		cmd.Env = append(cmd.Env, "SSH_ORIGINAL_COMMAND="+rawCmd)
+	}
+	cmd.Env = append(cmd.Env, ss.identityEnv()...)
+	cmd.Env = append(cmd.Env, ss.scratchDirEnv()...)
 
 	if ss.agentListener != nil {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_AUTH_SOCK=%s", ss.agentListener.Addr()))
 	}
+	if ss.x11 != nil {
+		cmd.Env = append(cmd.Env, ss.x11.env()...)
+	}
+	if sshStrictEnv() {
+		cmd.Env = strictEnv(cmd.Env)
+	}
 
 	ptyReq, winCh, isPty := ss.Pty()
+	if isPty && ss.Subsystem() == "sftp" {
+		// Some clients request a PTY before starting sftp. The sftp server
+		// speaks a binary protocol that a PTY would mangle, so ignore it.
+		// Window changes must still be drained so that they don't block the
+		// session's requests.
+		ss.logf("ignoring pty request for sftp subsystem")
+		go drainWindowChanges(winCh)
+		isPty = false
+	}
 	if !isPty {
 		ss.logf("starting non-pty command: %+v", cmd.Args)
-		return ss.startWithStdPipes()
+		if err := ss.startWithStdPipes(); err != nil {
+			return err
+		}
+		ss.maybeStartSystemdScope(cmd.Process.Pid)
+		return nil
 	}
 
 	if sshDisablePTY() {
-		ss.logf("pty support disabled by envknob")
+		ss.errf("pty support disabled by envknob")
 		return errors.New("pty support disabled by envknob")
 	}
 
@@ -494,6 +925,7 @@ func (ss *sshSession) launchProcess() error {
 	if err != nil {
 		return err
 	}
+	ss.maybeStartSystemdScope(cmd.Process.Pid)
 
 	// We need to be able to close stdin and stdout separately later so make a
 	// dup.
@@ -513,6 +945,12 @@ func (ss *sshSession) launchProcess() error {
 	return nil
 }
 
+// drainWindowChanges discards window changes from winCh until it's closed.
+func drainWindowChanges(winCh <-chan ssh.Window) {
+	for range winCh {
+	}
+}
+
 func resizeWindow(fd int, winCh <-chan ssh.Window) {
 	for win := range winCh {
 		unix.IoctlSetWinsize(fd, syscall.TIOCSWINSZ, &unix.Winsize{
@@ -671,8 +1109,8 @@ func (ss *sshSession) startWithPTY() (ptyFile, tty *os.File, err error) {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("SSH_TTY=%s", fullPath))
 	}
 
-	if ptyReq.Term != "" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	if term := ss.allowedTerm(ptyReq.Term); term != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", term))
 	}
 	cmd.Stdin = tty
 	cmd.Stdout = tty
@@ -721,6 +1159,28 @@ func envForUser(u *userMeta) []string {
 	}
 }
 
+// strictEnvVar reports whether the environment variable k may be set in
+// sessions when TS_SSH_STRICT_ENV is set: it's one of the variables that
+// launchProcess and startWithPTY set, or one accepted from the client.
+func strictEnvVar(k string) bool {
+	switch k {
+	case "PATH", "HOME", "USER", "SHELL", "TERM",
+		"SSH_CLIENT", "SSH_CONNECTION", "SSH_ORIGINAL_COMMAND", "SSH_TTY", "SSH_AUTH_SOCK",
+		"DISPLAY", "XAUTHORITY":
+		return true
+	}
+	return strings.HasPrefix(k, "TAILSCALE_") || acceptEnvPair(k+"=")
+}
+
+// strictEnv returns the key=value pairs of env whose keys strictEnvVar
+// allows. It modifies env in place.
+func strictEnv(env []string) []string {
+	return slices.DeleteFunc(env, func(kv string) bool {
+		k, _, _ := strings.Cut(kv, "=")
+		return !strictEnvVar(k)
+	})
+}
+
 // updateStringInSlice mutates ss to change the first occurrence of a
 // to b.
 func updateStringInSlice(ss []string, a, b string) {
@@ -732,6 +1192,26 @@ func updateStringInSlice(ss []string, a, b string) {
 	}
 }
 
+// identityEnv returns the environment variables identifying the Tailscale
+// identity of the client, as key=value pairs, if the action sets
+// ExposeIdentityEnv. Clients can't set them themselves; see acceptEnvPair.
+func (ss *sshSession) identityEnv() []string {
+	if !ss.conn.finalAction.ExposeIdentityEnv {
+		return nil
+	}
+	ci := ss.conn.info
+	var env []string
+	if ci.node.IsTagged() {
+		env = append(env, "TAILSCALE_SRC_TAGS="+strings.Join(ci.node.Tags().AsSlice(), ","))
+	} else {
+		env = append(env, "TAILSCALE_USER_LOGIN="+ci.uprof.LoginName)
+	}
+	return append(env,
+		"TAILSCALE_SRC_NODE="+strings.TrimSuffix(ci.node.Name(), "."),
+		"TAILSCALE_SSH_SESSION_ID="+ss.sharedID,
+	)
+}
+
 // acceptEnvPair reports whether the environment variable key=value pair
 // should be accepted from the client. It uses the same default as OpenSSH
 // AcceptEnv.
@@ -743,6 +1223,28 @@ func acceptEnvPair(kv string) bool {
 	return k == "TERM" || k == "LANG" || strings.HasPrefix(k, "LC_")
 }
 
+// defaultTerm is the TERM used where one is needed but the client didn't
+// send one, and the default TS_SSH_TERM_FALLBACK.
+const defaultTerm = "xterm-256color"
+
+// allowedTerm returns the TERM to use for the client-provided term: term
+// itself if it's empty or allowed by TS_SSH_ALLOWED_TERMS, or the fallback
+// otherwise.
+func (ss *sshSession) allowedTerm(term string) string {
+	allowed := sshAllowedTerms()
+	if term == "" || allowed == "" {
+		return term
+	}
+	for _, pat := range strings.Split(allowed, ",") {
+		if ok, _ := path.Match(strings.TrimSpace(pat), term); ok {
+			return term
+		}
+	}
+	fallback := cmp.Or(sshTermFallback(), defaultTerm)
+	ss.logf("client TERM %q not allowed; using %q", term, fallback)
+	return fallback
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
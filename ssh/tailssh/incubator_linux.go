@@ -20,6 +20,7 @@
 func init() {
 	ptyName = ptyNameLinux
 	maybeStartLoginSession = maybeStartLoginSessionLinux
+	startSystemdScope = startSystemdScopeLinux
 }
 
 func ptyNameLinux(f *os.File) (string, error) {
@@ -34,6 +35,19 @@ func ptyNameLinux(f *os.File) (string, error) {
 // callLogin1 invokes the provided method of the "login1" service over D-Bus.
 // https://www.freedesktop.org/software/systemd/man/org.freedesktop.login1.html
 func callLogin1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
+	return callSystemBus("org.freedesktop.login1", "/org/freedesktop/login1", method, flags, args...)
+}
+
+// callSystemd1 invokes the provided method of the "systemd1" service over
+// D-Bus.
+// https://www.freedesktop.org/software/systemd/man/org.freedesktop.systemd1.html
+func callSystemd1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
+	return callSystemBus("org.freedesktop.systemd1", "/org/freedesktop/systemd1", method, flags, args...)
+}
+
+// callSystemBus invokes the provided method of the object at objectPath of
+// the service name over the D-Bus system bus.
+func callSystemBus(name, objectPath, method string, flags dbus.Flags, args ...any) (*dbus.Call, error) {
 	conn, err := dbus.SystemBus()
 	if err != nil {
 		// DBus probably not running.
@@ -43,7 +57,6 @@ func callLogin1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
-	name, objectPath := "org.freedesktop.login1", "/org/freedesktop/login1"
 	obj := conn.Object(name, dbus.ObjectPath(objectPath))
 	call := obj.CallWithContext(ctx, method, flags, args...)
 	if call.Err != nil {
@@ -52,6 +65,34 @@ func callLogin1(method string, flags dbus.Flags, args ...any) (*dbus.Call, error
 	return call, nil
 }
 
+// unitProperty is a property of a systemd unit, as passed to
+// Systemd1.Manager.StartTransientUnit.
+type unitProperty struct {
+	Name  string
+	Value dbus.Variant
+}
+
+// startSystemdScopeLinux is the linux implementation of startSystemdScope.
+func startSystemdScopeLinux(unit string, pid int) (stop func() error, err error) {
+	props := []unitProperty{
+		{"Description", dbus.MakeVariant("Tailscale SSH session")},
+		{"PIDs", dbus.MakeVariant([]uint32{uint32(pid)})},
+		// Garbage collect the unit even if the session fails.
+		{"CollectMode", dbus.MakeVariant("inactive-or-failed")},
+	}
+	var aux []struct { // unused, but required by the signature
+		Name  string
+		Props []unitProperty
+	}
+	if _, err := callSystemd1("org.freedesktop.systemd1.Manager.StartTransientUnit", 0, unit, "fail", props, aux); err != nil {
+		return nil, err
+	}
+	return func() error {
+		_, err := callSystemd1("org.freedesktop.systemd1.Manager.StopUnit", 0, unit, "fail")
+		return err
+	}, nil
+}
+
 // createSessionArgs is a wrapper struct for the Login1.Manager.CreateSession args.
 // The CreateSession API arguments and response types are defined here:
 // https://www.freedesktop.org/software/systemd/man/org.freedesktop.login1.html
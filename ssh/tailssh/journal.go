@@ -0,0 +1,103 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// journalSocketPath is where systemd-journald listens for entries in
+	// its native protocol.
+	journalSocketPath = "/run/systemd/journal/socket"
+
+	// journalPriority is the syslog severity of session entries:
+	// informational.
+	journalPriority = "6"
+
+	// journalIOTimeout bounds sending each entry to the journal.
+	journalIOTimeout = time.Second
+)
+
+// journalField is a field of a journal entry.
+type journalField struct {
+	name, value string
+}
+
+// appendJournalField appends f to b in the journal's native protocol: as
+// NAME=value and a newline, or, for values containing newlines, as the name,
+// a newline, the length of the value as a little-endian uint64, the value
+// and a newline.
+func appendJournalField(b []byte, f journalField) []byte {
+	if !strings.Contains(f.value, "\n") {
+		b = append(b, f.name...)
+		b = append(b, '=')
+		b = append(b, f.value...)
+		return append(b, '\n')
+	}
+	b = append(b, f.name...)
+	b = append(b, '\n')
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(f.value)))
+	b = append(b, f.value...)
+	return append(b, '\n')
+}
+
+// sendJournal sends an entry with fields to the journal listening on socket.
+func sendJournal(socket string, fields []journalField) error {
+	var msg []byte
+	for _, f := range fields {
+		msg = appendJournalField(msg, f)
+	}
+	c, err := net.DialTimeout("unixgram", socket, journalIOTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(journalIOTimeout))
+	_, err = c.Write(msg)
+	return err
+}
+
+// journalSessionEvent logs the start or stop of ss, per event, to the
+// systemd journal with structured fields, if TS_SSH_JOURNAL is set. The
+// exit code is only included for stops. If the journal is unavailable, the
+// event is logged normally instead.
+func (ss *sshSession) journalSessionEvent(event string, exitCode int) {
+	if !sshJournal() {
+		return
+	}
+	ci := ss.conn.info
+	msg := fmt.Sprintf("ssh session %s: %s from %v (%v) as local user %q", event, ss.sharedID, ci.uprof.LoginName, ci.src, ss.conn.localUser.Username)
+	if event == "stop" {
+		msg += fmt.Sprintf(" with exit code %d", exitCode)
+	}
+	fields := []journalField{
+		{"MESSAGE", msg},
+		{"PRIORITY", journalPriority},
+		{"SYSLOG_IDENTIFIER", "tailscaled"},
+		{"TS_SSH_EVENT", event},
+		{"TS_SSH_USER", ci.sshUser},
+		{"TS_LOCAL_USER", ss.conn.localUser.Username},
+		{"TS_USER", ci.uprof.LoginName},
+		{"TS_SRC", ci.src.String()},
+		{"TS_CONN_ID", ss.conn.connID},
+		{"TS_SESSION_ID", ss.sharedID},
+	}
+	if event == "stop" {
+		fields = append(fields, journalField{"TS_EXIT_CODE", strconv.Itoa(exitCode)})
+	}
+	socket := cmp.Or(ss.conn.srv.journalSocket, journalSocketPath)
+	if err := sendJournal(socket, fields); err != nil {
+		ss.vlogf("journal unavailable: %v", err)
+		ss.logf("%s", msg)
+	}
+}
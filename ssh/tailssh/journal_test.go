@@ -0,0 +1,195 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/envknob"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+// parseJournalEntry parses an entry in the journal's native protocol.
+func parseJournalEntry(b []byte) (map[string]string, error) {
+	fields := map[string]string{}
+	for len(b) > 0 {
+		i := bytes.IndexAny(b, "=\n")
+		if i < 0 {
+			return nil, fmt.Errorf("truncated field %q", b)
+		}
+		name := string(b[:i])
+		if b[i] == '=' {
+			b = b[i+1:]
+			j := bytes.IndexByte(b, '\n')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated field %s", name)
+			}
+			fields[name] = string(b[:j])
+			b = b[j+1:]
+			continue
+		}
+		b = b[i+1:]
+		if len(b) < 8 {
+			return nil, fmt.Errorf("truncated length of field %s", name)
+		}
+		n := binary.LittleEndian.Uint64(b)
+		b = b[8:]
+		if uint64(len(b)) < n+1 || b[n] != '\n' {
+			return nil, fmt.Errorf("truncated value of field %s", name)
+		}
+		fields[name] = string(b[:n])
+		b = b[n+1:]
+	}
+	return fields, nil
+}
+
+func TestAppendJournalField(t *testing.T) {
+	var b []byte
+	b = appendJournalField(b, journalField{"A", "simple"})
+	b = appendJournalField(b, journalField{"B", "multi\nline"})
+	b = appendJournalField(b, journalField{"C", ""})
+	want := "A=simple\nB\n\x0a\x00\x00\x00\x00\x00\x00\x00multi\nline\nC=\n"
+	if string(b) != want {
+		t.Fatalf("got %q; want %q", b, want)
+	}
+	got, err := parseJournalEntry(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["A"] != "simple" || got["B"] != "multi\nline" || got["C"] != "" || len(got) != 3 {
+		t.Errorf("parsed %q", got)
+	}
+}
+
+// startJournalSSH connects to a new server that logs sessions to journal,
+// and runs a command, returning once it has exited. It returns what the
+// server logged.
+func startJournalSSH(t *testing.T, journal string) string {
+	t.Helper()
+	envknob.Setenv("TS_SSH_JOURNAL", "true")
+	t.Cleanup(func() { envknob.Setenv("TS_SSH_JOURNAL", "") })
+	var (
+		logMu sync.Mutex
+		logs  strings.Builder
+	)
+	s := &server{
+		logf: func(format string, args ...any) {
+			logMu.Lock()
+			defer logMu.Unlock()
+			fmt.Fprintf(&logs, format+"\n", args...)
+		},
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+		},
+		journalSocket: journal,
+	}
+	defer s.Shutdown()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	go s.HandleSSHConn(dc)
+	cfg := &gossh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	session.Run("exit 3")
+	logMu.Lock()
+	defer logMu.Unlock()
+	return logs.String()
+}
+
+func TestJournalSessionEvents(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	// Not t.TempDir, whose paths can be too long for Unix sockets.
+	dir, err := os.MkdirTemp("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	pc, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	startJournalSSH(t, socket)
+
+	buf := make([]byte, 64<<10)
+	pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for _, event := range []string{"start", "stop"} {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("reading %s entry: %v", event, err)
+		}
+		fields, err := parseJournalEntry(buf[:n])
+		if err != nil {
+			t.Fatalf("%s entry %q: %v", event, buf[:n], err)
+		}
+		want := map[string]string{
+			"PRIORITY":          "6",
+			"SYSLOG_IDENTIFIER": "tailscaled",
+			"TS_SSH_EVENT":      event,
+			"TS_SSH_USER":       "alice",
+			"TS_LOCAL_USER":     currentUser,
+			"TS_USER":           "peer",
+			"TS_SRC":            "100.100.100.101:2231",
+		}
+		if event == "stop" {
+			want["TS_EXIT_CODE"] = "3"
+		}
+		for k, v := range want {
+			if fields[k] != v {
+				t.Errorf("%s entry: %s = %q; want %q", event, k, fields[k], v)
+			}
+		}
+		if !strings.HasPrefix(fields["TS_CONN_ID"], "ssh-conn-") || !strings.HasPrefix(fields["TS_SESSION_ID"], "sess-") {
+			t.Errorf("%s entry: TS_CONN_ID = %q, TS_SESSION_ID = %q", event, fields["TS_CONN_ID"], fields["TS_SESSION_ID"])
+		}
+		if !strings.HasPrefix(fields["MESSAGE"], "ssh session "+event+": ") {
+			t.Errorf("%s entry: MESSAGE = %q", event, fields["MESSAGE"])
+		}
+	}
+}
+
+func TestJournalFallback(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	logs := startJournalSSH(t, filepath.Join(t.TempDir(), "missing"))
+	for _, want := range []string{"ssh session start: sess-", "ssh session stop: sess-"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("logs lack %q:\n%s", want, logs)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+// MemRecorder is an in-memory recording sink for tests, so that they can
+// assert on the exact bytes of session recordings without a recorder or
+// local disk. Use UseMemRecorder to record a server's sessions to it.
+type MemRecorder struct {
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced on every Close
+	recs    []*memRecording
+}
+
+// UseMemRecorder makes srv record every session to a new in-memory
+// recording in the returned MemRecorder, instead of to any recorders or
+// local disk.
+func UseMemRecorder(srv *server) *MemRecorder {
+	r := &MemRecorder{changed: make(chan struct{})}
+	srv.testRecordingSink = func() io.WriteCloser {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		rec := &memRecording{r: r}
+		r.recs = append(r.recs, rec)
+		return rec
+	}
+	return r
+}
+
+// Recordings waits for n recordings to have been closed, and returns the
+// contents of all recordings in the order they were started. It fails the
+// test if that takes too long.
+func (r *MemRecorder) Recordings(tb testing.TB, n int) [][]byte {
+	tb.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		r.mu.Lock()
+		var closed int
+		for _, rec := range r.recs {
+			if rec.closed {
+				closed++
+			}
+		}
+		if closed >= n {
+			ret := make([][]byte, len(r.recs))
+			for i, rec := range r.recs {
+				ret[i] = bytes.Clone(rec.buf.Bytes())
+			}
+			r.mu.Unlock()
+			return ret
+		}
+		changed := r.changed
+		r.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout:
+			tb.Fatalf("timed out waiting for %d recordings; have %d", n, closed)
+		}
+	}
+}
+
+// memRecording is a single recording of a MemRecorder.
+type memRecording struct {
+	r *MemRecorder
+
+	// The following are guarded by r.mu.
+	buf    bytes.Buffer
+	closed bool
+}
+
+func (m *memRecording) Write(p []byte) (int, error) {
+	m.r.mu.Lock()
+	defer m.r.mu.Unlock()
+	if m.closed {
+		return 0, errors.New("recording closed")
+	}
+	return m.buf.Write(p)
+}
+
+func (m *memRecording) Close() error {
+	m.r.mu.Lock()
+	defer m.r.mu.Unlock()
+	if m.closed {
+		return errors.New("recording already closed")
+	}
+	m.closed = true
+	close(m.r.changed)
+	m.r.changed = make(chan struct{})
+	return nil
+}
+
+// parseCast parses an asciinema cast recording into its header and events.
+func parseCast(tb testing.TB, cast []byte) (CastHeader, [][]any) {
+	tb.Helper()
+	var ch CastHeader
+	var events [][]any
+	sc := bufio.NewScanner(bytes.NewReader(cast))
+	for i := 0; sc.Scan(); i++ {
+		if i == 0 {
+			if err := json.Unmarshal(sc.Bytes(), &ch); err != nil {
+				tb.Fatalf("cast header: %v", err)
+			}
+			continue
+		}
+		var ev []any
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			tb.Fatalf("cast event %q: %v", sc.Bytes(), err)
+		}
+		events = append(events, ev)
+	}
+	if err := sc.Err(); err != nil {
+		tb.Fatal(err)
+	}
+	return ch, events
+}
+
+func TestMemRecorder(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	s := &server{
+		logf: t.Logf,
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+		},
+	}
+	defer s.Shutdown()
+	mr := UseMemRecorder(s)
+
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	const sshUser = "alice"
+	cfg := &gossh.ClientConfig{
+		User:            sshUser,
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	go s.HandleSSHConn(dc)
+	c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.Output("echo Ran echo!"); err != nil {
+		t.Fatal(err)
+	}
+
+	recs := mr.Recordings(t, 1)
+	if len(recs) != 1 {
+		t.Fatalf("got %d recordings; want 1", len(recs))
+	}
+	ch, events := parseCast(t, recs[0])
+	if ch.Version != 2 || ch.SSHUser != sshUser || ch.Command != "echo Ran echo!" {
+		t.Errorf("header = %+v", ch)
+	}
+	var out strings.Builder
+	for _, ev := range events {
+		if len(ev) != 3 || ev[1] != "o" {
+			t.Fatalf("unexpected event %q", ev)
+		}
+		out.WriteString(ev[2].(string))
+	}
+	if got := out.String(); !strings.HasSuffix(got, "Ran echo!\n") {
+		t.Errorf("recorded output = %q; want it to end in %q", got, "Ran echo!\n")
+	}
+}
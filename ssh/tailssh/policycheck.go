@@ -0,0 +1,184 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// ParsePolicy parses the JSON encoding of an SSH policy, as found in the
+// debug SSH policy file (TS_DEBUG_SSH_POLICY_FILE).
+func ParsePolicy(b []byte) (*tailcfg.SSHPolicy, error) {
+	p := new(tailcfg.SSHPolicy)
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, fmt.Errorf("invalid SSH policy JSON: %w", err)
+	}
+	return p, nil
+}
+
+// ReadPolicyFile reads and parses the SSH policy file at path, like
+// ParsePolicy.
+func ReadPolicyFile(path string) (*tailcfg.SSHPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// ValidatePolicy reports problems with pol that make its rules fail to
+// match or behave other than as likely intended, such as rules without
+// principals or actions. It returns nil if there are none.
+//
+// A policy that passes is not necessarily correct; use EvalPolicy to check
+// what it does for particular connections.
+func ValidatePolicy(pol *tailcfg.SSHPolicy) error {
+	var errs []error
+	for i, r := range pol.Rules {
+		rulef := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("rule %d: %s", i, fmt.Sprintf(format, args...)))
+		}
+		if r == nil {
+			rulef("null rule")
+			continue
+		}
+		if len(r.Principals) == 0 {
+			rulef("no principals; it never matches")
+		}
+		for j, p := range r.Principals {
+			switch {
+			case p == nil:
+				rulef("principal %d: null principal", j)
+			case p.NodeIP != "":
+				if _, err := netip.ParseAddr(p.NodeIP); err != nil {
+					rulef("principal %d: invalid nodeIP: %v", j, err)
+				}
+			case !p.Any && p.Node.IsZero() && p.UserLogin == "":
+				rulef("principal %d: no node, nodeIP, userLogin or any; it never matches", j)
+			}
+		}
+		a := r.Action
+		if a == nil {
+			rulef("no action")
+			continue
+		}
+		switch {
+		case a.Accept && a.Reject:
+			rulef("action both accepts and rejects")
+		case !a.Accept && !a.Reject && a.HoldAndDelegate == "":
+			rulef("action neither accepts, rejects nor delegates")
+		}
+		if !a.Reject && len(r.SSHUsers) == 0 {
+			rulef("no sshUsers; it never matches")
+		}
+		for _, g := range a.RecorderGroups {
+			if _, ok := pol.RecorderGroups[g]; !ok {
+				rulef("unknown recorder group %q", g)
+			}
+		}
+		if fc := a.ForceCommand; fc != nil && len(fc.Args) == 0 {
+			rulef("forced command with no args")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PolicyScenario is a synthetic SSH connection to evaluate an SSH policy
+// against with EvalPolicy.
+type PolicyScenario struct {
+	// SSHUser is the requested ssh-user ("root", "alice", etc). It's
+	// normalized as it would be for real connections.
+	SSHUser string
+
+	// Src is the Tailscale IP and port that the connection comes from.
+	Src netip.AddrPort
+
+	// Dst is the Tailscale IP and port that the connection comes for.
+	Dst netip.AddrPort
+
+	// Node is the node of Src, if known.
+	Node tailcfg.NodeView
+
+	// UserLogin is the login name of the user of Node.
+	UserLogin string
+
+	// PubKey is the public key that the client authenticates with, or nil
+	// for none.
+	PubKey gossh.PublicKey
+
+	// Now is the time to evaluate rule expiry at. If zero, it's the current
+	// time.
+	Now time.Time
+}
+
+// PolicyOutcome is the outcome of evaluating an SSH policy for a
+// PolicyScenario.
+type PolicyOutcome struct {
+	// Action is the action of the matching rule, or nil if none matched.
+	// It may still reject the connection or delegate the decision.
+	Action *tailcfg.SSHAction
+
+	// RuleIndex is the index of the matching rule, or -1 if none matched.
+	RuleIndex int
+
+	// LocalUser is the local user that the connection would run as.
+	LocalUser string
+
+	// DenyReason is the reason code that the connection is denied with,
+	// such as "no_match" or "rejected", or empty if it's not denied
+	// outright.
+	DenyReason string
+
+	// Mismatches describes why each rule before the matching one (or every
+	// rule, if none matched) didn't match, like "rule 0: user didn't
+	// match".
+	Mismatches []string
+}
+
+// EvalPolicy evaluates pol for the connection described by sc, the same way
+// that the server does, without starting one. It's meant for checking
+// policies under development.
+//
+// Public keys at https URLs in pol are fetched as usual.
+func EvalPolicy(pol *tailcfg.SSHPolicy, sc PolicyScenario) PolicyOutcome {
+	srv := &server{logf: logger.Discard}
+	if !sc.Now.IsZero() {
+		srv.timeNow = func() time.Time { return sc.Now }
+	}
+	sshUser := strings.TrimSuffix(sc.SSHUser, forcePasswordSuffix)
+	c := &conn{
+		srv: srv,
+		info: &sshConnInfo{
+			sshUser: normalizeSSHUser(sshUser, sshNormalizeUser()),
+			src:     sc.Src,
+			dst:     sc.Dst,
+			node:    sc.Node,
+			uprof:   tailcfg.UserProfile{LoginName: sc.UserLogin},
+		},
+	}
+	var out PolicyOutcome
+	out.Action, out.LocalUser, out.RuleIndex, out.DenyReason = c.evalSSHPolicyRules(pol, sc.PubKey, func(i int, err error) {
+		out.Mismatches = append(out.Mismatches, fmt.Sprintf("rule %d: %v", i, err))
+	})
+	if out.Action != nil && out.Action.Reject {
+		out.DenyReason = denyRejected
+	}
+	return out
+}
@@ -0,0 +1,193 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/tailcfg"
+)
+
+const testPolicyJSON = `{
+	"rules": [
+		{
+			"principals": [{"userLogin": "bob@example.com"}],
+			"sshUsers": {"*": "bob"},
+			"action": {"accept": true}
+		},
+		{
+			"ruleExpires": "2024-01-01T00:00:00Z",
+			"principals": [{"userLogin": "alice@example.com"}],
+			"sshUsers": {"root": "root"},
+			"action": {"accept": true}
+		},
+		{
+			"principals": [{"userLogin": "alice@example.com"}],
+			"sshUsers": {"alice": "=", "deploy": "deploy"},
+			"action": {"accept": true, "sessionDuration": 3600000000000}
+		},
+		{
+			"principals": [{"any": true}],
+			"action": {"reject": true, "message": "go away"}
+		}
+	]
+}`
+
+func TestParsePolicy(t *testing.T) {
+	if _, err := ParsePolicy([]byte(testPolicyJSON)); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{``, `{"rules": [}`, `{"rules": {}}`} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil || !strings.Contains(err.Error(), "invalid SSH policy JSON") {
+			t.Errorf("ParsePolicy(%q) = %v; want JSON error", bad, err)
+		}
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPolicyFile(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("ReadPolicyFile = %v; want error naming %v", err, path)
+	}
+	if _, err := ReadPolicyFile(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("ReadPolicyFile of missing file = %v; want not-exist error", err)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	pol, err := ParsePolicy([]byte(testPolicyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidatePolicy(pol); err != nil {
+		t.Errorf("ValidatePolicy = %v; want nil", err)
+	}
+
+	pol, err = ParsePolicy([]byte(`{
+		"rules": [
+			null,
+			{"principals": [{"any": true}], "sshUsers": {"*": "="}},
+			{"sshUsers": {"*": "="}, "action": {"accept": true}},
+			{"principals": [{"nodeIP": "bogus"}, {}], "action": {"accept": true, "reject": true}},
+			{"principals": [{"any": true}], "sshUsers": {"*": "="}, "action": {"recorderGroups": ["nope"]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidatePolicy(pol)
+	if err == nil {
+		t.Fatal("ValidatePolicy = nil; want errors")
+	}
+	want := []string{
+		"rule 0: null rule",
+		"rule 1: no action",
+		"rule 2: no principals; it never matches",
+		"rule 3: principal 0: invalid nodeIP",
+		"rule 3: principal 1: no node, nodeIP, userLogin or any; it never matches",
+		"rule 3: action both accepts and rejects",
+		"rule 4: action neither accepts, rejects nor delegates",
+		"rule 4: unknown recorder group \"nope\"",
+	}
+	lines := strings.Split(err.Error(), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got errors:\n%v\nwant %d", err, len(want))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(lines[i], w) {
+			t.Errorf("error %d = %q; want prefix %q", i, lines[i], w)
+		}
+	}
+}
+
+func TestEvalPolicy(t *testing.T) {
+	pol, err := ParsePolicy([]byte(testPolicyJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	noCatchAll := &tailcfg.SSHPolicy{Rules: pol.Rules[:3]}
+	tests := []struct {
+		name string
+		pol  *tailcfg.SSHPolicy // or nil for pol
+		sc   PolicyScenario
+		want PolicyOutcome
+	}{
+		{
+			name: "accept",
+			sc:   PolicyScenario{SSHUser: "alice", UserLogin: "alice@example.com", Now: now},
+			want: PolicyOutcome{
+				Action:    &tailcfg.SSHAction{Accept: true, SessionDuration: time.Hour},
+				RuleIndex: 2,
+				LocalUser: "alice",
+				Mismatches: []string{
+					"rule 0: principal didn't match",
+					"rule 1: rule expired",
+				},
+			},
+		},
+		{
+			name: "password-suffix",
+			sc:   PolicyScenario{SSHUser: "deploy+password", UserLogin: "alice@example.com", Now: now},
+			want: PolicyOutcome{
+				Action:    &tailcfg.SSHAction{Accept: true, SessionDuration: time.Hour},
+				RuleIndex: 2,
+				LocalUser: "deploy",
+				Mismatches: []string{
+					"rule 0: principal didn't match",
+					"rule 1: rule expired",
+				},
+			},
+		},
+		{
+			name: "rejected",
+			sc:   PolicyScenario{SSHUser: "root", UserLogin: "carol@example.com", Now: now},
+			want: PolicyOutcome{
+				Action:     &tailcfg.SSHAction{Reject: true, Message: "go away"},
+				RuleIndex:  3,
+				DenyReason: denyRejected,
+				Mismatches: []string{
+					"rule 0: principal didn't match",
+					"rule 1: rule expired",
+					"rule 2: user didn't match",
+				},
+			},
+		},
+		{
+			name: "no-match",
+			pol:  noCatchAll,
+			sc:   PolicyScenario{SSHUser: "root", UserLogin: "alice@example.com", Now: now},
+			want: PolicyOutcome{
+				RuleIndex:  -1,
+				DenyReason: denyRuleExpired,
+				Mismatches: []string{
+					"rule 0: principal didn't match",
+					"rule 1: rule expired",
+					"rule 2: user didn't match",
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.pol
+			if p == nil {
+				p = pol
+			}
+			got := EvalPolicy(p, tt.sc)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
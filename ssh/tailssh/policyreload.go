@@ -0,0 +1,91 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"tailscale.com/envknob"
+	"tailscale.com/types/logger"
+)
+
+// errNoPolicyFile is returned by ReloadPolicyFile if TS_DEBUG_SSH_POLICY_FILE
+// isn't set.
+var errNoPolicyFile = errors.New("no debug SSH policy file set")
+
+// ReloadPolicyFile re-reads and validates the debug SSH policy file
+// (TS_DEBUG_SSH_POLICY_FILE) and logs the result. If it could be read, the
+// active sessions are then re-evaluated against the policy in effect, as by
+// OnPolicyChange, and those it no longer accepts are terminated.
+//
+// If the file can't be read or parsed, the active sessions are left alone,
+// so that a partially written file doesn't terminate all of them. The
+// returned error reports any problem found with the file, including those
+// of ValidatePolicy, which don't keep it from being applied.
+func (srv *server) ReloadPolicyFile() error {
+	path := envknob.SSHPolicyFile()
+	if path == "" {
+		return errNoPolicyFile
+	}
+	pol, err := ReadPolicyFile(path)
+	if err != nil {
+		srv.logf("ssh: reloading debug SSH policy file: %v", err)
+		return err
+	}
+	verr := ValidatePolicy(pol)
+	if verr != nil {
+		srv.logf("ssh: debug SSH policy file %v has problems: %v", path, verr)
+		verr = fmt.Errorf("%s: %w", path, verr)
+	}
+	switch ep := srv.effectivePolicy(logger.Discard); {
+	case ep.Source == "netmap":
+		srv.logf("ssh: reloaded debug SSH policy file %v with %d rules; not in effect, as the tailnet policy is", path, len(pol.Rules))
+	case !ep.Enabled:
+		srv.logf("ssh: reloaded debug SSH policy file %v with %d rules; not in effect, as SSH isn't running", path, len(pol.Rules))
+	default:
+		srv.logf("ssh: reloaded debug SSH policy file %v with %d rules", path, len(pol.Rules))
+	}
+	srv.OnPolicyChange()
+	return verr
+}
+
+// startPolicyReloadOnSIGHUP makes srv reload the debug SSH policy file, with
+// ReloadPolicyFile, whenever tailscaled receives SIGHUP, if
+// TS_DEBUG_SSH_POLICY_FILE is set. Otherwise SIGHUP is left to its default
+// handling. It stops on Shutdown.
+func (srv *server) startPolicyReloadOnSIGHUP() {
+	if envknob.SSHPolicyFile() == "" {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	srv.mu.Lock()
+	srv.reloadSignals = ch
+	srv.mu.Unlock()
+	go func() {
+		for range ch {
+			srv.logf("ssh: SIGHUP received; reloading debug SSH policy file")
+			srv.ReloadPolicyFile()
+		}
+	}()
+}
+
+// stopPolicyReloadOnSIGHUP undoes startPolicyReloadOnSIGHUP, if it was
+// called.
+func (srv *server) stopPolicyReloadOnSIGHUP() {
+	srv.mu.Lock()
+	ch := srv.reloadSignals
+	srv.reloadSignals = nil
+	srv.mu.Unlock()
+	if ch != nil {
+		signal.Stop(ch)
+		close(ch)
+	}
+}
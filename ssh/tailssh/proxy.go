@@ -0,0 +1,329 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+)
+
+// proxyDialTimeout is how long to wait for the SSH handshake with the
+// target of an SSHAction.ProxyTo to complete.
+const proxyDialTimeout = 15 * time.Second
+
+// proxyClientVersion is the SSH client version that jump hosts connect to the
+// targets of their SSHAction.ProxyTo with, followed by " for=" and the login
+// name of the user they're proxying for.
+//
+// It tells targets that the connection is on behalf of the jump host's users,
+// rather than of the jump host itself, so that they only authorize it by
+// rules that name the jump host. See sshConnInfo.proxied.
+const proxyClientVersion = "SSH-2.0-Tailscale-Proxy"
+
+// proxyClientVersionFor returns the SSH client version to proxy connections
+// for the user with login name to the target of an SSHAction.ProxyTo.
+func proxyClientVersionFor(login string) string {
+	// Version strings may only have printable ASCII characters.
+	login = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '?'
+		}
+		return r
+	}, login)
+	return proxyClientVersion + " for=" + login
+}
+
+// parseProxyClientVersion reports whether v, a client's SSH version, is that
+// of a jump host proxying a connection, per proxyClientVersionFor, and if so
+// the login name of the user it's for.
+func parseProxyClientVersion(v string) (login string, ok bool) {
+	rest, ok := strings.CutPrefix(v, proxyClientVersion)
+	if !ok || (rest != "" && rest[0] != ' ') {
+		return "", false
+	}
+	_, login, _ = strings.Cut(rest, " for=")
+	return login, true
+}
+
+// runProxied runs the session by proxying it to a session on the node at
+// the final action's ProxyTo, rather than running a local process. The
+// session is recorded here as usual.
+func (ss *sshSession) runProxied() {
+	target := ss.conn.finalAction.ProxyTo
+	ss.conn.srv.addMetric(metricProxiedSessions, 1)
+
+	// The target node handles any PTY itself.
+	ss.DisablePTYEmulation()
+
+	var rec *recording // or nil if disabled
+	if ss.Subsystem() == "" {
+		var ok bool
+		if rec, ok = ss.maybeStartRecording(); !ok {
+			return
+		}
+		if rec != nil {
+			defer rec.Close()
+		}
+		if sl := ss.startOutputSyslog(); sl != nil {
+			defer sl.Close()
+		}
+	}
+
+	client, err := ss.conn.dialProxyTarget(ss.ctx, target)
+	if err != nil {
+		ss.errf("proxy to %v: %v", target, err)
+		fmt.Fprintf(ss.Stderr(), "can't connect to %s\r\n", target)
+		ss.Exit(1)
+		return
+	}
+	defer client.Close()
+	go func() {
+		<-ss.ctx.Done()
+		client.Close()
+	}()
+
+	err = ss.proxySession(client, rec)
+	// Tell the client why the session was terminated, if it was, before
+	// closing its output.
+	var uve userVisibleError
+	if errors.As(context.Cause(ss.ctx), &uve) {
+		fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+	}
+	ss.CloseWrite()
+	if err == nil {
+		ss.logf("Session complete")
+		ss.Exit(0)
+		return
+	}
+	var ee interface{ ExitStatus() int } // *gossh.ExitError or proxyExitError
+	if errors.As(err, &ee) {
+		ss.logf("proxied session exited: code=%v", ee.ExitStatus())
+		ss.Exit(ee.ExitStatus())
+		return
+	}
+	ss.errf("proxied session: %v", err)
+	ss.Exit(1)
+}
+
+// proxySession starts a session on client matching ss, copies its I/O to
+// and from ss until it finishes, and returns its result as returned by
+// gossh.Session.Wait, or by proxySubsystem for subsystem sessions.
+func (ss *sshSession) proxySession(client *gossh.Client, rec *recording) error {
+	// Count and limit the I/O, as for local sessions, so that it resets the
+	// action's IdleTimeout and is held to its MaxOutputBytes and SFTP limits.
+	lim := ss.newOutputLimiter()
+	sftpLim := ss.newSFTPLimits()
+	stdout := sftpLim.writer(lim.writer(countingWriter{&ss.bytesOut, ss.outputWriter(rec, ss), ss.markActive}))
+	stderr := lim.writer(countingWriter{&ss.bytesOut, ss.Stderr(), ss.markActive})
+	stdin := func(w io.Writer) io.Writer {
+		return sftpLim.writer(countingWriter{&ss.bytesIn, rec.writer("i", w), ss.markActive})
+	}
+	if ss.Subsystem() != "" {
+		return ss.proxySubsystem(client, stdin, stdout, stderr)
+	}
+
+	sess, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer sess.Close()
+
+	for _, kv := range ss.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			// The target may refuse to set any of them, like OpenSSH
+			// does for those not in its AcceptEnv.
+			sess.Setenv(k, v)
+		}
+	}
+	if ptyReq, winCh, isPty := ss.Pty(); isPty {
+		if err := sess.RequestPty(ptyReq.Term, ptyReq.Window.Height, ptyReq.Window.Width, ptyReq.Modes); err != nil {
+			return fmt.Errorf("pty request: %w", err)
+		}
+		go func() {
+			for win := range winCh {
+				sess.WindowChange(win.Height, win.Width)
+			}
+		}()
+	}
+
+	wrStdin, err := sess.StdinPipe()
+	if err != nil {
+		return err
+	}
+	sess.Stdout = stdout
+	sess.Stderr = stderr
+
+	if ss.RawCommand() != "" {
+		err = sess.Start(ss.RawCommand())
+	} else {
+		err = sess.Shell()
+	}
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer wrStdin.Close()
+		if _, err := io.Copy(stdin(wrStdin), ss); err != nil {
+			ss.errf("proxy stdin copy: %v", err)
+		}
+	}()
+	return sess.Wait()
+}
+
+// proxySubsystem is proxySession for subsystem sessions, with the I/O of ss
+// copied through stdin, stdout and stderr.
+//
+// It uses a session channel directly, as gossh.Session can't be waited on
+// after only a RequestSubsystem. It returns a proxyExitError if the
+// subsystem exits with a nonzero status.
+func (ss *sshSession) proxySubsystem(client *gossh.Client, stdin func(io.Writer) io.Writer, stdout, stderr io.Writer) error {
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	exitStatus := make(chan int, 1) // or -1 if none was sent
+	go func() {
+		status := -1
+		for req := range reqs {
+			if req.Type == "exit-status" && len(req.Payload) == 4 {
+				status = int(binary.BigEndian.Uint32(req.Payload))
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		exitStatus <- status
+	}()
+
+	for _, kv := range ss.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			ch.SendRequest("env", false, gossh.Marshal(&struct {
+				Name, Value string
+			}{k, v}))
+		}
+	}
+	ok, err := ch.SendRequest("subsystem", true, gossh.Marshal(&struct {
+		Name string
+	}{ss.Subsystem()}))
+	if err == nil && !ok {
+		err = errors.New("subsystem request failed")
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer ch.CloseWrite()
+		if _, err := io.Copy(stdin(ch), ss); err != nil {
+			ss.errf("proxy stdin copy: %v", err)
+		}
+	}()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(stdout, ch)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(stderr, ch.Stderr())
+	}()
+	wg.Wait()
+	switch status := <-exitStatus; status {
+	case 0:
+		return nil
+	case -1:
+		return errors.New("subsystem exited without exit status")
+	default:
+		return proxyExitError(status)
+	}
+}
+
+// proxyExitError is the error of a proxied subsystem that exited with a
+// nonzero status.
+type proxyExitError int
+
+func (e proxyExitError) Error() string   { return fmt.Sprintf("exit status %d", int(e)) }
+func (e proxyExitError) ExitStatus() int { return int(e) }
+
+// dialProxyTarget connects to the Tailscale SSH server at target
+// ("host:port") as the ssh-user requested by the client. It identifies
+// itself as proxying for the client's user with proxyClientVersionFor.
+//
+// The target's host key must be one of those advertised in the Hostinfo
+// of the peer it's connected to.
+func (c *conn) dialProxyTarget(ctx context.Context, target string) (*gossh.Client, error) {
+	dialer := c.srv.lb.Dialer()
+	if dialer == nil {
+		return nil, errors.New("no dialer")
+	}
+	ctx, cancel := context.WithTimeout(ctx, proxyDialTimeout)
+	defer cancel()
+	nc, err := dialer.UserDial(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(dl)
+	}
+	cfg := &gossh.ClientConfig{
+		User:            c.info.sshUser,
+		ClientVersion:   proxyClientVersionFor(c.info.uprof.LoginName),
+		HostKeyCallback: c.proxyHostKeyCallback,
+		BannerCallback: func(message string) error {
+			c.vlogf("proxy banner from %v: %q", target, message)
+			return nil
+		},
+	}
+	sc, chans, reqs, err := gossh.NewClientConn(nc, target, cfg)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return gossh.NewClient(sc, chans, reqs), nil
+}
+
+// proxyHostKeyCallback is the gossh.HostKeyCallback for connections to the
+// target of an SSHAction.ProxyTo. It accepts key only if the peer with the
+// remote IP address advertises it as one of its SSH host keys.
+func (c *conn) proxyHostKeyCallback(hostname string, remote net.Addr, key gossh.PublicKey) error {
+	ap, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return err
+	}
+	nm := c.srv.lb.NetMap()
+	if nm == nil {
+		return errors.New("no netmap")
+	}
+	ip := ap.Addr().Unmap()
+	for _, p := range nm.Peers {
+		if !p.Addresses().ContainsFunc(func(pfx netip.Prefix) bool {
+			return pfx.IsSingleIP() && pfx.Addr() == ip
+		}) {
+			continue
+		}
+		hostKeys := p.Hostinfo().SSH_HostKeys()
+		for i := 0; i < hostKeys.Len(); i++ {
+			if pubKeyMatchesAuthorizedKey(key, hostKeys.At(i)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key of %v not advertised by %v", hostname, p.Name())
+	}
+	return fmt.Errorf("no peer with IP %v", ip)
+}
@@ -0,0 +1,284 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+const (
+	// recordingFilePrefix and recordingFileSuffix bracket the names of
+	// recordings written to local disk by openFileForRecording. In between
+	// is the start time in Unix nanoseconds, a dash, and a random string.
+	recordingFilePrefix = "ssh-session-"
+	recordingFileSuffix = ".cast"
+
+	// recordingGzipSuffix follows recordingFileSuffix in the names of
+	// recordings gzip-compressed per TS_SSH_RECORDING_GZIP.
+	recordingGzipSuffix = ".gz"
+
+	// maxCastHeaderSize is the maximum number of bytes read from the start of
+	// a recording when looking for its CastHeader.
+	maxCastHeaderSize = 64 << 10
+)
+
+// recordingsDir returns the directory in which SSH session recordings are
+// stored when recording to local disk.
+func (srv *server) recordingsDir() (string, error) {
+	varRoot := srv.lb.TailscaleVarRoot()
+	if varRoot == "" {
+		return "", errors.New("no var root for recording storage")
+	}
+	return filepath.Join(varRoot, "ssh-sessions"), nil
+}
+
+// checkRecordingsDir returns the FileInfo of dir, the directory that
+// recordings are written to, or an error if it isn't safe to write them
+// there: if it's a symlink or not a directory, isn't owned by the current
+// user, or is writable by other users. Otherwise, local users could redirect
+// or tamper with recordings.
+func checkRecordingsDir(dir string) (fs.FileInfo, error) {
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		return nil, fmt.Errorf("recordings directory %s is a symlink", dir)
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("recordings directory %s is not a directory", dir)
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return nil, fmt.Errorf("recordings directory %s is owned by uid %d, not %d", dir, st.Uid, os.Geteuid())
+	}
+	if perm := fi.Mode().Perm(); perm&0o022 != 0 {
+		return nil, fmt.Errorf("recordings directory %s is writable by other users (mode %v)", dir, perm)
+	}
+	return fi, nil
+}
+
+// createAppendOnlyRecording creates a new recording file in dir, like
+// os.CreateTemp but opened with O_APPEND (and write-only), so that it can be
+// on an append-only (WORM) mount or have the append-only attribute: such
+// storage refuses writes at other offsets than the end, truncation and
+// renames. Its name ends with suffix. The caller must wrap it in an
+// appendOnlyFile.
+func createAppendOnlyRecording(dir string, now time.Time, suffix string) (*os.File, error) {
+	for range 10 {
+		var r [8]byte
+		if _, err := rand.Read(r[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, fmt.Sprintf("%s%v-%x%s", recordingFilePrefix, now.UnixNano(), r, suffix))
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		return f, err
+	}
+	return nil, errors.New("recording: too many name collisions")
+}
+
+// appendOnlyFile is a recording file created by createAppendOnlyRecording.
+// It only ever writes to the end of the file, exposing no way to seek or
+// truncate it, and syncs it to disk before closing it, so that the recording
+// is durable once written to storage that allows no later fixups.
+type appendOnlyFile struct {
+	f *os.File
+}
+
+func (a appendOnlyFile) Write(p []byte) (int, error) {
+	return a.f.Write(p)
+}
+
+// Close syncs the file to disk and closes it.
+func (a appendOnlyFile) Close() error {
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// gzipRecordingFile is a gzip-compressed recording file, per
+// TS_SSH_RECORDING_GZIP.
+type gzipRecordingFile struct {
+	zw *gzip.Writer
+	f  io.WriteCloser // an *os.File or appendOnlyFile
+}
+
+func newGzipRecordingFile(f io.WriteCloser) *gzipRecordingFile {
+	return &gzipRecordingFile{zw: gzip.NewWriter(f), f: f}
+}
+
+func (g *gzipRecordingFile) Write(p []byte) (int, error) {
+	return g.zw.Write(p)
+}
+
+// Flush writes out the data compressed so far, so that it can be
+// decompressed even if the recording is never closed, and syncs the file to
+// disk if it supports that.
+func (g *gzipRecordingFile) Flush() error {
+	if err := g.zw.Flush(); err != nil {
+		return err
+	}
+	if s, ok := g.f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Close finishes the gzip stream and then closes the file.
+func (g *gzipRecordingFile) Close() error {
+	err := g.zw.Close()
+	if cerr := g.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseRecordingFileName reports whether name looks like the name of a
+// recording written by openFileForRecording, and if so, when it started.
+func parseRecordingFileName(name string) (start time.Time, ok bool) {
+	rest, ok := strings.CutPrefix(name, recordingFilePrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+	rest = strings.TrimSuffix(rest, recordingGzipSuffix)
+	rest, ok = strings.CutSuffix(rest, recordingFileSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+	nanos, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, n), true
+}
+
+// ListRecordings returns the metadata of the SSH session recordings stored on
+// local disk, most recent first. It does not expose their contents.
+func (srv *server) ListRecordings() ([]apitype.SSHRecording, error) {
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var recs []apitype.SSHRecording
+	for _, de := range des {
+		if !de.Type().IsRegular() {
+			continue
+		}
+		start, ok := parseRecordingFileName(de.Name())
+		if !ok {
+			continue
+		}
+		rec, err := readRecordingInfo(filepath.Join(dir, de.Name()))
+		if err != nil {
+			srv.logf("ssh: skipping recording %q: %v", de.Name(), err)
+			continue
+		}
+		rec.Start = start
+		recs = append(recs, rec)
+	}
+	slices.SortFunc(recs, func(a, b apitype.SSHRecording) int {
+		return b.Start.Compare(a.Start)
+	})
+	return recs, nil
+}
+
+// readRecordingInfo returns the metadata of the recording at path, as found
+// in its CastHeader, decompressing it first if it's gzip-compressed. A
+// recording whose header can't be parsed (for instance, because it was just
+// created) is still returned, without the header fields. Its Size is that of
+// the file, compressed or not.
+func readRecordingInfo(path string) (apitype.SSHRecording, error) {
+	rec := apitype.SSHRecording{Name: filepath.Base(path)}
+	f, err := os.Open(path)
+	if err != nil {
+		return rec, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return rec, err
+	}
+	rec.Size = fi.Size()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, recordingGzipSuffix) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return rec, nil
+		}
+		r = zr
+	}
+	var ch CastHeader
+	if err := json.NewDecoder(io.LimitReader(r, maxCastHeaderSize)).Decode(&ch); err != nil {
+		return rec, nil
+	}
+	rec.SessionID = ch.SessionID
+	rec.ConnectionID = ch.ConnectionID
+	rec.SSHUser = ch.SSHUser
+	rec.LocalUser = ch.LocalUser
+	rec.Part = ch.Part
+	return rec, nil
+}
+
+// errInvalidRecordingName is returned by OpenRecording for names that don't
+// refer to a recording in the recordings directory. It wraps fs.ErrNotExist.
+var errInvalidRecordingName = fmt.Errorf("invalid recording name: %w", fs.ErrNotExist)
+
+// OpenRecording opens the local-disk recording with the provided base name
+// for reading. The name must be one returned by ListRecordings; in
+// particular, it must not contain any path separators, so it's not possible
+// to open files outside of the recordings directory.
+func (srv *server) OpenRecording(name string) (*os.File, error) {
+	if name != filepath.Base(name) || strings.ContainsAny(name, `/\`) {
+		return nil, errInvalidRecordingName
+	}
+	if _, ok := parseRecordingFileName(name); !ok {
+		return nil, errInvalidRecordingName
+	}
+	dir, err := srv.recordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, name)
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("recording %q is not a regular file", name)
+	}
+	return os.Open(path)
+}
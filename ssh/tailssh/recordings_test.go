@@ -0,0 +1,610 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"golang.org/x/sys/unix"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest"
+	"tailscale.com/util/must"
+)
+
+func TestListRecordings(t *testing.T) {
+	varRoot := t.TempDir()
+	dir := filepath.Join(varRoot, "ssh-sessions")
+	if err := os.MkdirAll(filepath.Join(dir, "subdir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Unix(1700000000, 123)
+	t2 := t1.Add(time.Hour)
+	t3 := t2.Add(time.Hour)
+	writeFile := func(name, contents string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	castFile := func(start time.Time, suffix string, ch CastHeader, lines ...string) (name, contents string) {
+		j, err := json.Marshal(ch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = string(j) + "\n"
+		for _, l := range lines {
+			contents += l + "\n"
+		}
+		return fmt.Sprintf("ssh-session-%d-%s.cast", start.UnixNano(), suffix), contents
+	}
+
+	name1, c1 := castFile(t1, "111", CastHeader{
+		Version:      2,
+		SSHUser:      "alice",
+		LocalUser:    "root",
+		ConnectionID: "ssh-conn-1",
+		SessionID:    "sess-1",
+	}, `[0.1,"o","hello"]`)
+	name2, c2 := castFile(t2, "222", CastHeader{
+		Version:      2,
+		SSHUser:      "bob",
+		LocalUser:    "deploy",
+		ConnectionID: "ssh-conn-2",
+	})
+	name3 := fmt.Sprintf("ssh-session-%d-333.cast", t3.UnixNano())
+	writeFile(name1, c1)
+	writeFile(name2, c2)
+	writeFile(name3, "") // just created; no header yet
+	writeFile("not-a-recording.txt", "hello")
+	writeFile("ssh-session-bogus.cast", "{}")
+
+	srv := &server{
+		logf: t.Logf,
+		lb:   &localState{varRoot: varRoot},
+	}
+	got, err := srv.ListRecordings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []apitype.SSHRecording{
+		{Name: name3, Start: t3},
+		{Name: name2, Start: t2, Size: int64(len(c2)), ConnectionID: "ssh-conn-2", SSHUser: "bob", LocalUser: "deploy"},
+		{Name: name1, Start: t1, Size: int64(len(c1)), ConnectionID: "ssh-conn-1", SessionID: "sess-1", SSHUser: "alice", LocalUser: "root"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+
+	// No recordings directory yet is not an error.
+	srv.lb = &localState{varRoot: t.TempDir()}
+	got, err = srv.ListRecordings()
+	if err != nil || len(got) != 0 {
+		t.Errorf("ListRecordings with no directory = %v, %v; want none", got, err)
+	}
+}
+
+func TestOpenRecording(t *testing.T) {
+	varRoot := t.TempDir()
+	dir := filepath.Join(varRoot, "ssh-sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	const name = "ssh-session-1-abc.cast"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(varRoot, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const symlinkName = "ssh-session-2-def.cast"
+	if err := os.Symlink(secret, filepath.Join(dir, symlinkName)); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{
+		logf: t.Logf,
+		lb:   &localState{varRoot: varRoot},
+	}
+	f, err := srv.OpenRecording(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, bad := range []string{
+		"",
+		"..",
+		"../secret",
+		"ssh-session-1-abc.cast/../../secret",
+		"secret",
+		symlinkName,
+	} {
+		if f, err := srv.OpenRecording(bad); err == nil {
+			f.Close()
+			t.Errorf("OpenRecording(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestOpenFileForRecordingChecksDir(t *testing.T) {
+	newSession := func(varRoot string) *sshSession {
+		return &sshSession{conn: &conn{srv: &server{
+			logf: t.Logf,
+			lb:   &localState{varRoot: varRoot},
+		}}}
+	}
+
+	// A fresh directory is created and used.
+	varRoot := t.TempDir()
+	f, err := newSession(varRoot).openFileForRecording(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, dir string)
+	}{
+		{"symlink", func(t *testing.T, dir string) {
+			if err := os.Symlink(t.TempDir(), dir); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"world-writable", func(t *testing.T, dir string) {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"not-a-dir", func(t *testing.T, dir string) {
+			if err := os.WriteFile(dir, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			varRoot := t.TempDir()
+			dir := filepath.Join(varRoot, "ssh-sessions")
+			tt.setup(t, dir)
+			if f, err := newSession(varRoot).openFileForRecording(time.Now()); err == nil {
+				f.Close()
+				t.Fatal("openFileForRecording succeeded; want error")
+			}
+			if tt.name == "symlink" {
+				target, err := os.Readlink(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if des, _ := os.ReadDir(target); len(des) != 0 {
+					t.Errorf("recording written to symlink target: %v", des)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenFileForRecordingAppendOnly(t *testing.T) {
+	envknob.Setenv("TS_SSH_RECORDING_APPEND_ONLY", "true")
+	t.Cleanup(func() { envknob.Setenv("TS_SSH_RECORDING_APPEND_ONLY", "") })
+	varRoot := t.TempDir()
+	ss := &sshSession{conn: &conn{srv: &server{
+		logf: t.Logf,
+		lb:   &localState{varRoot: varRoot},
+	}}}
+	start := time.Unix(1700000000, 123)
+	w, err := ss.openFileForRecording(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	af, ok := w.(appendOnlyFile)
+	if !ok {
+		t.Fatalf("openFileForRecording returned %T; want appendOnlyFile", w)
+	}
+	// Nothing may seek or truncate the recording through its writer.
+	if _, ok := w.(io.Seeker); ok {
+		t.Error("recording writer is an io.Seeker")
+	}
+	if _, ok := w.(interface{ Truncate(int64) error }); ok {
+		t.Error("recording writer can be truncated")
+	}
+	flags, err := unix.FcntlInt(af.f.Fd(), unix.F_GETFL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags&unix.O_APPEND == 0 || flags&unix.O_ACCMODE != unix.O_WRONLY {
+		t.Errorf("recording file flags = %#x; want O_WRONLY|O_APPEND", flags)
+	}
+	name := af.f.Name()
+	if got, ok := parseRecordingFileName(filepath.Base(name)); !ok || !got.Equal(start) {
+		t.Errorf("parseRecordingFileName(%q) = %v, %v; want %v", filepath.Base(name), got, ok, start)
+	}
+
+	// Writes always go to the end, even with another writer appending
+	// concurrently, as with an append-only mount.
+	io.WriteString(w, "a")
+	other, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(other, "X")
+	other.Close()
+	io.WriteString(w, "b")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "aXb" {
+		t.Errorf("recording = %q; want %q", got, "aXb")
+	}
+}
+
+func TestRecordingFinalizedOnShutdown(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	envknob.Setenv("TS_DEBUG_LOG_SSH", "true")
+	t.Cleanup(func() { envknob.Setenv("TS_DEBUG_LOG_SSH", "") })
+	varRoot := t.TempDir()
+	s := &server{
+		logf: t.Logf,
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+			varRoot:      varRoot,
+		},
+	}
+	defer s.Shutdown()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	go s.HandleSSHConn(dc)
+	cfg := &gossh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Start("echo started; sleep 30"); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "started\n" {
+		t.Fatalf("first line = %q, %v", line, err)
+	}
+
+	// Shut down mid-session.
+	start := time.Now()
+	s.Shutdown()
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Shutdown took %v", d)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(varRoot, "ssh-sessions", "*.cast"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("recordings = %q, %v; want one", matches, err)
+	}
+	b, err := os.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	if !strings.HasSuffix(string(b), "\n") || len(lines) < 3 {
+		t.Fatalf("recording isn't complete lines: %q", b)
+	}
+	var ch CastHeader
+	if err := json.Unmarshal([]byte(lines[0]), &ch); err != nil || ch.Version != 2 {
+		t.Fatalf("header %q: %v", lines[0], err)
+	}
+	var out strings.Builder
+	var last []any
+	for _, l := range lines[1:] {
+		last = nil
+		if err := json.Unmarshal([]byte(l), &last); err != nil {
+			t.Fatalf("event %q: %v", l, err)
+		}
+		if len(last) == 3 && last[1] == "o" {
+			out.WriteString(last[2].(string))
+		}
+	}
+	if !strings.Contains(out.String(), "started") {
+		t.Errorf("recorded output = %q; want it to contain %q", out.String(), "started")
+	}
+	if len(last) != 3 || last[1] != "m" || last[2] != "tailscaled shutdown" {
+		t.Errorf("last event = %q; want shutdown marker", last)
+	}
+}
+
+func TestRecordingRollover(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	envknob.Setenv("TS_DEBUG_LOG_SSH", "true")
+	envknob.Setenv("TS_SSH_RECORDING_ROLLOVER", "300ms")
+	envknob.Setenv("TS_SSH_RECORDING_WALL_CLOCK", "true")
+	t.Cleanup(func() {
+		envknob.Setenv("TS_DEBUG_LOG_SSH", "")
+		envknob.Setenv("TS_SSH_RECORDING_ROLLOVER", "")
+		envknob.Setenv("TS_SSH_RECORDING_WALL_CLOCK", "")
+	})
+	varRoot := t.TempDir()
+	s := &server{
+		logf: t.Logf,
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+			varRoot:      varRoot,
+		},
+	}
+	defer s.Shutdown()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	go s.HandleSSHConn(dc)
+	cfg := &gossh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	out, err := session.Output("for i in 1 2 3 4 5 6 7 8; do echo line$i; sleep 0.2; done")
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+
+	var recs []apitype.SSHRecording
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		recs, err = s.ListRecordings()
+		if err != nil {
+			return err
+		}
+		if len(recs) < 3 {
+			return fmt.Errorf("got %d recordings; want at least 3", len(recs))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(recs) // oldest first
+
+	// Each part's events are timed relative to its start, which is that
+	// part's wall-clock time of an event minus its time. A part must start
+	// when the previous one ends, with its rollover marker.
+	var (
+		output   strings.Builder
+		firstHdr CastHeader
+		prevEnd  time.Time // of the previous part, if known
+	)
+	for i, rec := range recs {
+		b, err := os.ReadFile(filepath.Join(varRoot, "ssh-sessions", rec.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		var ch CastHeader
+		if err := json.Unmarshal([]byte(lines[0]), &ch); err != nil || ch.Version != 2 {
+			t.Fatalf("part %d: header %q: %v", i, lines[0], err)
+		}
+		if ch.Part != i || rec.Part != i {
+			t.Errorf("part %d: header Part = %d, listed Part = %d", i, ch.Part, rec.Part)
+		}
+		if i == 0 {
+			firstHdr = ch
+		} else if ch.SessionID != firstHdr.SessionID || ch.ConnectionID != firstHdr.ConnectionID || ch.SSHUser != firstHdr.SSHUser || ch.Command != firstHdr.Command {
+			t.Errorf("part %d: header %+v doesn't continue %+v", i, ch, firstHdr)
+		}
+		var (
+			start       time.Time // of this part, if known
+			last        []any
+			lastElapsed float64
+		)
+		for _, l := range lines[1:] {
+			last = nil
+			if err := json.Unmarshal([]byte(l), &last); err != nil {
+				t.Fatalf("part %d: event %q: %v", i, l, err)
+			}
+			elapsed := last[0].(float64)
+			if elapsed < lastElapsed {
+				t.Errorf("part %d: event %q goes back in time", i, l)
+			}
+			lastElapsed = elapsed
+			if last[1] != "o" {
+				continue
+			}
+			output.WriteString(last[2].(string))
+			wall, err := time.Parse(time.RFC3339Nano, last[3].(string))
+			if err != nil {
+				t.Fatalf("part %d: event %q: %v", i, l, err)
+			}
+			if start.IsZero() {
+				start = wall.Add(-time.Duration(elapsed * float64(time.Second)))
+			}
+		}
+		if !start.IsZero() {
+			if ch.Timestamp != start.Unix() {
+				t.Errorf("part %d: Timestamp = %d; want %d", i, ch.Timestamp, start.Unix())
+			}
+			if d := start.Sub(prevEnd); !prevEnd.IsZero() && (d < -time.Millisecond || d > time.Millisecond) {
+				t.Errorf("part %d starts at %v; previous part ended at %v", i, start, prevEnd)
+			}
+		}
+		prevEnd = time.Time{}
+		if i < len(recs)-1 {
+			if len(last) != 3 || last[1] != "m" || last[2] != "rollover" {
+				t.Errorf("part %d: last event = %q; want rollover marker", i, last)
+			} else if !start.IsZero() {
+				prevEnd = start.Add(time.Duration(lastElapsed * float64(time.Second)))
+			}
+		}
+	}
+	var want strings.Builder
+	for i := 1; i <= 8; i++ {
+		fmt.Fprintf(&want, "line%d\r\n", i)
+	}
+	if got := strings.ReplaceAll(output.String(), "\r\n", "\n"); got != strings.ReplaceAll(want.String(), "\r\n", "\n") {
+		t.Errorf("recorded output = %q; want %q", output.String(), want.String())
+	}
+}
+
+func TestGzipRecording(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	envknob.Setenv("TS_DEBUG_LOG_SSH", "true")
+	envknob.Setenv("TS_SSH_RECORDING_GZIP", "true")
+	t.Cleanup(func() {
+		envknob.Setenv("TS_DEBUG_LOG_SSH", "")
+		envknob.Setenv("TS_SSH_RECORDING_GZIP", "")
+		envknob.Setenv("TS_SSH_RECORDING_APPEND_ONLY", "")
+	})
+	for _, appendOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("append-only=%v", appendOnly), func(t *testing.T) {
+			envknob.Setenv("TS_SSH_RECORDING_APPEND_ONLY", fmt.Sprint(appendOnly))
+			varRoot := t.TempDir()
+			s := &server{
+				logf: t.Logf,
+				lb: &localState{
+					sshEnabled:   true,
+					matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+					varRoot:      varRoot,
+				},
+			}
+			defer s.Shutdown()
+			src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+			sc, dc := memnet.NewTCPConn(src, dst, 1024)
+			go s.HandleSSHConn(dc)
+			c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), &gossh.ClientConfig{
+				User:            "alice",
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := gossh.NewClient(c, chans, reqs)
+			defer client.Close()
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			if out, err := session.Output("echo hello"); err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+
+			// Once the recording is closed, it's a complete gzip stream of
+			// a cast, listed with the fields of its header.
+			var (
+				recs []apitype.SSHRecording
+				cast []byte
+			)
+			if err := tstest.WaitFor(5*time.Second, func() error {
+				recs, err = s.ListRecordings()
+				if err != nil {
+					return err
+				}
+				if len(recs) != 1 {
+					return fmt.Errorf("got %d recordings; want 1", len(recs))
+				}
+				f, err := os.Open(filepath.Join(varRoot, "ssh-sessions", recs[0].Name))
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				zr, err := gzip.NewReader(f)
+				if err != nil {
+					return err
+				}
+				cast, err = io.ReadAll(zr)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			rec := recs[0]
+			if !strings.HasSuffix(rec.Name, ".cast.gz") {
+				t.Errorf("recording name %q lacks .cast.gz suffix", rec.Name)
+			}
+			if rec.SessionID == "" || rec.SSHUser != "alice" {
+				t.Errorf("listed recording %+v lacks header fields", rec)
+			}
+			hdr, events := parseCast(t, cast)
+			if hdr.Version != 2 || hdr.SessionID != rec.SessionID {
+				t.Errorf("cast header %+v; want version 2 of session %q", hdr, rec.SessionID)
+			}
+			var output strings.Builder
+			for _, ev := range events {
+				if ev[1] == "o" {
+					output.WriteString(ev[2].(string))
+				}
+			}
+			if !strings.Contains(output.String(), "hello") {
+				t.Errorf("recorded output %q lacks %q", output.String(), "hello")
+			}
+		})
+	}
+}
+
+func TestParseRecordingFileNameGzip(t *testing.T) {
+	start := time.Unix(1700000000, 123)
+	for _, name := range []string{
+		"ssh-session-1700000000000000123-abc.cast",
+		"ssh-session-1700000000000000123-abc.cast.gz",
+	} {
+		if got, ok := parseRecordingFileName(name); !ok || !got.Equal(start) {
+			t.Errorf("parseRecordingFileName(%q) = %v, %v; want %v", name, got, ok, start)
+		}
+	}
+	for _, name := range []string{
+		"ssh-session-1700000000000000123-abc.gz",
+		"ssh-session-1700000000000000123-abc.cast.gz.gz",
+	} {
+		if _, ok := parseRecordingFileName(name); ok {
+			t.Errorf("parseRecordingFileName(%q) succeeded; want failure", name)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+// forwardedTCPChannelType is the type of the channels that connections to the
+// listeners of remote port forwards are forwarded to the client over.
+const forwardedTCPChannelType = "forwarded-tcpip"
+
+// remoteForwardRequest is the payload of a "tcpip-forward" or
+// "cancel-tcpip-forward" global request, per RFC 4254, section 7.1.
+type remoteForwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+// remoteForwardSuccess is the reply to a "tcpip-forward" request, with the
+// port bound, which is chosen by the server if the request's was zero.
+type remoteForwardSuccess struct {
+	BindPort uint32
+}
+
+// remoteForwardChannelData is the extra data of a "forwarded-tcpip" channel,
+// per RFC 4254, section 7.2.
+type remoteForwardChannelData struct {
+	DestAddr   string
+	DestPort   uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// handleTCPIPForward handles "tcpip-forward" global requests for remote port
+// forwarding, as with ssh -R, if c.mayReversePortForwardTo allows it. It
+// listens on the requested address on this node, as limited by
+// remoteForwardBindAddr, and forwards each connection
+// to it back to the client over a new "forwarded-tcpip" channel, which
+// counts towards the connection's channel limit. The listener is closed when
+// the forward is cancelled or the connection closes.
+func (c *conn) handleTCPIPForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var fr remoteForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &fr); err != nil {
+		c.errf("invalid tcpip-forward request: %v", err)
+		return false, nil
+	}
+	if !c.mayReversePortForwardTo(ctx, fr.BindAddr, fr.BindPort) {
+		return false, []byte("port forwarding is disabled")
+	}
+	bindAddr, err := c.remoteForwardBindAddr(fr.BindAddr, fr.BindPort)
+	if err != nil {
+		c.logf("remote port forward denied: %v", err)
+		return false, nil
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(bindAddr, strconv.FormatUint(uint64(fr.BindPort), 10)))
+	if err != nil {
+		c.errf("remote port forward: %v", err)
+		return false, nil
+	}
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+	key := remoteForwardKey(fr.BindAddr, port)
+
+	c.mu.Lock()
+	if c.handled {
+		c.mu.Unlock()
+		ln.Close()
+		return false, nil
+	}
+	if c.remoteForwards == nil {
+		c.remoteForwards = map[string]net.Listener{}
+	}
+	if old := c.remoteForwards[key]; old != nil {
+		old.Close()
+	}
+	c.remoteForwards[key] = ln
+	c.stopIdleTimerLocked()
+	c.mu.Unlock()
+
+	c.logf("remote port forward: listening on %v", ln.Addr())
+	sshConn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	go c.serveRemoteForward(sshConn, ln, fr.BindAddr, port)
+	return true, gossh.Marshal(&remoteForwardSuccess{port})
+}
+
+// remoteForwardBindAddr returns the address to listen on for a remote port
+// forward requested on addr and port, or an error if it isn't allowed.
+//
+// As tailscaled runs as root, forwards may only listen on loopback or on one
+// of this node's own Tailscale addresses, and on privileged ports only if the
+// local user is root. Requests to listen on all addresses, or on localhost,
+// listen on IPv4 loopback, as OpenSSH does without GatewayPorts.
+func (c *conn) remoteForwardBindAddr(addr string, port uint32) (string, error) {
+	switch addr {
+	case "", "0.0.0.0", "::", "*", "localhost":
+		addr = "127.0.0.1"
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid bind address %q", addr)
+	}
+	if !ip.IsLoopback() && !c.srv.isSelfAddr(ip) {
+		return "", fmt.Errorf("bind address %v is neither loopback nor one of this node's addresses", ip)
+	}
+	if port != 0 && port < 1024 && (c.localUser == nil || c.localUser.Uid != "0") {
+		return "", fmt.Errorf("privileged port %d is only allowed for root", port)
+	}
+	return ip.String(), nil
+}
+
+// handleCancelTCPIPForward handles "cancel-tcpip-forward" global requests,
+// closing the listener of the remote port forward they name.
+func (c *conn) handleCancelTCPIPForward(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	var fr remoteForwardRequest
+	if err := gossh.Unmarshal(req.Payload, &fr); err != nil {
+		c.errf("invalid cancel-tcpip-forward request: %v", err)
+		return false, nil
+	}
+	key := remoteForwardKey(fr.BindAddr, fr.BindPort)
+	c.mu.Lock()
+	ln, ok := c.remoteForwards[key]
+	if ok {
+		delete(c.remoteForwards, key)
+		if c.idleLocked() {
+			c.startIdleTimerLocked()
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	c.logf("remote port forward: cancelled %v", ln.Addr())
+	ln.Close()
+	return true, nil
+}
+
+// remoteForwardKey returns the key in conn.remoteForwards of the forward
+// bound to port on addr, as requested.
+func remoteForwardKey(addr string, port uint32) string {
+	return net.JoinHostPort(addr, strconv.FormatUint(uint64(port), 10))
+}
+
+// closeRemoteForwards closes the listeners of all of c's remote port
+// forwards. It's called once c is closed.
+func (c *conn) closeRemoteForwards() {
+	c.mu.Lock()
+	lns := c.remoteForwards
+	c.remoteForwards = nil
+	c.mu.Unlock()
+	for _, ln := range lns {
+		ln.Close()
+	}
+}
+
+// serveRemoteForward accepts connections on ln, the listener of a remote
+// port forward bound to port on bindAddr, and forwards each back to the
+// client over sshConn until ln is closed.
+func (c *conn) serveRemoteForward(sshConn *gossh.ServerConn, ln net.Listener, bindAddr string, port uint32) {
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		release, ok := c.reserveChannel(forwardedTCPChannelType)
+		if !ok {
+			nc.Close()
+			continue
+		}
+		originAddr, originPort := "", 0
+		if ta, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+			originAddr, originPort = ta.IP.String(), ta.Port
+		}
+		payload := gossh.Marshal(&remoteForwardChannelData{
+			DestAddr:   bindAddr,
+			DestPort:   port,
+			OriginAddr: originAddr,
+			OriginPort: uint32(originPort),
+		})
+		go c.forwardToClient(sshConn, nc, payload, release)
+	}
+}
+
+// forwardToClient opens a "forwarded-tcpip" channel to the client with the
+// channel data payload and copies between it and nc, in both directions,
+// until both are done. It closes nc, and calls release once the channel is
+// closed.
+func (c *conn) forwardToClient(sshConn *gossh.ServerConn, nc net.Conn, payload []byte, release func()) {
+	defer release()
+	defer nc.Close()
+	ch, reqs, err := sshConn.OpenChannel(forwardedTCPChannelType, payload)
+	if err != nil {
+		c.vlogf("remote port forward: opening channel: %v", err)
+		return
+	}
+	defer ch.Close()
+	c.srv.addMetric(metricRemotePortForward, 1)
+	go gossh.DiscardRequests(reqs)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, nc)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(nc, ch)
+		if cw, ok := nc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			nc.Close()
+		}
+	}()
+	wg.Wait()
+}
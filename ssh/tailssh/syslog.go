@@ -0,0 +1,313 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+const (
+	// syslogPriority is the RFC 5424 PRI of session output messages:
+	// facility authpriv (10), as session output may be sensitive, and
+	// severity informational (6).
+	syslogPriority = 10*8 + 6
+
+	// syslogSDID is the SD-ID of the structured data element identifying
+	// the session of each message. 32473 is the private enterprise number
+	// reserved for documentation (RFC 5612).
+	syslogSDID = "tailscale@32473"
+
+	// syslogMaxLine is the maximum length of the output line in a message;
+	// longer lines are split.
+	syslogMaxLine = 2 << 10
+
+	// syslogQueueLen is how many messages may be queued for sending before
+	// new ones are dropped, so that a slow or unreachable syslog server
+	// never slows down sessions.
+	syslogQueueLen = 1024
+
+	// syslogRedialInterval is how long to wait before redialing after
+	// failing to connect to the syslog server. Messages are dropped
+	// meanwhile.
+	syslogRedialInterval = 5 * time.Second
+
+	// syslogIOTimeout bounds dials of and writes to the syslog server.
+	syslogIOTimeout = 5 * time.Second
+)
+
+// syslogSink sends session output lines to a syslog server, as RFC 5424
+// messages. It reconnects as needed. It's shared by all sessions of a
+// server; see (*server).outputSyslogSink.
+type syslogSink struct {
+	target   string // TS_SSH_OUTPUT_SYSLOG value it was created for
+	network  string // "udp", "tcp", "unixgram" or "unix"
+	addr     string
+	hostname string
+	logf     logger.Logf
+	srv      *server // or nil; for metrics
+
+	msgs      chan []byte
+	done      chan struct{} // closed by close
+	closeOnce sync.Once
+	exited    chan struct{} // closed when run returns
+}
+
+// newSyslogSink returns a running syslogSink for target, in the format of
+// TS_SSH_OUTPUT_SYSLOG: "local" for the local syslog daemon, or a
+// "udp://host:port", "tcp://host:port", "unixgram:///path" or
+// "unix:///path" URL. Dropped messages are counted in the metrics of srv,
+// which may be nil.
+func newSyslogSink(srv *server, target string, logf logger.Logf) (*syslogSink, error) {
+	s := &syslogSink{
+		srv:    srv,
+		target: target,
+		logf:   logf,
+		msgs:   make(chan []byte, syslogQueueLen),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	if target == "local" {
+		s.network, s.addr = "unixgram", "/dev/log"
+	} else {
+		network, addr, ok := strings.Cut(target, "://")
+		if !ok || addr == "" {
+			return nil, fmt.Errorf("invalid syslog target %q", target)
+		}
+		switch network {
+		case "udp", "tcp", "unixgram", "unix":
+		default:
+			return nil, fmt.Errorf("unsupported syslog network %q", network)
+		}
+		s.network, s.addr = network, addr
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	go s.run()
+	return s, nil
+}
+
+// send queues the message m to be sent, or drops it if the queue is full or
+// s is closed.
+func (s *syslogSink) send(m []byte) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	select {
+	case s.msgs <- m:
+	default:
+		s.srv.addMetric(metricSyslogDropped, 1)
+	}
+}
+
+// close stops s, dropping any messages not yet sent.
+func (s *syslogSink) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+	<-s.exited
+}
+
+// run sends queued messages until s is closed.
+func (s *syslogSink) run() {
+	defer close(s.exited)
+	var (
+		conn     net.Conn // or nil if not connected
+		nextDial time.Time
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		var m []byte
+		select {
+		case <-s.done:
+			return
+		case m = <-s.msgs:
+		}
+		if s.network == "tcp" || s.network == "unix" {
+			// Octet-counting framing, per RFC 6587.
+			m = append(fmt.Appendf(nil, "%d ", len(m)), m...)
+		}
+		// Retry once on a fresh connection, as a stream connection
+		// closed by the server is only noticed when writing to it.
+		for attempt := 0; ; attempt++ {
+			if conn == nil {
+				if time.Now().Before(nextDial) {
+					s.srv.addMetric(metricSyslogDropped, 1)
+					break
+				}
+				var err error
+				conn, err = net.DialTimeout(s.network, s.addr, syslogIOTimeout)
+				if err != nil {
+					s.logf("ssh output syslog: %v", err)
+					nextDial = time.Now().Add(syslogRedialInterval)
+					s.srv.addMetric(metricSyslogDropped, 1)
+					break
+				}
+			}
+			conn.SetWriteDeadline(time.Now().Add(syslogIOTimeout))
+			_, err := conn.Write(m)
+			if err == nil {
+				break
+			}
+			conn.Close()
+			conn = nil
+			if attempt > 0 {
+				s.logf("ssh output syslog: %v", err)
+				s.srv.addMetric(metricSyslogDropped, 1)
+				break
+			}
+		}
+	}
+}
+
+// syslogLineWriter is an io.Writer that sends each line written to it to a
+// syslogSink, tagged with the session it's the output of. It never fails.
+type syslogLineWriter struct {
+	sink *syslogSink
+	sd   string // RFC 5424 structured data identifying the session
+
+	mu  sync.Mutex
+	buf []byte // incomplete last line
+}
+
+// startOutputSyslog starts teeing the output of ss to the server's syslog
+// sink, if TS_SSH_OUTPUT_SYSLOG is set. The returned writer, if non-nil,
+// must be closed once the session's output is done, to send any incomplete
+// last line.
+func (ss *sshSession) startOutputSyslog() io.Closer {
+	sink := ss.conn.srv.outputSyslogSink()
+	if sink == nil {
+		return nil
+	}
+	ci := ss.conn.info
+	params := []string{
+		"conn", ss.conn.connID,
+		"session", ss.sharedID,
+		"src", ci.src.String(),
+		"user", ci.uprof.LoginName,
+		"sshUser", ci.sshUser,
+	}
+	if ci.node.Valid() {
+		params = append(params, "node", ci.node.Name())
+	}
+	if lu := ss.conn.localUser; lu != nil {
+		params = append(params, "localUser", lu.Username)
+	}
+	ss.outputSyslog = &syslogLineWriter{
+		sink: sink,
+		sd:   syslogStructuredData(syslogSDID, params...),
+	}
+	return ss.outputSyslog
+}
+
+// syslogStructuredData returns an RFC 5424 SD-ELEMENT with the provided ID
+// and alternating names and values of params.
+func syslogStructuredData(id string, params ...string) string {
+	var b strings.Builder
+	b.WriteString("[")
+	b.WriteString(id)
+	for i := 0; i+1 < len(params); i += 2 {
+		fmt.Fprintf(&b, ` %s="%s"`, params[i], syslogParamEscaper.Replace(params[i+1]))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// syslogParamEscaper escapes the characters that RFC 5424 requires escaping
+// in PARAM-VALUEs.
+var syslogParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+func (w *syslogLineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	rest := w.buf
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		w.sendLine(rest[:i])
+		rest = rest[i+1:]
+	}
+	for len(rest) >= syslogMaxLine {
+		w.sendLine(rest[:syslogMaxLine])
+		rest = rest[syslogMaxLine:]
+	}
+	w.buf = w.buf[:copy(w.buf, rest)]
+	return len(p), nil
+}
+
+// Close sends any incomplete last line.
+func (w *syslogLineWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.sendLine(w.buf)
+	w.buf = nil
+	return nil
+}
+
+// sendLine sends line as a message, unless it's empty. w.mu must be held.
+func (w *syslogLineWriter) sendLine(line []byte) {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) == 0 {
+		return
+	}
+	s := w.sink
+	m := fmt.Appendf(nil, "<%d>1 %s %s tailscaled %d ssh-output %s ",
+		syslogPriority, time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, os.Getpid(), w.sd)
+	s.send(append(m, line...))
+}
+
+// outputSyslogSink returns the syslog sink for TS_SSH_OUTPUT_SYSLOG, or nil
+// if it's unset or invalid. The sink is created on first use and replaced if
+// the knob changes.
+func (srv *server) outputSyslogSink() *syslogSink {
+	target := sshOutputSyslog()
+	if target == "" {
+		return nil
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if s := srv.syslog; s != nil {
+		if s.target == target {
+			return s
+		}
+		go s.close()
+	}
+	s, err := newSyslogSink(srv, target, srv.logf)
+	if err != nil {
+		srv.logf("ssh output syslog: %v", err)
+		srv.syslog = nil
+		return nil
+	}
+	srv.syslog = s
+	return s
+}
+
+// outputWriter returns w wrapped to also record the output written to it in
+// rec and to tee it to syslog, if enabled. Either may be nil.
+func (ss *sshSession) outputWriter(rec *recording, w io.Writer) io.Writer {
+	w = rec.writer("o", w)
+	if ss.outputSyslog != nil {
+		w = io.MultiWriter(ss.outputSyslog, w)
+	}
+	return w
+}
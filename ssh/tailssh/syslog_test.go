@@ -0,0 +1,206 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || darwin
+
+package tailssh
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/envknob"
+	"tailscale.com/net/memnet"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/must"
+)
+
+// syslogMsgRx matches the session output messages sent by syslogLineWriter,
+// capturing the structured data and the line.
+var syslogMsgRx = regexp.MustCompile(`^<86>1 \S+ \S+ tailscaled \d+ ssh-output (\[tailscale@32473 [^]]*\]) (.*)$`)
+
+func TestSyslogOutput(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skipf("skipping on %q; only runs on linux and darwin", runtime.GOOS)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	envknob.Setenv("TS_SSH_OUTPUT_SYSLOG", "udp://"+pc.LocalAddr().String())
+	t.Cleanup(func() { envknob.Setenv("TS_SSH_OUTPUT_SYSLOG", "") })
+
+	s := &server{
+		logf: t.Logf,
+		lb: &localState{
+			sshEnabled:   true,
+			matchingRule: newSSHRule(&tailcfg.SSHAction{Accept: true}),
+		},
+	}
+	defer s.Shutdown()
+	src, dst := must.Get(netip.ParseAddrPort("100.100.100.101:2231")), must.Get(netip.ParseAddrPort("100.100.100.102:22"))
+	sc, dc := memnet.NewTCPConn(src, dst, 1024)
+	go s.HandleSSHConn(dc)
+	cfg := &gossh.ClientConfig{
+		User:            "alice",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	}
+	c, chans, reqs, err := gossh.NewClientConn(sc, sc.RemoteAddr().String(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gossh.NewClient(c, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	out, err := session.Output("echo first; echo second; printf partial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first\nsecond\npartial"; string(out) != want {
+		t.Errorf("session output = %q; want %q", out, want)
+	}
+
+	var lines []string
+	buf := make([]byte, 64<<10)
+	pc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for len(lines) < 3 {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("after %q: %v", lines, err)
+		}
+		m := syslogMsgRx.FindStringSubmatch(string(buf[:n]))
+		if m == nil {
+			t.Fatalf("malformed message %q", buf[:n])
+		}
+		for _, want := range []string{`conn="ssh-conn-`, `session="sess-`, `src="100.100.100.101:2231"`, `user="peer"`, `sshUser="alice"`, `localUser="` + currentUser + `"`} {
+			if !strings.Contains(m[1], want) {
+				t.Errorf("structured data %s lacks %s", m[1], want)
+			}
+		}
+		lines = append(lines, m[2])
+	}
+	if want := []string{"first", "second", "partial"}; strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("syslog lines = %q; want %q", lines, want)
+	}
+}
+
+func TestSyslogLineWriter(t *testing.T) {
+	sink := &syslogSink{
+		hostname: "host",
+		msgs:     make(chan []byte, 100),
+		done:     make(chan struct{}),
+	}
+	w := &syslogLineWriter{sink: sink, sd: syslogStructuredData("id", "k", "v")}
+	long := strings.Repeat("x", syslogMaxLine+10)
+	for _, p := range []string{"one\r\ntw", "o\n\n", long, "\nlast"} {
+		if n, err := io.WriteString(w, p); n != len(p) || err != nil {
+			t.Fatalf("Write = %v, %v", n, err)
+		}
+	}
+	w.Close()
+	close(sink.msgs)
+
+	var got []string
+	for m := range sink.msgs {
+		s := string(m)
+		if !strings.HasPrefix(s, "<86>1 ") {
+			t.Fatalf("message %q lacks RFC 5424 header", s)
+		}
+		_, line, ok := strings.Cut(s, `[id k="v"] `)
+		if !ok {
+			t.Fatalf("message %q lacks structured data", s)
+		}
+		got = append(got, line)
+	}
+	want := []string{"one", "two", long[:syslogMaxLine], long[syslogMaxLine:], "last"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("lines = %q; want %q", got, want)
+	}
+}
+
+func TestSyslogStructuredData(t *testing.T) {
+	got := syslogStructuredData("id@1", "a", `quote"back\slash]bracket`, "b", "")
+	want := `[id@1 a="quote\"back\\slash\]bracket" b=""]`
+	if got != want {
+		t.Errorf("got %s; want %s", got, want)
+	}
+}
+
+func TestSyslogSinkReconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	// readMsg reads an octet-counted message from br.
+	readMsg := func(br *bufio.Reader) (string, error) {
+		lenStr, err := br.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(lenStr, " "))
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return string(b), err
+	}
+
+	sink, err := newSyslogSink(nil, "tcp://"+ln.Addr().String(), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.close()
+	w := &syslogLineWriter{sink: sink, sd: "-"}
+
+	io.WriteString(w, "before\n")
+	c1 := <-conns
+	c1.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if m, err := readMsg(bufio.NewReader(c1)); err != nil || !strings.HasSuffix(m, " before") {
+		t.Fatalf("first message = %q, %v", m, err)
+	}
+
+	// The server goes away; the sink must reconnect.
+	c1.Close()
+	var c2 net.Conn
+	for i := 0; c2 == nil; i++ {
+		if i == 100 {
+			t.Fatal("sink didn't reconnect")
+		}
+		io.WriteString(w, "after\n")
+		select {
+		case c2 = <-conns:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer c2.Close()
+	c2.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if m, err := readMsg(bufio.NewReader(c2)); err != nil || !strings.HasSuffix(m, " after") {
+		t.Fatalf("message after reconnect = %q, %v", m, err)
+	}
+}
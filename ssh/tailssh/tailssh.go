@@ -13,6 +13,7 @@
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
@@ -24,17 +25,23 @@
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"golang.org/x/sys/unix"
+	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
+	"tailscale.com/metrics"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/net/tsdial"
 	"tailscale.com/tailcfg"
@@ -42,6 +49,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/types/views"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/util/httpm"
 	"tailscale.com/util/mak"
@@ -53,6 +61,307 @@
 	sshDisableSFTP       = envknob.RegisterBool("TS_SSH_DISABLE_SFTP")
 	sshDisableForwarding = envknob.RegisterBool("TS_SSH_DISABLE_FORWARDING")
 	sshDisablePTY        = envknob.RegisterBool("TS_SSH_DISABLE_PTY")
+	sshDisableX11        = envknob.RegisterBool("TS_SSH_DISABLE_X11")
+
+	// sshRequireHomeDir, if set, makes sessions fail to start if the local
+	// user's home directory is missing, rather than starting them in "/".
+	sshRequireHomeDir = envknob.RegisterBool("TS_SSH_REQUIRE_HOME_DIR")
+
+	// sshNormalizeUser is a comma-separated list of normalizations to apply
+	// to the ssh-user requested by clients before it's matched against
+	// policy; see normalizeSSHUser. By default, none are applied.
+	sshNormalizeUser = envknob.RegisterString("TS_SSH_NORMALIZE_USER")
+
+	// sshForwardIdleTimeout, if non-zero, is how long a local port forward
+	// (direct-tcpip channel) may go without any data flowing before it's
+	// closed. The session it belongs to is unaffected.
+	sshForwardIdleTimeout = envknob.RegisterDuration("TS_SSH_FORWARD_IDLE_TIMEOUT")
+
+	// sshWhoIsRetries is how many more times to try WhoIs for an incoming
+	// connection if it fails while there's no netmap. Zero means the
+	// default of defaultWhoIsRetries; negative means not to retry.
+	sshWhoIsRetries = envknob.RegisterInt("TS_SSH_WHOIS_RETRIES")
+
+	// sshAllowedPubKeyAlgos, if non-empty, is a comma-separated list of the
+	// public key authentication algorithms (such as "ssh-ed25519" or
+	// "rsa-sha2-256") that clients may sign with. Connections offering keys
+	// any other way are denied, so that an organization's crypto policy can
+	// be enforced even though the keys aren't used for identity. RSA keys
+	// may sign with "ssh-rsa" (SHA-1), "rsa-sha2-256" or "rsa-sha2-512", and
+	// certificates with the algorithms of their keys. By default, all
+	// algorithms are permitted. It doesn't apply to clients that don't
+	// offer keys.
+	sshAllowedPubKeyAlgos = envknob.RegisterString("TS_SSH_ALLOWED_PUBKEY_ALGORITHMS")
+
+	// sshRecordingFlushInterval is how often recorded data is flushed to
+	// recording writers that support it (Flush or Sync), so that it's not
+	// lost on a crash. Zero means the default of
+	// defaultRecordingFlushInterval; negative disables periodic flushing.
+	sshRecordingFlushInterval = envknob.RegisterDuration("TS_SSH_RECORDING_FLUSH_INTERVAL")
+
+	// sshRecordingRollover, if positive, is how often the recordings of
+	// long-lived sessions are split: the current recording file or upload
+	// is closed and a new one started, beginning with the same header but
+	// for its Timestamp and Part. Zero or negative never splits them.
+	sshRecordingRollover = envknob.RegisterDuration("TS_SSH_RECORDING_ROLLOVER")
+
+	// sshRecordingWallClock, if set, adds the wall-clock time of each
+	// recorded event alongside its offset from the start of the recording,
+	// to correlate recordings with other logs. Cast events get it as an
+	// extra fourth element, which standard asciinema players ignore.
+	sshRecordingWallClock = envknob.RegisterBool("TS_SSH_RECORDING_WALL_CLOCK")
+
+	// sshRecordingSummary, if set, ends each recording of a session that
+	// ran to completion with a summary of it for auditors; see
+	// recordingSummary.
+	sshRecordingSummary = envknob.RegisterBool("TS_SSH_RECORDING_SUMMARY")
+
+	// sshRecordInput, if set, records the input of all recorded sessions,
+	// as if their actions had SSHAction.RecordInput set. That includes any
+	// passwords typed at prompts.
+	sshRecordInput = envknob.RegisterBool("TS_SSH_RECORD_INPUT")
+
+	// sshSystemdScope, if set, runs each session's process in a transient
+	// systemd scope unit, where supported, so that systemd accounts for
+	// its resources and cleans up any processes left when it ends.
+	sshSystemdScope = envknob.RegisterBool("TS_SSH_SYSTEMD_SCOPE")
+
+	// sshDenialLinger is a debug knob for how long to wait after sending a
+	// denial banner before failing the auth attempt, after which clients
+	// give up and disconnect. Some clients don't reliably display banners
+	// received just before disconnecting.
+	sshDenialLinger = envknob.RegisterDuration("TS_DEBUG_SSH_DENIAL_LINGER")
+
+	// sshMaxBannerLen is the maximum length in bytes of auth banners sent
+	// to clients; longer ones are truncated. Zero means the default of
+	// defaultMaxBannerLen.
+	sshMaxBannerLen = envknob.RegisterInt("TS_SSH_MAX_BANNER_LEN")
+
+	// sshLogLevelKnob is the verbosity of connection and session logs, as
+	// one of the logLevel* values. If unset, it's logLevelInfo, or
+	// logLevelVerbose if TS_DEBUG_SSH_VLOG is set.
+	sshLogLevelKnob = envknob.RegisterInt("TS_SSH_LOG_LEVEL")
+
+	// sshHandshakeTimeout is how long clients have to complete the SSH
+	// handshake and reach a matching policy rule before the connection is
+	// dropped, so that stalled or deliberately slow clients can't tie up
+	// resources. Zero means the default of defaultHandshakeTimeout;
+	// negative disables it.
+	sshHandshakeTimeout = envknob.RegisterDuration("TS_SSH_HANDSHAKE_TIMEOUT")
+
+	// sshMaxChannelsPerConn is the maximum number of channels of any type
+	// (sessions, port forwards, agent connections) that may be open at
+	// once on a single connection; new ones past it are rejected. Zero
+	// means the default of defaultMaxChannelsPerConn; negative disables it.
+	sshMaxChannelsPerConn = envknob.RegisterInt("TS_SSH_MAX_CHANNELS_PER_CONN")
+
+	// sshMaxDelegateHops is the maximum number of HoldAndDelegate actions
+	// followed for a connection before it's denied, so that a delegate
+	// chain that loops can't hang connections. Zero or negative means the
+	// default of defaultMaxDelegateHops.
+	sshMaxDelegateHops = envknob.RegisterInt("TS_SSH_MAX_DELEGATE_HOPS")
+
+	// sshOutputSyslog, if set, is where to send the output of sessions
+	// (other than SFTP) line by line as RFC 5424 syslog messages, in
+	// addition to any recordings: "local" for the local syslog daemon, or
+	// a "udp://host:port", "tcp://host:port", "unixgram:///path" or
+	// "unix:///path" URL. See syslogSink.
+	sshOutputSyslog = envknob.RegisterString("TS_SSH_OUTPUT_SYSLOG")
+
+	// sshAllowedRequestTypes, if non-empty, is a comma-separated list of the
+	// global request types (such as "tcpip-forward") that the server
+	// handles. Others are rejected, regardless of the policy. If empty, all
+	// supported types are handled.
+	sshAllowedRequestTypes = envknob.RegisterString("TS_SSH_ALLOWED_REQUEST_TYPES")
+
+	// sshAllowPrivilegedUID allows SSHUsers to map to numeric uids below
+	// minUnprivilegedUID, such as "=0". Privileged users mapped by name,
+	// such as "root", are allowed regardless.
+	sshAllowPrivilegedUID = envknob.RegisterBool("TS_SSH_ALLOW_PRIVILEGED_UID")
+
+	// sshRecordingAppendOnly makes recordings to local disk compatible with
+	// append-only (WORM) storage: each file is created with O_APPEND, only
+	// ever appended to, and synced to disk when the recording ends. See
+	// createAppendOnlyRecording.
+	sshRecordingAppendOnly = envknob.RegisterBool("TS_SSH_RECORDING_APPEND_ONLY")
+
+	// sshRecordingGzip makes recordings to local disk gzip-compressed, named
+	// *.cast.gz rather than *.cast, as long interactive sessions' casts can
+	// get huge. Recordings uploaded to recorders aren't affected.
+	sshRecordingGzip = envknob.RegisterBool("TS_SSH_RECORDING_GZIP")
+
+	// sshAcceptHookTimeout bounds each call made inline during auth to a
+	// dependency that might be slow: the WhoIs lookup of the client and the
+	// server's acceptHook. Connections are denied if one takes longer. Zero
+	// means the default of defaultAcceptHookTimeout; negative disables it.
+	sshAcceptHookTimeout = envknob.RegisterDuration("TS_SSH_ACCEPT_HOOK_TIMEOUT")
+
+	// sshMaxConnLifetime, if positive, is the maximum time a connection may
+	// stay open, regardless of activity and of each session's
+	// SessionDuration. Once it elapses, the connection's sessions are
+	// terminated and it's closed, so that clients must reconnect and be
+	// authorized again. See (*conn).expire.
+	sshMaxConnLifetime = envknob.RegisterDuration("TS_SSH_MAX_CONN_LIFETIME")
+
+	// sshConnExpiryWarning is how long before a connection's
+	// TS_SSH_MAX_CONN_LIFETIME elapses its user is first warned, so that
+	// they can save their work; see (*conn).warnExpiry. Zero means the
+	// default of defaultConnExpiryWarning; negative disables the warnings.
+	sshConnExpiryWarning = envknob.RegisterDuration("TS_SSH_CONN_EXPIRY_WARNING")
+
+	// sshIdleConnTimeout, if positive, is how long an authenticated
+	// connection may stay open once all of its sessions and other channels
+	// have closed, such as one kept open by a client for multiplexing,
+	// before it's closed to free its resources. See (*conn).reapIfIdle.
+	sshIdleConnTimeout = envknob.RegisterDuration("TS_SSH_IDLE_CONN_TIMEOUT")
+
+	// sshSessionTermGrace, if positive, overrides each action's
+	// SessionTermGrace: how long a terminated session's process is given to
+	// exit after SIGTERM before it's sent SIGKILL.
+	sshSessionTermGrace = envknob.RegisterDuration("TS_SSH_SESSION_TERM_GRACE")
+
+	// sshMaxNetMapAge, if positive, is how long ago tailscaled may have last
+	// heard from control for the SSH policy in its netmap to still be
+	// trusted. Past it, such as during a long control outage, the policy
+	// may be stale and allow access that has since been revoked, so
+	// connections are denied, unless TS_SSH_STALE_NETMAP_WARN_ONLY is set.
+	sshMaxNetMapAge = envknob.RegisterDuration("TS_SSH_MAX_NETMAP_AGE")
+
+	// sshStaleNetMapWarnOnly makes connections evaluated against a netmap
+	// older than TS_SSH_MAX_NETMAP_AGE only log a warning instead of being
+	// denied.
+	sshStaleNetMapWarnOnly = envknob.RegisterBool("TS_SSH_STALE_NETMAP_WARN_ONLY")
+
+	// sshAcceptCacheTTL is how long the policy decision for a connection is
+	// reused for later connections of the same identity, ssh-user and
+	// policy, so that clients reconnecting often don't each evaluate the
+	// policy; see acceptCache. Zero means the default of
+	// defaultAcceptCacheTTL; negative disables the cache.
+	sshAcceptCacheTTL = envknob.RegisterDuration("TS_SSH_ACCEPT_CACHE_TTL")
+
+	// sshAllowedTerms, if non-empty, is a comma-separated list of the TERM
+	// values (or path.Match patterns, like "xterm*") that clients may set,
+	// to keep terminfo entries that might be exploitable from being used.
+	// Others are replaced with TS_SSH_TERM_FALLBACK, both in the session's
+	// environment and its recording. By default, any TERM is allowed.
+	sshAllowedTerms = envknob.RegisterString("TS_SSH_ALLOWED_TERMS")
+
+	// sshTermFallback is the TERM that replaces values not allowed by
+	// TS_SSH_ALLOWED_TERMS. If empty, it's defaultTerm.
+	sshTermFallback = envknob.RegisterString("TS_SSH_TERM_FALLBACK")
+
+	// sshAcceptLogSample, if greater than one, samples the routine logs of
+	// accepting connections and starting their sessions: only one in every
+	// sshAcceptLogSample connections gets them, to cut log volume on busy
+	// hosts. Denials and errors are always logged. See (*conn).acceptLogf.
+	sshAcceptLogSample = envknob.RegisterInt("TS_SSH_ACCEPT_LOG_SAMPLE")
+
+	// sshStrictEnv, if true, restricts the environment of sessions to the
+	// variables tailscaled explicitly sets (see strictEnvVar), dropping any
+	// others, and keeps the login shell from defaulting to tailscaled's own
+	// $SHELL, so that nothing from tailscaled's environment, like cloud
+	// credentials, can leak into sessions.
+	sshStrictEnv = envknob.RegisterBool("TS_SSH_STRICT_ENV")
+
+	// sshRequireSelfDst, if true, refuses connections to local addresses
+	// that aren't among this node's own Tailscale addresses, per the self
+	// node of the netmap, instead of accepting any Tailscale IP. Without a
+	// netmap, all connections are refused.
+	sshRequireSelfDst = envknob.RegisterBool("TS_SSH_REQUIRE_SELF_DST")
+
+	// sshReadOnly puts the server in read-only maintenance mode: users may
+	// still connect and run commands as policy allows, but port
+	// forwarding, agent forwarding, X11 forwarding and SFTP writes are
+	// disabled regardless of policy, and a banner explains why. See
+	// readOnlyBanner.
+	sshReadOnly = envknob.RegisterBool("TS_SSH_READ_ONLY")
+
+	// sshIDPrefix, if set, is prepended with a hyphen to the IDs of
+	// connections and sessions, such as to tell apart the hosts or
+	// environments they're from in external systems. It must be a valid
+	// correlation token; see validCorrelationToken. Invalid values are
+	// ignored.
+	sshIDPrefix = envknob.RegisterString("TS_SSH_ID_PREFIX")
+
+	// sshSameUserOnly, if true and tailscaled isn't running as root,
+	// denies connections mapped to local users other than the one
+	// tailscaled runs as during auth, with an explanation, instead of
+	// accepting them only to fail each session, which a non-root
+	// tailscaled can't switch users for.
+	sshSameUserOnly = envknob.RegisterBool("TS_SSH_SAME_USER_ONLY")
+
+	// sshRecorderBreakerThreshold is the number of consecutive failures to
+	// connect to a recorder after which sessions skip it for
+	// sshRecorderBreakerCooldown; see recorderBreaker. Zero means the
+	// default of defaultRecorderBreakerThreshold; negative disables it.
+	sshRecorderBreakerThreshold = envknob.RegisterInt("TS_SSH_RECORDER_BREAKER_THRESHOLD")
+
+	// sshRecorderBreakerCooldown is how long an unhealthy recorder is
+	// skipped for before it's tried again. Zero means the default of
+	// defaultRecorderBreakerCooldown.
+	sshRecorderBreakerCooldown = envknob.RegisterDuration("TS_SSH_RECORDER_BREAKER_COOLDOWN")
+
+	// sshCapabilityBanner, if set, makes accepted connections get an auth
+	// banner summarizing what the policy allows them to do; see
+	// (*conn).capabilitySummary.
+	sshCapabilityBanner = envknob.RegisterBool("TS_SSH_CAPABILITY_BANNER")
+
+	// sshAllowedLocalUsers, if non-empty, is a comma-separated list of the
+	// only local users that connections may log in as, regardless of the
+	// policy. See localUserAllowed.
+	sshAllowedLocalUsers = envknob.RegisterString("TS_SSH_ALLOWED_LOCAL_USERS")
+
+	// sshDeniedLocalUsers is a comma-separated list of local users that
+	// connections may never log in as, regardless of the policy, such as
+	// "root". It takes precedence over sshAllowedLocalUsers.
+	sshDeniedLocalUsers = envknob.RegisterString("TS_SSH_DENIED_LOCAL_USERS")
+
+	// sshSingleInteractiveSession, if true, refuses a new interactive
+	// session, one with a PTY, while the same identity already has one
+	// active on this host. Identities are users, or nodes for tagged nodes;
+	// see (*conn).identityKey. SFTP and commands without a PTY are exempt.
+	sshSingleInteractiveSession = envknob.RegisterBool("TS_SSH_SINGLE_INTERACTIVE_SESSION")
+
+	// sshJournal, if true, logs the start and stop of each session to the
+	// systemd journal, with structured fields such as TS_SSH_USER and
+	// TS_CONN_ID; see (*sshSession).journalSessionEvent.
+	sshJournal = envknob.RegisterBool("TS_SSH_JOURNAL")
+
+	// sshKeyboardInteractiveAuth, if true, makes authorized clients answer
+	// an empty keyboard-interactive challenge, with no questions, instead of
+	// accepting them with the "none" method, which compliance scanners
+	// flag. It only changes what's advertised: authorization is still by
+	// Tailscale identity and policy, evaluated for the "none" attempt, as
+	// always, and the challenge accepts whatever the client answers.
+	sshKeyboardInteractiveAuth = envknob.RegisterBool("TS_SSH_KEYBOARD_INTERACTIVE_AUTH")
+
+	// sshMaxRecordings, if positive, is the most sessions that may be
+	// recorded at once, across all connections, so that recording doesn't
+	// saturate I/O or recorder bandwidth. A session that would exceed it
+	// waits up to sshRecordingSlotWait for another recording to end, and
+	// then is handled like when its recorders can't be reached: it's
+	// rejected if a recording sink's OnRecordingFailure says so, and
+	// otherwise continues unrecorded, marked as having failed open.
+	sshMaxRecordings = envknob.RegisterInt("TS_SSH_MAX_RECORDINGS")
+
+	// sshRecordingSlotWait, if positive, is how long a session waits for
+	// fewer than sshMaxRecordings sessions to be recorded before giving up
+	// on recording it.
+	sshRecordingSlotWait = envknob.RegisterDuration("TS_SSH_RECORDING_SLOT_WAIT")
+
+	// sshKeepSessionsOnNodeKeyChange, if true, lets sessions continue after
+	// this node's key changes, such as by fast user switching or
+	// re-authentication, only logging it. By default they're terminated,
+	// as what they send to control and recorders is tied to the old key;
+	// see (*conn).nodeKeyChanged.
+	sshKeepSessionsOnNodeKeyChange = envknob.RegisterBool("TS_SSH_KEEP_SESSIONS_ON_NODE_KEY_CHANGE")
+
+	// sshRequireSecureControl, if true, aborts the requests to control
+	// that the backend can't vouch are made over the Noise protocol,
+	// instead of only warning about them: fetches of HoldAndDelegate
+	// actions, which then deny the connection, and event notifications,
+	// such as of recording failures. See (*server).checkControlTransport.
+	sshRequireSecureControl = envknob.RegisterBool("TS_SSH_REQUIRE_SECURE_CONTROL")
 )
 
 const (
@@ -75,6 +384,40 @@ type ipnLocalBackend interface {
 	NodeKey() key.NodePublic
 }
 
+// secureControlTransport is implemented by the ipnLocalBackends that can
+// vouch for the transport of DoNoiseRequest.
+type secureControlTransport interface {
+	// ControlTransportSecure reports whether DoNoiseRequest sends requests
+	// to control over the Noise protocol, which is encrypted and
+	// authenticated with control's key, and never over anything else.
+	ControlTransportSecure() bool
+}
+
+// errInsecureControlTransport is returned by checkControlTransport when
+// TS_SSH_REQUIRE_SECURE_CONTROL is set and the backend can't vouch for the
+// transport of requests to control.
+var errInsecureControlTransport = errors.New("tailssh: control transport not verified secure")
+
+// checkControlTransport checks that requests to control made with
+// DoNoiseRequest use the secure path, per secureControlTransport, before
+// what, a description of a request, is made. If the backend can't vouch for
+// it, it logs so (once, unless refusing) and, if TS_SSH_REQUIRE_SECURE_CONTROL is set, returns
+// errInsecureControlTransport, so that the request isn't made.
+func (srv *server) checkControlTransport(what string) error {
+	if t, ok := srv.lb.(secureControlTransport); ok && t.ControlTransportSecure() {
+		return nil
+	}
+	srv.addMetric(metricInsecureControl, 1)
+	if !sshRequireSecureControl() {
+		srv.insecureControlWarnOnce.Do(func() {
+			srv.logf("warning: %s: control transport not verified secure; set TS_SSH_REQUIRE_SECURE_CONTROL to refuse", what)
+		})
+		return nil
+	}
+	srv.logf("refusing %s: control transport not verified secure", what)
+	return errInsecureControlTransport
+}
+
 type server struct {
 	lb             ipnLocalBackend
 	logf           logger.Logf
@@ -82,14 +425,49 @@ type server struct {
 
 	pubKeyHTTPClient *http.Client     // or nil for http.DefaultClient
 	timeNow          func() time.Time // or nil for time.Now
+	geteuid          func() int       // or nil for os.Geteuid
+
+	// lastHeardFromControl, if non-nil, returns when tailscaled last heard
+	// from control, or the zero time if it hasn't; see netMapStale.
+	lastHeardFromControl func() time.Time
+
+	// testRecordingSink, if non-nil, returns the sink to record each
+	// session to in tests, instead of any recorders or local disk.
+	testRecordingSink func() io.WriteCloser
+
+	// journalSocket, if non-empty, is the socket of the journal to log
+	// sessions to in tests, instead of journalSocketPath.
+	journalSocket string
+
+	// acceptHook, if non-nil, is an additional authorization check of each
+	// connection, run once the policy accepted it (or may, pending
+	// HoldAndDelegate). A non-nil error denies the connection. It's bounded
+	// by TS_SSH_ACCEPT_HOOK_TIMEOUT and must return promptly once its
+	// context is done.
+	acceptHook func(ctx context.Context, ci *sshConnInfo) error
 
 	sessionWaitGroup sync.WaitGroup
 
+	metrics serverMetrics // see addMetric
+
+	acceptCache acceptCache // see evaluatePolicy
+
+	acceptLogSeq atomic.Uint64 // connections considered for accept log sampling
+
+	recorderBreaker recorderBreaker // see connectToRecorder
+
+	insecureControlWarnOnce sync.Once // see checkControlTransport
+
 	// mu protects the following
 	mu                   sync.Mutex
 	activeConns          map[*conn]bool              // set; value is always true
 	fetchPublicKeysCache map[string]pubKeyCacheEntry // by https URL
 	shutdownCalled       bool
+	syslog               *syslogSink         // or nil; see outputSyslogSink
+	recordings           map[*recording]bool // active; see trackRecording
+	activeRecordings     int                 // including starting ones; see acquireRecordingSlot
+	recordingSlotFreed   chan struct{}       // or nil; closed and replaced when activeRecordings decreases
+	reloadSignals        chan os.Signal      // or nil; see startPolicyReloadOnSIGHUP
 }
 
 func (srv *server) now() time.Time {
@@ -99,6 +477,26 @@ func (srv *server) now() time.Time {
 	return time.Now()
 }
 
+func (srv *server) euid() int {
+	if srv.geteuid != nil {
+		return srv.geteuid()
+	}
+	return os.Geteuid()
+}
+
+// canSwitchTo reports whether tailscaled can run sessions as lu: it must be
+// running as root, or as lu itself.
+func (srv *server) canSwitchTo(lu *userMeta) bool {
+	euid := srv.euid()
+	return euid == 0 || lu.Uid == strconv.Itoa(euid)
+}
+
+// cantSwitchUserMessage returns the user-visible explanation of why
+// tailscaled can't run sessions as lu, per canSwitchTo.
+func (srv *server) cantSwitchUserMessage(lu *userMeta) string {
+	return fmt.Sprintf("tailscaled runs as uid %d, not root, so it can't start sessions as user %q, only as itself; run tailscaled as root to allow switching users", srv.euid(), lu.Username)
+}
+
 func init() {
 	ipnlocal.RegisterNewSSHServer(func(logf logger.Logf, lb *ipnlocal.LocalBackend) (ipnlocal.SSHServer, error) {
 		tsd, err := os.Executable()
@@ -112,25 +510,61 @@ func init() {
 			timeNow: func() time.Time {
 				return lb.ControlNow(time.Now())
 			},
+			lastHeardFromControl: lb.HealthTracker().LastStreamedMapResponse,
 		}
+		srv.startPolicyReloadOnSIGHUP()
 
 		return srv, nil
 	})
+	expvar.Publish("gauge_ssh_active_sessions_by_user", metricActiveSessionsByLocalUser)
+	expvar.Publish("ssh_recording_local_write_seconds", metricRecordingWriteLatency)
+	expvar.Publish("ssh_recording_recorder_write_seconds", metricRecorderWriteLatency)
+	expvar.Publish("ssh_recording_outcomes", metricRecordingOutcomes)
 }
 
 // attachSessionToConnIfNotShutdown ensures that srv is not shutdown before
 // attaching the session to the conn. This ensures that once Shutdown is called,
 // new sessions are not allowed and existing ones are cleaned up.
-// It reports whether ss was attached to the conn.
-func (srv *server) attachSessionToConnIfNotShutdown(ss *sshSession) bool {
+// It returns a userVisibleError if ss wasn't attached to the conn: because
+// srv is shutting down, or per TS_SSH_SINGLE_INTERACTIVE_SESSION.
+func (srv *server) attachSessionToConnIfNotShutdown(ss *sshSession) error {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	if srv.shutdownCalled {
 		// Do not start any new sessions.
-		return false
+		return userVisibleError{"Tailscale SSH is shutting down", errDenied}
+	}
+	if ss.interactive && sshSingleInteractiveSession() {
+		if other := srv.interactiveSessionOfLocked(ss.conn.identityKey()); other != nil {
+			ss.logf("refusing interactive session; %v already has one: %v", ss.conn.identityKey(), other.sharedID)
+			srv.addMetric(metricDuplicateSessions, 1)
+			return userVisibleError{"You already have an interactive session on this host; only one is allowed at a time", errDenied}
+		}
 	}
 	ss.conn.attachSession(ss)
-	return true
+	return nil
+}
+
+// interactiveSessionOfLocked returns an active interactive session of the
+// identity with the provided identityKey, or nil if there's none. srv.mu
+// must be held.
+func (srv *server) interactiveSessionOfLocked(identityKey string) *sshSession {
+	for c := range srv.activeConns {
+		if c.info == nil || c.identityKey() != identityKey {
+			continue
+		}
+		c.mu.Lock()
+		i := slices.IndexFunc(c.sessions, func(ss *sshSession) bool { return ss.interactive })
+		var ss *sshSession
+		if i >= 0 {
+			ss = c.sessions[i]
+		}
+		c.mu.Unlock()
+		if ss != nil {
+			return ss
+		}
+	}
+	return nil
 }
 
 func (srv *server) trackActiveConn(c *conn, add bool) {
@@ -150,18 +584,134 @@ func (srv *server) NumActiveConns() int {
 	return len(srv.activeConns)
 }
 
+// ActiveSessionsBySSHUser returns the number of active SSH sessions keyed by
+// the ssh-user requested by the client (before any mapping to a local user).
+// Users without active sessions are omitted.
+func (srv *server) ActiveSessionsBySSHUser() map[string]int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	m := map[string]int{}
+	for c := range srv.activeConns {
+		c.mu.Lock()
+		for _, ss := range c.sessions {
+			m[ss.conn.info.sshUser]++
+		}
+		c.mu.Unlock()
+	}
+	return m
+}
+
+// ConnAction returns the action that the active connection with the
+// provided connID was resolved to, after any HoldAndDelegate resolution,
+// with the URLs in it redacted. It reports false if there's no such
+// connection with active sessions.
+func (srv *server) ConnAction(connID string) (_ apitype.SSHConnAction, ok bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.activeConns {
+		if c.connID != connID {
+			continue
+		}
+		// The action fields are set during auth, which has completed once
+		// the conn has sessions.
+		c.mu.Lock()
+		hasSessions := len(c.sessions) > 0
+		c.mu.Unlock()
+		if !hasSessions || c.finalAction == nil {
+			return apitype.SSHConnAction{}, false
+		}
+		return apitype.SSHConnAction{
+			ConnectionID: c.connID,
+			SSHUser:      c.info.sshUser,
+			LocalUser:    c.localUser.Username,
+			Delegated:    c.action0 != c.finalAction,
+			Action:       redactActionURLs(c.finalAction),
+		}, true
+	}
+	return apitype.SSHConnAction{}, false
+}
+
+// ActiveSessions returns the active SSH sessions, including the status of
+// their recordings, sorted by session ID.
+func (srv *server) ActiveSessions() []apitype.SSHSession {
+	srv.mu.Lock()
+	var sessions []*sshSession
+	for c := range srv.activeConns {
+		c.mu.Lock()
+		sessions = append(sessions, c.sessions...)
+		c.mu.Unlock()
+	}
+	srv.mu.Unlock()
+
+	// The recording status is read without holding srv.mu, as it waits
+	// for any write to the recording in progress.
+	ret := make([]apitype.SSHSession, 0, len(sessions))
+	for _, ss := range sessions {
+		c := ss.conn
+		as := apitype.SSHSession{
+			SessionID:    ss.sharedID,
+			ConnectionID: c.connID,
+			SSHUser:      c.info.sshUser,
+			Recording:    ss.recordingStatus(),
+		}
+		if c.localUser != nil {
+			as.LocalUser = c.localUser.Username
+		}
+		ret = append(ret, as)
+	}
+	slices.SortFunc(ret, func(a, b apitype.SSHSession) int {
+		return strings.Compare(a.SessionID, b.SessionID)
+	})
+	return ret
+}
+
+// redactActionURLs returns a copy of a with the URLs in it, which may
+// contain secrets, replaced by "redacted".
+func redactActionURLs(a *tailcfg.SSHAction) *tailcfg.SSHAction {
+	a = a.Clone()
+	redact := func(s *string) {
+		if *s != "" {
+			*s = "redacted"
+		}
+	}
+	redact(&a.HoldAndDelegate)
+	redact(&a.NotifyCommandURL)
+	if a.OnRecordingFailure != nil {
+		redact(&a.OnRecordingFailure.NotifyURL)
+	}
+	for _, sink := range a.RecordingSinks {
+		if sink.OnRecordingFailure != nil {
+			redact(&sink.OnRecordingFailure.NotifyURL)
+		}
+	}
+	return a
+}
+
 // HandleSSHConn handles a Tailscale SSH connection from c.
 // This is the entry point for all SSH connections.
 // When this returns, the connection is closed.
 func (srv *server) HandleSSHConn(nc net.Conn) error {
-	metricIncomingConnections.Add(1)
+	srv.addMetric(metricIncomingConnections, 1)
 	c, err := srv.newConn()
 	if err != nil {
 		return err
 	}
 	srv.trackActiveConn(c, true)        // add
 	defer srv.trackActiveConn(c, false) // remove
+	if d := sshMaxConnLifetime(); d > 0 {
+		t := time.AfterFunc(d, func() { c.expire(d, nc) })
+		defer t.Stop()
+		for _, left := range connExpiryWarnings(d) {
+			w := time.AfterFunc(d-left, func() { c.warnExpiry(left) })
+			defer w.Stop()
+		}
+	}
 	c.HandleConn(nc)
+	c.mu.Lock()
+	c.handled = true
+	c.stopIdleTimerLocked()
+	c.mu.Unlock()
+	c.closeRemoteForwards()
 
 	// Return nil to signal to netstack's interception that it doesn't need to
 	// log. If ss.HandleConn had problems, it can log itself (ideally on an
@@ -171,18 +721,49 @@ func (srv *server) HandleSSHConn(nc net.Conn) error {
 
 // Shutdown terminates all active sessions.
 func (srv *server) Shutdown() {
+	srv.stopPolicyReloadOnSIGHUP()
+
 	srv.mu.Lock()
 	srv.shutdownCalled = true
+	recs := make([]*recording, 0, len(srv.recordings))
+	for r := range srv.recordings {
+		recs = append(recs, r)
+	}
+	srv.mu.Unlock()
+
+	// Finalize recordings before closing the connections, so that they
+	// end cleanly rather than with whatever the sessions were doing when
+	// torn down.
+	var wg sync.WaitGroup
+	for _, r := range recs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.finalize("tailscaled shutdown")
+		}()
+	}
+	wg.Wait()
+
+	srv.mu.Lock()
 	for c := range srv.activeConns {
 		c.Close()
 	}
 	srv.mu.Unlock()
 	srv.sessionWaitGroup.Wait()
+
+	srv.mu.Lock()
+	sl := srv.syslog
+	srv.syslog = nil
+	srv.mu.Unlock()
+	if sl != nil {
+		sl.close()
+	}
 }
 
 // OnPolicyChange terminates any active sessions that no longer match
 // the SSH access policy.
 func (srv *server) OnPolicyChange() {
+	srv.acceptCache.clear()
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	for c := range srv.activeConns {
@@ -205,6 +786,8 @@ func (srv *server) OnPolicyChange() {
 // Do the user auth
 //   - NoClientAuthHandler
 //   - PublicKeyHandler (only if NoClientAuthHandler returns errPubKeyRequired)
+//   - KeyboardInteractiveHandler (only if NoClientAuthHandler returns
+//     errConfirmationRequired or errKeyboardInteractiveRequired)
 //
 // Once auth is done, the conn can be multiplexed with multiple sessions and
 // channels concurrently. At which point any of the following can be called
@@ -229,36 +812,127 @@ type conn struct {
 	// accept any password in the PasswordHandler.
 	anyPasswordIsOkay bool // set by NoClientAuthCallback
 
+	// confirmationPending is whether the client is authorized but must
+	// still answer the final action's ConfirmationPrompt with
+	// keyboard-interactive auth before being accepted.
+	confirmationPending bool // set by NoClientAuthCallback and PublicKeyHandler
+
+	// challengePending is whether the client is authorized but must still
+	// answer an empty keyboard-interactive challenge, in place of "none"
+	// auth succeeding; see sshKeyboardInteractiveAuth.
+	challengePending bool // set by NoClientAuthCallback
+
 	action0        *tailcfg.SSHAction // set by doPolicyAuth; first matching action
+	ruleIndex      int                // set by doPolicyAuth; index in SSHPolicy.Rules of action0's rule
 	currentAction  *tailcfg.SSHAction // set by doPolicyAuth, updated by resolveNextAction
 	finalAction    *tailcfg.SSHAction // set by doPolicyAuth or resolveNextAction
 	finalActionErr error              // set by doPolicyAuth or resolveNextAction
 
 	info         *sshConnInfo    // set by setInfo
+	nodeKey      key.NodePublic  // set by setInfo; this node's key then, or zero
 	localUser    *userMeta       // set by doPolicyAuth
 	userGroupIDs []string        // set by doPolicyAuth
 	pubKey       gossh.PublicKey // set by doPolicyAuth
 
+	// denialCounted is whether the connection has been counted in
+	// metricDenials. Clients commonly retry denied connections with
+	// several auth methods, each denied again.
+	denialCounted bool
+
+	// acceptLogSampledOut is whether the routine accept logs of the
+	// connection are skipped, per TS_SSH_ACCEPT_LOG_SAMPLE.
+	acceptLogSampledOut bool // set by setInfo
+
+	delegateHops int // HoldAndDelegate actions followed by resolveNextAction
+
+	// recordingPolicyOnce guards recordingPol, the SSH policy that the
+	// recorder groups of the connection's sessions are resolved in. It's
+	// read once, as reading a debug policy file on every call to
+	// recordingSinks would be wasteful.
+	recordingPolicyOnce sync.Once
+	recordingPol        *tailcfg.SSHPolicy // or nil
+
 	// mu protects the following fields.
 	//
 	// srv.mu should be acquired prior to mu.
 	// It is safe to just acquire mu, but unsafe to
 	// acquire mu and then srv.mu.
-	mu       sync.Mutex // protects the following
-	sessions []*sshSession
+	mu          sync.Mutex // protects the following
+	sessions    []*sshSession
+	numChannels int         // open channels of any type; see reserveChannel
+	idleTimer   *time.Timer // or nil; runs while there are no channels, per TS_SSH_IDLE_CONN_TIMEOUT
+	idleGen     uint64      // incremented for each idleTimer started
+	handled     bool        // HandleConn returned; the connection is closed
+
+	// remoteForwards are the listeners of the remote port forwards requested
+	// with "tcpip-forward", keyed by the requested bind address joined with
+	// the bound port.
+	remoteForwards map[string]net.Listener
+}
+
+// Log levels for TS_SSH_LOG_LEVEL. Each level also logs everything logged by
+// the levels below it.
+const (
+	logLevelError   = 1 // failures and denials
+	logLevelInfo    = 2 // connection and session lifecycle; the default
+	logLevelAuth    = 3 // details of auth decisions
+	logLevelVerbose = 4 // everything, as with TS_DEBUG_SSH_VLOG
+)
+
+// sshLogLevel returns the configured log level; see sshLogLevelKnob.
+func sshLogLevel() int {
+	if sshVerboseLogging() {
+		return logLevelVerbose
+	}
+	if l := sshLogLevelKnob(); l > 0 {
+		return min(l, logLevelVerbose)
+	}
+	return logLevelInfo
+}
+
+// atLogLevel returns a logger.Logf that logs to logf only when the
+// configured log level is at least level.
+func atLogLevel(level int, logf logger.Logf) logger.Logf {
+	return func(format string, args ...any) {
+		if sshLogLevel() >= level {
+			logf(format, args...)
+		}
+	}
 }
 
-func (c *conn) logf(format string, args ...any) {
+func (c *conn) logAt(level int, format string, args ...any) {
+	if sshLogLevel() < level {
+		return
+	}
 	format = fmt.Sprintf("%v: %v", c.connID, format)
 	c.srv.logf(format, args...)
 }
 
-func (c *conn) vlogf(format string, args ...any) {
-	if sshVerboseLogging() {
+func (c *conn) errf(format string, args ...any)  { c.logAt(logLevelError, format, args...) }
+func (c *conn) logf(format string, args ...any)  { c.logAt(logLevelInfo, format, args...) }
+func (c *conn) authf(format string, args ...any) { c.logAt(logLevelAuth, format, args...) }
+func (c *conn) vlogf(format string, args ...any) { c.logAt(logLevelVerbose, format, args...) }
+
+// acceptLogf is like logf, for the routine logs of accepting c and starting
+// its sessions, which are skipped if c was sampled out by
+// TS_SSH_ACCEPT_LOG_SAMPLE.
+func (c *conn) acceptLogf(format string, args ...any) {
+	if !c.acceptLogSampledOut {
 		c.logf(format, args...)
 	}
 }
 
+// sampleAcceptLogs decides whether c gets routine accept logs, per
+// TS_SSH_ACCEPT_LOG_SAMPLE: the first of every N connections does.
+func (c *conn) sampleAcceptLogs() {
+	n := sshAcceptLogSample()
+	if n <= 1 {
+		return
+	}
+	seq := c.srv.acceptLogSeq.Add(1) - 1
+	c.acceptLogSampledOut = seq%uint64(n) != 0
+}
+
 // isAuthorized walks through the action chain and returns nil if the connection
 // is authorized. If the connection is not authorized, it returns
 // errDenied. If the action chain resolution fails, it returns the
@@ -267,21 +941,38 @@ func (c *conn) isAuthorized(ctx ssh.Context) error {
 	action := c.currentAction
 	for {
 		if action.Accept {
+			if action.ProxyTo != "" && action.ForceCommand != nil {
+				// Proxied sessions run whatever the client requests
+				// on the target, so the forced command couldn't be
+				// enforced.
+				c.errf("denying: action has both ProxyTo and ForceCommand")
+				c.sendDenialBanner(ctx, denyRejected)
+				return errDenied
+			}
 			if c.pubKey != nil {
-				metricPublicKeyAccepts.Add(1)
+				c.srv.addMetric(metricPublicKeyAccepts, 1)
+			}
+			if sshCapabilityBanner() {
+				if err := c.sendAuthBanner(ctx, c.capabilitySummary()); err != nil {
+					return err
+				}
 			}
 			return nil
 		}
 		if action.Reject || action.HoldAndDelegate == "" {
+			c.sendDenialBanner(ctx, denyRejected)
 			return errDenied
 		}
 		var err error
 		action, err = c.resolveNextAction(ctx)
 		if err != nil {
+			if errors.Is(err, errDelegateHopLimit) {
+				c.sendDenialBanner(ctx, denyDelegateHops)
+			}
 			return err
 		}
 		if action.Message != "" {
-			if err := ctx.SendAuthBanner(action.Message); err != nil {
+			if err := c.sendAuthBanner(ctx, action.Message); err != nil {
 				return err
 			}
 		}
@@ -292,10 +983,156 @@ func (c *conn) isAuthorized(ctx ssh.Context) error {
 // policy.
 var errDenied = errors.New("ssh: access denied")
 
+// Denial reason codes are sent to clients in the auth banner of denied
+// connections (as "tailscale: access denied [code=no_match]") so that tooling
+// can tell the denials apart. They are part of the user-visible interface and
+// must not change.
+const (
+	denyNoPolicy     = "no_policy"     // SSH is disabled or the node has no SSH policy
+	denyNoMatch      = "no_match"      // no rule applies to the connecting identity
+	denyRuleExpired  = "rule_expired"  // the only rules that applied have expired
+	denyUserMismatch = "user_mismatch" // rules apply, but not for the requested ssh-user
+	denyRejected     = "rejected"      // the matching rule (or a delegate) rejected it
+	denyDelegateHops = "delegate_hops" // delegates delegated more than sshMaxDelegateHops times
+	denyHookTimeout  = "hook_timeout"  // a dependency of auth took longer than sshAcceptHookTimeout
+	denyStaleNetMap  = "stale_netmap"  // control hasn't been heard from in sshMaxNetMapAge
+	denySameUser     = "same_user"     // tailscaled isn't root and the local user isn't its own, per sshSameUserOnly
+	denyHostUser     = "host_user"     // the host doesn't allow the local user, per sshAllowedLocalUsers or sshDeniedLocalUsers
+)
+
+// denialError is the error returned by evaluatePolicy when no rule accepts a
+// connection. code is one of the deny* reason codes.
+type denialError struct {
+	code string
+	msg  string
+}
+
+func (e *denialError) Error() string { return "tailssh: rejecting connection; " + e.msg }
+
+// readOnlyBanner is the auth banner sent to accepted connections while
+// TS_SSH_READ_ONLY is set.
+const readOnlyBanner = "tailscale: this node is in read-only maintenance mode; port forwarding, agent forwarding, X11 forwarding and SFTP writes are disabled\r\n"
+
+// capabilitySummary returns the auth banner sent to accepted connections
+// while TS_SSH_CAPABILITY_BANNER is set. It lists what c.finalAction allows,
+// as limited by the server's knobs, so that users needn't guess why
+// something like port forwarding fails.
+func (c *conn) capabilitySummary() string {
+	a := c.finalAction
+	noForwarding := sshDisableForwarding() || sshReadOnly()
+	var allowed []string
+	if !noForwarding && allowsTCPForwarding(a, tailcfg.SSHTCPForwardingLocal) {
+		allowed = append(allowed, "local port forwarding")
+	}
+	if !noForwarding && allowsTCPForwarding(a, tailcfg.SSHTCPForwardingRemote) {
+		allowed = append(allowed, "remote port forwarding")
+	}
+	if a.AllowAgentForwarding && !sshReadOnly() {
+		allowed = append(allowed, "agent forwarding")
+	}
+	if a.AllowX11Forwarding && !noForwarding && !sshDisableX11() {
+		allowed = append(allowed, "X11 forwarding")
+	}
+	if len(allowed) == 0 {
+		allowed = append(allowed, "no port or agent forwarding")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "tailscale: allowed: %s\r\n", strings.Join(allowed, ", "))
+	if a.SessionDuration > 0 {
+		fmt.Fprintf(&b, "tailscale: sessions end after %v\r\n", a.SessionDuration)
+	}
+	if a.IdleTimeout > 0 {
+		fmt.Fprintf(&b, "tailscale: sessions end after %v idle\r\n", a.IdleTimeout)
+	}
+	if len(c.recordingSinks()) > 0 || recordSSHToLocalDisk() || c.srv.testRecordingSink != nil {
+		b.WriteString("tailscale: sessions are recorded\r\n")
+	}
+	return b.String()
+}
+
+// defaultMaxBannerLen is the default maximum length of auth banners; see
+// sshMaxBannerLen. Some clients fail the handshake on much longer ones.
+const defaultMaxBannerLen = 4 << 10
+
+// bannerEllipsis is appended to auth banners truncated by clampBanner.
+const bannerEllipsis = "...\r\n"
+
+// sendAuthBanner sends msg to the client as an auth banner, truncated to
+// TS_SSH_MAX_BANNER_LEN bytes.
+func (c *conn) sendAuthBanner(ctx ssh.Context, msg string) error {
+	maxLen := sshMaxBannerLen()
+	if maxLen <= 0 {
+		maxLen = defaultMaxBannerLen
+	}
+	if clamped := clampBanner(msg, maxLen); clamped != msg {
+		c.logf("truncating %d byte auth banner to %d bytes", len(msg), len(clamped))
+		c.srv.addMetric(metricBannerTruncated, 1)
+		msg = clamped
+	}
+	return ctx.SendAuthBanner(msg)
+}
+
+// clampBanner returns msg if it is at most maxLen bytes long. Otherwise, it
+// returns as much of msg as fits in maxLen bytes followed by bannerEllipsis,
+// without splitting a UTF-8 sequence.
+func clampBanner(msg string, maxLen int) string {
+	if len(msg) <= maxLen {
+		return msg
+	}
+	n := max(maxLen-len(bannerEllipsis), 0)
+	for n > 0 && !utf8.RuneStart(msg[n]) {
+		n--
+	}
+	return msg[:n] + bannerEllipsis
+}
+
+// sendDenialBanner sends the client an auth banner saying that the connection
+// was denied, with the provided deny* reason code. It also counts the denial
+// in metricDenials, once per connection.
+//
+// If TS_DEBUG_SSH_DENIAL_LINGER is set, it then waits that long before
+// returning, so that the client has time to display the banner.
+func (c *conn) sendDenialBanner(ctx ssh.Context, code string) {
+	if !c.denialCounted {
+		c.denialCounted = true
+		if m, ok := metricDenials[code]; ok {
+			c.srv.addMetric(m, 1)
+		}
+		who := "connection"
+		if c.info != nil {
+			who = c.info.String()
+		}
+		c.errf("access denied to %v [code=%s]", who, code)
+	}
+	if err := c.sendAuthBanner(ctx, fmt.Sprintf("tailscale: access denied [code=%s]\r\n", code)); err != nil {
+		c.vlogf("failed to send denial banner: %v", err)
+		return
+	}
+	if d := sshDenialLinger(); d > 0 {
+		c.vlogf("lingering %v after denial", d)
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
 // errPubKeyRequired is returned by NoClientAuthCallback to make the client
 // resort to public-key auth; not user visible.
 var errPubKeyRequired = errors.New("ssh publickey required")
 
+// errConfirmationRequired is returned by NoClientAuthCallback and
+// PublicKeyHandler to make the client answer the ConfirmationPrompt with
+// keyboard-interactive auth; not user visible.
+var errConfirmationRequired = errors.New("ssh confirmation required")
+
+// errKeyboardInteractiveRequired is returned by NoClientAuthCallback to make
+// the client answer an empty keyboard-interactive challenge, if
+// sshKeyboardInteractiveAuth is set; not user visible.
+var errKeyboardInteractiveRequired = errors.New("ssh keyboard-interactive required")
+
 // NoClientAuthCallback implements gossh.NoClientAuthCallback and is called by
 // the ssh.Server when the client first connects with the "none"
 // authentication method.
@@ -308,14 +1145,23 @@ func (c *conn) isAuthorized(ctx ssh.Context) error {
 // (reject). The errors may be wrapped.
 func (c *conn) NoClientAuthCallback(ctx ssh.Context) error {
 	if c.insecureSkipTailscaleAuth {
+		c.clearHandshakeDeadline(ctx)
 		return nil
 	}
+	// Clients may retry "none" auth. Only the latest attempt counts, so
+	// that a password can't be accepted on the strength of an earlier
+	// attempt that the policy has since stopped authorizing.
+	c.anyPasswordIsOkay = false
+	c.challengePending = false
 	if err := c.doPolicyAuth(ctx, nil /* no pub key */); err != nil {
 		return err
 	}
 	if err := c.isAuthorized(ctx); err != nil {
 		return err
 	}
+	if c.needsConfirmation() {
+		return errConfirmationRequired
+	}
 
 	// Let users specify a username ending in +password to force password auth.
 	// This exists for buggy SSH clients that get confused by success from
@@ -324,11 +1170,18 @@ func (c *conn) NoClientAuthCallback(ctx ssh.Context) error {
 		c.anyPasswordIsOkay = true
 		return errors.New("any password please") // not shown to users
 	}
+	if sshKeyboardInteractiveAuth() {
+		c.challengePending = true
+		return errKeyboardInteractiveRequired
+	}
+	c.setContextValues(ctx)
 	return nil
 }
 
 func (c *conn) nextAuthMethodCallback(cm gossh.ConnMetadata, prevErrors []error) (nextMethod []string) {
 	switch {
+	case c.confirmationPending, c.challengePending:
+		nextMethod = append(nextMethod, "keyboard-interactive")
 	case c.anyPasswordIsOkay:
 		nextMethod = append(nextMethod, "password")
 	case len(prevErrors) > 0 && prevErrors[len(prevErrors)-1] == errPubKeyRequired:
@@ -348,25 +1201,144 @@ func (c *conn) nextAuthMethodCallback(cm gossh.ConnMetadata, prevErrors []error)
 // "none" succeeding and they want our SSH server to require a dummy password
 // prompt instead. We then accept any password since we've already authenticated
 // & authorized them.
+//
+// The connection then proceeds exactly as if "none" auth had succeeded: it
+// has the same identity, final action and context values, so its sessions
+// are recorded and can be terminated by policy changes just the same.
 func (c *conn) fakePasswordHandler(ctx ssh.Context, password string) bool {
-	return c.anyPasswordIsOkay
+	if !c.anyPasswordIsOkay || c.finalAction == nil || !c.finalAction.Accept {
+		return false
+	}
+	c.setContextValues(ctx)
+	return true
+}
+
+// needsConfirmation reports whether the final action requires the user to
+// answer a ConfirmationPrompt before being accepted, and records that in
+// c.confirmationPending. It must only be called once the connection has been
+// authorized.
+func (c *conn) needsConfirmation() bool {
+	c.confirmationPending = c.finalAction != nil && c.finalAction.ConfirmationPrompt != ""
+	return c.confirmationPending
+}
+
+// confirmationHandler is our implementation of the KeyboardInteractiveHandler
+// hook. It asks the user the final action's ConfirmationPrompt, and accepts
+// the connection if the answer matches its ConfirmationResponse.
+//
+// If sshKeyboardInteractiveAuth made the client use keyboard-interactive
+// auth instead, it sends a challenge without questions and accepts the
+// connection, which is already authorized, whatever the answer.
+func (c *conn) confirmationHandler(ctx ssh.Context, challenge gossh.KeyboardInteractiveChallenge) bool {
+	if c.challengePending {
+		if c.finalAction == nil || !c.finalAction.Accept {
+			return false
+		}
+		if _, err := challenge("Tailscale SSH", "Authenticated by Tailscale identity.", nil, nil); err != nil {
+			c.errf("keyboard-interactive challenge failed: %v", err)
+			return false
+		}
+		c.challengePending = false
+		c.setContextValues(ctx)
+		return true
+	}
+	if !c.confirmationPending {
+		return false
+	}
+	a := c.finalAction
+	answers, err := challenge("Tailscale SSH", "", []string{a.ConfirmationPrompt}, []bool{true})
+	if err != nil {
+		c.errf("confirmation prompt failed: %v", err)
+		return false
+	}
+	if len(answers) != 1 || answers[0] != a.ConfirmationResponse {
+		c.errf("denying connection: confirmation prompt not confirmed")
+		c.srv.addMetric(metricConfirmationDenied, 1)
+		return false
+	}
+	c.confirmationPending = false
+	c.setContextValues(ctx)
+	return true
 }
 
 // PublicKeyHandler implements ssh.PublicKeyHandler is called by the
 // ssh.Server when the client presents a public key.
 func (c *conn) PublicKeyHandler(ctx ssh.Context, pubKey ssh.PublicKey) error {
+	// The ServerConfig's PublicKeyAuthAlgorithms already limits the
+	// signature algorithms, but not to none if none were valid.
+	if !pubKeyAlgorithmAllowed(pubKeyType(pubKey), sshAllowedPubKeyAlgos()) {
+		c.errf("rejecting SSH public key of disallowed type %q", pubKey.Type())
+		c.srv.addMetric(metricPubKeyAlgoDenied, 1)
+		return fmt.Errorf("%w: public key type %q not allowed", errDenied, pubKey.Type())
+	}
 	if err := c.doPolicyAuth(ctx, pubKey); err != nil {
 		// TODO(maisem/bradfitz): surface the error here.
-		c.logf("rejecting SSH public key %s: %v", bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)), err)
+		c.errf("rejecting SSH public key %s: %v", bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)), err)
 		return err
 	}
 	if err := c.isAuthorized(ctx); err != nil {
 		return err
 	}
+	if c.needsConfirmation() {
+		return errConfirmationRequired
+	}
 	c.logf("accepting SSH public key %s", bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)))
+	c.setContextValues(ctx)
 	return nil
 }
 
+// pubKeyAlgorithmAllowed reports whether a client public key of type keyType
+// may sign with any of the public key authentication algorithms in allowed,
+// a comma-separated list. An empty allowed permits all types.
+func pubKeyAlgorithmAllowed(keyType, allowed string) bool {
+	if strings.TrimSpace(allowed) == "" {
+		return true
+	}
+	for _, algo := range strings.Split(allowed, ",") {
+		algo = strings.TrimSpace(algo)
+		if algo == keyType {
+			return true
+		}
+		if keyType == gossh.KeyAlgoRSA && (algo == gossh.KeyAlgoRSASHA256 || algo == gossh.KeyAlgoRSASHA512) {
+			return true
+		}
+	}
+	return false
+}
+
+// pubKeyType returns the type of pubKey or, for a certificate, of its key.
+func pubKeyType(pubKey ssh.PublicKey) string {
+	if cert, ok := pubKey.(*gossh.Certificate); ok {
+		return cert.Key.Type()
+	}
+	return pubKey.Type()
+}
+
+// knownPubKeyAuthAlgorithms are the public key authentication algorithms
+// that gossh supports, which are all that
+// gossh.ServerConfig.PublicKeyAuthAlgorithms may have.
+var knownPubKeyAuthAlgorithms = []string{
+	gossh.KeyAlgoED25519,
+	gossh.KeyAlgoSKED25519, gossh.KeyAlgoSKECDSA256,
+	gossh.KeyAlgoECDSA256, gossh.KeyAlgoECDSA384, gossh.KeyAlgoECDSA521,
+	gossh.KeyAlgoRSASHA256, gossh.KeyAlgoRSASHA512, gossh.KeyAlgoRSA,
+	gossh.KeyAlgoDSA,
+}
+
+// pubKeyAuthAlgorithms returns the public key authentication algorithms in
+// allowed, a comma-separated list, that gossh supports, for
+// gossh.ServerConfig.PublicKeyAuthAlgorithms. It returns nil, for all of
+// them, if allowed is empty.
+func pubKeyAuthAlgorithms(allowed string) []string {
+	var algos []string
+	for _, algo := range strings.Split(allowed, ",") {
+		if algo = strings.TrimSpace(algo); slices.Contains(knownPubKeyAuthAlgorithms, algo) {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
 // doPolicyAuth verifies that conn can proceed with the specified (optional)
 // pubKey. It returns nil if the matching policy action is Accept or
 // HoldAndDelegate. If pubKey is nil, there was no policy match but there is a
@@ -374,45 +1346,85 @@ func (c *conn) PublicKeyHandler(ctx ssh.Context, pubKey ssh.PublicKey) error {
 // it returns errDenied.
 func (c *conn) doPolicyAuth(ctx ssh.Context, pubKey ssh.PublicKey) error {
 	if err := c.setInfo(ctx); err != nil {
-		c.logf("failed to get conninfo: %v", err)
+		c.errf("failed to get conninfo: %v", err)
+		if errors.Is(err, errAcceptHookTimeout) {
+			c.sendDenialBanner(ctx, denyHookTimeout)
+		}
 		return errDenied
 	}
-	a, localUser, err := c.evaluatePolicy(pubKey)
+	a, localUser, ruleIndex, err := c.evaluatePolicy(pubKey)
 	if err != nil {
+		c.authf("policy denied %v (pubkey=%v): %v", c.info, pubKey != nil, err)
 		if pubKey == nil && c.havePubKeyPolicy() {
 			return errPubKeyRequired
 		}
+		if de, ok := err.(*denialError); ok {
+			c.sendDenialBanner(ctx, de.code)
+		}
 		return fmt.Errorf("%w: %v", errDenied, err)
 	}
+	c.authf("policy matched %v (pubkey=%v): rule=%d local-user=%q accept=%v reject=%v delegated=%v", c.info, pubKey != nil, ruleIndex, localUser, a.Accept, a.Reject, a.HoldAndDelegate != "")
 	c.action0 = a
+	c.ruleIndex = ruleIndex
 	c.currentAction = a
 	c.pubKey = pubKey
 	if a.Message != "" {
-		if err := ctx.SendAuthBanner(a.Message); err != nil {
+		if err := c.sendAuthBanner(ctx, a.Message); err != nil {
 			return fmt.Errorf("SendBanner: %w", err)
 		}
 	}
 	if a.Accept || a.HoldAndDelegate != "" {
+		if err := c.runAcceptHook(ctx); err != nil {
+			c.authf("accept hook denied %v: %v", c.info, err)
+			if errors.Is(err, errAcceptHookTimeout) {
+				c.sendDenialBanner(ctx, denyHookTimeout)
+			} else {
+				c.sendDenialBanner(ctx, denyRejected)
+			}
+			return fmt.Errorf("%w: %v", errDenied, err)
+		}
 		if a.Accept {
 			c.finalAction = a
 		}
-		lu, err := userLookup(localUser)
+		if sshReadOnly() {
+			if err := c.sendAuthBanner(ctx, readOnlyBanner); err != nil {
+				return fmt.Errorf("SendBanner: %w", err)
+			}
+		}
+		lu, err := lookupLocalUser(localUser)
 		if err != nil {
-			c.logf("failed to look up %v: %v", localUser, err)
-			ctx.SendAuthBanner(fmt.Sprintf("failed to look up %v\r\n", localUser))
+			c.errf("failed to look up %v: %v", localUser, err)
+			c.sendAuthBanner(ctx, fmt.Sprintf("failed to look up %v\r\n", localUser))
 			return err
 		}
+		if !localUserAllowed(lu, sshAllowedLocalUsers(), sshDeniedLocalUsers()) {
+			c.authf("denying local user %q; not allowed on this host", lu.Username)
+			c.sendDenialBanner(ctx, denyHostUser)
+			c.sendAuthBanner(ctx, fmt.Sprintf("tailscale: this host doesn't allow logging in as local user %q\r\n", lu.Username))
+			return errDenied
+		}
+		if sshSameUserOnly() && !c.srv.canSwitchTo(lu) {
+			c.authf("denying local user %q; tailscaled runs as uid %d, not root", lu.Username, c.srv.euid())
+			c.sendDenialBanner(ctx, denySameUser)
+			c.sendAuthBanner(ctx, c.srv.cantSwitchUserMessage(lu)+"\r\n")
+			return errDenied
+		}
 		gids, err := lu.GroupIds()
 		if err != nil {
-			c.logf("failed to look up local user's group IDs: %v", err)
+			c.errf("failed to look up local user's group IDs: %v", err)
 			return err
 		}
 		c.userGroupIDs = gids
 		c.localUser = lu
+		// The rest of auth may legitimately take a while, such as while
+		// the user follows a HoldAndDelegate URL. It's bounded by
+		// fetchSSHAction's timeout instead.
+		c.clearHandshakeDeadline(ctx)
 		return nil
 	}
 	if a.Reject {
 		c.finalAction = a
+		c.sendDenialBanner(ctx, denyRejected)
 		return errDenied
 	}
 	// Shouldn't get here, but:
@@ -422,8 +1434,9 @@ func (c *conn) doPolicyAuth(ctx ssh.Context, pubKey ssh.PublicKey) error {
 // ServerConfig implements ssh.ServerConfigCallback.
 func (c *conn) ServerConfig(ctx ssh.Context) *gossh.ServerConfig {
 	return &gossh.ServerConfig{
-		NoClientAuth:           true, // required for the NoClientAuthCallback to run
-		NextAuthMethodCallback: c.nextAuthMethodCallback,
+		NoClientAuth:            true, // required for the NoClientAuthCallback to run
+		NextAuthMethodCallback:  c.nextAuthMethodCallback,
+		PublicKeyAuthAlgorithms: pubKeyAuthAlgorithms(sshAllowedPubKeyAlgos()),
 	}
 }
 
@@ -439,40 +1452,51 @@ func (srv *server) newConn() (*conn, error) {
 	srv.mu.Unlock()
 	c := &conn{srv: srv}
 	now := srv.now()
-	c.connID = fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5))
-	fwdHandler := &ssh.ForwardedTCPHandler{}
+	c.connID = decorateID(fmt.Sprintf("ssh-conn-%s-%02x", now.UTC().Format("20060102T150405"), randBytes(5)), "")
 	c.Server = &ssh.Server{
 		Version:              "Tailscale",
 		ServerConfigCallback: c.ServerConfig,
 
+		ConnCallback: c.startHandshakeDeadline,
+
 		NoClientAuthHandler: c.NoClientAuthCallback,
 		PublicKeyHandler:    c.PublicKeyHandler,
 		PasswordHandler:     c.fakePasswordHandler,
 
+		KeyboardInteractiveHandler: c.confirmationHandler,
+
 		Handler:                       c.handleSessionPostSSHAuth,
 		LocalPortForwardingCallback:   c.mayForwardLocalPortTo,
 		ReversePortForwardingCallback: c.mayReversePortForwardTo,
+		X11Callback:                   c.mayForwardX11,
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
 			"sftp": c.handleSessionPostSSHAuth,
 		},
 		// Note: the direct-tcpip channel handler and LocalPortForwardingCallback
-		// only adds support for forwarding ports from the local machine.
-		// TODO(maisem/bradfitz): add remote port forwarding support.
+		// add support for forwarding ports from the local machine, and the
+		// tcpip-forward request handlers for forwarding ports on it back to
+		// the client; see remoteforward.go.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": ssh.DirectTCPIPHandler,
+			"direct-tcpip": c.handleDirectTCPIP,
 		},
 		RequestHandlers: map[string]ssh.RequestHandler{
-			"tcpip-forward":        fwdHandler.HandleSSHRequest,
-			"cancel-tcpip-forward": fwdHandler.HandleSSHRequest,
+			"tcpip-forward":        c.handleTCPIPForward,
+			"cancel-tcpip-forward": c.handleCancelTCPIPForward,
 		},
 	}
 	ss := c.Server
 	for k, v := range ssh.DefaultRequestHandlers {
 		ss.RequestHandlers[k] = v
 	}
+	if allowed := sshAllowedRequestTypes(); allowed != "" {
+		restrictRequestHandlers(ss.RequestHandlers, allowed)
+	}
 	for k, v := range ssh.DefaultChannelHandlers {
 		ss.ChannelHandlers[k] = v
 	}
+	for k, v := range ss.ChannelHandlers {
+		ss.ChannelHandlers[k] = c.limitChannels(v)
+	}
 	for k, v := range ssh.DefaultSubsystemHandlers {
 		ss.SubsystemHandlers[k] = v
 	}
@@ -486,50 +1510,481 @@ func (srv *server) newConn() (*conn, error) {
 	return c, nil
 }
 
-// mayReversePortPortForwardTo reports whether the ctx should be allowed to port forward
-// to the specified host and port.
-// TODO(bradfitz/maisem): should we have more checks on host/port?
-func (c *conn) mayReversePortForwardTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	if sshDisableForwarding() {
+// localUserAllowed reports whether the host allows logging in as the local
+// user lu, per allowed and denied, the values of TS_SSH_ALLOWED_LOCAL_USERS
+// and TS_SSH_DENIED_LOCAL_USERS: comma-separated lists of usernames, or of
+// "=UID" for users by uid. lu is allowed unless it's in denied, or allowed
+// is non-empty and it's not in allowed.
+func localUserAllowed(lu *userMeta, allowed, denied string) bool {
+	in := func(list string) bool {
+		for _, u := range strings.Split(list, ",") {
+			u = strings.TrimSpace(u)
+			if u != "" && (u == lu.Username || u == "="+lu.Uid) {
+				return true
+			}
+		}
 		return false
 	}
-	if c.finalAction != nil && c.finalAction.AllowRemotePortForwarding {
-		metricRemotePortForward.Add(1)
-		return true
+	if in(denied) {
+		return false
 	}
-	return false
+	return strings.TrimSpace(allowed) == "" || in(allowed)
 }
 
-// mayForwardLocalPortTo reports whether the ctx should be allowed to port forward
-// to the specified host and port.
-// TODO(bradfitz/maisem): should we have more checks on host/port?
-func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	if sshDisableForwarding() {
-		return false
-	}
-	if c.finalAction != nil && c.finalAction.AllowLocalPortForwarding {
-		metricLocalPortForward.Add(1)
-		return true
+// restrictRequestHandlers removes the handlers of global request types not
+// in allowed, a comma-separated list, from handlers, so that the server
+// rejects them.
+func restrictRequestHandlers(handlers map[string]ssh.RequestHandler, allowed string) {
+	var types []string
+	for _, typ := range strings.Split(allowed, ",") {
+		types = append(types, strings.TrimSpace(typ))
+	}
+	for typ := range handlers {
+		if !slices.Contains(types, typ) {
+			delete(handlers, typ)
+		}
 	}
-	return false
 }
 
-// havePubKeyPolicy reports whether any policy rule may provide access by means
-// of a ssh.PublicKey.
-func (c *conn) havePubKeyPolicy() bool {
-	if c.info == nil {
-		panic("havePubKeyPolicy called before setInfo")
+const defaultHandshakeTimeout = 2 * time.Minute
+
+// handshakeConnContextKey is the key of the *handshakeDeadlineConn of a
+// connection in its ssh.Context. It's kept there rather than in conn, as the
+// connections handled by a conn needn't be handled one at a time.
+var handshakeConnContextKey = &contextKey{"tailssh-handshake-conn"}
+
+// startHandshakeDeadline implements ssh.ConnCallback. It makes reads from nc
+// fail once the TS_SSH_HANDSHAKE_TIMEOUT has passed, until
+// clearHandshakeDeadline is called with ctx.
+func (c *conn) startHandshakeDeadline(ctx ssh.Context, nc net.Conn) net.Conn {
+	d := sshHandshakeTimeout()
+	if d == 0 {
+		d = defaultHandshakeTimeout
+	}
+	if d < 0 {
+		return nc
+	}
+	hc := &handshakeDeadlineConn{
+		Conn:     nc,
+		deadline: time.Now().Add(d),
+		onTimeout: func(err error) {
+			c.logf("dropping connection that didn't complete the handshake in time: %v", err)
+			c.srv.addMetric(metricHandshakeTimeouts, 1)
+		},
 	}
-	// Is there any rule that looks like it'd require a public key for this
-	// sshUser?
-	pol, ok := c.sshPolicy()
-	if !ok {
-		return false
+	hc.Conn.SetReadDeadline(hc.deadline)
+	ctx.SetValue(handshakeConnContextKey, hc)
+	return hc
+}
+
+// clearHandshakeDeadline removes the deadline set by startHandshakeDeadline
+// on the connection of ctx, if any.
+func (c *conn) clearHandshakeDeadline(ctx ssh.Context) {
+	if hc, ok := ctx.Value(handshakeConnContextKey).(*handshakeDeadlineConn); ok {
+		hc.clear()
 	}
-	for _, r := range pol.Rules {
-		if c.ruleExpired(r) {
-			continue
-		}
+}
+
+// handshakeDeadlineConn is a net.Conn whose reads fail once deadline has
+// passed, regardless of the read deadlines set by its user, until clear is
+// called.
+type handshakeDeadlineConn struct {
+	net.Conn
+
+	timedOut  atomic.Bool     // whether a read failed because of deadline
+	onTimeout func(err error) // called with the error of the first such read
+
+	mu        sync.Mutex
+	deadline  time.Time // or zero once cleared
+	requested time.Time // the read deadline last set by the user
+}
+
+func (hc *handshakeDeadlineConn) Read(p []byte) (int, error) {
+	n, err := hc.Conn.Read(p)
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		hc.mu.Lock()
+		timedOut := !hc.deadline.IsZero() && !time.Now().Before(hc.deadline)
+		hc.mu.Unlock()
+		if timedOut && hc.timedOut.CompareAndSwap(false, true) {
+			hc.onTimeout(err)
+		}
+	}
+	return n, err
+}
+
+func (hc *handshakeDeadlineConn) SetDeadline(t time.Time) error {
+	if err := hc.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return hc.SetReadDeadline(t)
+}
+
+func (hc *handshakeDeadlineConn) SetReadDeadline(t time.Time) error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.requested = t
+	return hc.Conn.SetReadDeadline(hc.readDeadlineLocked())
+}
+
+// readDeadlineLocked returns the earlier of deadline and requested, where
+// zero values mean no deadline.
+func (hc *handshakeDeadlineConn) readDeadlineLocked() time.Time {
+	if hc.deadline.IsZero() || (!hc.requested.IsZero() && hc.requested.Before(hc.deadline)) {
+		return hc.requested
+	}
+	return hc.deadline
+}
+
+func (hc *handshakeDeadlineConn) clear() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if hc.deadline.IsZero() {
+		return
+	}
+	hc.deadline = time.Time{}
+	hc.Conn.SetReadDeadline(hc.requested)
+}
+
+// handleDirectTCPIP handles a "direct-tcpip" (local port forwarding) channel
+// with ssh.DirectTCPIPHandler. If TS_SSH_FORWARD_IDLE_TIMEOUT is set, the
+// channel is closed once it has been idle for that long.
+func (c *conn) handleDirectTCPIP(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	if d := sshForwardIdleTimeout(); d > 0 {
+		newChan = &idleClosingNewChannel{NewChannel: newChan, timeout: d, logf: c.logf, srv: c.srv}
+	}
+	ssh.DirectTCPIPHandler(srv, conn, newChan, ctx)
+}
+
+// idleClosingNewChannel is a gossh.NewChannel whose accepted channel is an
+// idleClosingChannel.
+type idleClosingNewChannel struct {
+	gossh.NewChannel
+	timeout time.Duration
+	logf    logger.Logf
+	srv     *server
+}
+
+func (nc *idleClosingNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := nc.NewChannel.Accept()
+	if err != nil {
+		return ch, reqs, err
+	}
+	ich := &idleClosingChannel{
+		Channel: ch,
+		timeout: nc.timeout,
+		logf:    nc.logf,
+		srv:     nc.srv,
+		start:   time.Now(),
+	}
+	ich.mu.Lock()
+	ich.timer = time.AfterFunc(nc.timeout, ich.checkIdle)
+	ich.mu.Unlock()
+	return ich, reqs, nil
+}
+
+// idleClosingChannel is a gossh.Channel that closes itself once no data has
+// been read from or written to it for timeout.
+type idleClosingChannel struct {
+	gossh.Channel
+	timeout time.Duration
+	logf    logger.Logf
+	srv     *server
+	start   time.Time
+
+	// lastActive is the time of the last read or write, as a duration
+	// since start.
+	lastActive atomic.Int64
+
+	mu    sync.Mutex
+	timer *time.Timer // fires checkIdle; nil once closed
+}
+
+func (ch *idleClosingChannel) Read(p []byte) (int, error) {
+	n, err := ch.Channel.Read(p)
+	if n > 0 {
+		ch.lastActive.Store(int64(time.Since(ch.start)))
+	}
+	return n, err
+}
+
+func (ch *idleClosingChannel) Write(p []byte) (int, error) {
+	n, err := ch.Channel.Write(p)
+	if n > 0 {
+		ch.lastActive.Store(int64(time.Since(ch.start)))
+	}
+	return n, err
+}
+
+func (ch *idleClosingChannel) Close() error {
+	ch.mu.Lock()
+	if ch.timer != nil {
+		ch.timer.Stop()
+		ch.timer = nil
+	}
+	ch.mu.Unlock()
+	return ch.Channel.Close()
+}
+
+// checkIdle closes ch if it has been idle for at least ch.timeout, and
+// otherwise rearms ch.timer for when it would be.
+func (ch *idleClosingChannel) checkIdle() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.timer == nil {
+		return
+	}
+	idle := time.Since(ch.start) - time.Duration(ch.lastActive.Load())
+	if idle < ch.timeout {
+		ch.timer.Reset(ch.timeout - idle)
+		return
+	}
+	ch.timer = nil
+	ch.logf("closing local port forward idle for %v", idle.Round(time.Millisecond))
+	ch.srv.addMetric(metricIdleForwardClosed, 1)
+	ch.Channel.Close()
+}
+
+// defaultMaxChannelsPerConn is the default maximum number of open channels
+// per connection; see sshMaxChannelsPerConn.
+const defaultMaxChannelsPerConn = 128
+
+// reserveChannel reserves one of the connection's channel slots for a new
+// channel of type typ. If the connection is at its limit, it reports false.
+// Otherwise, the returned func releases the slot; it may be called more than
+// once.
+func (c *conn) reserveChannel(typ string) (release func(), ok bool) {
+	max := sshMaxChannelsPerConn()
+	if max == 0 {
+		max = defaultMaxChannelsPerConn
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.numChannels >= max {
+		c.errf("rejecting %s channel: %d channels already open", typ, c.numChannels)
+		c.srv.addMetric(metricChannelsRejected, 1)
+		return nil, false
+	}
+	c.numChannels++
+	c.stopIdleTimerLocked()
+	return sync.OnceFunc(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.numChannels--
+		if c.idleLocked() {
+			c.startIdleTimerLocked()
+		}
+	}), true
+}
+
+// idleLocked reports whether c has no open channels or remote port forward
+// listeners. c.mu must be held.
+func (c *conn) idleLocked() bool {
+	return c.numChannels == 0 && len(c.remoteForwards) == 0
+}
+
+// stopIdleTimerLocked stops the timer started by startIdleTimerLocked, if
+// running. c.mu must be held.
+func (c *conn) stopIdleTimerLocked() {
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+}
+
+// startIdleTimerLocked starts the timer closing c once it has had no open
+// channels or remote port forwards for TS_SSH_IDLE_CONN_TIMEOUT, if set.
+// c.mu must be held.
+func (c *conn) startIdleTimerLocked() {
+	d := sshIdleConnTimeout()
+	if d <= 0 || c.handled || c.idleTimer != nil {
+		return
+	}
+	c.idleGen++
+	gen := c.idleGen
+	c.idleTimer = time.AfterFunc(d, func() { c.reapIfIdle(gen, d) })
+}
+
+// reapIfIdle closes c if it still has no open channels since its idle timer
+// of generation gen started, d ago. As the SSH protocol has no way to show a
+// message to a client outside of auth and channels, the reason is only
+// logged.
+func (c *conn) reapIfIdle(gen uint64, d time.Duration) {
+	c.mu.Lock()
+	if c.idleTimer == nil || c.idleGen != gen || !c.idleLocked() || c.handled {
+		c.mu.Unlock()
+		return
+	}
+	c.idleTimer = nil
+	c.mu.Unlock()
+	c.srv.addMetric(metricIdleConnReaped, 1)
+	c.logf("connection idle with no sessions for %v; closing", d)
+	c.Close()
+}
+
+// limitChannels returns a ssh.ChannelHandler that runs h for new channels
+// while the connection has a free channel slot, and otherwise rejects them.
+func (c *conn) limitChannels(h ssh.ChannelHandler) ssh.ChannelHandler {
+	return func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+		release, ok := c.reserveChannel(newChan.ChannelType())
+		if !ok {
+			newChan.Reject(gossh.ResourceShortage, "too many open channels")
+			return
+		}
+		nc := &countedNewChannel{NewChannel: newChan, release: release, handled: make(chan struct{})}
+		h(srv, conn, nc, ctx)
+		close(nc.handled)
+	}
+}
+
+// countedNewChannel is a gossh.NewChannel that holds one of its connection's
+// channel slots until it's rejected or, once accepted, closed.
+type countedNewChannel struct {
+	gossh.NewChannel
+	release func()
+	handled chan struct{} // closed when the channel's handler returns
+}
+
+func (nc *countedNewChannel) Reject(reason gossh.RejectionReason, message string) error {
+	nc.release()
+	return nc.NewChannel.Reject(reason, message)
+}
+
+func (nc *countedNewChannel) Accept() (gossh.Channel, <-chan *gossh.Request, error) {
+	ch, reqs, err := nc.NewChannel.Accept()
+	if err != nil {
+		nc.release()
+		return ch, reqs, err
+	}
+	// The channel's requests are closed once the channel is closed by
+	// both sides or the connection goes away, whichever of its users
+	// closes it. Requests that nothing reads once the handler returns are
+	// discarded, so that they don't keep the slot held.
+	out := make(chan *gossh.Request)
+	go func() {
+		defer nc.release()
+		defer close(out)
+		for req := range reqs {
+			select {
+			case out <- req:
+			case <-nc.handled:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+		}
+	}()
+	return ch, out, nil
+}
+
+// channelLimitListener is a net.Listener of connections that are each
+// forwarded to the client over a new channel, such as agent connections. It
+// closes accepted connections immediately while the connection is at its
+// channel limit.
+type channelLimitListener struct {
+	net.Listener
+	c   *conn
+	typ string // channel type, for logging
+}
+
+func (ln *channelLimitListener) Accept() (net.Conn, error) {
+	for {
+		nc, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		release, ok := ln.c.reserveChannel(ln.typ)
+		if !ok {
+			nc.Close()
+			continue
+		}
+		return &releasingConn{Conn: nc, release: release}, nil
+	}
+}
+
+// releasingConn is a net.Conn that calls release when closed.
+type releasingConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	defer c.release()
+	return c.Conn.Close()
+}
+
+// CloseWrite shuts down the writing side of the underlying connection, if
+// it supports that, as *net.UnixConn does.
+func (c *releasingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// mayReversePortPortForwardTo reports whether the ctx should be allowed to port forward
+// to the specified host and port.
+// TODO(bradfitz/maisem): should we have more checks on host/port?
+func (c *conn) mayReversePortForwardTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
+	if sshDisableForwarding() || sshReadOnly() {
+		return false
+	}
+	if c.finalAction != nil && allowsTCPForwarding(c.finalAction, tailcfg.SSHTCPForwardingRemote) {
+		return true
+	}
+	return false
+}
+
+// mayForwardLocalPortTo reports whether the ctx should be allowed to port forward
+// to the specified host and port.
+// TODO(bradfitz/maisem): should we have more checks on host/port?
+func (c *conn) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
+	if sshDisableForwarding() || sshReadOnly() {
+		return false
+	}
+	if c.finalAction != nil && allowsTCPForwarding(c.finalAction, tailcfg.SSHTCPForwardingLocal) {
+		c.srv.addMetric(metricLocalPortForward, 1)
+		return true
+	}
+	return false
+}
+
+// allowsTCPForwarding reports whether a allows TCP port forwarding of kind,
+// which is either tailcfg.SSHTCPForwardingLocal or
+// tailcfg.SSHTCPForwardingRemote.
+//
+// a.TCPForwarding takes precedence if set; otherwise, the older
+// AllowLocalPortForwarding and AllowRemotePortForwarding are used.
+func allowsTCPForwarding(a *tailcfg.SSHAction, kind tailcfg.SSHTCPForwarding) bool {
+	switch a.TCPForwarding {
+	case "":
+		if kind == tailcfg.SSHTCPForwardingLocal {
+			return a.AllowLocalPortForwarding
+		}
+		return a.AllowRemotePortForwarding
+	case tailcfg.SSHTCPForwardingAll:
+		return true
+	case tailcfg.SSHTCPForwardingLocal, tailcfg.SSHTCPForwardingRemote:
+		return a.TCPForwarding == kind
+	}
+	return false
+}
+
+// havePubKeyPolicy reports whether any policy rule may provide access by means
+// of a ssh.PublicKey.
+func (c *conn) havePubKeyPolicy() bool {
+	if c.info == nil {
+		panic("havePubKeyPolicy called before setInfo")
+	}
+	// Is there any rule that looks like it'd require a public key for this
+	// sshUser?
+	pol, ok := c.sshPolicy()
+	if !ok {
+		return false
+	}
+	for _, r := range pol.Rules {
+		if c.ruleExpired(r) {
+			continue
+		}
 		if mapLocalUser(r.SSHUsers, c.info.sshUser) == "" {
 			continue
 		}
@@ -546,33 +2001,50 @@ func (c *conn) havePubKeyPolicy() bool {
 // If there is no SSHPolicy in the netmap, it returns a debugPolicy
 // if one is defined.
 func (c *conn) sshPolicy() (_ *tailcfg.SSHPolicy, ok bool) {
-	lb := c.srv.lb
+	ep := c.srv.effectivePolicy(c.logf)
+	if ep.Error != "" {
+		c.errf("error reading debug SSH policy file: %v", ep.Error)
+	}
+	return ep.Policy, ep.Policy != nil
+}
+
+// effectivePolicy returns the SSH policy in effect and where it came from,
+// as used by sshPolicy. It logs to logf before reading the debug policy
+// file.
+func (srv *server) effectivePolicy(logf logger.Logf) apitype.SSHEffectivePolicy {
+	lb := srv.lb
+	ep := apitype.SSHEffectivePolicy{
+		File:                 envknob.SSHPolicyFile(),
+		TailnetPolicyIgnored: envknob.SSHIgnoreTailnetPolicy(),
+	}
 	if !lb.ShouldRunSSH() {
-		return nil, false
+		return ep
 	}
+	ep.Enabled = true
 	nm := lb.NetMap()
 	if nm == nil {
-		return nil, false
+		return ep
 	}
-	if pol := nm.SSHPolicy; pol != nil && !envknob.SSHIgnoreTailnetPolicy() {
-		return pol, true
+	if pol := nm.SSHPolicy; pol != nil && !ep.TailnetPolicyIgnored {
+		ep.Source, ep.Policy = "netmap", pol
+		return ep
 	}
-	debugPolicyFile := envknob.SSHPolicyFile()
-	if debugPolicyFile != "" {
-		c.logf("reading debug SSH policy file: %v", debugPolicyFile)
-		f, err := os.ReadFile(debugPolicyFile)
+	if ep.File != "" {
+		logf("reading debug SSH policy file: %v", ep.File)
+		p, err := ReadPolicyFile(ep.File)
 		if err != nil {
-			c.logf("error reading debug SSH policy file: %v", err)
-			return nil, false
+			ep.Error = err.Error()
+			return ep
 		}
-		p := new(tailcfg.SSHPolicy)
-		if err := json.Unmarshal(f, p); err != nil {
-			c.logf("invalid JSON in %v: %v", debugPolicyFile, err)
-			return nil, false
-		}
-		return p, true
+		ep.Source, ep.Policy = "file", p
 	}
-	return nil, false
+	return ep
+}
+
+// EffectivePolicy returns the SSH policy currently in effect, as resolved
+// for new connections, and where it came from.
+func (srv *server) EffectivePolicy() apitype.SSHEffectivePolicy {
+	return srv.effectivePolicy(logger.Discard)
 }
 
 func toIPPort(a net.Addr) (ipp netip.AddrPort) {
@@ -598,37 +2070,355 @@ func (c *conn) setInfo(ctx ssh.Context) error {
 		src:     toIPPort(ctx.RemoteAddr()),
 		dst:     toIPPort(ctx.LocalAddr()),
 	}
+	// Normalize after trimming forcePasswordSuffix, so that stripping a
+	// domain can't also strip the suffix.
+	if u := normalizeSSHUser(ci.sshUser, sshNormalizeUser()); u != ci.sshUser {
+		c.logf("normalized ssh-user %q to %q", ci.sshUser, u)
+		ci.sshUser = u
+	}
 	if !tsaddr.IsTailscaleIP(ci.dst.Addr()) {
 		return fmt.Errorf("tailssh: rejecting non-Tailscale local address %v", ci.dst)
 	}
 	if !tsaddr.IsTailscaleIP(ci.src.Addr()) {
 		return fmt.Errorf("tailssh: rejecting non-Tailscale remote address %v", ci.src)
 	}
-	node, uprof, ok := c.srv.lb.WhoIs(ci.src)
+	if sshRequireSelfDst() && !c.srv.isSelfAddr(ci.dst.Addr()) {
+		return fmt.Errorf("tailssh: rejecting local address %v that isn't this node's", ci.dst)
+	}
+	var (
+		node  tailcfg.NodeView
+		uprof tailcfg.UserProfile
+		ok    bool
+	)
+	if err := callWithTimeout(ctx, acceptHookTimeout(), func(context.Context) error {
+		node, uprof, ok = c.whoIs(ci.src)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("WhoIs(%v): %w", ci.src, err)
+	}
 	if !ok {
 		return fmt.Errorf("unknown Tailscale identity from src %v", ci.src)
 	}
 	ci.node = node
 	ci.uprof = uprof
+	if login, ok := parseProxyClientVersion(ctx.ClientVersion()); ok {
+		ci.proxied, ci.proxiedFor = true, login
+		c.logf("connection proxied by %v for %q", uprof.LoginName, login)
+	}
 
 	c.idH = ctx.SessionID()
+	c.nodeKey = c.srv.lb.NodeKey()
 	c.info = ci
-	c.logf("handling conn: %v", ci.String())
+	c.sampleAcceptLogs()
+	c.acceptLogf("handling conn: %v", ci.String())
 	return nil
 }
 
+// isSelfAddr reports whether a is one of this node's own Tailscale addresses,
+// per the self node of the current netmap. It reports false if there's no
+// netmap.
+func (srv *server) isSelfAddr(a netip.Addr) bool {
+	nm := srv.lb.NetMap()
+	if nm == nil {
+		return false
+	}
+	addrs := nm.GetAddresses()
+	for i := range addrs.Len() {
+		if p := addrs.At(i); p.IsSingleIP() && p.Addr() == a {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultAcceptHookTimeout is the default of TS_SSH_ACCEPT_HOOK_TIMEOUT.
+const defaultAcceptHookTimeout = 10 * time.Second
+
+// errAcceptHookTimeout is returned by callWithTimeout when the call doesn't
+// return in time.
+var errAcceptHookTimeout = errors.New("timed out")
+
+// acceptHookTimeout returns the TS_SSH_ACCEPT_HOOK_TIMEOUT, or zero if it's
+// disabled.
+func acceptHookTimeout() time.Duration {
+	d := sshAcceptHookTimeout()
+	if d == 0 {
+		return defaultAcceptHookTimeout
+	}
+	return max(d, 0)
+}
+
+// callWithTimeout calls f and returns its error, or errAcceptHookTimeout if
+// it doesn't return within d, in which case f keeps running in the background
+// with its context canceled. If d is zero, f is called without a timeout.
+// f must not touch any state other than its own once its context is done.
+func callWithTimeout(ctx context.Context, d time.Duration, f func(context.Context) error) error {
+	if d <= 0 {
+		return f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- f(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%w after %v", errAcceptHookTimeout, d)
+		}
+		return ctx.Err()
+	}
+}
+
+// runAcceptHook runs the server's acceptHook, if any, for c, bounded by
+// TS_SSH_ACCEPT_HOOK_TIMEOUT.
+func (c *conn) runAcceptHook(ctx context.Context) error {
+	h := c.srv.acceptHook
+	if h == nil {
+		return nil
+	}
+	ci := c.info
+	return callWithTimeout(ctx, acceptHookTimeout(), func(ctx context.Context) error {
+		return h(ctx, ci)
+	})
+}
+
+const defaultWhoIsRetries = 3
+
+// whoIsRetryDelay is the delay before the first WhoIs retry. It doubles with
+// every retry. It's a var for tests.
+var whoIsRetryDelay = 100 * time.Millisecond
+
+// whoIs looks up the Tailscale identity of src.
+//
+// WhoIs can fail transiently while there's no netmap, such as right after
+// tailscaled reconnects to control, so in that case it's retried a few times
+// with backoff (see TS_SSH_WHOIS_RETRIES). If there is a netmap, src is
+// genuinely unknown and it's not retried.
+func (c *conn) whoIs(src netip.AddrPort) (n tailcfg.NodeView, u tailcfg.UserProfile, ok bool) {
+	retries := sshWhoIsRetries()
+	if retries == 0 {
+		retries = defaultWhoIsRetries
+	}
+	delay := whoIsRetryDelay
+	for attempt := 0; ; attempt++ {
+		n, u, ok = c.srv.lb.WhoIs(src)
+		if ok || attempt >= retries || c.srv.lb.NetMap() != nil {
+			return n, u, ok
+		}
+		c.logf("WhoIs(%v) failed with no netmap; retrying in %v", src, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
 // evaluatePolicy returns the SSHAction and localUser after evaluating
 // the SSHPolicy for this conn. The pubKey may be nil for "none" auth.
-func (c *conn) evaluatePolicy(pubKey gossh.PublicKey) (_ *tailcfg.SSHAction, localUser string, _ error) {
+func (c *conn) evaluatePolicy(pubKey gossh.PublicKey) (_ *tailcfg.SSHAction, localUser string, ruleIndex int, _ error) {
 	pol, ok := c.sshPolicy()
 	if !ok {
-		return nil, "", fmt.Errorf("tailssh: rejecting connection; no SSH policy")
+		return nil, "", -1, &denialError{code: denyNoPolicy, msg: "no SSH policy"}
+	}
+	if reason, stale := c.srv.netMapStale(); stale {
+		if !sshStaleNetMapWarnOnly() {
+			return nil, "", -1, &denialError{code: denyStaleNetMap, msg: "SSH policy may be stale; " + reason}
+		}
+		c.logf("warning: SSH policy may be stale; %s", reason)
+	}
+	key, cacheable := c.acceptCacheKey(pol, pubKey)
+	if cacheable {
+		if e, ok := c.srv.acceptCache.get(key, c.srv.now()); ok {
+			c.srv.addMetric(metricAcceptCacheHits, 1)
+			return e.action, e.localUser, e.ruleIndex, nil
+		}
+	}
+	gen := c.srv.acceptCache.generation()
+	a, localUser, ruleIndex, code := c.evalSSHPolicyRules(pol, pubKey, nil)
+	if a == nil {
+		return nil, "", -1, &denialError{code: code, msg: "no matching policy"}
+	}
+	if cacheable {
+		if ttl := acceptCacheTTL(); ttl > 0 {
+			now := c.srv.now()
+			expires := now.Add(ttl)
+			if re := pol.Rules[ruleIndex].RuleExpires; re != nil && re.Before(expires) {
+				expires = *re
+			}
+			c.srv.acceptCache.put(gen, key, acceptCacheEntry{
+				action:    a,
+				localUser: localUser,
+				ruleIndex: ruleIndex,
+				expires:   expires,
+			}, now)
+		}
+	}
+	return a, localUser, ruleIndex, nil
+}
+
+const (
+	defaultAcceptCacheTTL = 10 * time.Second
+	maxAcceptCacheEntries = 1000
+)
+
+// acceptCacheTTL returns how long to cache policy decisions for, per
+// TS_SSH_ACCEPT_CACHE_TTL, or zero if they mustn't be cached.
+func acceptCacheTTL() time.Duration {
+	switch d := sshAcceptCacheTTL(); {
+	case d == 0:
+		return defaultAcceptCacheTTL
+	case d < 0:
+		return 0
+	default:
+		return d
+	}
+}
+
+// acceptCacheKey returns the key of c's policy decision under pol in the
+// server's acceptCache, and whether the decision may be cached at all.
+// Decisions involving a public key aren't, as the keys a rule accepts may
+// be fetched from a URL and change under the same policy.
+func (c *conn) acceptCacheKey(pol *tailcfg.SSHPolicy, pubKey gossh.PublicKey) (_ acceptCacheKey, ok bool) {
+	if pubKey != nil || acceptCacheTTL() == 0 {
+		return acceptCacheKey{}, false
 	}
-	a, localUser, ok := c.evalSSHPolicy(pol, pubKey)
+	ci := c.info
+	k := acceptCacheKey{
+		src:       ci.src.Addr(),
+		userLogin: ci.uprof.LoginName,
+		sshUser:   ci.sshUser,
+		proxied:   ci.proxied,
+		policy:    pol,
+	}
+	if ci.node.Valid() {
+		k.node = ci.node.StableID()
+		k.nodeCaps = nodeCapsKey(ci.node)
+	}
+	return k, true
+}
+
+// nodeCapsKey returns the names of n's node capabilities, sorted and
+// NUL-separated, for acceptCacheKey.nodeCaps.
+func nodeCapsKey(n tailcfg.NodeView) string {
+	var caps []string
+	n.CapMap().Range(func(c tailcfg.NodeCapability, _ views.Slice[tailcfg.RawMessage]) bool {
+		caps = append(caps, string(c))
+		return true
+	})
+	slices.Sort(caps)
+	return strings.Join(caps, "\x00")
+}
+
+// acceptCacheKey identifies a policy decision in an acceptCache: the
+// identity and capabilities of the client, the ssh-user it asked for, and
+// the policy.
+type acceptCacheKey struct {
+	src       netip.Addr
+	node      tailcfg.StableNodeID
+	userLogin string
+	sshUser   string
+	proxied   bool
+
+	// nodeCaps are the node's capabilities, per nodeCapsKey, which
+	// principals may require with NodeCap. They can be revoked without the
+	// policy changing.
+	nodeCaps string
+
+	// policy is the policy the decision was made under. A new netmap
+	// only carries a new SSHPolicy if the policy changed, so it
+	// identifies the policy version.
+	policy *tailcfg.SSHPolicy
+}
+
+// acceptCacheEntry is a policy decision cached in an acceptCache: the
+// results of evaluatePolicy.
+type acceptCacheEntry struct {
+	action    *tailcfg.SSHAction
+	localUser string
+	ruleIndex int
+	expires   time.Time // no later than the rule's RuleExpires
+}
+
+// acceptCache caches the policy decisions of evaluatePolicy for a short
+// time (TS_SSH_ACCEPT_CACHE_TTL), so that clients reconnecting frequently
+// don't each evaluate the policy. Only matches are cached. It's cleared by
+// OnPolicyChange and entries are keyed by policy, so a decision is never
+// reused under another policy; checks that don't depend on the policy,
+// like netMapStale, still run for every connection.
+type acceptCache struct {
+	mu      sync.Mutex
+	gen     uint64 // incremented by clear
+	entries map[acceptCacheKey]acceptCacheEntry
+}
+
+func (ac *acceptCache) get(k acceptCacheKey, now time.Time) (_ acceptCacheEntry, ok bool) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	e, ok := ac.entries[k]
 	if !ok {
-		return nil, "", fmt.Errorf("tailssh: rejecting connection; no matching policy")
+		return e, false
+	}
+	if !now.Before(e.expires) {
+		delete(ac.entries, k)
+		return e, false
+	}
+	return e, true
+}
+
+// generation returns the current generation of ac, to pass to put.
+func (ac *acceptCache) generation() uint64 {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.gen
+}
+
+// put caches e under k, unless ac was cleared since generation returned
+// gen, in which case e may predate a policy change.
+func (ac *acceptCache) put(gen uint64, k acceptCacheKey, e acceptCacheEntry, now time.Time) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if gen != ac.gen {
+		return
 	}
-	return a, localUser, nil
+	if len(ac.entries) >= maxAcceptCacheEntries {
+		for k, e := range ac.entries {
+			if !now.Before(e.expires) {
+				delete(ac.entries, k)
+			}
+		}
+		if len(ac.entries) >= maxAcceptCacheEntries {
+			clear(ac.entries)
+		}
+	}
+	mak.Set(&ac.entries, k, e)
+}
+
+// clear removes all entries from ac, such as when the policy changes.
+func (ac *acceptCache) clear() {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.gen++
+	clear(ac.entries)
+}
+
+// netMapStale reports whether the netmap, and so the SSH policy, must be
+// considered stale per TS_SSH_MAX_NETMAP_AGE, and if so, why. Control
+// streams keep-alives even when the netmap doesn't change, so the time
+// tailscaled last heard from control is how old the netmap is known to be
+// current as of.
+func (srv *server) netMapStale() (reason string, stale bool) {
+	maxAge := sshMaxNetMapAge()
+	if maxAge <= 0 || srv.lastHeardFromControl == nil {
+		return "", false
+	}
+	last := srv.lastHeardFromControl()
+	if last.IsZero() {
+		return "never heard from control", true
+	}
+	if age := time.Since(last); age > maxAge {
+		return fmt.Sprintf("last heard from control %v ago", age.Round(time.Second)), true
+	}
+	return "", false
 }
 
 // pubKeyCacheEntry is the cache value for an HTTPS URL of public keys (like
@@ -734,6 +2524,13 @@ func (srv *server) fetchPublicKeysURL(url string) ([]string, error) {
 // completed. It also handles SFTP requests.
 func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 	// Do this check after auth, but before starting the session.
+	if sub := s.Subsystem(); sub != "" && !c.subsystemAllowed(sub) {
+		c.errf("denying session: subsystem %q not in AllowedCommands", sub)
+		fmt.Fprintf(s.Stderr(), "Subsystem not allowed: %q\r\n", sub)
+		c.srv.addMetric(metricCommandDenied, 1)
+		s.Exit(1)
+		return
+	}
 	switch s.Subsystem() {
 	case "sftp":
 		if sshDisableSFTP() {
@@ -741,21 +2538,129 @@ func (c *conn) handleSessionPostSSHAuth(s ssh.Session) {
 			s.Exit(1)
 			return
 		}
-		metricSFTP.Add(1)
+		c.srv.addMetric(metricSFTP, 1)
 	case "":
 		// Regular SSH session.
-	default:
-		fmt.Fprintf(s.Stderr(), "Unsupported subsystem %q\r\n", s.Subsystem())
+		if !c.commandAllowed(s.RawCommand()) {
+			if s.RawCommand() == "" {
+				c.errf("denying session: interactive shell not in AllowedCommands")
+				fmt.Fprintf(s.Stderr(), "Interactive shell not allowed\r\n")
+			} else {
+				c.errf("denying session: command %q not in AllowedCommands", s.RawCommand())
+				fmt.Fprintf(s.Stderr(), "Command not allowed: %q\r\n", s.RawCommand())
+			}
+			c.srv.addMetric(metricCommandDenied, 1)
+			s.Exit(1)
+			return
+		}
+	default:
+		fmt.Fprintf(s.Stderr(), "Unsupported subsystem %q\r\n", s.Subsystem())
+		s.Exit(1)
+		return
+	}
+
+	if c.nodeKeyChanged() && !sshKeepSessionsOnNodeKeyChange() {
+		c.errf("denying session: node key changed since the connection was authorized")
+		fmt.Fprintf(s.Stderr(), "%s\r\n", errNodeKeyChanged.SSHTerminationMessage())
 		s.Exit(1)
 		return
 	}
 
 	ss := c.newSSHSession(s)
-	ss.logf("handling new SSH connection from %v (%v) to ssh-user %q", c.info.uprof.LoginName, c.info.src.Addr(), c.localUser.Username)
-	ss.logf("access granted to %v as ssh-user %q", c.info.uprof.LoginName, c.localUser.Username)
+	ss.acceptLogf("handling new SSH connection from %v (%v) to ssh-user %q (local user %q)", c.info.uprof.LoginName, c.info.src.Addr(), c.info.sshUser, c.localUser.Username)
+	ss.acceptLogf("access granted to %v as ssh-user %q (local user %q) by rule %d", c.info.uprof.LoginName, c.info.sshUser, c.localUser.Username, c.ruleIndex)
 	ss.run()
 }
 
+// commandAllowed reports whether the final action allows sessions to request
+// rawCmd, the command as sent by the client, or the empty string for an
+// interactive shell, per its AllowedCommands.
+func (c *conn) commandAllowed(rawCmd string) bool {
+	a := c.finalAction
+	if a == nil || len(a.AllowedCommands) == 0 || a.ForceCommand != nil {
+		return true
+	}
+	if rawCmd == "" {
+		// Shells must be explicitly allowed, not just by a pattern
+		// like "*".
+		return slices.Contains(a.AllowedCommands, "")
+	}
+	for _, pat := range a.AllowedCommands {
+		if commandMatches(pat, rawCmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// subsystemAllowedPrefix is the prefix of the AllowedCommands entries that
+// allow the subsystems they name, like "subsystem:sftp".
+const subsystemAllowedPrefix = "subsystem:"
+
+// subsystemAllowed reports whether the final action allows sessions to
+// request the subsystem sub, per its AllowedCommands: when it has any, only
+// subsystems listed with subsystemAllowedPrefix are.
+func (c *conn) subsystemAllowed(sub string) bool {
+	a := c.finalAction
+	if a == nil || len(a.AllowedCommands) == 0 {
+		return true
+	}
+	return slices.Contains(a.AllowedCommands, subsystemAllowedPrefix+sub)
+}
+
+// shellMetachars are the characters that "*" and "?" in AllowedCommands
+// patterns don't match. Commands are run by the local user's shell, so these
+// would let a command allowed by a pattern run others with it.
+const shellMetachars = ";|&$`<>()\n"
+
+// commandMatches reports whether cmd matches the AllowedCommands pattern
+// pat, in which "*" matches any run of characters, including none, and "?"
+// any single character, except for shellMetachars, which only match
+// themselves. Unlike with path.Match, "*" matches slashes too, as commands'
+// arguments are typically paths.
+func commandMatches(pat, cmd string) bool {
+	// Each of cmd's shellMetachars must be matched by the same one in pat,
+	// so match the parts between them separately.
+	for {
+		pi := strings.IndexAny(pat, shellMetachars)
+		ci := strings.IndexAny(cmd, shellMetachars)
+		if pi < 0 || ci < 0 {
+			return pi < 0 && ci < 0 && globMatches(pat, cmd)
+		}
+		if pat[pi] != cmd[ci] || !globMatches(pat[:pi], cmd[:ci]) {
+			return false
+		}
+		pat, cmd = pat[pi+1:], cmd[ci+1:]
+	}
+}
+
+// globMatches reports whether cmd matches pat, in which "*" matches any run
+// of characters, including none, and "?" any single character.
+func globMatches(pat, cmd string) bool {
+	// Backtrack to just after the last "*", if any, on mismatches.
+	var p, c, starP, starC int
+	starP = -1
+	for c < len(cmd) {
+		switch {
+		case p < len(pat) && pat[p] == '*':
+			starP, starC = p, c
+			p++
+		case p < len(pat) && (pat[p] == '?' || pat[p] == cmd[c]):
+			p++
+			c++
+		case starP >= 0:
+			starC++
+			p, c = starP+1, starC
+		default:
+			return false
+		}
+	}
+	for p < len(pat) && pat[p] == '*' {
+		p++
+	}
+	return p == len(pat)
+}
+
 // resolveNextAction starts at c.currentAction and makes it way through the
 // action chain one step at a time. An action without a HoldAndDelegate is
 // considered the final action. Once a final action is reached, this function
@@ -791,27 +2696,45 @@ func (c *conn) resolveNextAction(sctx ssh.Context) (action *tailcfg.SSHAction, e
 	action = c.currentAction
 	if action.Accept || action.Reject {
 		if action.Reject {
-			metricTerminalReject.Add(1)
+			c.srv.addMetric(metricTerminalReject, 1)
 		} else {
-			metricTerminalAccept.Add(1)
+			c.srv.addMetric(metricTerminalAccept, 1)
 		}
 		return action, nil
 	}
 	url := action.HoldAndDelegate
 	if url == "" {
-		metricTerminalMalformed.Add(1)
+		c.srv.addMetric(metricTerminalMalformed, 1)
 		return nil, errors.New("reached Action that lacked Accept, Reject, and HoldAndDelegate")
 	}
-	metricHolds.Add(1)
+	maxHops := sshMaxDelegateHops()
+	if maxHops <= 0 {
+		maxHops = defaultMaxDelegateHops
+	}
+	if c.delegateHops >= maxHops {
+		c.errf("denying after %d HoldAndDelegate hops", c.delegateHops)
+		return nil, errDelegateHopLimit
+	}
+	c.delegateHops++
+	c.srv.addMetric(metricHolds, 1)
 	url = c.expandDelegateURLLocked(url)
 	nextAction, err := c.fetchSSHAction(ctx, url)
 	if err != nil {
-		metricTerminalFetchError.Add(1)
+		c.srv.addMetric(metricTerminalFetchError, 1)
 		return nil, fmt.Errorf("fetching SSHAction from %s: %w", url, err)
 	}
+	c.authf("delegated action resolved: accept=%v reject=%v delegated=%v", nextAction.Accept, nextAction.Reject, nextAction.HoldAndDelegate != "")
 	return nextAction, nil
 }
 
+// defaultMaxDelegateHops is the default maximum number of HoldAndDelegate
+// actions followed per connection; see sshMaxDelegateHops.
+const defaultMaxDelegateHops = 10
+
+// errDelegateHopLimit is returned by resolveNextAction once a connection has
+// followed the maximum number of HoldAndDelegate actions.
+var errDelegateHopLimit = fmt.Errorf("%w: too many HoldAndDelegate hops", errDenied)
+
 func (c *conn) expandDelegateURLLocked(actionURL string) string {
 	nm := c.srv.lb.NetMap()
 	ci := c.info
@@ -842,16 +2765,61 @@ func (c *conn) expandPublicKeyURL(pubKeyURL string) string {
 	).Replace(pubKeyURL)
 }
 
+// expandHomeDir returns the SSHAction.HomeDir template tmpl with its
+// identity variables expanded. It fails if the result isn't an absolute
+// path, or if an expanded value could escape its path element.
+func (c *conn) expandHomeDir(tmpl string) (string, error) {
+	loginName := c.info.uprof.LoginName
+	localPart, _, _ := strings.Cut(loginName, "@")
+	vars := []string{
+		"$SSH_USER", c.info.sshUser,
+		"$LOCAL_USER", c.localUser.Username,
+		"$LOGINNAME_EMAIL", loginName,
+		"$LOGINNAME_LOCALPART", localPart,
+	}
+	for i := 0; i < len(vars); i += 2 {
+		if !strings.Contains(tmpl, vars[i]) {
+			continue
+		}
+		if v := vars[i+1]; v == "" || v == "." || v == ".." || strings.ContainsAny(v, "/\x00") {
+			return "", fmt.Errorf("%s value %q can't be used in a path", vars[i], v)
+		}
+	}
+	dir := strings.NewReplacer(vars...).Replace(tmpl)
+	if strings.Contains(dir, "$") {
+		return "", fmt.Errorf("unknown variable in %q", tmpl)
+	}
+	if !filepath.IsAbs(dir) {
+		return "", fmt.Errorf("%q is not an absolute path", dir)
+	}
+	return filepath.Clean(dir), nil
+}
+
 // sshSession is an accepted Tailscale SSH session.
 type sshSession struct {
 	ssh.Session
 	sharedID string // ID that's shared with control
-	logf     logger.Logf
+
+	// interactive is whether the session has a PTY and isn't a subsystem,
+	// for TS_SSH_SINGLE_INTERACTIVE_SESSION. It's set before the session is
+	// attached to its conn, and not changed after.
+	interactive bool
+	baseLogf    logger.Logf // unfiltered; use the logf methods instead
 
 	ctx           context.Context
 	cancelCtx     context.CancelCauseFunc
 	conn          *conn
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	x11           *x11Forward  // non-nil if X11 forwarding requested+allowed
+
+	outputSyslog *syslogLineWriter // set by startOutputSyslog; or nil if disabled
+
+	// set by resolveWorkDir:
+	workDir         string // the process's working directory
+	homeDir         string // the session's home directory, used as HOME
+	homeDirOverride bool   // homeDir is from SSHAction.HomeDir
+	containerPID    int    // if non-zero, the process whose namespaces to enter; see SSHAction.EnterContainer
+	scratchDir      string // if non-empty, the session's scratch directory; see makeScratchDir
 
 	// initialized by launchProcess:
 	cmd      *exec.Cmd
@@ -865,20 +2833,65 @@ type sshSession struct {
 	// For non-pty sessions, this is the stdin, stdout, stderr fds.
 	childPipes []io.Closer
 
+	// bytesIn and bytesOut count the bytes copied to the process's stdin
+	// and from its stdout and stderr, respectively. Bytes discarded once
+	// a byteLimiter's limit is exceeded aren't counted.
+	bytesIn, bytesOut atomic.Int64
+
+	// lastActive is when input or output last flowed, in Unix nanoseconds,
+	// for the action's IdleTimeout; see markActive.
+	lastActive atomic.Int64
+
+	// rec is the session's recording, once started, for its status. It's
+	// nil if the session isn't recorded.
+	rec atomic.Pointer[recording]
+
+	// recordingFailedOpen is whether a recording sink failed to start and
+	// the session continued without it.
+	recordingFailedOpen atomic.Bool
+
+	// stopScope, if non-nil, stops the systemd scope the process runs in.
+	// It is set by maybeStartSystemdScope.
+	stopScope func() error
+
 	// We use this sync.Once to ensure that we only terminate the process once,
 	// either it exits itself or is terminated
 	exitOnce sync.Once
+
+	// processExited is closed once the process has exited and been waited
+	// for.
+	processExited chan struct{}
+}
+
+func (ss *sshSession) errf(format string, args ...any) {
+	atLogLevel(logLevelError, ss.baseLogf)(format, args...)
+}
+
+func (ss *sshSession) logf(format string, args ...any) {
+	atLogLevel(logLevelInfo, ss.baseLogf)(format, args...)
 }
 
 func (ss *sshSession) vlogf(format string, args ...any) {
-	if sshVerboseLogging() {
+	atLogLevel(logLevelVerbose, ss.baseLogf)(format, args...)
+}
+
+// acceptLogf is like logf, for the routine logs of accepting ss; see
+// (*conn).acceptLogf.
+func (ss *sshSession) acceptLogf(format string, args ...any) {
+	if !ss.conn.acceptLogSampledOut {
 		ss.logf(format, args...)
 	}
 }
 
 func (c *conn) newSSHSession(s ssh.Session) *sshSession {
 	sharedID := fmt.Sprintf("sess-%s-%02x", c.srv.now().UTC().Format("20060102T150405"), randBytes(5))
-	c.logf("starting session: %v", sharedID)
+	token := envValFromList(s.Environ(), correlationEnvVar)
+	if token != "" && !validCorrelationToken(token) {
+		c.logf("ignoring invalid %s %q", correlationEnvVar, token)
+		token = ""
+	}
+	sharedID = decorateID(sharedID, token)
+	c.acceptLogf("starting session: %v", sharedID)
 	ctx, cancel := context.WithCancelCause(s.Context())
 	return &sshSession{
 		Session:   s,
@@ -886,14 +2899,61 @@ func (c *conn) newSSHSession(s ssh.Session) *sshSession {
 		ctx:       ctx,
 		cancelCtx: cancel,
 		conn:      c,
-		logf:      logger.WithPrefix(c.srv.logf, "ssh-session("+sharedID+"): "),
+		baseLogf:  logger.WithPrefix(c.srv.logf, "ssh-session("+sharedID+"): "),
+
+		processExited: make(chan struct{}),
+	}
+}
+
+// correlationEnvVar is the environment variable that clients may send with a
+// session to have a correlation token, such as the ID of a ticket in an
+// external system, included in its ID, as used in logs, recordings and
+// notifications.
+const correlationEnvVar = "TAILSCALE_SSH_CORRELATION_ID"
+
+// maxCorrelationTokenLen is the maximum length of correlation tokens.
+const maxCorrelationTokenLen = 64
+
+// validCorrelationToken reports whether s may be included in connection or
+// session IDs: it must be non-empty, at most maxCorrelationTokenLen bytes of
+// ASCII letters, digits, '.', '_' or '-', so that IDs stay safe to use in
+// logs, URLs and file names.
+func validCorrelationToken(s string) bool {
+	if s == "" || len(s) > maxCorrelationTokenLen {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// decorateID returns id with the TS_SSH_ID_PREFIX, if valid, prepended and
+// token, if non-empty, appended, joined with hyphens. The random part of id
+// keeps the result unique, whatever the affixes.
+func decorateID(id, token string) string {
+	if p := sshIDPrefix(); validCorrelationToken(p) {
+		id = p + "-" + id
 	}
+	if token != "" {
+		id += "-" + token
+	}
+	return id
 }
 
 // isStillValid reports whether the conn is still valid.
 func (c *conn) isStillValid() bool {
-	a, localUser, err := c.evaluatePolicy(c.pubKey)
-	c.vlogf("stillValid: %+v %v %v", a, localUser, err)
+	if c.localUser == nil {
+		// Auth hasn't finished, or failed. There are no sessions to
+		// revoke, and auth evaluates the policy itself.
+		return true
+	}
+	a, localUser, _, err := c.evaluatePolicy(c.pubKey)
+	c.authf("stillValid: %+v %v %v", a, localUser, err)
 	if err != nil {
 		return false
 	}
@@ -906,10 +2966,18 @@ func (c *conn) isStillValid() bool {
 // checkStillValid checks that the conn is still valid per the latest SSHPolicy.
 // If not, it terminates all sessions associated with the conn.
 func (c *conn) checkStillValid() {
+	if c.nodeKeyChanged() {
+		if sshKeepSessionsOnNodeKeyChange() {
+			c.logf("node key changed since the connection was authorized; keeping its sessions")
+		} else {
+			c.terminateForNodeKeyChange()
+			return
+		}
+	}
 	if c.isStillValid() {
 		return
 	}
-	metricPolicyChangeKick.Add(1)
+	c.srv.addMetric(metricPolicyChangeKick, 1)
 	c.logf("session no longer valid per new SSH policy; closing")
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -921,7 +2989,113 @@ func (c *conn) checkStillValid() {
 	}
 }
 
+// errNodeKeyChanged is the error that sessions are terminated with when this
+// node's key changed since their connection was authorized.
+var errNodeKeyChanged = userVisibleError{
+	"This node's Tailscale key changed, such as by switching users or re-authenticating; reconnect to continue.",
+	errors.New("node key changed"),
+}
+
+// nodeKeyChanged reports whether this node's key is no longer the one it
+// had when c was authorized, such as after fast user switching (FUS) or
+// re-authentication, or it no longer has one. Requests made on behalf of
+// c's sessions with the new key, such as to control or recorders, would
+// then fail in confusing ways, if at all.
+func (c *conn) nodeKeyChanged() bool {
+	return !c.nodeKey.IsZero() && c.srv.lb.NodeKey() != c.nodeKey
+}
+
+// terminateForNodeKeyChange terminates the sessions of c with
+// errNodeKeyChanged.
+func (c *conn) terminateForNodeKeyChange() {
+	c.srv.addMetric(metricNodeKeyChanged, 1)
+	c.logf("node key changed since the connection was authorized; closing its sessions")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.sessions {
+		s.cancelCtx(errNodeKeyChanged)
+	}
+}
+
+// connExpiryGrace is how long sessions are given to end after their
+// connection's lifetime elapses, so that they can tell their users why,
+// before the connection is closed.
+const connExpiryGrace = time.Second
+
+// expire ends c, which has been open for sshMaxConnLifetime d, by
+// terminating its sessions and, after connExpiryGrace, closing nc. It also
+// ends connections still in auth, such as those waiting on HoldAndDelegate.
+func (c *conn) expire(d time.Duration, nc net.Conn) {
+	c.srv.addMetric(metricConnLifetimeExpired, 1)
+	c.logf("connection lifetime of %v elapsed; closing", d)
+	c.mu.Lock()
+	n := len(c.sessions)
+	for _, s := range c.sessions {
+		s.cancelCtx(userVisibleError{
+			fmt.Sprintf("Connection lifetime of %v elapsed; reconnect to continue.", d),
+			context.DeadlineExceeded,
+		})
+	}
+	c.mu.Unlock()
+	if n > 0 {
+		time.Sleep(connExpiryGrace)
+	}
+	nc.Close()
+}
+
+// defaultConnExpiryWarning is the default TS_SSH_CONN_EXPIRY_WARNING.
+const defaultConnExpiryWarning = 5 * time.Minute
+
+// connExpiryWarnings returns how long before the lifetime d of a connection
+// elapses to warn its user, longest first: the TS_SSH_CONN_EXPIRY_WARNING
+// lead time, counting down with a warning a minute and ten seconds before,
+// if shorter. There are none if the lead time isn't shorter than d.
+func connExpiryWarnings(d time.Duration) []time.Duration {
+	lead := sshConnExpiryWarning()
+	if lead == 0 {
+		lead = defaultConnExpiryWarning
+	}
+	if lead < 0 || lead >= d {
+		return nil
+	}
+	ws := []time.Duration{lead}
+	for _, w := range []time.Duration{time.Minute, 10 * time.Second} {
+		if w < lead {
+			ws = append(ws, w)
+		}
+	}
+	return ws
+}
+
+// warnExpiry warns the user of c that its lifetime elapses in left. The
+// warning is written to the stderr of only one of its sessions, preferring
+// the newest with a PTY, so that clients multiplexing many sessions over c
+// don't get it many times.
+func (c *conn) warnExpiry(left time.Duration) {
+	c.mu.Lock()
+	var ss *sshSession
+	for i := len(c.sessions) - 1; i >= 0; i-- {
+		s := c.sessions[i]
+		if _, _, isPty := s.Pty(); isPty {
+			ss = s
+			break
+		}
+		if ss == nil {
+			ss = s
+		}
+	}
+	c.mu.Unlock()
+	if ss == nil {
+		return
+	}
+	c.logf("connection lifetime elapses in %v; warning session %s", left, ss.sharedID)
+	fmt.Fprintf(ss.Stderr(), "\r\nThis connection will be closed in %v, when its maximum lifetime elapses. Save your work and reconnect.\r\n", left)
+}
+
 func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHAction, error) {
+	if err := c.srv.checkControlTransport("fetching SSHAction"); err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
 	defer cancel()
 	bo := backoff.NewBackoff("fetch-ssh-action", c.logf, 10*time.Second)
@@ -944,7 +3118,7 @@ func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHActi
 			if len(body) > 1<<10 {
 				body = body[:1<<10]
 			}
-			c.logf("fetch of %v: %s, %s", url, res.Status, body)
+			c.errf("fetch of %v: %s, %s", url, res.Status, body)
 			bo.BackOff(ctx, fmt.Errorf("unexpected status: %v", res.Status))
 			continue
 		}
@@ -952,7 +3126,7 @@ func (c *conn) fetchSSHAction(ctx context.Context, url string) (*tailcfg.SSHActi
 		err = json.NewDecoder(res.Body).Decode(a)
 		res.Body.Close()
 		if err != nil {
-			c.logf("invalid next SSHAction JSON from %v: %v", url, err)
+			c.errf("invalid next SSHAction JSON from %v: %v", url, err)
 			bo.BackOff(ctx, err)
 			continue
 		}
@@ -977,10 +3151,45 @@ func (ss *sshSession) killProcessOnContextDone() {
 		ss.logf("terminating SSH session from %v: %v", ss.conn.info.src.Addr(), err)
 		// We don't need to Process.Wait here, sshSession.run() does
 		// the waiting regardless of termination reason.
+		ss.terminateProcess()
+	})
+}
+
+// defaultSessionTermGrace is the default of how long a terminated session's
+// process is given to exit after SIGTERM; see sessionTermGrace.
+const defaultSessionTermGrace = 5 * time.Second
+
+// sessionTermGrace returns how long ss's process is given to exit after
+// SIGTERM before it's sent SIGKILL: TS_SSH_SESSION_TERM_GRACE if set, else
+// the action's SessionTermGrace, else defaultSessionTermGrace.
+func (ss *sshSession) sessionTermGrace() time.Duration {
+	if d := sshSessionTermGrace(); d > 0 {
+		return d
+	}
+	if a := ss.conn.finalAction; a != nil && a.SessionTermGrace > 0 {
+		return a.SessionTermGrace
+	}
+	return defaultSessionTermGrace
+}
 
-		// TODO(maisem): should this be a SIGTERM followed by a SIGKILL?
+// terminateProcess sends ss's process SIGTERM, so that it can save its
+// state and exit, and then SIGKILL if it hasn't exited within
+// sessionTermGrace.
+func (ss *sshSession) terminateProcess() {
+	if err := ss.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// The process has likely exited already.
 		ss.cmd.Process.Kill()
-	})
+		return
+	}
+	grace := ss.sessionTermGrace()
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-ss.processExited:
+	case <-t.C:
+		ss.logf("process did not exit within %v of SIGTERM; killing", grace)
+		ss.cmd.Process.Kill()
+	}
 }
 
 // attachSession registers ss as an active session.
@@ -992,6 +3201,7 @@ func (c *conn) attachSession(ss *sshSession) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.sessions = append(c.sessions, ss)
+	metricActiveSessionsByLocalUser.Get(c.localUser.Username).Add(1)
 }
 
 // detachSession unregisters s from the list of active sessions.
@@ -1002,6 +3212,7 @@ func (c *conn) detachSession(ss *sshSession) {
 	for i, s := range c.sessions {
 		if s == ss {
 			c.sessions = append(c.sessions[:i], c.sessions[i+1:]...)
+			metricActiveSessionsByLocalUser.Get(c.localUser.Username).Add(-1)
 			break
 		}
 	}
@@ -1009,11 +3220,17 @@ func (c *conn) detachSession(ss *sshSession) {
 
 var errSessionDone = errors.New("session is done")
 
+// mayForwardAgent reports whether c's action allows agent forwarding, unless
+// the server is in read-only mode (TS_SSH_READ_ONLY).
+func (c *conn) mayForwardAgent() bool {
+	return c.finalAction.AllowAgentForwarding && !sshReadOnly()
+}
+
 // handleSSHAgentForwarding starts a Unix socket listener and in the background
 // forwards agent connections between the listener and the ssh.Session.
 // On success, it assigns ss.agentListener.
 func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) error {
-	if !ssh.AgentRequested(ss) || !ss.conn.finalAction.AllowAgentForwarding {
+	if !ssh.AgentRequested(ss) || !ss.conn.mayForwardAgent() {
 		return nil
 	}
 	if sshDisableForwarding() {
@@ -1023,6 +3240,26 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) erro
 		return nil
 	}
 	ss.logf("ssh: agent forwarding requested")
+	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
+	if err != nil {
+		return err
+	}
+	if ss.homeDirOverride && ss.workDir == ss.homeDir {
+		// Place the socket in the session's home, which may be the only
+		// directory it shares with the host (such as in a container).
+		ln, err := newAgentListenerIn(ss.homeDir, int(uid), int(gid))
+		if err == nil {
+			go ssh.ForwardAgentConnections(&channelLimitListener{Listener: ln, c: ss.conn, typ: "auth-agent@openssh.com"}, s)
+			ss.agentListener = ln
+			return nil
+		}
+		ss.logf("ssh: agent socket in %q failed, using default: %v", ss.homeDir, err)
+	}
+
 	ln, err := ssh.NewAgentListener()
 	if err != nil {
 		return err
@@ -1033,14 +3270,6 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) erro
 		}
 	}()
 
-	uid, err := strconv.ParseUint(lu.Uid, 10, 32)
-	if err != nil {
-		return err
-	}
-	gid, err := strconv.ParseUint(lu.Gid, 10, 32)
-	if err != nil {
-		return err
-	}
 	socket := ln.Addr().String()
 	dir := filepath.Dir(socket)
 	// Make sure the socket is accessible only by the user.
@@ -1055,29 +3284,127 @@ func (ss *sshSession) handleSSHAgentForwarding(s ssh.Session, lu *userMeta) erro
 		return err
 	}
 
-	go ssh.ForwardAgentConnections(ln, s)
+	go ssh.ForwardAgentConnections(&channelLimitListener{Listener: ln, c: ss.conn, typ: "auth-agent@openssh.com"}, s)
 	ss.agentListener = ln
 	return nil
 }
 
+// testHookAgentDirCreated, if non-nil, is called by newAgentListenerIn with
+// the directory it created, before it's opened.
+var testHookAgentDirCreated func(dir string)
+
+// newAgentListenerIn is like ssh.NewAgentListener, but creates the socket in
+// a new directory within dir, which is removed when the listener is closed.
+// The socket is made accessible only by uid and gid.
+//
+// As dir may be writable by the user, who could swap the new directory for a
+// symlink to somewhere else, paths within it aren't trusted: the directory is
+// opened without following symlinks and checked to be the one created, and
+// the socket is bound and changed only through that descriptor. Binding
+// through a descriptor needs /proc, so this is only supported on Linux.
+func newAgentListenerIn(dir string, uid, gid int) (_ net.Listener, err error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	sockDir, err := os.MkdirTemp(dir, ".tailscale-ssh-agent-")
+	if err != nil {
+		return nil, err
+	}
+	if testHookAgentDirCreated != nil {
+		testHookAgentDirCreated(sockDir)
+	}
+	dirFD, err := unix.Open(sockDir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", sockDir, err)
+	}
+	ln := &dirRemovingListener{dir: sockDir, dirFD: dirFD}
+	defer func() {
+		if err != nil {
+			ln.Close()
+		}
+	}()
+	var st unix.Stat_t
+	if err := unix.Fstat(dirFD, &st); err != nil {
+		return nil, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR || int(st.Uid) != os.Geteuid() || st.Mode&0o077 != 0 {
+		return nil, fmt.Errorf("%q was replaced", sockDir)
+	}
+
+	const name = "agent.sock"
+	ul, err := net.Listen("unix", fmt.Sprintf("/proc/self/fd/%d/%s", dirFD, name))
+	if err != nil {
+		return nil, err
+	}
+	// The path it was bound to is only valid while dirFD is open, so remove
+	// the socket through dirFD instead.
+	ul.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Listener = ul
+	ln.addr = &net.UnixAddr{Name: filepath.Join(sockDir, name), Net: "unix"}
+
+	// Make sure the socket is accessible only by the user, and the dir is
+	// also accessible.
+	if err := unix.Fchmodat(dirFD, name, 0600, 0); err != nil {
+		return nil, err
+	}
+	if err := unix.Fchownat(dirFD, name, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return nil, err
+	}
+	if err := unix.Fchmod(dirFD, 0755); err != nil {
+		return nil, err
+	}
+	return ln, nil
+}
+
+// dirRemovingListener is a net.Listener, listening on a socket in the
+// directory dir, that removes the socket and dir once closed.
+type dirRemovingListener struct {
+	net.Listener               // or nil if not yet listening
+	addr         *net.UnixAddr // the socket's address within dir
+	dir          string
+	dirFD        int // descriptor of dir
+}
+
+func (ln *dirRemovingListener) Addr() net.Addr {
+	return ln.addr
+}
+
+func (ln *dirRemovingListener) Close() error {
+	var err error
+	if ln.Listener != nil {
+		err = ln.Listener.Close()
+		unix.Unlinkat(ln.dirFD, filepath.Base(ln.addr.Name), 0)
+	}
+	unix.Close(ln.dirFD)
+	// Only an empty directory is removed, so if dir was replaced there's
+	// nothing of anyone else's to remove.
+	os.Remove(ln.dir)
+	return err
+}
+
 // run is the entrypoint for a newly accepted SSH session.
 //
 // It handles ss once it's been accepted and determined
 // that it should run.
 func (ss *sshSession) run() {
-	metricActiveSessions.Add(1)
-	defer metricActiveSessions.Add(-1)
+	ss.conn.srv.addMetric(metricActiveSessions, 1)
+	defer ss.conn.srv.addMetric(metricActiveSessions, -1)
 	defer ss.cancelCtx(errSessionDone)
 
-	if attached := ss.conn.srv.attachSessionToConnIfNotShutdown(ss); !attached {
-		fmt.Fprintf(ss, "Tailscale SSH is shutting down\r\n")
+	_, _, isPty := ss.Pty()
+	ss.interactive = isPty && ss.Subsystem() == ""
+	if err := ss.conn.srv.attachSessionToConnIfNotShutdown(ss); err != nil {
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+		}
 		ss.Exit(1)
 		return
 	}
 	defer ss.conn.detachSession(ss)
 
 	lu := ss.conn.localUser
-	logf := ss.logf
+	errf := ss.errf
 
 	if ss.conn.finalAction.SessionDuration != 0 {
 		t := time.AfterFunc(ss.conn.finalAction.SessionDuration, func() {
@@ -1088,53 +3415,122 @@ func (ss *sshSession) run() {
 		})
 		defer t.Stop()
 	}
+	if d := ss.conn.finalAction.IdleTimeout; d > 0 {
+		defer ss.startIdleTimeout(d)()
+	}
+
+	if sub := ss.Subsystem(); ss.conn.finalAction.StrictRecording && !recordableSubsystem(sub) && ss.shouldRecord() {
+		errf("refusing unrecordable subsystem %q under strict recording", sub)
+		fmt.Fprintf(ss.Stderr(), "%s sessions can't be recorded, which this host requires\r\n", sub)
+		ss.Exit(1)
+		return
+	}
+
+	if ss.conn.finalAction.ProxyTo != "" {
+		ss.runProxied()
+		return
+	}
 
-	if euid := os.Geteuid(); euid != 0 {
-		if lu.Uid != fmt.Sprint(euid) {
-			ss.logf("can't switch to user %q from process euid %v", lu.Username, euid)
-			fmt.Fprintf(ss, "can't switch user\r\n")
+	if fc := ss.conn.finalAction.ForceCommand; fc != nil {
+		if len(fc.Args) == 0 {
+			errf("forced command has no args")
+			fmt.Fprintf(ss, "invalid forced command\r\n")
+			ss.Exit(1)
+			return
+		}
+		if ss.Subsystem() != "" {
+			errf("refusing subsystem %q with forced command", ss.Subsystem())
+			fmt.Fprintf(ss.Stderr(), "subsystem %q not allowed\r\n", ss.Subsystem())
 			ss.Exit(1)
 			return
 		}
+		if _, _, isPtyReq := ss.Pty(); fc.Confirm && !isPtyReq {
+			errf("refusing forced command needing confirmation without a PTY")
+			fmt.Fprintf(ss.Stderr(), "this command must be confirmed on a terminal; retry with a PTY (ssh -t)\r\n")
+			ss.Exit(1)
+			return
+		}
+	}
+
+	if !ss.conn.srv.canSwitchTo(lu) {
+		ss.errf("can't switch to user %q from process euid %v", lu.Username, ss.conn.srv.euid())
+		fmt.Fprintf(ss, "%s\r\n", ss.conn.srv.cantSwitchUserMessage(lu))
+		ss.Exit(1)
+		return
+	}
+
+	if err := ss.resolveWorkDir(); err != nil {
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+		}
+		ss.Exit(1)
+		return
+	}
+	if err := ss.resolveContainer(); err != nil {
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+		}
+		ss.Exit(1)
+		return
+	}
+	if err := ss.makeScratchDir(); err != nil {
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+		}
+		ss.Exit(1)
+		return
 	}
+	// Normally removed after the post-session command below; this is for
+	// the sessions that end before their process starts.
+	defer ss.removeScratchDir()
 
 	// Take control of the PTY so that we can configure it below.
 	// See https://github.com/tailscale/tailscale/issues/4146
 	ss.DisablePTYEmulation()
 
+	if fc := ss.conn.finalAction.ForceCommand; fc != nil && fc.Confirm {
+		if !ss.confirmForcedCommand(fc) {
+			ss.logf("forced command declined")
+			fmt.Fprintf(ss, "Aborted.\r\n")
+			ss.Exit(1)
+			return
+		}
+		ss.logf("forced command confirmed")
+	}
+
 	var rec *recording // or nil if disabled
-	if ss.Subsystem() != "sftp" {
+	if recordableSubsystem(ss.Subsystem()) {
 		if err := ss.handleSSHAgentForwarding(ss, lu); err != nil {
-			ss.logf("agent forwarding failed: %v", err)
+			ss.errf("agent forwarding failed: %v", err)
 		} else if ss.agentListener != nil {
 			// TODO(maisem/bradfitz): add a way to close all session resources
 			defer ss.agentListener.Close()
 		}
+		if err := ss.startX11Forwarding(ss, lu); err != nil {
+			ss.errf("X11 forwarding failed: %v", err)
+		} else if ss.x11 != nil {
+			defer ss.x11.Close()
+		}
 
-		if ss.shouldRecord() {
-			var err error
-			rec, err = ss.startNewRecording()
-			if err != nil {
-				var uve userVisibleError
-				if errors.As(err, &uve) {
-					fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
-				} else {
-					fmt.Fprintf(ss, "can't start new recording\r\n")
-				}
-				ss.logf("startNewRecording: %v", err)
-				ss.Exit(1)
-				return
-			}
-			ss.logf("startNewRecording: <nil>")
-			if rec != nil {
-				defer rec.Close()
-			}
+		var ok bool
+		if rec, ok = ss.maybeStartRecording(); !ok {
+			return
+		}
+		if rec != nil {
+			ss.rec.Store(rec)
+			defer rec.Close()
+		}
+		if sl := ss.startOutputSyslog(); sl != nil {
+			defer sl.Close()
 		}
 	}
 
 	err := ss.launchProcess()
 	if err != nil {
-		logf("start failed: %v", err.Error())
+		errf("start failed: %v", err.Error())
 		if errors.Is(err, context.Canceled) {
 			err := context.Cause(ss.ctx)
 			var uve userVisibleError
@@ -1145,13 +3541,17 @@ func (ss *sshSession) run() {
 		ss.Exit(1)
 		return
 	}
+	ss.auditCommand()
+	ss.journalSessionEvent("start", 0)
 	go ss.killProcessOnContextDone()
 
+	lim := ss.newOutputLimiter()
+	sftpLim := ss.newSFTPLimits()
 	var processDone atomic.Bool
 	go func() {
 		defer ss.wrStdin.Close()
-		if _, err := io.Copy(rec.writer("i", ss.wrStdin), ss); err != nil {
-			logf("stdin copy: %v", err)
+		if _, err := io.Copy(sftpLim.writer(rec.writer("i", countingWriter{&ss.bytesIn, ss.wrStdin, ss.markActive})), ss); err != nil {
+			errf("stdin copy: %v", err)
 			ss.cancelCtx(err)
 		}
 	}()
@@ -1164,11 +3564,11 @@ func (ss *sshSession) run() {
 	}
 	go func() {
 		defer ss.rdStdout.Close()
-		_, err := io.Copy(rec.writer("o", ss), ss.rdStdout)
+		_, err := io.Copy(sftpLim.writer(lim.writer(countingWriter{&ss.bytesOut, ss.outputWriter(rec, ss), ss.markActive})), ss.rdStdout)
 		if err != nil && !errors.Is(err, io.EOF) {
 			isErrBecauseProcessExited := processDone.Load() && errors.Is(err, syscall.EIO)
 			if !isErrBecauseProcessExited {
-				logf("stdout copy: %v, %T", err)
+				errf("stdout copy: %v, %T", err)
 				ss.cancelCtx(err)
 			}
 		}
@@ -1181,9 +3581,9 @@ func (ss *sshSession) run() {
 	if ss.rdStderr != nil {
 		go func() {
 			defer ss.rdStderr.Close()
-			_, err := io.Copy(ss.Stderr(), ss.rdStderr)
+			_, err := io.Copy(lim.writer(countingWriter{&ss.bytesOut, ss.Stderr(), ss.markActive}), ss.rdStderr)
 			if err != nil {
-				logf("stderr copy: %v", err)
+				errf("stderr copy: %v", err)
 			}
 			if openOutputStreams.Add(-1) == 0 {
 				ss.CloseWrite()
@@ -1194,6 +3594,7 @@ func (ss *sshSession) run() {
 
 	err = ss.cmd.Wait()
 	processDone.Store(true)
+	close(ss.processExited)
 
 	// This will either make the SSH Termination goroutine be a no-op,
 	// or itself will be a no-op because the process was killed by the
@@ -1208,43 +3609,348 @@ func (ss *sshSession) run() {
 	case <-outputDone:
 	case <-ss.ctx.Done():
 	}
+	if ss.stopScope != nil {
+		// Kill any processes the session left behind.
+		if err := ss.stopScope(); err != nil {
+			ss.vlogf("stopping systemd scope: %v", err)
+		}
+	}
+	ss.runPostSessionCommand()
+	ss.removeScratchDir()
 
+	code := 0
 	if err == nil {
 		ss.logf("Session complete")
-		ss.Exit(0)
-		return
-	}
-	if ee, ok := err.(*exec.ExitError); ok {
-		code := ee.ProcessState.ExitCode()
+	} else if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ProcessState.ExitCode()
 		ss.logf("Wait: code=%v", code)
-		ss.Exit(code)
-		return
+	} else {
+		ss.logf("Wait: %v", err)
+		code = 1
+	}
+	if rec != nil && sshRecordingSummary() {
+		if err := rec.writeSummary(ss.recordingSummary(rec, code)); err != nil {
+			errf("recording: error writing summary: %v", err)
+		}
 	}
+	ss.journalSessionEvent("stop", code)
+	ss.Exit(code)
+}
 
-	ss.logf("Wait: %v", err)
-	ss.Exit(1)
-	return
+// countingWriter is an io.Writer that counts the bytes written to w in n.
+type countingWriter struct {
+	n *atomic.Int64
+	w io.Writer
+
+	// active, if non-nil, is called on each write, before it's done.
+	active func()
 }
 
-// recordSSHToLocalDisk is a deprecated dev knob to allow recording SSH sessions
-// to local storage. It is only used if there is no recording configured by the
+func (w countingWriter) Write(p []byte) (int, error) {
+	if w.active != nil {
+		w.active()
+	}
+	n, err := w.w.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+// markActive records that ss's input or output flowed just now, resetting
+// its IdleTimeout.
+func (ss *sshSession) markActive() {
+	ss.lastActive.Store(ss.conn.srv.now().UnixNano())
+}
+
+// startIdleTimeout terminates ss once it's gone d without input or output,
+// as recorded by markActive. Rather than resetting a timer for every write,
+// it checks when ss was last active each time its timer fires, and sleeps
+// again for the rest of d if it's been active since. It returns a func to
+// stop it.
+func (ss *sshSession) startIdleTimeout(d time.Duration) (stop func()) {
+	ss.markActive()
+	var (
+		mu      sync.Mutex
+		t       *time.Timer
+		stopped bool
+	)
+	check := func() {
+		idle := ss.conn.srv.now().Sub(time.Unix(0, ss.lastActive.Load()))
+		if idle < d {
+			mu.Lock()
+			if !stopped {
+				t.Reset(d - idle)
+			}
+			mu.Unlock()
+			return
+		}
+		ss.logf("idle for %v; terminating", idle.Round(time.Millisecond))
+		ss.cancelCtx(userVisibleError{
+			fmt.Sprintf("Idle timeout of %v elapsed.", d),
+			context.DeadlineExceeded,
+		})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	t = time.AfterFunc(d, check)
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = true
+		t.Stop()
+	}
+}
+
+// recordingSummary is the summary of a session that ends its recordings if
+// TS_SSH_RECORDING_SUMMARY is set.
+type recordingSummary struct {
+	Duration float64 `json:"duration"` // seconds since the start of the recording
+	ExitCode int     `json:"exitCode"` // or -1 if the process was killed by a signal
+	BytesIn  int64   `json:"bytesIn"`  // bytes sent to the process's stdin
+	BytesOut int64   `json:"bytesOut"` // bytes from its stdout and stderr
+
+	// Reason is why the session ended: "exited" if the process exited on
+	// its own, or the message or error it was terminated with.
+	Reason string `json:"reason"`
+}
+
+// recordingSummary returns the summary of ss, which is recorded in rec and
+// whose process exited with code.
+func (ss *sshSession) recordingSummary(rec *recording, code int) recordingSummary {
+	reason := "exited"
+	if cause := context.Cause(ss.ctx); cause != nil {
+		if ste, ok := cause.(SSHTerminationError); ok && ste.SSHTerminationMessage() != "" {
+			reason = ste.SSHTerminationMessage()
+		} else {
+			reason = cause.Error()
+		}
+	}
+	return recordingSummary{
+		Duration: time.Since(rec.start).Seconds(),
+		ExitCode: code,
+		BytesIn:  ss.bytesIn.Load(),
+		BytesOut: ss.bytesOut.Load(),
+		Reason:   reason,
+	}
+}
+
+// byteLimiter terminates a session once more than max bytes have been
+// written through its writers, such as by enforcing the MaxOutputBytes of a
+// session's action on its stdout and stderr combined.
+type byteLimiter struct {
+	ss     *sshSession
+	max    int64
+	what   string               // what's limited, capitalized, like "Output"
+	metric *clientmetric.Metric // incremented when max is exceeded
+	n      atomic.Int64         // bytes written so far
+}
+
+// newOutputLimiter returns the byteLimiter for the output of ss, or nil if
+// its action doesn't limit its output.
+func (ss *sshSession) newOutputLimiter() *byteLimiter {
+	max := ss.conn.finalAction.MaxOutputBytes
+	if max <= 0 {
+		return nil
+	}
+	return &byteLimiter{ss: ss, max: max, what: "Output", metric: metricOutputLimitExceeded}
+}
+
+// writer returns w wrapped to count the bytes written to it towards l.
+// It returns w itself if l is nil.
+func (l *byteLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return limitedWriter{l, w}
+}
+
+type limitedWriter struct {
+	l *byteLimiter
+	w io.Writer
+}
+
+// Write writes p to w, up to the limit. Once the limit is exceeded, it
+// terminates the session and discards the rest of what's written, so that
+// the copies to w finish normally.
+func (w limitedWriter) Write(p []byte) (int, error) {
+	l := w.l
+	n := l.n.Add(int64(len(p)))
+	if n <= l.max {
+		return w.w.Write(p)
+	}
+	if prev := n - int64(len(p)); prev <= l.max {
+		// This write exceeds the limit first.
+		l.ss.conn.srv.addMetric(l.metric, 1)
+		l.ss.logf("%s limit of %d bytes exceeded; terminating session", strings.ToLower(l.what), l.max)
+		l.ss.cancelCtx(userVisibleError{
+			fmt.Sprintf("%s limit of %d bytes exceeded.", l.what, l.max),
+			errByteLimitExceeded,
+		})
+		if _, err := w.w.Write(p[:l.max-prev]); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+var errByteLimitExceeded = errors.New("byte limit exceeded")
+
+// sftpLimits enforces the SFTPMaxBytes and SFTPMaxBytesPerSecond of a
+// session's action on its SFTP protocol stream, in both directions combined.
+type sftpLimits struct {
+	ctx   context.Context // the session's
+	bytes *byteLimiter    // or nil if unlimited
+	rate  *rate.Limiter   // or nil if unlimited
+}
+
+// sftpRateBurst is the most bytes of an SFTP stream that are let through at
+// once when its rate is limited.
+const sftpRateBurst = 32 << 10
+
+// newSFTPLimits returns the sftpLimits of ss, or nil if it isn't an SFTP
+// session or its action doesn't limit SFTP transfers.
+func (ss *sshSession) newSFTPLimits() *sftpLimits {
+	if ss.Subsystem() != "sftp" {
+		return nil
+	}
+	a := ss.conn.finalAction
+	if a.SFTPMaxBytes <= 0 && a.SFTPMaxBytesPerSecond <= 0 {
+		return nil
+	}
+	l := &sftpLimits{ctx: ss.ctx}
+	if a.SFTPMaxBytes > 0 {
+		l.bytes = &byteLimiter{ss: ss, max: a.SFTPMaxBytes, what: "SFTP transfer", metric: metricSFTPLimitExceeded}
+	}
+	if bps := a.SFTPMaxBytesPerSecond; bps > 0 {
+		l.rate = rate.NewLimiter(rate.Limit(bps), int(min(bps, sftpRateBurst)))
+	}
+	return l
+}
+
+// writer returns w wrapped to enforce l on the bytes written to it.
+// It returns w itself if l is nil.
+func (l *sftpLimits) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	w = l.bytes.writer(w)
+	if l.rate != nil {
+		w = rateLimitedWriter{l.ctx, l.rate, w}
+	}
+	return w
+}
+
+// rateLimitedWriter is an io.Writer that writes to w no faster than lim
+// allows. Writes fail once ctx is done.
+type rateLimitedWriter struct {
+	ctx context.Context
+	lim *rate.Limiter
+	w   io.Writer
+}
+
+func (w rateLimitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p[:min(len(p), w.lim.Burst())]
+		if err := w.lim.WaitN(w.ctx, len(chunk)); err != nil {
+			return n, err
+		}
+		m, err := w.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// recordSSHToLocalDisk is a deprecated dev knob to allow recording SSH sessions
+// to local storage. It is only used if there is no recording configured by the
 // coordination server. This will be removed in the future.
 var recordSSHToLocalDisk = envknob.RegisterBool("TS_DEBUG_LOG_SSH")
 
-// recorders returns the list of recorders to use for this session.
-// If the final action has a non-empty list of recorders, that list is
-// returned. Otherwise, the list of recorders from the initial action
-// is returned.
-func (ss *sshSession) recorders() ([]netip.AddrPort, *tailcfg.SSHRecorderFailureAction) {
-	if len(ss.conn.finalAction.Recorders) > 0 {
-		return ss.conn.finalAction.Recorders, ss.conn.finalAction.OnRecordingFailure
+// recordingSinks returns the sinks to record this session to. If the final
+// action has any recording destinations, its sinks are returned. Otherwise,
+// those of the initial action are.
+//
+// The action's Recorders, if any, are returned as the first sink, in
+// SSHRecordingFormatCast format. If the action's RecorderGroups resolve to
+// no recorders, that sink has none, so that it fails to start as its
+// OnRecordingFailure says, rather than the session going unrecorded. Sinks
+// without their own OnRecordingFailure inherit the action's.
+func (ss *sshSession) recordingSinks() []*tailcfg.SSHRecordingSink {
+	return ss.conn.recordingSinks()
+}
+
+// recordingSinks returns the recording sinks of c's sessions; see
+// (*sshSession).recordingSinks.
+func (c *conn) recordingSinks() []*tailcfg.SSHRecordingSink {
+	a := c.finalAction
+	if len(a.Recorders) == 0 && len(a.RecorderGroups) == 0 && len(a.RecordingSinks) == 0 {
+		a = c.action0
+	}
+	var sinks []*tailcfg.SSHRecordingSink
+	if recorders := resolveRecorders(a, c.recordingPolicy()); len(recorders) > 0 || len(a.RecorderGroups) > 0 {
+		sinks = append(sinks, &tailcfg.SSHRecordingSink{
+			Recorders:          recorders,
+			Format:             tailcfg.SSHRecordingFormatCast,
+			OnRecordingFailure: a.OnRecordingFailure,
+		})
+	}
+	for _, sink := range a.RecordingSinks {
+		if sink == nil || len(sink.Recorders) == 0 {
+			continue
+		}
+		sink = sink.Clone()
+		if sink.Format == "" {
+			sink.Format = tailcfg.SSHRecordingFormatCast
+		}
+		if sink.OnRecordingFailure == nil {
+			sink.OnRecordingFailure = a.OnRecordingFailure
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+// recordingPolicy returns the SSH policy c's recorder groups are resolved
+// in, or nil if there's none. It's read the first time it's needed.
+func (c *conn) recordingPolicy() *tailcfg.SSHPolicy {
+	c.recordingPolicyOnce.Do(func() {
+		c.recordingPol, _ = c.sshPolicy()
+	})
+	return c.recordingPol
+}
+
+// resolveRecorders returns the recorders of a: those in the groups of pol
+// named by a.RecorderGroups, in order and without duplicates, or if none of
+// those groups are defined, a.Recorders. pol may be nil.
+func resolveRecorders(a *tailcfg.SSHAction, pol *tailcfg.SSHPolicy) []netip.AddrPort {
+	if len(a.RecorderGroups) == 0 || pol == nil {
+		return a.Recorders
+	}
+	var recorders []netip.AddrPort
+	for _, name := range a.RecorderGroups {
+		for _, ap := range pol.RecorderGroups[name] {
+			if !slices.Contains(recorders, ap) {
+				recorders = append(recorders, ap)
+			}
+		}
+	}
+	if len(recorders) == 0 {
+		return a.Recorders
 	}
-	return ss.conn.action0.Recorders, ss.conn.action0.OnRecordingFailure
+	return recorders
+}
+
+// recordableSubsystem reports whether the I/O of sessions of the subsystem
+// sub ("" for none) is recorded. The binary protocols of subsystems such as
+// SFTP aren't.
+func recordableSubsystem(sub string) bool {
+	return sub == ""
 }
 
 func (ss *sshSession) shouldRecord() bool {
-	recs, _ := ss.recorders()
-	return len(recs) > 0 || recordSSHToLocalDisk()
+	return len(ss.recordingSinks()) > 0 || recordSSHToLocalDisk() || ss.conn.srv.testRecordingSink != nil
 }
 
 type sshConnInfo struct {
@@ -1262,12 +3968,32 @@ type sshConnInfo struct {
 
 	// uprof is node's UserProfile.
 	uprof tailcfg.UserProfile
+
+	// proxied is whether node is a jump host proxying the connection for one
+	// of its users, per its SSHAction.ProxyTo, as it says with its client
+	// version. Such connections are only authorized by rules whose
+	// principals name node, by Node or NodeIP, as the others don't trust it
+	// to act for its users.
+	proxied bool
+
+	// proxiedFor, if proxied, is the login name of the user node says it's
+	// proxying for. It's only logged.
+	proxiedFor string
 }
 
 func (ci *sshConnInfo) String() string {
 	return fmt.Sprintf("%v->%v@%v", ci.src, ci.sshUser, ci.dst)
 }
 
+// identityKey returns a key identifying who c is from: its user, or its
+// node if the node is tagged, as tagged nodes don't belong to a user.
+func (c *conn) identityKey() string {
+	if c.info.node.Valid() && c.info.node.IsTagged() {
+		return "node:" + string(c.info.node.StableID())
+	}
+	return "user:" + c.info.uprof.LoginName
+}
+
 func (c *conn) ruleExpired(r *tailcfg.SSHRule) bool {
 	if r.RuleExpires == nil {
 		return false
@@ -1275,16 +4001,70 @@ func (c *conn) ruleExpired(r *tailcfg.SSHRule) bool {
 	return r.RuleExpires.Before(c.srv.now())
 }
 
-func (c *conn) evalSSHPolicy(pol *tailcfg.SSHPolicy, pubKey gossh.PublicKey) (a *tailcfg.SSHAction, localUser string, ok bool) {
-	for _, r := range pol.Rules {
-		if a, localUser, err := c.matchRule(r, pubKey); err == nil {
-			return a, localUser, true
+// evalSSHPolicy returns the action and local user of the first rule in pol
+// that matches the conn. If none match, it returns a nil action and the deny*
+// reason code of the rule that came closest to matching.
+func (c *conn) evalSSHPolicy(pol *tailcfg.SSHPolicy, pubKey gossh.PublicKey) (a *tailcfg.SSHAction, localUser string, denyCode string) {
+	a, localUser, _, denyCode = c.evalSSHPolicyRules(pol, pubKey, nil)
+	return a, localUser, denyCode
+}
+
+// evalSSHPolicyRules is like evalSSHPolicy, but also returns the index in
+// pol.Rules of the matching rule, or -1 if none match. If onMismatch is
+// non-nil, it's called with the index and matchRule error of each rule that
+// didn't match.
+func (c *conn) evalSSHPolicyRules(pol *tailcfg.SSHPolicy, pubKey gossh.PublicKey, onMismatch func(i int, err error)) (a *tailcfg.SSHAction, localUser string, ruleIndex int, denyCode string) {
+	denyCode = denyNoMatch
+	for i, r := range pol.Rules {
+		a, localUser, err := c.matchRule(r, pubKey)
+		if err == nil {
+			return a, localUser, i, ""
+		}
+		if onMismatch != nil {
+			onMismatch(i, err)
 		}
+		if code := c.denialCode(r, err); denialCodeRank(code) > denialCodeRank(denyCode) {
+			denyCode = code
+		}
+	}
+	return nil, "", -1, denyCode
+}
+
+// denialCode returns the deny* reason code for rule r not matching with err.
+//
+// matchRule checks the rule's expiry and ssh-users before its principals, so
+// an expired or user-mismatched rule is only blamed if its principals
+// otherwise match the Tailscale identity of the conn. Otherwise, the rule
+// wasn't meant for the conn at all, and it's just no_match.
+func (c *conn) denialCode(r *tailcfg.SSHRule, err error) string {
+	if err != errRuleExpired && err != errUserMatch {
+		return denyNoMatch
+	}
+	if !slices.ContainsFunc(r.Principals, func(p *tailcfg.SSHPrincipal) bool {
+		return p != nil && c.principalMatchesTailscaleIdentity(p)
+	}) {
+		return denyNoMatch
+	}
+	if err == errRuleExpired && (r.Action.Reject || mapLocalUser(r.SSHUsers, c.info.sshUser) != "") {
+		return denyRuleExpired
+	}
+	return denyUserMismatch
+}
+
+// denialCodeRank ranks the deny* reason codes returned by denialCode from
+// least to most specific.
+func denialCodeRank(code string) int {
+	switch code {
+	case denyUserMismatch:
+		return 1
+	case denyRuleExpired:
+		return 2
 	}
-	return nil, "", false
+	return 0
 }
 
-// internal errors for testing; they don't escape to callers or logs.
+// internal errors for testing and for the diagnostics of EvalPolicy; they
+// don't escape to SSH clients.
 var (
 	errNilRule        = errors.New("nil rule")
 	errNilAction      = errors.New("nil action")
@@ -1296,14 +4076,14 @@ func (c *conn) evalSSHPolicy(pol *tailcfg.SSHPolicy, pubKey gossh.PublicKey) (a
 
 func (c *conn) matchRule(r *tailcfg.SSHRule, pubKey gossh.PublicKey) (a *tailcfg.SSHAction, localUser string, err error) {
 	defer func() {
-		c.vlogf("matchRule(%+v): %v", r, err)
+		c.authf("matchRule(%+v): %v", r, err)
 	}()
 
 	if c == nil {
 		return nil, "", errInvalidConn
 	}
 	if c.info == nil {
-		c.logf("invalid connection state")
+		c.errf("invalid connection state")
 		return nil, "", errInvalidConn
 	}
 	if r == nil {
@@ -1332,12 +4112,37 @@ func (c *conn) matchRule(r *tailcfg.SSHRule, pubKey gossh.PublicKey) (a *tailcfg
 	return r.Action, localUser, nil
 }
 
+// normalizeSSHUser returns sshUser normalized according to the comma-separated
+// list of normalizations in opts, applied in order:
+//
+//   - "lowercase" converts sshUser to lower case.
+//   - "strip-domain" removes any "@domain" suffix, so "alice@corp" becomes
+//     "alice".
+//
+// Unknown normalizations are ignored.
+func normalizeSSHUser(sshUser, opts string) string {
+	for _, opt := range strings.Split(opts, ",") {
+		switch strings.TrimSpace(opt) {
+		case "lowercase":
+			sshUser = strings.ToLower(sshUser)
+		case "strip-domain":
+			sshUser, _, _ = strings.Cut(sshUser, "@")
+		}
+	}
+	return sshUser
+}
+
 func mapLocalUser(ruleSSHUsers map[string]string, reqSSHUser string) (localUser string) {
 	v, ok := ruleSSHUsers[reqSSHUser]
 	if !ok {
 		v = ruleSSHUsers["*"]
 	}
 	if v == "=" {
+		if _, ok := numericLocalUser(reqSSHUser); ok {
+			// Local users may only be given by uid by the policy, not
+			// by clients.
+			return ""
+		}
 		return reqSSHUser
 	}
 	return v
@@ -1361,6 +4166,10 @@ func (c *conn) principalMatches(p *tailcfg.SSHPrincipal, pubKey gossh.PublicKey)
 	if !c.principalMatchesTailscaleIdentity(p) {
 		return false, nil
 	}
+	if p.NodeCap != "" && !c.info.node.HasCap(p.NodeCap) {
+		c.vlogf("principal requires node capability %q, which %v lacks", p.NodeCap, c.info.src.Addr())
+		return false, nil
+	}
 	return c.principalMatchesPubKey(p, pubKey)
 }
 
@@ -1369,9 +4178,6 @@ func (c *conn) principalMatches(p *tailcfg.SSHPrincipal, pubKey gossh.PublicKey)
 // This function does not consider PubKeys.
 func (c *conn) principalMatchesTailscaleIdentity(p *tailcfg.SSHPrincipal) bool {
 	ci := c.info
-	if p.Any {
-		return true
-	}
 	if !p.Node.IsZero() && ci.node.Valid() && p.Node == ci.node.StableID() {
 		return true
 	}
@@ -1380,6 +4186,14 @@ func (c *conn) principalMatchesTailscaleIdentity(p *tailcfg.SSHPrincipal) bool {
 			return true
 		}
 	}
+	if ci.proxied {
+		// Only principals naming the jump host trust it to act for its
+		// users.
+		return false
+	}
+	if p.Any {
+		return true
+	}
 	if p.UserLogin != "" && ci.uprof.LoginName == p.UserLogin {
 		return true
 	}
@@ -1483,6 +4297,28 @@ type CastHeader struct {
 	// It may be shared across multiple sessions over the same connection in
 	// case of SSH multiplexing.
 	ConnectionID string `json:"connectionID"`
+
+	// SessionID uniquely identifies the recorded session. It is the same ID
+	// that is shared with control.
+	SessionID string `json:"sessionID,omitempty"`
+
+	// RuleIndex is the index in the SSHPolicy rules of the rule that
+	// authorized the session, as first matched before any HoldAndDelegate.
+	// SSH rules have no identifiers other than their index.
+	RuleIndex int `json:"ruleIndex"`
+
+	// Part is the index, from zero, of this recording among the parts of
+	// a session's recording split by TS_SSH_RECORDING_ROLLOVER. Each part
+	// has the header of the first one, but for Part and Timestamp, which
+	// is when the part started; its events' times are relative to that.
+	// Playing back the parts of a SessionID in order plays back the
+	// session.
+	Part int `json:"part,omitempty"`
+
+	// ApprovalMetadata is the SSHAction.ApprovalMetadata of the action
+	// that accepted the session, such as who approved it by way of a
+	// HoldAndDelegate webhook.
+	ApprovalMetadata map[string]string `json:"approvalMetadata,omitempty"`
 }
 
 // sessionRecordingClient returns an http.Client that uses srv.lb.Dialer() to
@@ -1541,6 +4377,7 @@ func (ss *sshSession) connectToRecorder(ctx context.Context, recs []netip.AddrPo
 		return nil, nil, nil, err
 	}
 
+	srv := ss.conn.srv
 	var errs []error
 	var attempts []*tailcfg.SSHRecordingAttempt
 	for _, ap := range recs {
@@ -1548,6 +4385,13 @@ func (ss *sshSession) connectToRecorder(ctx context.Context, recs []netip.AddrPo
 			Recorder: ap,
 		}
 		attempts = append(attempts, attempt)
+		if !srv.recorderBreaker.allow(ap, srv.now()) {
+			err := fmt.Errorf("recording: skipping recorder %v after repeated failures", ap)
+			attempt.FailureMessage = err.Error()
+			errs = append(errs, err)
+			srv.addMetric(metricRecorderSkipped, 1)
+			continue
+		}
 
 		// We dial the recorder and wait for it to send a 100-continue
 		// response before returning from this function. This ensures that
@@ -1567,6 +4411,7 @@ func (ss *sshSession) connectToRecorder(ctx context.Context, recs []netip.AddrPo
 			err = fmt.Errorf("recording: error starting recording: %w", err)
 			attempt.FailureMessage = err.Error()
 			errs = append(errs, err)
+			srv.recorderDone(ap, false)
 			continue
 		}
 		// We set the Expect header to 100-continue, so that the recorder
@@ -1600,31 +4445,139 @@ func (ss *sshSession) connectToRecorder(ctx context.Context, recs []netip.AddrPo
 			}
 			attempt.FailureMessage = err.Error()
 			errs = append(errs, err)
+			srv.recorderDone(ap, false)
 			continue
 		}
+		srv.recorderDone(ap, true)
 		return pw, attempts, errChan, nil
 	}
 	return nil, attempts, nil, multierr.New(errs...)
 }
 
+// recorderDone records in srv.recorderBreaker whether connecting to the
+// recorder ap succeeded, logging and counting changes of its health.
+func (srv *server) recorderDone(ap netip.AddrPort, ok bool) {
+	opened, closed := srv.recorderBreaker.done(ap, ok, srv.now())
+	switch {
+	case opened:
+		srv.logf("recording: recorder %v keeps failing; skipping it for %v", ap, recorderBreakerCooldown())
+		srv.addMetric(metricRecordersUnhealthy, 1)
+	case closed:
+		srv.logf("recording: recorder %v is healthy again", ap)
+		srv.addMetric(metricRecordersUnhealthy, -1)
+	}
+}
+
 func (ss *sshSession) openFileForRecording(now time.Time) (_ io.WriteCloser, err error) {
-	varRoot := ss.conn.srv.lb.TailscaleVarRoot()
-	if varRoot == "" {
-		return nil, errors.New("no var root for recording storage")
+	dir, err := ss.conn.srv.recordingsDir()
+	if err != nil {
+		return nil, err
 	}
-	dir := filepath.Join(varRoot, "ssh-sessions")
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
 	}
-	f, err := os.CreateTemp(dir, fmt.Sprintf("ssh-session-%v-*.cast", now.UnixNano()))
+	fi, err := checkRecordingsDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	gz := ss.gzipsRecordings()
+	suffix := recordingFileSuffix
+	if gz {
+		suffix += recordingGzipSuffix
+	}
+	var f *os.File
+	if sshRecordingAppendOnly() {
+		f, err = createAppendOnlyRecording(dir, now, suffix)
+	} else {
+		f, err = os.CreateTemp(dir, fmt.Sprintf("%s%v-*%s", recordingFilePrefix, now.UnixNano(), suffix))
+	}
 	if err != nil {
 		return nil, err
 	}
-	return f, nil
+	// Make sure that dir wasn't replaced after it was checked.
+	if fi2, err := os.Lstat(dir); err != nil || !os.SameFile(fi, fi2) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("recordings directory %s changed while creating recording", dir)
+	}
+	var w io.WriteCloser = f
+	if sshRecordingAppendOnly() {
+		w = appendOnlyFile{f}
+	}
+	if gz {
+		w = newGzipRecordingFile(w)
+	}
+	return w, nil
+}
+
+// gzipsRecordings reports whether ss's recordings to local disk are
+// gzip-compressed, per TS_SSH_RECORDING_GZIP.
+func (ss *sshSession) gzipsRecordings() bool {
+	return sshRecordingGzip()
+}
+
+// maybeStartRecording starts recording the session if it should be
+// recorded. If that fails, it tells the user why, exits the session and
+// returns false. The returned recording may be nil even if ok.
+func (ss *sshSession) maybeStartRecording() (rec *recording, ok bool) {
+	if !ss.shouldRecord() || ss.declinedRecording() {
+		return nil, true
+	}
+	rec, err := ss.startNewRecording()
+	if err != nil {
+		var uve userVisibleError
+		if errors.As(err, &uve) {
+			fmt.Fprintf(ss, "%s\r\n", uve.SSHTerminationMessage())
+		} else {
+			fmt.Fprintf(ss, "can't start new recording\r\n")
+		}
+		ss.errf("startNewRecording: %v", err)
+		ss.Exit(1)
+		return nil, false
+	}
+	ss.logf("startNewRecording: <nil>")
+	return rec, true
+}
+
+// noRecordingEnvVar is the environment variable that clients send, with a
+// true value like "1", to opt out of having their session recorded, if the
+// action's RecordingOptional allows it.
+const noRecordingEnvVar = "TAILSCALE_SSH_NO_RECORDING"
+
+// declinedRecording reports whether the user of ss opted out of having it
+// recorded with noRecordingEnvVar, and its action allows that. Opt-outs
+// are logged, whether or not they're honored, and honored ones are reported
+// to control.
+func (ss *sshSession) declinedRecording() bool {
+	v := envValFromList(ss.Environ(), noRecordingEnvVar)
+	if optOut, _ := strconv.ParseBool(v); !optOut {
+		return false
+	}
+	if !ss.conn.finalAction.RecordingOptional {
+		ss.logf("recording: ignoring opt-out; policy requires recording")
+		return false
+	}
+	ss.logf("recording: user opted out; not recording session")
+	for _, sink := range ss.recordingSinks() {
+		if f := sink.OnRecordingFailure; f != nil && f.NotifyURL != "" {
+			re := ss.newEventNotifyRequest(ss.conn.srv.lb.NodeKey(), tailcfg.SSHSessionRecordingDeclined)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), eventNotifyTimeout)
+				defer cancel()
+				ss.sendEventNotify(ctx, re, f.NotifyURL)
+			}()
+			break
+		}
+	}
+	return true
 }
 
-// startNewRecording starts a new SSH session recording.
-// It may return a nil recording if recording is not available.
+// startNewRecording starts a new SSH session recording, writing to each of
+// the session's recording sinks.
+//
+// Sinks fail independently: a sink that fails to start is skipped, unless its
+// OnRecordingFailure rejects the session. It may return a nil recording if
+// recording is not available.
 func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	// We store the node key as soon as possible when creating
 	// a new recording incase of FUS.
@@ -1632,15 +4585,8 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	if nodeKey.IsZero() {
 		return nil, errors.New("ssh server is unavailable: no node key")
 	}
-
-	recorders, onFailure := ss.recorders()
-	var localRecording bool
-	if len(recorders) == 0 {
-		if recordSSHToLocalDisk() {
-			localRecording = true
-		} else {
-			return nil, errors.New("no recorders configured")
-		}
+	if ss.conn.nodeKeyChanged() && !sshKeepSessionsOnNodeKeyChange() {
+		return nil, errNodeKeyChanged
 	}
 
 	var w ssh.Window
@@ -1648,78 +4594,27 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		w = ptyReq.Window
 	}
 
-	term := envValFromList(ss.Environ(), "TERM")
+	term := ss.allowedTerm(envValFromList(ss.Environ(), "TERM"))
 	if term == "" {
-		term = "xterm-256color" // something non-empty
+		term = defaultTerm // something non-empty
 	}
 
+	if !ss.acquireRecordingSlot() {
+		return nil, ss.recordingSlotUnavailable(nodeKey)
+	}
 	now := time.Now()
 	rec := &recording{
-		ss:       ss,
-		start:    now,
-		failOpen: onFailure == nil || onFailure.TerminateSessionWithMessage == "",
-	}
-
-	// We want to use a background context for uploading and not ss.ctx.
-	// ss.ctx is closed when the session closes, but we don't want to break the upload at that time.
-	// Instead we want to wait for the session to close the writer when it finishes.
-	ctx := context.Background()
-	if localRecording {
-		rec.out, err = ss.openFileForRecording(now)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		var errChan <-chan error
-		var attempts []*tailcfg.SSHRecordingAttempt
-		rec.out, attempts, errChan, err = ss.connectToRecorder(ctx, recorders)
-		if err != nil {
-			if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
-				eventType := tailcfg.SSHSessionRecordingFailed
-				if onFailure.RejectSessionWithMessage != "" {
-					eventType = tailcfg.SSHSessionRecordingRejected
-				}
-				ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
-			}
-
-			if onFailure != nil && onFailure.RejectSessionWithMessage != "" {
-				ss.logf("recording: error starting recording (rejecting session): %v", err)
-				return nil, userVisibleError{
-					error: err,
-					msg:   onFailure.RejectSessionWithMessage,
-				}
-			}
-			ss.logf("recording: error starting recording (failing open): %v", err)
-			return nil, nil
-		}
-		go func() {
-			err := <-errChan
-			if err == nil {
-				// Success.
-				ss.logf("recording: finished uploading recording")
-				return
-			}
-			if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
-				lastAttempt := attempts[len(attempts)-1]
-				lastAttempt.FailureMessage = err.Error()
-
-				eventType := tailcfg.SSHSessionRecordingFailed
-				if onFailure.TerminateSessionWithMessage != "" {
-					eventType = tailcfg.SSHSessionRecordingTerminated
-				}
-
-				ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
-			}
-			if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
-				ss.logf("recording: error uploading recording (closing session): %v", err)
-				ss.cancelCtx(userVisibleError{
-					error: err,
-					msg:   onFailure.TerminateSessionWithMessage,
-				})
-				return
-			}
-			ss.logf("recording: error uploading recording (failing open): %v", err)
-		}()
+		ss:        ss,
+		nodeKey:   nodeKey,
+		start:     now,
+		wallClock: sshRecordingWallClock(),
+		input:     ss.recordsInput(),
+	}
+	rec.holdsSlot.Store(true)
+	rec.sinks, err = ss.openRecordingSinks(nodeKey, now)
+	if err != nil || len(rec.sinks) == 0 {
+		rec.Close()
+		return nil, err
 	}
 
 	ch := CastHeader{
@@ -1744,6 +4639,15 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		SrcNode:      strings.TrimSuffix(ss.conn.info.node.Name(), "."),
 		SrcNodeID:    ss.conn.info.node.StableID(),
 		ConnectionID: ss.conn.connID,
+		SessionID:    ss.sharedID,
+		RuleIndex:    ss.conn.ruleIndex,
+	}
+	if a := ss.conn.finalAction; a != nil {
+		ch.ApprovalMetadata = a.ApprovalMetadata
+	}
+	for _, kv := range ss.identityEnv() {
+		k, v, _ := strings.Cut(kv, "=")
+		ch.Env[k] = v
 	}
 	if !ss.conn.info.node.IsTagged() {
 		ch.SrcNodeUser = ss.conn.info.uprof.LoginName
@@ -1751,12 +4655,9 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 	} else {
 		ch.SrcNodeTags = ss.conn.info.node.Tags().AsSlice()
 	}
-	j, err := json.Marshal(ch)
-	if err != nil {
-		return nil, err
-	}
-	j = append(j, '\n')
-	if _, err := rec.out.Write(j); err != nil {
+	rec.header = ch
+	if err := rec.writeHeader(ch); err != nil {
+		rec.Close()
 		if errors.Is(err, io.ErrClosedPipe) && ss.ctx.Err() != nil {
 			// If we got an io.ErrClosedPipe, it's likely because
 			// the recording server closed the connection on us. Return
@@ -1765,70 +4666,961 @@ func (ss *sshSession) startNewRecording() (_ *recording, err error) {
 		}
 		return nil, err
 	}
+	rec.startFlushing(recordingFlushInterval())
+	rec.startRollover(sshRecordingRollover())
+	ss.conn.srv.trackRecording(rec)
 	return rec, nil
 }
 
-// notifyControl sends a SSHEventNotifyRequest to control over noise.
-// A SSHEventNotifyRequest is sent when an action or state reached during
-// an SSH session is a defined EventType.
-func (ss *sshSession) notifyControl(ctx context.Context, nodeKey key.NodePublic, notifyType tailcfg.SSHEventType, attempts []*tailcfg.SSHRecordingAttempt, url string) {
-	re := tailcfg.SSHEventNotifyRequest{
-		EventType:         notifyType,
-		ConnectionID:      ss.conn.connID,
-		CapVersion:        tailcfg.CurrentCapabilityVersion,
-		NodeKey:           nodeKey,
-		SrcNode:           ss.conn.info.node.ID(),
-		SSHUser:           ss.conn.info.sshUser,
-		LocalUser:         ss.conn.localUser.Username,
-		RecordingAttempts: attempts,
-	}
-
-	body, err := json.Marshal(re)
-	if err != nil {
-		ss.logf("notifyControl: unable to marshal SSHNotifyRequest:", err)
-		return
+// openRecordingSinks opens the sinks that a recording of ss starting at now
+// writes to: the test sink, if any, or else those of the session's recording
+// sinks that could be started, or else a local recording file.
+//
+// Sinks fail independently, as described at startNewRecording; it returns
+// an error if one fails that rejects the session, or if there's nothing to
+// record to.
+func (ss *sshSession) openRecordingSinks(nodeKey key.NodePublic, now time.Time) ([]*recordingSink, error) {
+	if testSink := ss.conn.srv.testRecordingSink; testSink != nil {
+		return []*recordingSink{{
+			format:   tailcfg.SSHRecordingFormatCast,
+			dest:     "test",
+			failOpen: true,
+			out:      testSink(),
+		}}, nil
+	}
+	sinks := ss.recordingSinks()
+	if len(sinks) == 0 {
+		if !recordSSHToLocalDisk() {
+			return nil, errors.New("no recorders configured")
+		}
+		out, err := ss.openFileForRecording(now)
+		if err != nil {
+			countRecordingOutcome(false, recordingRejected)
+			return nil, err
+		}
+		return []*recordingSink{{
+			format:       tailcfg.SSHRecordingFormatCast,
+			dest:         "local",
+			failOpen:     true,
+			out:          out,
+			writeLatency: metricRecordingWriteLatency,
+		}}, nil
 	}
 
-	req, err := http.NewRequestWithContext(ctx, httpm.POST, url, bytes.NewReader(body))
-	if err != nil {
-		ss.logf("notifyControl: unable to create request:", err)
-		return
+	// We want to use a background context for uploading and not ss.ctx.
+	// ss.ctx is closed when the session closes, but we don't want to break the upload at that time.
+	// Instead we want to wait for the session to close the writer when it finishes.
+	ctx := context.Background()
+	var rss []*recordingSink
+	for _, sink := range sinks {
+		rs, err := ss.startRecordingSink(ctx, nodeKey, sink)
+		if err != nil {
+			closeRecordingSinks(rss)
+			return nil, err
+		}
+		if rs != nil {
+			rss = append(rss, rs)
+		}
 	}
+	return rss, nil
+}
 
-	resp, err := ss.conn.srv.lb.DoNoiseRequest(req)
-	if err != nil {
-		ss.logf("notifyControl: unable to send noise request:", err)
-		return
+// acquireRecordingSlot counts a new recording of ss in srv.activeRecordings,
+// waiting up to sshRecordingSlotWait for there to be fewer than
+// sshMaxRecordings if that's set. It reports whether it did; if so, the slot
+// must be released with releaseRecordingSlot, which recording.Close does.
+func (ss *sshSession) acquireRecordingSlot() bool {
+	srv := ss.conn.srv
+	var timeout <-chan time.Time
+	if d := sshRecordingSlotWait(); d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	for waited := false; ; waited = true {
+		max := sshMaxRecordings()
+		srv.mu.Lock()
+		if max <= 0 || srv.activeRecordings < max {
+			srv.activeRecordings++
+			srv.mu.Unlock()
+			if waited {
+				ss.logf("recording: got a recording slot after waiting")
+			}
+			return true
+		}
+		if srv.recordingSlotFreed == nil {
+			srv.recordingSlotFreed = make(chan struct{})
+		}
+		freed := srv.recordingSlotFreed
+		srv.mu.Unlock()
+		if !waited {
+			srv.addMetric(metricRecordingsCapped, 1)
+			if timeout == nil {
+				return false
+			}
+			ss.logf("recording: %d sessions already recorded; waiting for one to end", max)
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			return false
+		case <-ss.ctx.Done():
+			return false
+		}
 	}
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		ss.logf("notifyControl: noise request returned status code %v", resp.StatusCode)
-		return
+// releaseRecordingSlot releases a slot of acquireRecordingSlot, waking up
+// the sessions waiting for one.
+func (srv *server) releaseRecordingSlot() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.activeRecordings--
+	if srv.recordingSlotFreed != nil {
+		close(srv.recordingSlotFreed)
+		srv.recordingSlotFreed = nil
 	}
 }
 
-// recording is the state for an SSH session recording.
-type recording struct {
-	ss    *sshSession
-	start time.Time
-
-	// failOpen specifies whether the session should be allowed to
-	// continue if writing to the recording fails.
-	failOpen bool
-
-	mu  sync.Mutex // guards writes to, close of out
-	out io.WriteCloser
-}
+// recordingSlotUnavailable handles a session that can't be recorded because
+// sshMaxRecordings sessions already are, like startRecordingSink handles
+// unreachable recorders: it notifies control of the failure, and returns an
+// error if any recording sink's OnRecordingFailure rejects the session.
+// Otherwise, the session fails open, and it returns nil.
+func (ss *sshSession) recordingSlotUnavailable(nodeKey key.NodePublic) error {
+	err := errors.New("recording: too many sessions already being recorded")
+	sinks := ss.recordingSinks()
+	for _, sink := range sinks {
+		onFailure := sink.OnRecordingFailure
+		if onFailure == nil || onFailure.NotifyURL == "" {
+			continue
+		}
+		eventType := tailcfg.SSHSessionRecordingFailed
+		if onFailure.RejectSessionWithMessage != "" {
+			eventType = tailcfg.SSHSessionRecordingRejected
+		}
+		re := ss.newEventNotifyRequest(nodeKey, eventType)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), eventNotifyTimeout)
+			defer cancel()
+			ss.sendEventNotify(ctx, re, onFailure.NotifyURL)
+		}()
+	}
+	for _, sink := range sinks {
+		if onFailure := sink.OnRecordingFailure; onFailure != nil && onFailure.RejectSessionWithMessage != "" {
+			ss.errf("%v (rejecting session)", err)
+			countRecordingOutcome(true, recordingRejected)
+			return userVisibleError{
+				error: err,
+				msg:   onFailure.RejectSessionWithMessage,
+			}
+		}
+	}
+	ss.errf("%v (failing open)", err)
+	ss.recordingFailedOpen.Store(true)
+	countRecordingOutcome(len(sinks) > 0, recordingFailedOpen)
+	return nil
+}
+
+// trackRecording records that r is active, so that it's finalized by
+// Shutdown. It's untracked by r.Close.
+func (srv *server) trackRecording(r *recording) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	mak.Set(&srv.recordings, r, true)
+	r.srv = srv
+}
+
+// defaultRecordingFlushInterval is the default interval at which recordings
+// are flushed; see sshRecordingFlushInterval.
+const defaultRecordingFlushInterval = 5 * time.Second
+
+// recordingFlushInterval returns how often recordings should be flushed, or
+// zero if they shouldn't be flushed periodically.
+func recordingFlushInterval() time.Duration {
+	d := sshRecordingFlushInterval()
+	switch {
+	case d == 0:
+		return defaultRecordingFlushInterval
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+// startRecordingSink connects to one of the recorders of sink and starts
+// uploading to it in the background.
+//
+// If no recorder of sink accepts the recording, it returns an error if the
+// sink's OnRecordingFailure rejects the session, and otherwise a nil
+// recordingSink and nil error: the session continues without this sink.
+func (ss *sshSession) startRecordingSink(ctx context.Context, nodeKey key.NodePublic, sink *tailcfg.SSHRecordingSink) (*recordingSink, error) {
+	onFailure := sink.OnRecordingFailure
+
+	var out io.WriteCloser
+	var attempts []*tailcfg.SSHRecordingAttempt
+	var errChan <-chan error
+	var err error
+	switch sink.Format {
+	case tailcfg.SSHRecordingFormatCast, tailcfg.SSHRecordingFormatJSONLines:
+		if len(sink.Recorders) == 0 {
+			// Only recorder groups resolve to no recorders; see
+			// recordingSinks.
+			err = errors.New("recording: none of the action's recorder groups are defined")
+			break
+		}
+		out, attempts, errChan, err = ss.connectToRecorder(ctx, sink.Recorders)
+	default:
+		err = fmt.Errorf("recording: unsupported recording format %q", sink.Format)
+	}
+	if err != nil {
+		if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
+			eventType := tailcfg.SSHSessionRecordingFailed
+			if onFailure.RejectSessionWithMessage != "" {
+				eventType = tailcfg.SSHSessionRecordingRejected
+			}
+			ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
+		}
+
+		if onFailure != nil && onFailure.RejectSessionWithMessage != "" {
+			ss.errf("recording: error starting recording (rejecting session): %v", err)
+			countRecordingOutcome(true, recordingRejected)
+			return nil, userVisibleError{
+				error: err,
+				msg:   onFailure.RejectSessionWithMessage,
+			}
+		}
+		ss.errf("recording: error starting recording (failing open): %v", err)
+		ss.recordingFailedOpen.Store(true)
+		countRecordingOutcome(true, recordingFailedOpen)
+		return nil, nil
+	}
+	uploaded := make(chan struct{})
+	rs := &recordingSink{
+		format:       sink.Format,
+		dest:         attempts[len(attempts)-1].Recorder.String(),
+		failOpen:     onFailure == nil || onFailure.TerminateSessionWithMessage == "",
+		out:          out,
+		uploaded:     uploaded,
+		writeLatency: metricRecorderWriteLatency,
+	}
+	go func() {
+		err := <-errChan
+		close(uploaded)
+		if err == nil {
+			// Success.
+			ss.logf("recording: finished uploading recording")
+			countRecordingOutcome(true, recordingSucceeded)
+			return
+		}
+		rs.uploadFailed.Store(true)
+		if ss.conn.nodeKeyChanged() && !sshKeepSessionsOnNodeKeyChange() {
+			// The failure is most likely due to the key change, which
+			// makes notifying control with the old key pointless.
+			ss.errf("recording: error uploading recording after node key changed (closing session): %v", err)
+			countRecordingOutcome(true, recordingTerminated)
+			ss.cancelCtx(errNodeKeyChanged)
+			return
+		}
+		if onFailure != nil && onFailure.NotifyURL != "" && len(attempts) > 0 {
+			lastAttempt := attempts[len(attempts)-1]
+			lastAttempt.FailureMessage = err.Error()
+
+			eventType := tailcfg.SSHSessionRecordingFailed
+			if onFailure.TerminateSessionWithMessage != "" {
+				eventType = tailcfg.SSHSessionRecordingTerminated
+			}
+
+			ss.notifyControl(ctx, nodeKey, eventType, attempts, onFailure.NotifyURL)
+		}
+		if onFailure != nil && onFailure.TerminateSessionWithMessage != "" {
+			ss.errf("recording: error uploading recording (closing session): %v", err)
+			countRecordingOutcome(true, recordingTerminated)
+			ss.cancelCtx(userVisibleError{
+				error: err,
+				msg:   onFailure.TerminateSessionWithMessage,
+			})
+			return
+		}
+		ss.errf("recording: error uploading recording (failing open): %v", err)
+		countRecordingOutcome(true, recordingFailedOpen)
+	}()
+	return rs, nil
+}
+
+// notifyControl sends a SSHEventNotifyRequest to control over noise.
+// A SSHEventNotifyRequest is sent when an action or state reached during
+// an SSH session is a defined EventType.
+func (ss *sshSession) notifyControl(ctx context.Context, nodeKey key.NodePublic, notifyType tailcfg.SSHEventType, attempts []*tailcfg.SSHRecordingAttempt, url string) {
+	re := ss.newEventNotifyRequest(nodeKey, notifyType)
+	re.RecordingAttempts = attempts
+	ss.sendEventNotify(ctx, re, url)
+}
+
+// newEventNotifyRequest returns a SSHEventNotifyRequest of the provided type
+// for ss, with the fields common to all event types populated.
+func (ss *sshSession) newEventNotifyRequest(nodeKey key.NodePublic, notifyType tailcfg.SSHEventType) *tailcfg.SSHEventNotifyRequest {
+	re := &tailcfg.SSHEventNotifyRequest{
+		EventType:    notifyType,
+		ConnectionID: ss.conn.connID,
+		CapVersion:   tailcfg.CurrentCapabilityVersion,
+		NodeKey:      nodeKey,
+		SrcNode:      ss.conn.info.node.ID(),
+		SSHUser:      ss.conn.info.sshUser,
+		LocalUser:    ss.conn.localUser.Username,
+		Automated:    ss.automated(),
+	}
+	if a := ss.conn.finalAction; a != nil {
+		re.ApprovalMetadata = a.ApprovalMetadata
+	}
+	return re
+}
+
+// automated reports whether ss looks like automation rather than an
+// interactive login, for control to tell them apart: it has no PTY, or it's
+// from a tagged node.
+func (ss *sshSession) automated() bool {
+	if _, _, isPty := ss.Pty(); !isPty {
+		return true
+	}
+	return ss.conn.info.node.Valid() && ss.conn.info.node.IsTagged()
+}
+
+// sendEventNotify POSTs re to url on control over noise, logging any failure.
+// It isn't sent if TS_SSH_REQUIRE_SECURE_CONTROL is set and the transport
+// can't be verified secure, which is logged as an error.
+func (ss *sshSession) sendEventNotify(ctx context.Context, re *tailcfg.SSHEventNotifyRequest, url string) {
+	if err := ss.conn.srv.checkControlTransport("notifying control"); err != nil {
+		ss.errf("notifyControl: not sending %v event: %v", re.EventType, err)
+		return
+	}
+	body, err := json.Marshal(re)
+	if err != nil {
+		ss.errf("notifyControl: unable to marshal SSHNotifyRequest:", err)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, httpm.POST, url, bytes.NewReader(body))
+	if err != nil {
+		ss.errf("notifyControl: unable to create request:", err)
+		return
+	}
+
+	resp, err := ss.conn.srv.lb.DoNoiseRequest(req)
+	if err != nil {
+		ss.errf("notifyControl: unable to send noise request:", err)
+		return
+	}
+
+	if resp.StatusCode != http.StatusCreated {
+		ss.errf("notifyControl: noise request returned status code %v", resp.StatusCode)
+		return
+	}
+}
+
+// eventNotifyTimeout bounds the notifications to control sent in the
+// background, such as SSHCommandExecuted ones, which outlive the session if
+// need be.
+const eventNotifyTimeout = 30 * time.Second
+
+// sshCommandEvent is the machine-readable audit event logged by
+// auditCommand, as JSON, for each command run by a session.
+type sshCommandEvent struct {
+	ConnID    string `json:"connID"`
+	SessionID string `json:"sessionID"`
+	Src       string `json:"src"`
+	Node      string `json:"node,omitempty"`
+	User      string `json:"user"`
+	SSHUser   string `json:"sshUser"`
+	LocalUser string `json:"localUser"`
+
+	// RequestedCommand is the command requested by the client, before any
+	// expansion by the shell. It's empty if the client requested a shell
+	// but the action forced a command.
+	RequestedCommand string `json:"requestedCommand"`
+
+	// Argv is the command line that was started; see commandLine.
+	Argv []string `json:"argv"`
+
+	// Forced is whether Argv is the action's ForceCommand rather than
+	// RequestedCommand run by the user's shell.
+	Forced bool `json:"forced,omitempty"`
+}
+
+// auditCommand logs a "command: " line with the sshCommandEvent of the
+// command just started by ss, and notifies control of it if the action has a
+// NotifyCommandURL. It does nothing for interactive shells and subsystems.
+func (ss *sshSession) auditCommand() {
+	rawCmd := ss.RawCommand()
+	if ss.Subsystem() != "" || (rawCmd == "" && ss.conn.finalAction.ForceCommand == nil) {
+		return
+	}
+	name, args, _, _, isForced := ss.commandLine()
+	argv := append([]string{name}, args...)
+	ci := ss.conn.info
+	ev := sshCommandEvent{
+		ConnID:           ss.conn.connID,
+		SessionID:        ss.sharedID,
+		Src:              ci.src.String(),
+		User:             ci.uprof.LoginName,
+		SSHUser:          ci.sshUser,
+		LocalUser:        ss.conn.localUser.Username,
+		RequestedCommand: rawCmd,
+		Argv:             argv,
+		Forced:           isForced,
+	}
+	if ci.node.Valid() {
+		ev.Node = ci.node.Name()
+	}
+	j, err := json.Marshal(ev)
+	if err != nil {
+		ss.errf("command: %v", err)
+		return
+	}
+	ss.logf("command: %s", j)
+
+	url := ss.conn.finalAction.NotifyCommandURL
+	if url == "" {
+		return
+	}
+	re := ss.newEventNotifyRequest(ss.conn.srv.lb.NodeKey(), tailcfg.SSHCommandExecuted)
+	re.RequestedCommand = rawCmd
+	re.Argv = argv
+	re.Forced = isForced
+	go func() {
+		// Not ss.ctx, as the command may well be done before control is.
+		ctx, cancel := context.WithTimeout(context.Background(), eventNotifyTimeout)
+		defer cancel()
+		ss.sendEventNotify(ctx, re, url)
+	}()
+}
+
+// maxConfirmAnswerLen is the maximum length of the answer read by
+// confirmForcedCommand; further input is ignored.
+const maxConfirmAnswerLen = 16
+
+// confirmForcedCommand asks the user on the session's PTY to confirm running
+// the forced command fc, and reports whether they answered yes. It must be
+// called before the process is started, while the session's input is still
+// the raw keystrokes of the client's terminal, which it echoes.
+func (ss *sshSession) confirmForcedCommand(fc *tailcfg.SSHForceCommand) bool {
+	fmt.Fprintf(ss, "This will run %s. Continue? [y/N] ", strings.Join(fc.Args, " "))
+	var answer []byte
+	b := make([]byte, 1)
+	for {
+		n, err := ss.Read(b)
+		if err != nil {
+			return false
+		}
+		if n == 0 {
+			continue
+		}
+		switch c := b[0]; {
+		case c == '\r' || c == '\n':
+			io.WriteString(ss, "\r\n")
+			switch strings.ToLower(strings.TrimSpace(string(answer))) {
+			case "y", "yes":
+				return true
+			}
+			return false
+		case c == 0x03 || c == 0x04: // ^C, ^D
+			io.WriteString(ss, "\r\n")
+			return false
+		case c == 0x7f || c == '\b':
+			if len(answer) > 0 {
+				answer = answer[:len(answer)-1]
+				io.WriteString(ss, "\b \b")
+			}
+		case c >= ' ' && len(answer) < maxConfirmAnswerLen:
+			answer = append(answer, c)
+			ss.Write(b)
+		}
+	}
+}
+
+// recording is the state for an SSH session recording.
+type recording struct {
+	ss        *sshSession
+	nodeKey   key.NodePublic // for starting new parts
+	start     time.Time
+	wallClock bool // whether events include their wall-clock time
+	input     bool // whether input is recorded; see SSHAction.RecordInput
+
+	srv *server // or nil if not tracked; see trackRecording
+
+	mu            sync.Mutex // guards writes to, close of, and failure of sinks
+	sinks         []*recordingSink
+	header        CastHeader  // of the first part, for new ones; see rollOver
+	part          int         // index of the current part; see CastHeader.Part
+	partStart     time.Time   // when the current part started, if part > 0
+	flushTimer    *time.Timer // or nil if not flushing periodically
+	rolloverTimer *time.Timer // or nil if not rolling over periodically
+	closed        bool
+
+	holdsSlot atomic.Bool // whether r holds a slot of acquireRecordingSlot
+}
+
+// recordingSink is a destination of a recording.
+type recordingSink struct {
+	format tailcfg.SSHRecordingFormat
+	dest   string // where it records to, for status: a recorder's address, or "local"
+
+	// failOpen specifies whether the session should be allowed to
+	// continue if writing to this sink fails.
+	failOpen bool
+
+	// The following fields are guarded by recording.mu.
+
+	out io.WriteCloser // or nil once closed
+
+	// failedOpen specifies whether we've failed to write to out and should
+	// stop trying. It is only set if failOpen is set.
+	failedOpen bool
+
+	// dirty is whether out has been written to since it was last flushed.
+	dirty bool
+
+	// writeLatency, if non-nil, records how long each write to out takes.
+	writeLatency *metrics.Histogram
+
+	// uploaded, if non-nil, is closed once the recorder has responded to
+	// the upload to it, after out is closed.
+	uploaded <-chan struct{}
+
+	// uploadFailed is whether the upload to the recorder failed.
+	uploadFailed atomic.Bool
+}
+
+// status returns a snapshot of the status of r's sinks.
+func (r *recording) status() apitype.SSHSessionRecording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var st apitype.SSHSessionRecording
+	for _, s := range r.sinks {
+		failed := s.failedOpen || s.uploadFailed.Load()
+		st.FailedOpen = st.FailedOpen || failed
+		st.Active = st.Active || (!failed && s.out != nil)
+		st.Sinks = append(st.Sinks, apitype.SSHSessionRecordingSink{
+			Destination: s.dest,
+			Format:      string(s.format),
+			FailedOpen:  failed,
+		})
+	}
+	return st
+}
+
+// recordingStatus returns a snapshot of the status of the recording of ss.
+func (ss *sshSession) recordingStatus() apitype.SSHSessionRecording {
+	var st apitype.SSHSessionRecording
+	if rec := ss.rec.Load(); rec != nil {
+		st = rec.status()
+	}
+	if ss.recordingFailedOpen.Load() {
+		st.FailedOpen = true
+	}
+	return st
+}
+
+// startFlushing starts flushing r's sinks every interval, for as long as
+// they've been written to, until r is closed. It does nothing if interval
+// is zero.
+func (r *recording) startFlushing(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.flushTimer = time.AfterFunc(interval, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.closed {
+			return
+		}
+		r.flushLocked()
+		r.flushTimer.Reset(interval)
+	})
+}
+
+// startRollover starts splitting r in parts every interval, with rollOver,
+// until r is closed. It does nothing if interval isn't positive.
+func (r *recording) startRollover(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.rolloverTimer = time.AfterFunc(interval, func() {
+		if !r.rollOver() {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if !r.closed {
+			r.rolloverTimer.Reset(interval)
+		}
+	})
+}
+
+// rollOver ends the current part of r and starts the next one: it records a
+// "rollover" marker in and closes the current sinks, and writes the header,
+// with the Timestamp and Part of the new part, to new ones, opened like the
+// first ones were. Events are then timed relative to the new part's start.
+//
+// If no new sinks can be opened because that fails in a way that rejects
+// the session, or writing the header fails, the session is terminated. It
+// reports whether r carries on.
+func (r *recording) rollOver() bool {
+	ss := r.ss
+	if ss.conn.srv.lb.NodeKey() != r.nodeKey && !sshKeepSessionsOnNodeKeyChange() {
+		ss.errf("recording: not starting next part of recording: node key changed (closing session)")
+		ss.cancelCtx(errNodeKeyChanged)
+		return false
+	}
+	// Open the new sinks without holding r.mu, as connecting to recorders
+	// can take a while, and the session's writes to r would wait for it.
+	sinks, err := ss.openRecordingSinks(r.nodeKey, time.Now())
+	if err != nil {
+		ss.errf("recording: error starting next part of recording (closing session): %v", err)
+		ss.cancelCtx(err)
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		closeRecordingSinks(sinks)
+		return false
+	}
+	// The parts end and start at the same time, that of the marker.
+	now := time.Now()
+	if err := r.writeMarkerLocked("rollover", now); err != nil {
+		ss.errf("recording: error writing rollover marker: %v", err)
+	}
+	if err := closeRecordingSinks(r.sinks); err != nil {
+		ss.errf("recording: error closing part %d of recording: %v", r.part, err)
+	}
+	r.sinks = sinks
+	r.part++
+	r.partStart = now
+	ch := r.header
+	ch.Timestamp = now.Unix()
+	ch.Part = r.part
+	if err := r.writeHeaderLocked(ch); err != nil {
+		ss.errf("recording: error starting part %d of recording (closing session): %v", r.part, err)
+		ss.cancelCtx(err)
+		return false
+	}
+	ss.logf("recording: started part %d", r.part)
+	return true
+}
+
+// flushLocked flushes the sinks written to since they were last flushed,
+// if their writers support it. Writers with a Flush method are flushed, and
+// otherwise ones with a Sync method (such as *os.File) are synced.
+//
+// Flush failures are logged but otherwise ignored; they're expected to
+// surface as write failures too.
+func (r *recording) flushLocked() {
+	for _, s := range r.sinks {
+		if s.out == nil || s.failedOpen || !s.dirty {
+			continue
+		}
+		var err error
+		switch w := s.out.(type) {
+		case interface{ Flush() error }:
+			err = w.Flush()
+		case interface{ Sync() error }:
+			err = w.Sync()
+		}
+		if err != nil {
+			r.ss.errf("recording: error flushing %v recording: %v", s.format, err)
+		}
+		s.dirty = false
+	}
+}
 
 func (r *recording) Close() error {
+	if r.holdsSlot.Swap(false) {
+		r.ss.conn.srv.releaseRecordingSlot()
+	}
+	if r.srv != nil {
+		r.srv.mu.Lock()
+		delete(r.srv.recordings, r)
+		r.srv.mu.Unlock()
+	}
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	if r.out == nil {
-		return nil
+	r.closed = true
+	if r.flushTimer != nil {
+		r.flushTimer.Stop()
 	}
-	err := r.out.Close()
-	r.out = nil
-	return err
+	if r.rolloverTimer != nil {
+		r.rolloverTimer.Stop()
+	}
+	return closeRecordingSinks(r.sinks)
+}
+
+// closeRecordingSinks closes the outputs of sinks that aren't closed yet,
+// counting the outcomes of local ones. If sinks belong to a recording, its
+// mu must be held.
+func closeRecordingSinks(sinks []*recordingSink) error {
+	var errs []error
+	for _, s := range sinks {
+		if s.out == nil {
+			continue
+		}
+		err := s.out.Close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		s.out = nil
+		if s.uploaded == nil {
+			// The outcomes of uploads to recorders are counted once
+			// the recorder responds; see startRecordingSink.
+			if err != nil || s.failedOpen {
+				countRecordingOutcome(false, recordingFailedOpen)
+			} else {
+				countRecordingOutcome(false, recordingSucceeded)
+			}
+		}
+	}
+	return multierr.New(errs...)
+}
+
+// recordingFinalizeTimeout is how long finalize waits for recorders to
+// acknowledge the end of uploads.
+const recordingFinalizeTimeout = 5 * time.Second
+
+// finalize ends r early and cleanly, such as when tailscaled is shutting
+// down while its session is still running: it records a marker event with
+// the reason, syncs local recording files to disk, closes r, which ends
+// uploads to recorders, and waits a bit for recorders to acknowledge them.
+// Later writes by the session fail.
+//
+// The recording can't be finalized if tailscaled is killed without a chance
+// to shut down, as with SIGKILL. Periodic flushing (see
+// TS_SSH_RECORDING_FLUSH_INTERVAL) bounds what's lost then, and every event
+// is written as a whole line, so at most the last line is truncated.
+func (r *recording) finalize(reason string) {
+	if err := r.writeMarker(reason); err != nil {
+		r.ss.errf("recording: error writing final marker: %v", err)
+	}
+	var uploads []<-chan struct{}
+	r.mu.Lock()
+	for _, s := range r.sinks {
+		if s.out == nil {
+			continue
+		}
+		if f, ok := s.out.(interface{ Sync() error }); ok {
+			if err := f.Sync(); err != nil {
+				r.ss.errf("recording: error syncing %v recording: %v", s.format, err)
+			}
+		}
+		if s.uploaded != nil {
+			uploads = append(uploads, s.uploaded)
+		}
+	}
+	r.mu.Unlock()
+	if err := r.Close(); err != nil {
+		r.ss.errf("recording: error closing recording: %v", err)
+	}
+	timeout := time.NewTimer(recordingFinalizeTimeout)
+	defer timeout.Stop()
+	for _, u := range uploads {
+		select {
+		case <-u:
+		case <-timeout.C:
+			r.ss.errf("recording: timed out waiting for recorder to finish upload")
+			return
+		}
+	}
+	r.ss.logf("recording: finalized (%s)", reason)
+}
+
+// writeMarker records a marker event with the provided label in each of r's
+// sinks: an asciinema "m" event, or a JSON lines "marker" one.
+func (r *recording) writeMarker(label string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeMarkerLocked(label, time.Now())
+}
+
+// writeMarkerLocked is like writeMarker, but records the marker at the
+// provided time. r.mu must be held.
+func (r *recording) writeMarkerLocked(label string, at time.Time) error {
+	elapsed := at.Sub(r.partStartLocked()).Seconds()
+	return r.writeLineLocked(func(s *recordingSink) ([]byte, error) {
+		if s.format == tailcfg.SSHRecordingFormatJSONLines {
+			return json.Marshal(jsonlEvent{
+				Type:    "marker",
+				Elapsed: elapsed,
+				Data:    label,
+			})
+		}
+		return json.Marshal([]any{elapsed, "m", label})
+	})
+}
+
+// writeSummary records sum as the last line of each of r's sinks: a cast
+// event of type "x", with sum as JSON for its data, which standard asciinema
+// players skip as an unknown type, or a JSON lines "summary" event.
+//
+// The summary covers the whole session, even if its recording was split in
+// parts; the event's time is still relative to the start of the last part.
+func (r *recording) writeSummary(sum recordingSummary) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elapsed := sum.Duration - r.partStartLocked().Sub(r.start).Seconds()
+	return r.writeLineLocked(func(s *recordingSink) ([]byte, error) {
+		if s.format == tailcfg.SSHRecordingFormatJSONLines {
+			return json.Marshal(jsonlSummary{Type: "summary", recordingSummary: sum})
+		}
+		j, err := json.Marshal(sum)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal([]any{elapsed, "x", string(j)})
+	})
+}
+
+// writeHeader writes ch as the first line of each of r's sinks, in the
+// sink's format.
+func (r *recording) writeHeader(ch CastHeader) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.writeHeaderLocked(ch)
+}
+
+// writeHeaderLocked is like writeHeader, but r.mu must be held.
+func (r *recording) writeHeaderLocked(ch CastHeader) error {
+	return r.writeLineLocked(func(s *recordingSink) ([]byte, error) {
+		if s.format == tailcfg.SSHRecordingFormatJSONLines {
+			return json.Marshal(jsonlHeader{Type: "header", CastHeader: ch})
+		}
+		return json.Marshal(ch)
+	})
+}
+
+// writeEvent records that p was read from ("i") or written to ("o") the
+// session, in each of r's sinks.
+func (r *recording) writeEvent(dir string, p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	start := r.partStartLocked()
+	d := time.Since(start)
+	elapsed := d.Seconds()
+	var wallTime string
+	if r.wallClock {
+		// Derive it from the monotonic elapsed time rather than reading the
+		// clock again, so that it never goes backwards even if the system
+		// clock does.
+		wallTime = start.Add(d).UTC().Format(time.RFC3339Nano)
+	}
+	return r.writeLineLocked(func(s *recordingSink) ([]byte, error) {
+		if s.format == tailcfg.SSHRecordingFormatJSONLines {
+			typ := "output"
+			if dir == "i" {
+				typ = "input"
+			}
+			return json.Marshal(jsonlEvent{
+				Type:    typ,
+				Elapsed: elapsed,
+				Time:    wallTime,
+				Data:    string(p),
+			})
+		}
+		ev := []any{
+			elapsed,
+			dir,
+			string(p),
+		}
+		if wallTime != "" {
+			ev = append(ev, wallTime)
+		}
+		return json.Marshal(ev)
+	})
+}
+
+// partStartLocked returns when the current part of r started, which events
+// are timed relative to. r.mu must be held.
+func (r *recording) partStartLocked() time.Time {
+	if r.part == 0 {
+		return r.start
+	}
+	return r.partStart
+}
+
+// writeLineLocked writes the line returned by encode to each of r's sinks
+// that hasn't failed yet. r.mu must be held.
+//
+// A failing sink that fails open is no longer written to; any other failure
+// is returned.
+func (r *recording) writeLineLocked(encode func(*recordingSink) ([]byte, error)) error {
+	for _, s := range r.sinks {
+		if s.failedOpen {
+			continue
+		}
+		j, err := encode(s)
+		if err != nil {
+			return err
+		}
+		j = append(j, '\n')
+		if err := s.writeLocked(j); err != nil {
+			if !s.failOpen {
+				return err
+			}
+			r.ss.errf("recording: error writing %v recording (failing open): %v", s.format, err)
+			s.failedOpen = true
+		}
+	}
+	return nil
+}
+
+func (s *recordingSink) writeLocked(j []byte) error {
+	if s.out == nil {
+		return errors.New("logger closed")
+	}
+	var start time.Time
+	if s.writeLatency != nil {
+		start = time.Now()
+	}
+	_, err := s.out.Write(j)
+	if s.writeLatency != nil {
+		s.writeLatency.Observe(time.Since(start).Seconds())
+	}
+	if err != nil {
+		return fmt.Errorf("logger Write: %w", err)
+	}
+	s.dirty = true
+	return nil
+}
+
+// jsonlHeader is the first line of a tailcfg.SSHRecordingFormatJSONLines
+// recording.
+type jsonlHeader struct {
+	Type string `json:"type"` // always "header"
+	CastHeader
+}
+
+// jsonlEvent is a line following the jsonlHeader of a
+// tailcfg.SSHRecordingFormatJSONLines recording.
+type jsonlEvent struct {
+	Type    string  `json:"type"`           // "output", "input" or "marker"
+	Elapsed float64 `json:"elapsed"`        // seconds since the start of the recording
+	Time    string  `json:"time,omitempty"` // RFC 3339 wall-clock time, if TS_SSH_RECORDING_WALL_CLOCK
+	Data    string  `json:"data"`
+}
+
+// jsonlSummary is the last line of a tailcfg.SSHRecordingFormatJSONLines
+// recording if TS_SSH_RECORDING_SUMMARY is set.
+type jsonlSummary struct {
+	Type string `json:"type"` // always "summary"
+	recordingSummary
 }
 
 // writer returns an io.Writer around w that first records the write.
@@ -1842,61 +5634,38 @@ func (r *recording) writer(dir string, w io.Writer) io.Writer {
 	if r == nil {
 		return w
 	}
-	if dir == "i" {
-		// TODO: record input? Maybe not, since it might contain
+	if dir == "i" && !r.input {
+		// Input isn't recorded by default, as it might contain
 		// passwords.
 		return w
 	}
 	return &loggingWriter{r: r, dir: dir, w: w}
 }
 
-// loggingWriter is an io.Writer wrapper that writes first an
-// asciinema JSON cast format recording line, and then writes to w.
+// recordsInput reports whether the recordings of ss include its input, per
+// SSHAction.RecordInput or TS_SSH_RECORD_INPUT.
+func (ss *sshSession) recordsInput() bool {
+	if a := ss.conn.finalAction; a != nil && a.RecordInput {
+		return true
+	}
+	return sshRecordInput()
+}
+
+// loggingWriter is an io.Writer wrapper that first records the write to each
+// of the recording's sinks, and then writes to w.
 type loggingWriter struct {
 	r   *recording
 	dir string    // "i" or "o" (input or output)
-	w   io.Writer // underlying Writer, after writing to r.out
-
-	// recordingFailedOpen specifies whether we've failed to write to
-	// r.out and should stop trying. It is set to true if we fail to write
-	// to r.out and r.failOpen is set.
-	recordingFailedOpen bool
+	w   io.Writer // underlying Writer, after writing to r's sinks
 }
 
 func (w *loggingWriter) Write(p []byte) (n int, err error) {
-	if !w.recordingFailedOpen {
-		j, err := json.Marshal([]any{
-			time.Since(w.r.start).Seconds(),
-			w.dir,
-			string(p),
-		})
-		if err != nil {
-			return 0, err
-		}
-		j = append(j, '\n')
-		if err := w.writeCastLine(j); err != nil {
-			if !w.r.failOpen {
-				return 0, err
-			}
-			w.recordingFailedOpen = true
-		}
+	if err := w.r.writeEvent(w.dir, p); err != nil {
+		return 0, err
 	}
 	return w.w.Write(p)
 }
 
-func (w loggingWriter) writeCastLine(j []byte) error {
-	w.r.mu.Lock()
-	defer w.r.mu.Unlock()
-	if w.r.out == nil {
-		return errors.New("logger closed")
-	}
-	_, err := w.r.out.Write(j)
-	if err != nil {
-		return fmt.Errorf("logger Write: %w", err)
-	}
-	return nil
-}
-
 func envValFromList(env []string, wantKey string) (v string) {
 	for _, kv := range env {
 		if thisKey, v, ok := strings.Cut(kv, "="); ok && envEq(thisKey, wantKey) {
@@ -1928,8 +5697,179 @@ func envEq(a, b string) bool {
 	metricSFTP                = clientmetric.NewCounter("ssh_sftp_sessions")
 	metricLocalPortForward    = clientmetric.NewCounter("ssh_local_port_forward_requests")
 	metricRemotePortForward   = clientmetric.NewCounter("ssh_remote_port_forward_requests")
+	metricX11Forward          = clientmetric.NewCounter("ssh_x11_forward_requests")
+	metricIdleForwardClosed   = clientmetric.NewCounter("ssh_local_port_forward_idle_closed")
+	metricConfirmationDenied  = clientmetric.NewCounter("ssh_confirmation_denied")
+	metricPubKeyAlgoDenied    = clientmetric.NewCounter("ssh_publickey_algorithm_denied")
+	metricBannerTruncated     = clientmetric.NewCounter("ssh_auth_banner_truncated")
+	metricProxiedSessions     = clientmetric.NewCounter("ssh_proxied_sessions")
+	metricHandshakeTimeouts   = clientmetric.NewCounter("ssh_handshake_timeouts")
+	metricChannelsRejected    = clientmetric.NewCounter("ssh_channels_rejected")
+	metricSyslogDropped       = clientmetric.NewCounter("ssh_output_syslog_dropped")
+	metricConnLifetimeExpired = clientmetric.NewCounter("ssh_conn_lifetime_expired")
+	metricAcceptCacheHits     = clientmetric.NewCounter("ssh_accept_cache_hits")
+	metricOutputLimitExceeded = clientmetric.NewCounter("ssh_output_limit_exceeded")
+	metricSFTPLimitExceeded   = clientmetric.NewCounter("ssh_sftp_limit_exceeded")
+	metricRecorderSkipped     = clientmetric.NewCounter("ssh_recorder_skipped")
+	metricRecordersUnhealthy  = clientmetric.NewGauge("ssh_recorders_unhealthy")
+	metricDuplicateSessions   = clientmetric.NewCounter("ssh_duplicate_sessions")
+	metricInsecureControl     = clientmetric.NewCounter("ssh_insecure_control")
+	metricCommandDenied       = clientmetric.NewCounter("ssh_command_denied")
+	metricRecordingsCapped    = clientmetric.NewCounter("ssh_recordings_capped")
+	metricNodeKeyChanged      = clientmetric.NewCounter("ssh_node_key_changed")
+	metricIdleConnReaped      = clientmetric.NewCounter("ssh_idle_conn_reaped")
+
+	// metricDenials counts denied connections by deny* reason code.
+	// clientmetric doesn't support labels, so there's a metric per code.
+	metricDenials = map[string]*clientmetric.Metric{
+		denyNoPolicy:     clientmetric.NewCounter("ssh_denied_no_policy"),
+		denyNoMatch:      clientmetric.NewCounter("ssh_denied_no_match"),
+		denyRuleExpired:  clientmetric.NewCounter("ssh_denied_rule_expired"),
+		denyUserMismatch: clientmetric.NewCounter("ssh_denied_user_mismatch"),
+		denyRejected:     clientmetric.NewCounter("ssh_denied_rejected"),
+		denyDelegateHops: clientmetric.NewCounter("ssh_denied_delegate_hops"),
+		denyHookTimeout:  clientmetric.NewCounter("ssh_denied_hook_timeout"),
+		denyStaleNetMap:  clientmetric.NewCounter("ssh_denied_stale_netmap"),
+		denySameUser:     clientmetric.NewCounter("ssh_denied_same_user"),
+		denyHostUser:     clientmetric.NewCounter("ssh_denied_host_user"),
+	}
+
+	// metricActiveSessionsByLocalUser is the number of active sessions by
+	// local user. It's not by the requested ssh-user, which clients choose
+	// freely, as labels are never removed. clientmetric doesn't support
+	// labels, so this is an expvar, published in init.
+	metricActiveSessionsByLocalUser = &metrics.LabelMap{Label: "local_user"}
+
+	// metricRecordingWriteLatency and metricRecorderWriteLatency are the
+	// durations in seconds of writes of recorded events to local disk and
+	// to recorders, respectively. Writes to recorders block while the
+	// recorder isn't keeping up with the upload, so rising latencies warn
+	// of a struggling recorder before sessions start failing. Like
+	// metricActiveSessionsByLocalUser, they're expvars published in init.
+	metricRecordingWriteLatency = metrics.NewHistogram(recordingWriteLatencyBuckets)
+	metricRecorderWriteLatency  = metrics.NewHistogram(recordingWriteLatencyBuckets)
+
+	// metricRecordingOutcomes counts how recordings ended, per sink, by
+	// outcome and destination; see countRecordingOutcome. Like
+	// metricActiveSessionsByLocalUser, it's an expvar published in init.
+	metricRecordingOutcomes = &metrics.MultiLabelMap[recordingOutcome]{
+		Type: "counter",
+		Help: "Number of SSH session recordings by how they ended.",
+	}
+)
+
+// Recording outcomes, the outcome labels of metricRecordingOutcomes.
+const (
+	recordingSucceeded  = "success"   // the recording was written in full
+	recordingFailedOpen = "fail_open" // it failed, and the session went on unrecorded
+	recordingRejected   = "reject"    // it failed to start, and the session was refused
+	recordingTerminated = "terminate" // it failed, and the session was terminated
 )
 
+// recordingOutcome is the key of metricRecordingOutcomes.
+type recordingOutcome struct {
+	Outcome string `prom:"outcome"` // one of the recording* outcomes
+	Dest    string `prom:"dest"`    // "local" for local disk, or "remote" for recorders
+}
+
+// countRecordingOutcome counts the outcome of a recording to a single sink:
+// to recorders if remote, or else to local disk.
+func countRecordingOutcome(remote bool, outcome string) {
+	dest := "local"
+	if remote {
+		dest = "remote"
+	}
+	metricRecordingOutcomes.Add(recordingOutcome{Outcome: outcome, Dest: dest}, 1)
+	if o := metricObserver.Load(); o != nil {
+		(*o).AddMetric("ssh_recording_outcomes", false, map[string]string{"outcome": outcome, "dest": dest}, 1)
+	}
+}
+
+// MetricObserver is notified of every change to the SSH server's metrics,
+// so that they can be mirrored to a metrics system that doesn't ingest
+// clientmetrics, such as an OpenTelemetry meter: an adapter would add each
+// delta to an Int64Counter, or an Int64UpDownCounter for gauges, of the
+// same name and with the same attributes. Use SetMetricObserver to set it.
+type MetricObserver interface {
+	// AddMetric records that the metric with the provided clientmetric
+	// or expvar name changed by delta. Gauges, such as
+	// ssh_active_sessions, go up and down; other metrics are counters.
+	// Labels, if non-nil, are those of the series that changed, such as
+	// the "outcome" and "dest" of ssh_recording_outcomes.
+	//
+	// It's called synchronously by the SSH server, so it must be fast and
+	// must not call back into it.
+	AddMetric(name string, gauge bool, labels map[string]string, delta int64)
+}
+
+// metricObserver is the MetricObserver set by SetMetricObserver, if any.
+var metricObserver atomic.Pointer[MetricObserver]
+
+// SetMetricObserver sets o to be notified of the changes to the metrics of
+// all SSH servers of the process from now on, in addition to them being
+// counted in clientmetrics. A nil o stops notifying any previous one.
+func SetMetricObserver(o MetricObserver) {
+	if o == nil {
+		metricObserver.Store(nil)
+		return
+	}
+	metricObserver.Store(&o)
+}
+
+// serverMetrics are the values of the clientmetrics counted by a single
+// server, which are also counted in the process-wide clientmetrics. Unlike
+// those, they can be reset, so that tests and embedders running several
+// servers in a process can measure each over a window of their choosing.
+type serverMetrics struct {
+	mu     sync.Mutex
+	values map[*clientmetric.Metric]int64
+}
+
+// addMetric adds delta to m, both process-wide and in srv's own metrics.
+// srv may be nil, in which case only the process-wide value changes.
+func (srv *server) addMetric(m *clientmetric.Metric, delta int64) {
+	m.Add(delta)
+	if o := metricObserver.Load(); o != nil {
+		(*o).AddMetric(m.Name(), m.Type() == clientmetric.TypeGauge, nil, delta)
+	}
+	if srv == nil {
+		return
+	}
+	srv.metrics.mu.Lock()
+	defer srv.metrics.mu.Unlock()
+	mak.Set(&srv.metrics.values, m, srv.metrics.values[m]+delta)
+}
+
+// MetricsSnapshot returns the values of the metrics counted by srv since it
+// was created or since ResetMetrics was last called, by clientmetric name.
+// Metrics that srv hasn't counted are absent.
+func (srv *server) MetricsSnapshot() map[string]int64 {
+	srv.metrics.mu.Lock()
+	defer srv.metrics.mu.Unlock()
+	snap := make(map[string]int64, len(srv.metrics.values))
+	for m, v := range srv.metrics.values {
+		snap[m.Name()] = v
+	}
+	return snap
+}
+
+// ResetMetrics zeroes the counters in srv's own metrics, starting a new
+// measurement window. Gauges, such as the number of active sessions, keep
+// their current values, and the process-wide clientmetrics are unaffected.
+func (srv *server) ResetMetrics() {
+	srv.metrics.mu.Lock()
+	defer srv.metrics.mu.Unlock()
+	for m := range srv.metrics.values {
+		if m.Type() == clientmetric.TypeCounter {
+			delete(srv.metrics.values, m)
+		}
+	}
+}
+
+// recordingWriteLatencyBuckets are the upper bounds in seconds of the
+// buckets of metricRecordingWriteLatency and metricRecorderWriteLatency.
+var recordingWriteLatencyBuckets = []float64{0.001, 0.005, 0.025, 0.1, 0.5, 2.5, 10}
+
 // userVisibleError is a wrapper around an error that implements
 // SSHTerminationError, so msg is written to their session.
 type userVisibleError struct {
@@ -189,6 +189,72 @@ func TestIntegrationSFTP(t *testing.T) {
 	}
 }
 
+func TestIntegrationSFTPWithPTY(t *testing.T) {
+	debugTest.Store(true)
+	t.Cleanup(func() {
+		debugTest.Store(false)
+	})
+
+	filePath := "/tmp/sftptest-pty.dat"
+	wantText := "hello\nworld\r\n\x00\x03\x04"
+
+	// Some clients request a PTY before starting the sftp subsystem. The PTY
+	// must be ignored, or it would mangle the binary sftp protocol.
+	cl := testClient(t)
+	s, err := cl.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.RequestPty("xterm", 40, 80, ssh.TerminalModes{ssh.ECHO: 1}); err != nil {
+		t.Fatalf("unable to request pty: %s", err)
+	}
+	wr, err := s.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := s.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequestSubsystem("sftp"); err != nil {
+		t.Fatalf("unable to start sftp: %s", err)
+	}
+	// Window changes are ignored too, but mustn't block the session.
+	if err := s.WindowChange(50, 100); err != nil {
+		t.Fatalf("window change: %s", err)
+	}
+	scl, err := sftp.NewClientPipe(rd, wr)
+	if err != nil {
+		t.Fatalf("can't get sftp client: %s", err)
+	}
+	defer scl.Close()
+
+	file, err := scl.Create(filePath)
+	if err != nil {
+		t.Fatalf("can't create file: %s", err)
+	}
+	if _, err := file.Write([]byte(wantText)); err != nil {
+		t.Fatalf("can't write to file: %s", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("can't close file: %s", err)
+	}
+
+	file, err = scl.OpenFile(filePath, os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("can't open file: %s", err)
+	}
+	defer file.Close()
+	gotText, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("can't read file: %s", err)
+	}
+	if diff := cmp.Diff(string(gotText), wantText); diff != "" {
+		t.Fatalf("unexpected file contents (-got +want):\n%s", diff)
+	}
+}
+
 type session struct {
 	*ssh.Session
 
@@ -6,7 +6,10 @@
 package tailssh
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"os/user"
@@ -30,10 +33,17 @@ type userMeta struct {
 	// loginShellCached is the user's login shell, if known
 	// at the time of userLookup.
 	loginShellCached string
+
+	// synthetic is whether the user was mapped to by uid and has no
+	// passwd entry; see lookupLocalUser.
+	synthetic bool
 }
 
 // GroupIds returns the list of group IDs that the user is a member of.
 func (u *userMeta) GroupIds() ([]string, error) {
+	if u.synthetic {
+		return []string{u.Gid}, nil
+	}
 	return osuser.GetGroupIds(&u.User)
 }
 
@@ -48,6 +58,53 @@ func userLookup(username string) (*userMeta, error) {
 	return &userMeta{User: *u, loginShellCached: s}, nil
 }
 
+// minUnprivilegedUID is the lowest uid that SSHUsers may map to by number
+// without TS_SSH_ALLOW_PRIVILEGED_UID. Lower ones are root and, by the
+// usual convention, system accounts.
+const minUnprivilegedUID = 1000
+
+// numericLocalUser reports whether localUser, as mapped by SSHUsers, is a
+// local user's uid rather than its name: "=1000" or "1000". It returns the
+// uid in canonical form.
+func numericLocalUser(localUser string) (uid string, ok bool) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(localUser, "="), 10, 32)
+	if err != nil || n == math.MaxUint32 { // (uid_t)-1 means no uid
+		return "", false
+	}
+	return strconv.FormatUint(n, 10), true
+}
+
+// lookupLocalUser returns the local user that SSHUsers mapped to, by name or,
+// as reported by numericLocalUser, by uid. A uid without a passwd entry
+// results in a synthetic user whose name is the uid, with a primary group
+// of the same number, "/" as its home directory and /bin/sh as its shell.
+func lookupLocalUser(localUser string) (*userMeta, error) {
+	uid, ok := numericLocalUser(localUser)
+	if !ok {
+		return userLookup(localUser)
+	}
+	if n, _ := strconv.Atoi(uid); n < minUnprivilegedUID && !sshAllowPrivilegedUID() {
+		return nil, fmt.Errorf("refusing to map to privileged uid %s; set TS_SSH_ALLOW_PRIVILEGED_UID to allow", uid)
+	}
+	u, s, err := osuser.LookupByUIDWithShell(uid)
+	if err == nil {
+		return &userMeta{User: *u, loginShellCached: s}, nil
+	}
+	if !errors.As(err, new(user.UnknownUserIdError)) {
+		return nil, err
+	}
+	return &userMeta{
+		User: user.User{
+			Uid:      uid,
+			Gid:      uid,
+			Username: uid,
+			HomeDir:  "/",
+		},
+		loginShellCached: "/bin/sh",
+		synthetic:        true,
+	}, nil
+}
+
 func (u *userMeta) LoginShell() string {
 	if u.loginShellCached != "" {
 		// This field should be populated on Linux, at least, because
@@ -65,7 +122,7 @@ func (u *userMeta) LoginShell() string {
 			return strings.TrimSpace(s)
 		}
 	}
-	if e := os.Getenv("SHELL"); e != "" {
+	if e := os.Getenv("SHELL"); e != "" && !sshStrictEnv() {
 		return e
 	}
 	return "/bin/sh"
@@ -0,0 +1,313 @@
+// Copyright (c) Tailscale Inc & AUTHORS
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build linux || (darwin && !ios) || freebsd || openbsd
+
+package tailssh
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	gossh "github.com/tailscale/golang-x-crypto/ssh"
+	"tailscale.com/tempfork/gliderlabs/ssh"
+)
+
+const (
+	// x11AuthProto is the only X11 authentication protocol supported for
+	// forwarding, as it's the one whose cookies can be spoofed.
+	x11AuthProto = "MIT-MAGIC-COOKIE-1"
+
+	// x11CookieLen is the length of x11AuthProto cookies, in bytes.
+	x11CookieLen = 16
+
+	// x11DisplayOffset is the first X11 display number tried for forwarding,
+	// as with OpenSSH's X11DisplayOffset, to stay clear of any local X
+	// servers. Displays up to x11DisplayOffset+x11MaxDisplays-1 are tried.
+	x11DisplayOffset = 10
+	x11MaxDisplays   = 1000
+
+	// x11SetupTimeout is how long X11 clients have to send their connection
+	// setup, with its cookie, once they connect.
+	x11SetupTimeout = 10 * time.Second
+)
+
+// mayForwardX11 reports whether c's action allows X11 forwarding, unless
+// TS_SSH_DISABLE_X11, TS_SSH_DISABLE_FORWARDING or TS_SSH_READ_ONLY is set.
+// Only x11AuthProto cookies are supported.
+func (c *conn) mayForwardX11(ctx ssh.Context, x11 ssh.X11) bool {
+	if sshDisableX11() || sshDisableForwarding() || sshReadOnly() {
+		return false
+	}
+	if c.finalAction == nil || !c.finalAction.AllowX11Forwarding {
+		return false
+	}
+	if x11.AuthProtocol != x11AuthProto {
+		c.logf("rejecting X11 forwarding with unsupported auth protocol %q", x11.AuthProtocol)
+		return false
+	}
+	if cookie, err := hex.DecodeString(x11.AuthCookie); err != nil || len(cookie) != x11CookieLen {
+		c.logf("rejecting X11 forwarding with invalid auth cookie")
+		return false
+	}
+	c.srv.addMetric(metricX11Forward, 1)
+	return true
+}
+
+// x11Forward is the X11 forwarding of a session: a display on this node
+// whose connections are forwarded to the client's display.
+//
+// As with OpenSSH, the session's X11 clients are given a fake cookie, in an
+// Xauthority file of its own, rather than the client's real one. Each
+// connection's cookie is checked against the fake one and replaced with the
+// real one as it's forwarded, so that the real one never leaves the client.
+type x11Forward struct {
+	ln        net.Listener
+	display   int    // X11 display number
+	screen    uint32 // X11 screen number
+	dir       string // temporary directory of xauth
+	xauth     string // the session's Xauthority file
+	fake      []byte // the cookie in xauth
+	real      []byte // the client's cookie
+	single    bool   // forward only a single connection
+	closeOnce sync.Once
+}
+
+// startX11Forwarding starts X11 forwarding for ss, if the client requested it
+// and it was allowed by mayForwardX11: it listens on a free display, writes
+// a new Xauthority file for it readable only by lu, and in the background
+// forwards its connections to the client. On success, it assigns ss.x11.
+func (ss *sshSession) startX11Forwarding(s ssh.Session, lu *userMeta) (err error) {
+	x11, ok := s.X11()
+	if !ok {
+		return nil
+	}
+	real, err := hex.DecodeString(x11.AuthCookie)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(lu.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(lu.Gid)
+	if err != nil {
+		return err
+	}
+	ln, display, err := listenX11Display()
+	if err != nil {
+		return err
+	}
+	xf := &x11Forward{
+		ln:      ln,
+		display: display,
+		screen:  x11.ScreenNumber,
+		fake:    randBytes(len(real)),
+		real:    real,
+		single:  x11.SingleConnection,
+	}
+	defer func() {
+		if err != nil {
+			xf.Close()
+		}
+	}()
+	if xf.dir, err = os.MkdirTemp("", "tailscale-ssh-x11-"); err != nil {
+		return err
+	}
+	xf.xauth = filepath.Join(xf.dir, "Xauthority")
+	if err := os.WriteFile(xf.xauth, xauthEntry(display, xf.fake), 0600); err != nil {
+		return err
+	}
+	// Make sure the file and its directory are accessible only by the user.
+	if err := os.Chown(xf.xauth, uid, gid); err != nil {
+		return err
+	}
+	if err := os.Chown(xf.dir, uid, gid); err != nil {
+		return err
+	}
+	ss.logf("X11 forwarding on display %d", display)
+	go ss.forwardX11Connections(s, xf)
+	ss.x11 = xf
+	return nil
+}
+
+// listenX11Display listens on the TCP port of the first free X11 display on
+// localhost, from x11DisplayOffset, and returns its listener and number.
+func listenX11Display() (net.Listener, int, error) {
+	for display := x11DisplayOffset; display < x11DisplayOffset+x11MaxDisplays; display++ {
+		ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(6000+display)))
+		if err == nil {
+			return ln, display, nil
+		}
+	}
+	return nil, 0, errors.New("no free X11 display")
+}
+
+// xauthEntry returns an Xauthority file entry with the x11AuthProto cookie
+// for display on any host.
+func xauthEntry(display int, cookie []byte) []byte {
+	const familyWild = 0xffff
+	var b bytes.Buffer
+	field := func(v []byte) {
+		binary.Write(&b, binary.BigEndian, uint16(len(v)))
+		b.Write(v)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(familyWild))
+	field(nil) // address
+	field([]byte(strconv.Itoa(display)))
+	field([]byte(x11AuthProto))
+	field(cookie)
+	return b.Bytes()
+}
+
+// env returns the environment variables pointing the session's X11 clients
+// at xf's display.
+func (xf *x11Forward) env() []string {
+	return []string{
+		fmt.Sprintf("DISPLAY=localhost:%d.%d", xf.display, xf.screen),
+		"XAUTHORITY=" + xf.xauth,
+	}
+}
+
+// Close stops xf's listener and removes its Xauthority file. Connections
+// already forwarded aren't closed.
+func (xf *x11Forward) Close() error {
+	var err error
+	xf.closeOnce.Do(func() {
+		err = xf.ln.Close()
+		if xf.dir != "" {
+			os.RemoveAll(xf.dir)
+		}
+	})
+	return err
+}
+
+// forwardX11Connections forwards the connections to xf's display to the
+// client of s, over new X11 channels, until xf is closed or, if the client
+// asked only for a single connection, one has been forwarded.
+func (ss *sshSession) forwardX11Connections(s ssh.Session, xf *x11Forward) {
+	sshConn := s.Context().Value(ssh.ContextKeyConn).(gossh.Conn)
+	ln := &channelLimitListener{Listener: xf.ln, c: ss.conn, typ: ssh.X11ChannelType}
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		if xf.single {
+			xf.ln.Close()
+		}
+		go func() {
+			defer nc.Close()
+			if err := ss.forwardX11(sshConn, nc, xf); err != nil {
+				ss.vlogf("X11 connection from %v: %v", nc.RemoteAddr(), err)
+			}
+		}()
+		if xf.single {
+			return
+		}
+	}
+}
+
+// forwardX11 checks the cookie of the X11 connection nc against xf's fake
+// one and, if it matches, forwards nc, with the client's real cookie, over a
+// new X11 channel.
+func (ss *sshSession) forwardX11(sshConn gossh.Conn, nc net.Conn, xf *x11Forward) error {
+	nc.SetReadDeadline(time.Now().Add(x11SetupTimeout))
+	setup, err := readX11Setup(nc)
+	if err != nil {
+		return err
+	}
+	nc.SetReadDeadline(time.Time{})
+	if err := setup.spoof(xf.fake, xf.real); err != nil {
+		return err
+	}
+
+	originAddr, originPort := "", 0
+	if ta, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		originAddr, originPort = ta.IP.String(), ta.Port
+	}
+	ch, reqs, err := sshConn.OpenChannel(ssh.X11ChannelType, gossh.Marshal(&struct {
+		OriginAddr string
+		OriginPort uint32
+	}{originAddr, uint32(originPort)}))
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	go gossh.DiscardRequests(reqs)
+	if _, err := ch.Write(setup.b); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, nc)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(nc, ch)
+		if cw, ok := nc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	return nil
+}
+
+// x11Setup is the connection setup an X11 client starts its connection with.
+type x11Setup struct {
+	b    []byte // the whole setup, as sent
+	name []byte // the auth protocol name, within b
+	data []byte // the auth protocol data, within b
+}
+
+// readX11Setup reads the connection setup of an X11 client from r.
+func readX11Setup(r io.Reader) (*x11Setup, error) {
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	var bo binary.ByteOrder
+	switch hdr[0] {
+	case 'B':
+		bo = binary.BigEndian
+	case 'l':
+		bo = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid X11 byte order %#x", hdr[0])
+	}
+	nameLen, dataLen := int(bo.Uint16(hdr[6:])), int(bo.Uint16(hdr[8:]))
+	pad := func(n int) int { return (n + 3) &^ 3 }
+	b := make([]byte, len(hdr)+pad(nameLen)+pad(dataLen))
+	copy(b, hdr)
+	if _, err := io.ReadFull(r, b[len(hdr):]); err != nil {
+		return nil, err
+	}
+	name := b[len(hdr):][:nameLen]
+	data := b[len(hdr)+pad(nameLen):][:dataLen]
+	return &x11Setup{b: b, name: name, data: data}, nil
+}
+
+// spoof replaces the fake cookie in s with the real one, or returns an error
+// if s doesn't have the fake cookie. The cookies must be the same length.
+func (s *x11Setup) spoof(fake, real []byte) error {
+	if string(s.name) != x11AuthProto || subtle.ConstantTimeCompare(s.data, fake) != 1 {
+		return errors.New("rejected: wrong X11 authentication")
+	}
+	copy(s.data, real)
+	return nil
+}
@@ -3,7 +3,7 @@
 
 package tailcfg
 
-//go:generate go run tailscale.com/cmd/viewer --type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile --clonefunc
+//go:generate go run tailscale.com/cmd/viewer --type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHRecordingSink,SSHForceCommand,SSHPrincipal,ControlDialPlan,Location,UserProfile --clonefunc
 
 import (
 	"bytes"
@@ -136,7 +136,33 @@
 //   - 93: 2024-05-06: added support for stateful firewalling.
 //   - 94: 2024-05-06: Client understands Node.IsJailed.
 //   - 95: 2024-05-06: Client uses NodeAttrUserDialUseRoutes to change DNS dialing behavior.
-const CurrentCapabilityVersion CapabilityVersion = 95
+//   - 96: 2026-10-14: Client understands SSHAction.RecordingSinks.
+//   - 97: 2026-10-14: Client understands SSHAction.ConfirmationPrompt.
+//   - 98: 2026-10-14: Client understands SSHAction.ProxyTo.
+//   - 99: 2026-10-14: Client understands SSHAction.TCPForwarding.
+//   - 100: 2026-10-14: Client understands SSHAction.RecorderGroups.
+//   - 101: 2026-10-14: Client understands SSHAction.ForceCommand.
+//   - 102: 2026-10-14: Client understands SSHAction.NotifyCommandURL.
+//   - 103: 2026-10-14: Client understands SSHForceCommand.Confirm.
+//   - 104: 2026-10-14: Client understands SSHAction.ExposeIdentityEnv.
+//   - 105: 2026-10-14: Client understands SSHAction.StrictRecording.
+//   - 106: 2026-10-14: Client understands SSHAction.HomeDir.
+//   - 107: 2026-10-14: Client understands SSHAction.EnterContainer.
+//   - 108: 2026-10-14: Client understands SSHAction.MaxOutputBytes.
+//   - 109: 2026-10-14: Client understands SSHAction.RecordingOptional.
+//   - 110: 2026-10-14: Client understands SSHAction.PostSessionCommand.
+//   - 111: 2026-10-14: Client understands SSHAction.SFTPMaxBytes and SFTPMaxBytesPerSecond.
+//   - 112: 2026-10-14: Client understands SSHPrincipal.NodeCap.
+//   - 113: 2026-10-14: Client understands SSHAction.ScratchDir and ScratchDirIsWorkDir.
+//   - 114: 2026-10-14: Client understands SSHAction.AllowedCommands.
+//   - 115: 2026-10-14: Client understands SSHAction.ApprovalMetadata.
+//   - 116: 2026-10-14: Client understands SSHAction.RecordInput.
+//   - 117: 2026-10-14: Client understands SSHAction.SessionTermGrace.
+//   - 118: 2026-10-14: Client understands SSHAction.IdleTimeout.
+//   - 119: 2026-10-14: Client understands SSHAction.AllowX11Forwarding.
+//   - 120: 2026-10-14: Client authorizes SSH connections proxied by SSHAction.ProxyTo only by rules naming the jump host.
+//   - 121: 2026-10-14: Client sends SSHEventNotifyRequest.Automated.
+const CurrentCapabilityVersion CapabilityVersion = 121
 
 type StableID string
 
@@ -2343,6 +2369,11 @@ type SSHPolicy struct {
 	// public key authentication and the rules are evaluated again for each of
 	// the client's present keys.
 	Rules []*SSHRule `json:"rules"`
+
+	// RecorderGroups are named groups of SSH session recorders, which
+	// SSHAction.RecorderGroups refer to. It allows rules to select recorders
+	// by role (for example, the recorders in a region) without listing them.
+	RecorderGroups map[string][]netip.AddrPort `json:"recorderGroups,omitempty"`
 }
 
 // An SSH rule is a match predicate and associated action for an incoming SSH connection.
@@ -2372,7 +2403,9 @@ type SSHRule struct {
 	// If the map value is the empty string (for either the
 	// requested SSH user or "*"), the rule doesn't match.
 	// If the map value is "=", it means the ssh-user should map
-	// directly to the local-user.
+	// directly to the local-user, unless the ssh-user is a uid such
+	// as "1000" or "=1000": those only select a local user by uid
+	// when they're the map value.
 	// It may be nil if the Action is reject.
 	SSHUsers map[string]string `json:"sshUsers"`
 
@@ -2384,7 +2417,7 @@ type SSHRule struct {
 // SSHPrincipal is either a particular node or a user on any node.
 type SSHPrincipal struct {
 	// Matching any one of the following four field causes a match.
-	// It must also match Certs, if non-empty.
+	// It must also match Certs, if non-empty, and NodeCap, if set.
 
 	Node      StableNodeID `json:"node,omitempty"`
 	NodeIP    string       `json:"nodeIP,omitempty"`
@@ -2402,6 +2435,12 @@ type SSHPrincipal struct {
 	//   * $LOGINNAME_EMAIL ("foo@bar.com" or "foo@github")
 	//   * $LOGINNAME_LOCALPART (the "foo" from either of the above)
 	PubKeys []string `json:"pubKeys,omitempty"`
+
+	// NodeCap, if non-empty, means that this SSHPrincipal only matches if
+	// the source node also has this capability in its CapMap, such as to
+	// grant eligibility for SSH centrally as a capability. Nodes without
+	// it are denied, whatever the other fields match.
+	NodeCap NodeCapability `json:"nodeCap,omitempty"`
 }
 
 // SSHAction is how to handle an incoming connection.
@@ -2460,9 +2499,281 @@ type SSHAction struct {
 	// The recording will be uploaded to http://addr:port/record.
 	Recorders []netip.AddrPort `json:"recorders,omitempty"`
 
+	// RecorderGroups, if non-empty, are the names of groups in
+	// SSHPolicy.RecorderGroups whose recorders are used instead of
+	// Recorders. If none of the groups are defined in the policy,
+	// Recorders is used, and if that's empty too, recording the session
+	// fails as per OnRecordingFailure.
+	RecorderGroups []string `json:"recorderGroups,omitempty"`
+
 	// OnRecorderFailure is the action to take if recording fails.
 	// If nil, the default action is to fail open.
 	OnRecordingFailure *SSHRecorderFailureAction `json:"onRecordingFailure,omitempty"`
+
+	// RecordingSinks, if non-empty, are additional destinations of the SSH
+	// session recording, each receiving its own copy of the session in its
+	// own format. They are in addition to Recorders, which (if non-empty)
+	// act as a single sink in SSHRecordingFormatCast format.
+	//
+	// Each sink fails independently of the others: a sink's
+	// OnRecordingFailure, or if nil the OnRecordingFailure above, decides
+	// what happens to the session when that sink fails.
+	RecordingSinks []*SSHRecordingSink `json:"recordingSinks,omitempty"`
+
+	// ConfirmationPrompt, if non-empty, is a question asked of the user
+	// with keyboard-interactive authentication after their Tailscale
+	// identity has been established and the connection accepted, such as
+	// "Type CONFIRM to proceed:". The connection is denied unless the
+	// answer is exactly ConfirmationResponse.
+	ConfirmationPrompt string `json:"confirmationPrompt,omitempty"`
+
+	// ConfirmationResponse is the answer to ConfirmationPrompt that
+	// grants the connection. It is unused if ConfirmationPrompt is empty.
+	ConfirmationResponse string `json:"confirmationResponse,omitempty"`
+
+	// ProxyTo, if non-empty, is the "host:port" of another node's Tailscale
+	// SSH server, making this node a jump host. Instead of running
+	// processes locally, each accepted session is proxied to a session on
+	// that node, requested as the same ssh-user. The other node authorizes
+	// the connection as coming from this node, but as it's on behalf of
+	// this node's users, only by rules with principals naming this node by
+	// Node or NodeIP; those matching Any or a UserLogin don't apply. Its
+	// host key must be one it advertises in its Hostinfo. Sessions are
+	// still recorded on this node as specified by this action. Actions
+	// with both ProxyTo and ForceCommand are rejected, as the forced
+	// command can't be enforced on the other node.
+	ProxyTo string `json:"proxyTo,omitempty"`
+
+	// TCPForwarding, if non-empty, specifies which kinds of TCP port
+	// forwarding accepted connections may use, like OpenSSH's
+	// AllowTcpForwarding. When set, it takes precedence over
+	// AllowLocalPortForwarding and AllowRemotePortForwarding, which are
+	// then ignored. Unknown values allow no forwarding.
+	TCPForwarding SSHTCPForwarding `json:"tcpForwarding,omitempty"`
+
+	// ForceCommand, if non-nil, is the command that accepted sessions run
+	// instead of the user's login shell or the command requested by the
+	// client, like OpenSSH's ForceCommand. The requested command, if any, is
+	// available to it in $SSH_ORIGINAL_COMMAND. Subsystems such as SFTP are
+	// refused.
+	ForceCommand *SSHForceCommand `json:"forceCommand,omitempty"`
+
+	// NotifyCommandURL, if non-empty, specifies a HTTP POST URL to notify
+	// when an accepted session runs a command requested by the client or
+	// forced by ForceCommand. The payload is the JSON encoded
+	// SSHEventNotifyRequest struct, with EventType SSHCommandExecuted. The
+	// host field in the URL is ignored, and it will be sent to control over
+	// the Noise transport.
+	NotifyCommandURL string `json:"notifyCommandURL,omitempty"`
+
+	// ExposeIdentityEnv, if true, sets environment variables identifying
+	// the Tailscale identity of the client in the processes of accepted
+	// sessions, and in their recordings: TAILSCALE_USER_LOGIN (or, for
+	// tagged nodes, TAILSCALE_SRC_TAGS), TAILSCALE_SRC_NODE and
+	// TAILSCALE_SSH_SESSION_ID. They're opt-in so as not to change the
+	// environment that existing scripts run in.
+	ExposeIdentityEnv bool `json:"exposeIdentityEnv,omitempty"`
+
+	// StrictRecording, if true, refuses the sessions that would run
+	// unrecorded despite the action requiring recording, because their
+	// I/O can't be recorded: currently, all subsystems such as SFTP.
+	// Without it, they run unrecorded. It has no effect on sessions that
+	// aren't recorded.
+	StrictRecording bool `json:"strictRecording,omitempty"`
+
+	// HomeDir, if non-empty, overrides the local user's home directory
+	// from the passwd database for accepted sessions: it's used as HOME,
+	// as the initial working directory, and to hold the forwarded agent
+	// socket. It must be an absolute path, and may contain $SSH_USER,
+	// $LOCAL_USER, $LOGINNAME_EMAIL and $LOGINNAME_LOCALPART, which are
+	// expanded. The directory must be accessible to the local user.
+	HomeDir string `json:"homeDir,omitempty"`
+
+	// EnterContainer, if non-empty, makes accepted sessions run in the
+	// mount, PID and network namespaces of a container, like nsenter or
+	// docker exec. It's the PID of a process in the container, or the ID
+	// or name of a Docker container. It's only supported on Linux, when
+	// tailscaled runs as root, and not for SFTP.
+	EnterContainer string `json:"enterContainer,omitempty"`
+
+	// MaxOutputBytes, if positive, is the most output, on stdout and stderr
+	// combined, that each accepted session may produce. A session exceeding
+	// it is terminated, with a message, and the output past it is
+	// discarded. Zero means no limit.
+	MaxOutputBytes int64 `json:"maxOutputBytes,omitempty"`
+
+	// RecordingOptional, if true, lets users opt out of having accepted
+	// sessions recorded, such as for a private debugging session, by sending
+	// the environment variable TAILSCALE_SSH_NO_RECORDING=1 with them.
+	// Sessions are still recorded by default. An opt-out is logged and
+	// reported to the OnRecordingFailure NotifyURL, if any, as an
+	// SSHSessionRecordingDeclined event. Without RecordingOptional, opt-outs
+	// are ignored.
+	RecordingOptional bool `json:"recordingOptional,omitempty"`
+
+	// PostSessionCommand, if non-empty, is a cleanup command to run after
+	// the process of each accepted session exits, such as to wipe a scratch
+	// directory: the path of the command and its arguments. It's run
+	// directly, without a shell, as the local user, with the session's
+	// baseline and identity environment, whether the process exited on its
+	// own or was terminated, such as when SessionDuration elapsed. Its
+	// failure is logged but doesn't change the session's exit status.
+	PostSessionCommand []string `json:"postSessionCommand,omitempty"`
+
+	// SFTPMaxBytes, if positive, is the most bytes of SFTP protocol traffic,
+	// in both directions combined, that each accepted SFTP session may
+	// transfer. A session exceeding it is aborted with an error. Zero means no
+	// limit.
+	SFTPMaxBytes int64 `json:"sftpMaxBytes,omitempty"`
+
+	// SFTPMaxBytesPerSecond, if positive, caps the rate of SFTP protocol
+	// traffic, in both directions combined, of each accepted SFTP session.
+	// Transfers are throttled to it. Zero means no limit.
+	SFTPMaxBytesPerSecond int64 `json:"sftpMaxBytesPerSecond,omitempty"`
+
+	// ScratchDir, if true, gives each accepted session a fresh scratch
+	// directory, owned by the local user and only accessible to it, whose
+	// path is in the environment variable TSSH_SCRATCH. It's removed with its
+	// contents once the session's process has exited, after any
+	// PostSessionCommand, including when the session was terminated. It's not
+	// supported with EnterContainer.
+	ScratchDir bool `json:"scratchDir,omitempty"`
+
+	// ScratchDirIsWorkDir, if true, makes the scratch directory of ScratchDir
+	// the initial working directory of accepted sessions, instead of the home
+	// directory. It has no effect without ScratchDir.
+	ScratchDirIsWorkDir bool `json:"scratchDirIsWorkDir,omitempty"`
+
+	// AllowedCommands, if non-empty, restricts the commands that accepted
+	// sessions may request to those matching any of these patterns, such as
+	// "git-receive-pack *" or "rsync --server *". A pattern matches the whole
+	// command, as sent by the client: "*" matches any run of characters,
+	// including none, and "?" any single one; other characters match
+	// themselves. As commands are run by the local user's shell, the
+	// wildcards don't match the shell metacharacters ;|&$`<>() or newlines,
+	// which are only allowed where the pattern has them. Requests for an
+	// interactive shell are only allowed by the empty pattern, not by ones
+	// like "*", and are otherwise refused along with commands that don't
+	// match. Subsystems, such as SFTP, are then only allowed by entries
+	// naming them, like "subsystem:sftp". Commands aren't restricted with
+	// ForceCommand, whose command replaces any requested one.
+	AllowedCommands []string `json:"allowedCommands,omitempty"`
+
+	// ApprovalMetadata is optional information about the approval of the
+	// session, such as who approved it or the ID of its ticket, as set by a
+	// HoldAndDelegate webhook in the action it returns. Keys are free-form,
+	// such as "approver" and "ticket". It's recorded in the session's
+	// recordings and included in its SSHEventNotifyRequests, so that audits
+	// can tie them back to the approval.
+	ApprovalMetadata map[string]string `json:"approvalMetadata,omitempty"`
+
+	// RecordInput, if true, records the input of the session in its
+	// recordings as well as its output, for full-fidelity audits: as "i"
+	// events in the asciicast format, and "input" events in raw JSON lines.
+	// Input is recorded as sent by the client. Any echo of it by the PTY is
+	// recorded as output, as usual, and players such as asciinema only play
+	// back output, so recordings replay as before.
+	//
+	// This captures everything the user types, including passwords typed at
+	// prompts that don't echo them, such as those of sudo.
+	RecordInput bool `json:"recordInput,omitempty"`
+
+	// SessionTermGrace, if positive, is how long a session's process is given
+	// to exit after being sent SIGTERM, when the session is terminated such
+	// as on SessionDuration elapsing or the policy no longer accepting it,
+	// before it's sent SIGKILL. This lets shells and editors save their state.
+	// Zero means the default of 5 seconds.
+	SessionTermGrace time.Duration `json:"sessionTermGrace,omitempty"`
+
+	// IdleTimeout, if non-zero, is how long a session can go without any
+	// input or output before being terminated. Unlike SessionDuration, it
+	// doesn't limit sessions in use.
+	IdleTimeout time.Duration `json:"idleTimeout,omitempty"`
+
+	// AllowX11Forwarding, if true, allows accepted connections to forward
+	// X11 connections to the client's display if requested, as with ssh -X.
+	AllowX11Forwarding bool `json:"allowX11Forwarding,omitempty"`
+}
+
+// SSHForceCommand is a command forced on the sessions of an SSHAction.
+type SSHForceCommand struct {
+	// Args are the path of the command to run and its arguments. It is run
+	// directly, without a shell, as the local user.
+	Args []string `json:"args"`
+
+	// Argv0, if non-empty, is the argv[0] the command is run with, instead
+	// of Args[0]. It changes only what the command sees as its own name
+	// (and what tools such as ps show), not which program is run. Programs
+	// that behave differently depending on argv[0], such as login shells
+	// for a leading "-" or multi-call binaries, are affected accordingly,
+	// so it must be chosen with the same care as Args.
+	Argv0 string `json:"argv0,omitempty"`
+
+	// ResetEnv, if true, runs the command with only a minimal baseline
+	// environment (SHELL, USER, HOME, PATH, the SSH_* variables set by the
+	// server and, for a PTY, TERM) rather than also inheriting the
+	// variables sent by the client. Without it, the client can influence
+	// the command through variables such as LANG or LC_*, which is unsafe
+	// for commands not written to distrust their environment.
+	ResetEnv bool `json:"resetEnv,omitempty"`
+
+	// Confirm, if true, makes the user confirm each run of the command,
+	// for commands with destructive effects. Before running it, the
+	// session's terminal shows "This will run <command>. Continue? [y/N]"
+	// and the session is ended unless the user answers yes. Sessions
+	// without a PTY, which can't be asked, are refused.
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+// SSHTCPForwarding is a kind of TCP port forwarding permitted by an
+// SSHAction.
+type SSHTCPForwarding string
+
+const (
+	// SSHTCPForwardingLocal allows only local port forwarding
+	// ("direct-tcpip" channels, as with "ssh -L").
+	SSHTCPForwardingLocal SSHTCPForwarding = "local"
+
+	// SSHTCPForwardingRemote allows only remote port forwarding
+	// ("tcpip-forward" requests, as with "ssh -R").
+	SSHTCPForwardingRemote SSHTCPForwarding = "remote"
+
+	// SSHTCPForwardingAll allows both local and remote port forwarding.
+	SSHTCPForwardingAll SSHTCPForwarding = "all"
+
+	// SSHTCPForwardingNone allows no port forwarding.
+	SSHTCPForwardingNone SSHTCPForwarding = "none"
+)
+
+// SSHRecordingFormat is the format of an SSH session recording.
+type SSHRecordingFormat string
+
+const (
+	// SSHRecordingFormatCast is the asciinema v2 cast format: a JSON
+	// header line followed by JSON array event lines. It is the default.
+	SSHRecordingFormatCast SSHRecordingFormat = "cast"
+
+	// SSHRecordingFormatJSONLines is a format for machine consumption (for
+	// instance, by a SIEM) in which every line is a self-describing JSON
+	// object: a "header" line followed by "output" event lines.
+	SSHRecordingFormatJSONLines SSHRecordingFormat = "raw-jsonl"
+)
+
+// SSHRecordingSink is a destination of an SSH session recording.
+type SSHRecordingSink struct {
+	// Recorders are the addresses of the recorders of this sink, tried in
+	// order until one accepts the recording. The recording is uploaded to
+	// http://addr:port/record.
+	Recorders []netip.AddrPort `json:"recorders"`
+
+	// Format is the format of the recording sent to this sink.
+	// If empty, SSHRecordingFormatCast is used.
+	Format SSHRecordingFormat `json:"format,omitempty"`
+
+	// OnRecordingFailure is the action to take if recording to this sink
+	// fails. If nil, the OnRecordingFailure of the enclosing SSHAction is
+	// used.
+	OnRecordingFailure *SSHRecorderFailureAction `json:"onRecordingFailure,omitempty"`
 }
 
 // SSHRecorderFailureAction is the action to take if recording fails.
@@ -2512,6 +2823,30 @@ type SSHEventNotifyRequest struct {
 
 	// RecordingAttempts is the list of recorders that were attempted, in order.
 	RecordingAttempts []*SSHRecordingAttempt
+
+	// RequestedCommand is the command requested by the client, as sent and
+	// before any expansion by the shell. It's empty if the client requested
+	// an interactive shell. It's only set for SSHCommandExecuted events.
+	RequestedCommand string `json:",omitempty"`
+
+	// Argv is the command line that was run: the user's shell running
+	// RequestedCommand, or the SSHAction.ForceCommand when set. It's only
+	// set for SSHCommandExecuted events.
+	Argv []string `json:",omitempty"`
+
+	// Forced is whether Argv is an SSHAction.ForceCommand rather than
+	// RequestedCommand. It's only set for SSHCommandExecuted events.
+	Forced bool `json:",omitempty"`
+
+	// Automated is whether the session looks like automation rather than
+	// an interactive login: either the client didn't request a PTY, or
+	// SrcNode is tagged, and so isn't a person's device.
+	Automated bool `json:",omitempty"`
+
+	// ApprovalMetadata is the SSHAction.ApprovalMetadata of the action
+	// that accepted the session, such as who approved it by way of a
+	// HoldAndDelegate webhook, if any.
+	ApprovalMetadata map[string]string `json:",omitempty"`
 }
 
 // SSHEventType defines the event type linked to a SSH action or state.
@@ -2535,6 +2870,16 @@ type SSHEventNotifyRequest struct {
 	// the SSHRecorderFailureAction RejectSessionWithMessage
 	// or TerminateSessionWithMessage is empty.
 	SSHSessionRecordingFailed SSHEventType = 3
+	// SSHCommandExecuted is the event that defines when
+	// an accepted session starts a command requested by
+	// the client or forced by SSHAction.ForceCommand,
+	// and SSHAction.NotifyCommandURL is not empty.
+	SSHCommandExecuted SSHEventType = 4
+	// SSHSessionRecordingDeclined is the event that
+	// defines when the user of an accepted session opted
+	// out of having it recorded, as allowed by
+	// SSHAction.RecordingOptional.
+	SSHSessionRecordingDeclined SSHEventType = 5
 )
 
 // SSHRecordingAttempt is a single attempt to start a recording.
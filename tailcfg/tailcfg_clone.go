@@ -501,9 +501,20 @@ func (src *SSHAction) Clone() *SSHAction {
 	dst := new(SSHAction)
 	*dst = *src
 	dst.Recorders = append(src.Recorders[:0:0], src.Recorders...)
+	dst.RecorderGroups = append(src.RecorderGroups[:0:0], src.RecorderGroups...)
 	if dst.OnRecordingFailure != nil {
 		dst.OnRecordingFailure = ptr.To(*src.OnRecordingFailure)
 	}
+	if src.RecordingSinks != nil {
+		dst.RecordingSinks = make([]*SSHRecordingSink, len(src.RecordingSinks))
+		for i := range dst.RecordingSinks {
+			dst.RecordingSinks[i] = src.RecordingSinks[i].Clone()
+		}
+	}
+	dst.ForceCommand = src.ForceCommand.Clone()
+	dst.PostSessionCommand = append(src.PostSessionCommand[:0:0], src.PostSessionCommand...)
+	dst.AllowedCommands = append(src.AllowedCommands[:0:0], src.AllowedCommands...)
+	dst.ApprovalMetadata = maps.Clone(src.ApprovalMetadata)
 	return dst
 }
 
@@ -518,7 +529,74 @@ func (src *SSHAction) Clone() *SSHAction {
 	AllowLocalPortForwarding  bool
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
+	RecorderGroups            []string
 	OnRecordingFailure        *SSHRecorderFailureAction
+	RecordingSinks            []*SSHRecordingSink
+	ConfirmationPrompt        string
+	ConfirmationResponse      string
+	ProxyTo                   string
+	TCPForwarding             SSHTCPForwarding
+	ForceCommand              *SSHForceCommand
+	NotifyCommandURL          string
+	ExposeIdentityEnv         bool
+	StrictRecording           bool
+	HomeDir                   string
+	EnterContainer            string
+	MaxOutputBytes            int64
+	RecordingOptional         bool
+	PostSessionCommand        []string
+	SFTPMaxBytes              int64
+	SFTPMaxBytesPerSecond     int64
+	ScratchDir                bool
+	ScratchDirIsWorkDir       bool
+	AllowedCommands           []string
+	ApprovalMetadata          map[string]string
+	RecordInput               bool
+	SessionTermGrace          time.Duration
+	IdleTimeout               time.Duration
+	AllowX11Forwarding        bool
+}{})
+
+// Clone makes a deep copy of SSHRecordingSink.
+// The result aliases no memory with the original.
+func (src *SSHRecordingSink) Clone() *SSHRecordingSink {
+	if src == nil {
+		return nil
+	}
+	dst := new(SSHRecordingSink)
+	*dst = *src
+	dst.Recorders = append(src.Recorders[:0:0], src.Recorders...)
+	if dst.OnRecordingFailure != nil {
+		dst.OnRecordingFailure = ptr.To(*src.OnRecordingFailure)
+	}
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _SSHRecordingSinkCloneNeedsRegeneration = SSHRecordingSink(struct {
+	Recorders          []netip.AddrPort
+	Format             SSHRecordingFormat
+	OnRecordingFailure *SSHRecorderFailureAction
+}{})
+
+// Clone makes a deep copy of SSHForceCommand.
+// The result aliases no memory with the original.
+func (src *SSHForceCommand) Clone() *SSHForceCommand {
+	if src == nil {
+		return nil
+	}
+	dst := new(SSHForceCommand)
+	*dst = *src
+	dst.Args = append(src.Args[:0:0], src.Args...)
+	return dst
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _SSHForceCommandCloneNeedsRegeneration = SSHForceCommand(struct {
+	Args     []string
+	Argv0    string
+	ResetEnv bool
+	Confirm  bool
 }{})
 
 // Clone makes a deep copy of SSHPrincipal.
@@ -540,6 +618,7 @@ func (src *SSHPrincipal) Clone() *SSHPrincipal {
 	UserLogin string
 	Any       bool
 	PubKeys   []string
+	NodeCap   NodeCapability
 }{})
 
 // Clone makes a deep copy of ControlDialPlan.
@@ -603,7 +682,7 @@ func (src *UserProfile) Clone() *UserProfile {
 
 // Clone duplicates src into dst and reports whether it succeeded.
 // To succeed, <src, dst> must be of types <*T, *T> or <*T, **T>,
-// where T is one of User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile.
+// where T is one of User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHRecordingSink,SSHForceCommand,SSHPrincipal,ControlDialPlan,Location,UserProfile.
 func Clone(dst, src any) bool {
 	switch src := src.(type) {
 	case *User:
@@ -741,6 +820,24 @@ func Clone(dst, src any) bool {
 			*dst = src.Clone()
 			return true
 		}
+	case *SSHRecordingSink:
+		switch dst := dst.(type) {
+		case *SSHRecordingSink:
+			*dst = *src.Clone()
+			return true
+		case **SSHRecordingSink:
+			*dst = src.Clone()
+			return true
+		}
+	case *SSHForceCommand:
+		switch dst := dst.(type) {
+		case *SSHForceCommand:
+			*dst = *src.Clone()
+			return true
+		case **SSHForceCommand:
+			*dst = src.Clone()
+			return true
+		}
 	case *SSHPrincipal:
 		switch dst := dst.(type) {
 		case *SSHPrincipal:
@@ -19,7 +19,7 @@
 	"tailscale.com/types/views"
 )
 
-//go:generate go run tailscale.com/cmd/cloner  -clonefunc=true -type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHPrincipal,ControlDialPlan,Location,UserProfile
+//go:generate go run tailscale.com/cmd/cloner  -clonefunc=true -type=User,Node,Hostinfo,NetInfo,Login,DNSConfig,RegisterResponse,RegisterResponseAuth,RegisterRequest,DERPHomeParams,DERPRegion,DERPMap,DERPNode,SSHRule,SSHAction,SSHRecordingSink,SSHForceCommand,SSHPrincipal,ControlDialPlan,Location,UserProfile
 
 // View returns a readonly view of User.
 func (p *User) View() UserView {
@@ -1191,6 +1191,9 @@ func (v SSHActionView) HoldAndDelegate() string                { return v.ж.Hol
 func (v SSHActionView) AllowLocalPortForwarding() bool         { return v.ж.AllowLocalPortForwarding }
 func (v SSHActionView) AllowRemotePortForwarding() bool        { return v.ж.AllowRemotePortForwarding }
 func (v SSHActionView) Recorders() views.Slice[netip.AddrPort] { return views.SliceOf(v.ж.Recorders) }
+func (v SSHActionView) RecorderGroups() views.Slice[string] {
+	return views.SliceOf(v.ж.RecorderGroups)
+}
 func (v SSHActionView) OnRecordingFailure() *SSHRecorderFailureAction {
 	if v.ж.OnRecordingFailure == nil {
 		return nil
@@ -1199,6 +1202,39 @@ func (v SSHActionView) OnRecordingFailure() *SSHRecorderFailureAction {
 	return &x
 }
 
+func (v SSHActionView) RecordingSinks() views.SliceView[*SSHRecordingSink, SSHRecordingSinkView] {
+	return views.SliceOfViews[*SSHRecordingSink, SSHRecordingSinkView](v.ж.RecordingSinks)
+}
+func (v SSHActionView) ConfirmationPrompt() string        { return v.ж.ConfirmationPrompt }
+func (v SSHActionView) ConfirmationResponse() string      { return v.ж.ConfirmationResponse }
+func (v SSHActionView) ProxyTo() string                   { return v.ж.ProxyTo }
+func (v SSHActionView) TCPForwarding() SSHTCPForwarding   { return v.ж.TCPForwarding }
+func (v SSHActionView) ForceCommand() SSHForceCommandView { return v.ж.ForceCommand.View() }
+func (v SSHActionView) NotifyCommandURL() string          { return v.ж.NotifyCommandURL }
+func (v SSHActionView) ExposeIdentityEnv() bool           { return v.ж.ExposeIdentityEnv }
+func (v SSHActionView) StrictRecording() bool             { return v.ж.StrictRecording }
+func (v SSHActionView) HomeDir() string                   { return v.ж.HomeDir }
+func (v SSHActionView) EnterContainer() string            { return v.ж.EnterContainer }
+func (v SSHActionView) MaxOutputBytes() int64             { return v.ж.MaxOutputBytes }
+func (v SSHActionView) RecordingOptional() bool           { return v.ж.RecordingOptional }
+func (v SSHActionView) PostSessionCommand() views.Slice[string] {
+	return views.SliceOf(v.ж.PostSessionCommand)
+}
+func (v SSHActionView) SFTPMaxBytes() int64          { return v.ж.SFTPMaxBytes }
+func (v SSHActionView) SFTPMaxBytesPerSecond() int64 { return v.ж.SFTPMaxBytesPerSecond }
+func (v SSHActionView) ScratchDir() bool             { return v.ж.ScratchDir }
+func (v SSHActionView) ScratchDirIsWorkDir() bool    { return v.ж.ScratchDirIsWorkDir }
+func (v SSHActionView) AllowedCommands() views.Slice[string] {
+	return views.SliceOf(v.ж.AllowedCommands)
+}
+func (v SSHActionView) ApprovalMetadata() views.Map[string, string] {
+	return views.MapOf(v.ж.ApprovalMetadata)
+}
+func (v SSHActionView) RecordInput() bool               { return v.ж.RecordInput }
+func (v SSHActionView) SessionTermGrace() time.Duration { return v.ж.SessionTermGrace }
+func (v SSHActionView) IdleTimeout() time.Duration      { return v.ж.IdleTimeout }
+func (v SSHActionView) AllowX11Forwarding() bool        { return v.ж.AllowX11Forwarding }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHActionViewNeedsRegeneration = SSHAction(struct {
 	Message                   string
@@ -1210,7 +1246,154 @@ func (v SSHActionView) OnRecordingFailure() *SSHRecorderFailureAction {
 	AllowLocalPortForwarding  bool
 	AllowRemotePortForwarding bool
 	Recorders                 []netip.AddrPort
+	RecorderGroups            []string
 	OnRecordingFailure        *SSHRecorderFailureAction
+	RecordingSinks            []*SSHRecordingSink
+	ConfirmationPrompt        string
+	ConfirmationResponse      string
+	ProxyTo                   string
+	TCPForwarding             SSHTCPForwarding
+	ForceCommand              *SSHForceCommand
+	NotifyCommandURL          string
+	ExposeIdentityEnv         bool
+	StrictRecording           bool
+	HomeDir                   string
+	EnterContainer            string
+	MaxOutputBytes            int64
+	RecordingOptional         bool
+	PostSessionCommand        []string
+	SFTPMaxBytes              int64
+	SFTPMaxBytesPerSecond     int64
+	ScratchDir                bool
+	ScratchDirIsWorkDir       bool
+	AllowedCommands           []string
+	ApprovalMetadata          map[string]string
+	RecordInput               bool
+	SessionTermGrace          time.Duration
+	IdleTimeout               time.Duration
+	AllowX11Forwarding        bool
+}{})
+
+// View returns a readonly view of SSHRecordingSink.
+func (p *SSHRecordingSink) View() SSHRecordingSinkView {
+	return SSHRecordingSinkView{ж: p}
+}
+
+// SSHRecordingSinkView provides a read-only view over SSHRecordingSink.
+//
+// Its methods should only be called if `Valid()` returns true.
+type SSHRecordingSinkView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *SSHRecordingSink
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v SSHRecordingSinkView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v SSHRecordingSinkView) AsStruct() *SSHRecordingSink {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v SSHRecordingSinkView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *SSHRecordingSinkView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x SSHRecordingSink
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v SSHRecordingSinkView) Recorders() views.Slice[netip.AddrPort] {
+	return views.SliceOf(v.ж.Recorders)
+}
+func (v SSHRecordingSinkView) Format() SSHRecordingFormat { return v.ж.Format }
+func (v SSHRecordingSinkView) OnRecordingFailure() *SSHRecorderFailureAction {
+	if v.ж.OnRecordingFailure == nil {
+		return nil
+	}
+	x := *v.ж.OnRecordingFailure
+	return &x
+}
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _SSHRecordingSinkViewNeedsRegeneration = SSHRecordingSink(struct {
+	Recorders          []netip.AddrPort
+	Format             SSHRecordingFormat
+	OnRecordingFailure *SSHRecorderFailureAction
+}{})
+
+// View returns a readonly view of SSHForceCommand.
+func (p *SSHForceCommand) View() SSHForceCommandView {
+	return SSHForceCommandView{ж: p}
+}
+
+// SSHForceCommandView provides a read-only view over SSHForceCommand.
+//
+// Its methods should only be called if `Valid()` returns true.
+type SSHForceCommandView struct {
+	// ж is the underlying mutable value, named with a hard-to-type
+	// character that looks pointy like a pointer.
+	// It is named distinctively to make you think of how dangerous it is to escape
+	// to callers. You must not let callers be able to mutate it.
+	ж *SSHForceCommand
+}
+
+// Valid reports whether underlying value is non-nil.
+func (v SSHForceCommandView) Valid() bool { return v.ж != nil }
+
+// AsStruct returns a clone of the underlying value which aliases no memory with
+// the original.
+func (v SSHForceCommandView) AsStruct() *SSHForceCommand {
+	if v.ж == nil {
+		return nil
+	}
+	return v.ж.Clone()
+}
+
+func (v SSHForceCommandView) MarshalJSON() ([]byte, error) { return json.Marshal(v.ж) }
+
+func (v *SSHForceCommandView) UnmarshalJSON(b []byte) error {
+	if v.ж != nil {
+		return errors.New("already initialized")
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	var x SSHForceCommand
+	if err := json.Unmarshal(b, &x); err != nil {
+		return err
+	}
+	v.ж = &x
+	return nil
+}
+
+func (v SSHForceCommandView) Args() views.Slice[string] { return views.SliceOf(v.ж.Args) }
+func (v SSHForceCommandView) Argv0() string             { return v.ж.Argv0 }
+func (v SSHForceCommandView) ResetEnv() bool            { return v.ж.ResetEnv }
+func (v SSHForceCommandView) Confirm() bool             { return v.ж.Confirm }
+
+// A compilation failure here means this code must be regenerated, with the command at the top of this file.
+var _SSHForceCommandViewNeedsRegeneration = SSHForceCommand(struct {
+	Args     []string
+	Argv0    string
+	ResetEnv bool
+	Confirm  bool
 }{})
 
 // View returns a readonly view of SSHPrincipal.
@@ -1263,6 +1446,7 @@ func (v SSHPrincipalView) NodeIP() string               { return v.ж.NodeIP }
 func (v SSHPrincipalView) UserLogin() string            { return v.ж.UserLogin }
 func (v SSHPrincipalView) Any() bool                    { return v.ж.Any }
 func (v SSHPrincipalView) PubKeys() views.Slice[string] { return views.SliceOf(v.ж.PubKeys) }
+func (v SSHPrincipalView) NodeCap() NodeCapability      { return v.ж.NodeCap }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _SSHPrincipalViewNeedsRegeneration = SSHPrincipal(struct {
@@ -1271,6 +1455,7 @@ func (v SSHPrincipalView) PubKeys() views.Slice[string] { return views.SliceOf(v
 	UserLogin string
 	Any       bool
 	PubKeys   []string
+	NodeCap   NodeCapability
 }{})
 
 // View returns a readonly view of ControlDialPlan.
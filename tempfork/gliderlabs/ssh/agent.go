@@ -69,7 +69,9 @@ func ForwardAgentConnections(l net.Listener, s Session) {
 			wg.Add(2)
 			go func() {
 				io.Copy(conn, channel)
-				conn.(*net.UnixConn).CloseWrite()
+				if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
 				wg.Done()
 			}()
 			go func() {
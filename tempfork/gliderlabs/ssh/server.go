@@ -48,6 +48,7 @@ type Server struct {
 	ReversePortForwardingCallback ReversePortForwardingCallback // callback for allowing reverse port forwarding, denies all if nil
 	ServerConfigCallback          ServerConfigCallback          // callback for configuring detailed SSH options
 	SessionRequestCallback        SessionRequestCallback        // callback for allowing or denying SSH sessions
+	X11Callback                   X11Callback                   // callback for allowing X11 forwarding, denies all if nil
 
 	ConnectionFailedCallback ConnectionFailedCallback // callback to report connection failures
 
@@ -0,0 +1,29 @@
+package ssh
+
+const (
+	x11RequestType = "x11-req"
+
+	// X11ChannelType is the type of the channels that X11 connections are
+	// forwarded to the client over.
+	X11ChannelType = "x11"
+)
+
+// X11 represents an X11 forwarding request, as sent by the client with a
+// session's x11-req request.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4254#section-6.3.1
+type X11 struct {
+	// SingleConnection is whether only a single X11 connection should be
+	// forwarded.
+	SingleConnection bool
+
+	// AuthProtocol is the X11 authentication protocol of AuthCookie, such
+	// as "MIT-MAGIC-COOKIE-1".
+	AuthProtocol string
+
+	// AuthCookie is the client's X11 authentication cookie, hex encoded.
+	AuthCookie string
+
+	// ScreenNumber is the X11 screen number.
+	ScreenNumber uint32
+}